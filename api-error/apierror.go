@@ -0,0 +1,185 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"crispy-doodle/main.go/logging"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stable, machine readable error codes. Clients branch on these, so treat
+// them as part of the API: add new ones freely but never rename.
+const (
+	CodeBadRequest      = "bad_request"
+	CodeInvalidBody     = "invalid_body"
+	CodeUnauthorized    = "unauthorized"
+	CodeInvalidToken    = "invalid_token"
+	CodeInvalidLogin    = "invalid_credentials"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeTooLarge        = "too_large"
+	CodeQuotaExceeded   = "quota_exceeded"
+	CodeContentBlocked  = "content_blocked"
+	CodeBudgetExceeded  = "ai_budget_exceeded"
+	CodeUnsupportedType = "unsupported_type"
+	CodeRangeNotSatisfy = "range_not_satisfiable"
+	CodeRouteNotFound   = "route_not_found"
+	CodeMethodNotAllow  = "method_not_allowed"
+	CodeUpstream        = "upstream_error"
+	CodeUnavailable     = "unavailable"
+	CodeInternal        = "internal_error"
+)
+
+// Error is the single error shape returned by every endpoint, wrapped as
+// {"error": {...}}. The cause is logged but never serialized.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	cause     error
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details any) *Error {
+	cp := *e
+	cp.Details = details
+	return &cp
+}
+
+// Wrap returns a copy of e that records cause for logging.
+func (e *Error) Wrap(cause error) *Error {
+	cp := *e
+	cp.cause = cause
+	return &cp
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+// InvalidBody reports a request body that could not be bound. The decoder
+// message is safe to show and helps client developers.
+func InvalidBody(err error) *Error {
+	e := New(http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+	if err != nil {
+		e.Details = err.Error()
+	}
+	return e
+}
+
+func Unauthorized(message string) *Error {
+	return New(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, CodeForbidden, message)
+}
+
+// NotFound reports a missing resource, e.g. NotFound("channel").
+func NotFound(resource string) *Error {
+	return New(http.StatusNotFound, CodeNotFound, capitalize(resource)+" not found").
+		WithDetails(gin.H{"resource": resource})
+}
+
+// Conflict reports a resource that already exists, e.g. Conflict("user").
+func Conflict(resource string) *Error {
+	return New(http.StatusConflict, CodeConflict, capitalize(resource)+" already exists").
+		WithDetails(gin.H{"resource": resource})
+}
+
+// Upstream reports a failing third party service without leaking its reply.
+func Upstream(service string, cause error) *Error {
+	return New(http.StatusBadGateway, CodeUpstream, service+" request failed").Wrap(cause)
+}
+
+// Unavailable reports a feature the server cannot offer as deployed.
+func Unavailable(message string) *Error {
+	return New(http.StatusServiceUnavailable, CodeUnavailable, message)
+}
+
+func Internal(cause error) *Error {
+	return New(http.StatusInternalServerError, CodeInternal, "Internal server error").Wrap(cause)
+}
+
+// FromStore maps a store error for resource onto an API error: missing rows
+// become 404, uniqueness conflicts 409 and everything else an opaque 500.
+func FromStore(err error, resource string) *Error {
+	if errors.Is(err, store.ErrNotFound) {
+		return NotFound(resource).Wrap(err)
+	}
+	var conflict *store.ConflictError
+	if errors.As(err, &conflict) {
+		e := Conflict(resource).Wrap(err)
+		if conflict.Field != "" {
+			e.Details = gin.H{"resource": resource, "field": conflict.Field}
+		}
+		return e
+	}
+	return Internal(err)
+}
+
+// Abort writes err as the error envelope and stops the handler chain. Errors
+// that are not an *Error are treated as internal. 5xx causes are logged.
+func Abort(c *gin.Context, err error) {
+	resp := record(c, err)
+	c.AbortWithStatusJSON(resp.Status, gin.H{"error": resp})
+}
+
+// AbortStream is Abort for a server-sent event stream that has already
+// begun: the status is gone, so the envelope is sent as an "error" event.
+func AbortStream(c *gin.Context, err error) {
+	resp := record(c, err)
+	c.SSEvent("error", gin.H{"error": resp})
+	c.Writer.Flush()
+	c.Abort()
+}
+
+// record resolves err to the envelope sent for it, logs it and attaches it
+// to the context.
+func record(c *gin.Context, err error) *Error {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	resp := *apiErr
+	resp.RequestID = logging.RequestID(c)
+
+	logger := logging.FromContext(c)
+	if resp.Status >= http.StatusInternalServerError {
+		logger.Error(resp.Message, "code", resp.Code, "error", resp.cause)
+	} else if resp.cause != nil {
+		logger.Debug(resp.Message, "code", resp.Code, "error", resp.cause)
+	}
+	c.Error(apiErr)
+	return &resp
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -1,25 +1,35 @@
-package postgresdb
+package auth
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/global"
+	"crispy-doodle/main.go/logging"
+
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var accessSecret = []byte(os.Getenv("TOKEN_SECRET"))
-var refreshSecret = []byte(os.Getenv("REFRESH_TOKEN_SECRET"))
-
 type UserClaims struct {
 	ID string `json:"id"`
 	jwt.StandardClaims
 }
 
+func HashedPassword(password string) (string, error) {
+	hashedPassword, error := bcrypt.GenerateFromPassword([]byte(password), 10)
+	return string(hashedPassword), error
+}
+
+func CheckPasswordHash(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
 func GenerateTokens(userID string) (accessToken, refreshToken string, err error) {
 	accessClaims := UserClaims{
 		ID: userID,
@@ -40,20 +50,18 @@ func GenerateTokens(userID string) (accessToken, refreshToken string, err error)
 	at := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
 	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
 
-	accessToken, err = at.SignedString(accessSecret)
+	accessToken, err = at.SignedString([]byte(global.TokenSecret))
 	if err != nil {
 		return
 	}
-	refreshToken, err = rt.SignedString(refreshSecret)
+	refreshToken, err = rt.SignedString([]byte(global.RefreshTokenSecret))
 	return
 }
 
 func ValidateToken(tokenStr string, isRefresh bool) (*UserClaims, error) {
-	fmt.Printf("Validating token: %s\n", tokenStr)
-	secret := accessSecret
+	secret := []byte(global.TokenSecret)
 	if isRefresh {
-		fmt.Println("Using refresh token secret")
-		secret = refreshSecret
+		secret = []byte(global.RefreshTokenSecret)
 	}
 
 	token, err := jwt.ParseWithClaims(tokenStr, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
@@ -61,7 +69,6 @@ func ValidateToken(tokenStr string, isRefresh bool) (*UserClaims, error) {
 	})
 
 	if err != nil {
-		fmt.Printf("Error parsing token: %v\n", err)
 		return nil, err
 	}
 
@@ -76,16 +83,15 @@ func JWTMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
-			c.Abort()
+			apierror.Abort(c, apierror.Unauthorized("Missing Authorization header"))
 			return
 		}
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
 		claims, err := ValidateToken(tokenStr, false)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			logging.FromContext(c).Info("access token rejected", "error", err)
+			apierror.Abort(c, apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid token"))
 			return
 		}
 
@@ -2,7 +2,7 @@ package awservice
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,7 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 )
 
-func StartAws() aws.Config {
+func StartAws(logger *slog.Logger) aws.Config {
 
 	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
@@ -22,7 +22,8 @@ func StartAws() aws.Config {
 		config.WithCredentialsProvider(aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""))),
 	)
 	if err != nil {
-		log.Fatal("Error loading AWS Config.")
+		logger.Error("error loading AWS config", "error", err)
+		os.Exit(1)
 	}
 	return cfg
 }
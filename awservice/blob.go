@@ -0,0 +1,75 @@
+package awservice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when the key does not exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, other
+// than the last one.
+const MinPartSize = 5 << 20
+
+// Part identifies an uploaded part of a multipart upload.
+type Part struct {
+	Number int32
+	ETag   string
+}
+
+// PresignedRequest is a request a client can make directly against storage.
+// Headers must be sent exactly as given or the signature will not match.
+type PresignedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// BlobStore is where uploaded files live. The S3 backend talks to AWS or
+// any S3 compatible endpoint such as MinIO; the local backend keeps files on
+// disk and serves its own signed URLs.
+type BlobStore interface {
+	// Put stores body under key. size may be -1 when unknown.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get opens the object for reading. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetRange opens length bytes of the object from offset, or the rest of
+	// it when length is -1. The caller keeps the range within the object.
+	// The Size reported is that of the range.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	// Presign returns a URL anyone can GET the object from until it expires.
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+	// PresignPut returns a request that uploads exactly size bytes of
+	// contentType to key until it expires.
+	PresignPut(ctx context.Context, key string, size int64, contentType string, expires time.Duration) (*PresignedRequest, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Copy stores a copy of the object at from under to. Where the store
+	// allows it the bytes never pass through this server.
+	Copy(ctx context.Context, from, to string) error
+	// List calls fn for every object whose key starts with prefix, stopping
+	// at the first error fn returns. ContentType is not filled in.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+
+	// Multipart uploads build one object from parts sent separately. Parts
+	// are numbered from 1 and every part but the last must be at least
+	// MinPartSize. Nothing is visible under key until CompleteMultipart.
+	// last marks the final part, for stores that record where an object
+	// ends, such as EncryptedStore.
+	CreateMultipart(ctx context.Context, key, contentType string) (uploadID string, err error)
+	UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64, last bool) (etag string, err error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
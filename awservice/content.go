@@ -0,0 +1,161 @@
+package awservice
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeAttachment streams an attachment through the server, for clients
+// that cannot reach storage and for encrypted objects. Access and ?size=N
+// work as for DownloadFile. Originals can be fetched in parts with a Range
+// header; thumbnails are always sent whole. Responses carry an ETag, which
+// If-None-Match and If-Range are checked against, and are shown inline
+// unless ?download=true asks for a file to save.
+func ServeAttachment(blobs BlobStore, attachments store.AttachmentStore, c *gin.Context) {
+	attachment, size, ok := downloadable(attachments, c)
+	if !ok {
+		return
+	}
+
+	key, length, contentType := attachment.Key, attachment.Size, attachment.ContentType
+	thumbnail := variant(attachment, size)
+	if thumbnail != nil {
+		key, length, contentType = thumbnail.Key, -1, thumbnail.ContentType
+	}
+	etag := contentETag(attachment, thumbnail)
+
+	header := c.Writer.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", "private, no-cache")
+	header.Set("X-Content-Type-Options", "nosniff")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	status, offset := http.StatusOK, int64(0)
+	if length >= 0 {
+		header.Set("Accept-Ranges", "bytes")
+		spec := c.GetHeader("Range")
+		if ifRange := c.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+			// the client's part is of other content, so it needs all of it
+			spec = ""
+		}
+		if spec != "" {
+			start, end, ok, err := parseRange(spec, length)
+			if err != nil {
+				header.Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+				apierror.Abort(c, err)
+				return
+			}
+			if ok {
+				header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, length))
+				status, offset, length = http.StatusPartialContent, start, end-start+1
+			}
+		}
+	}
+
+	// large media takes longer than the server wide write timeout to send,
+	// and the response is bounded by what was asked for
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	var body io.ReadCloser
+	var err error
+	if status == http.StatusPartialContent {
+		body, _, err = blobs.GetRange(c, key, offset, length)
+	} else {
+		body, _, err = blobs.Get(c, key)
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	defer body.Close()
+
+	disposition := "inline"
+	if download, _ := strconv.ParseBool(c.Query("download")); download {
+		disposition = "attachment"
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	c.DataFromReader(status, length, contentType, body, nil)
+}
+
+// contentETag is a strong validator for what ServeAttachment sends. The
+// checksum changes whenever the stored bytes do; attachments uploaded
+// directly have none until processed and never change before then.
+func contentETag(attachment *store.Attachment, thumbnail *store.Thumbnail) string {
+	tag := attachment.Checksum
+	if tag == "" {
+		tag = attachment.ID
+	}
+	if thumbnail != nil {
+		tag += "-" + strconv.Itoa(thumbnail.Size)
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatches is the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange reads a Range header for an object of size bytes and returns
+// the first and last byte asked for. A header that cannot be parsed or asks
+// for several ranges is ignored, as HTTP allows, and ok is false. A range
+// that lies outside the object is an error to answer with.
+func parseRange(spec string, size int64) (start, end int64, ok bool, err error) {
+	unit, set, found := strings.Cut(spec, "=")
+	if !found || strings.TrimSpace(unit) != "bytes" || strings.Contains(set, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(set), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	notSatisfiable := apierror.New(http.StatusRequestedRangeNotSatisfiable, apierror.CodeRangeNotSatisfy, "Range not satisfiable").
+		WithDetails(gin.H{"size": size})
+
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, notSatisfiable
+		}
+		return max(size-n, 0), size - 1, true, nil
+	}
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if last != "" {
+		end, perr = strconv.ParseInt(last, 10, 64)
+		if perr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, notSatisfiable
+	}
+	return start, end, true, nil
+}
@@ -0,0 +1,66 @@
+package awservice
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		size       int64
+		start, end int64
+		ok, err    bool
+	}{
+		{"bytes=0-99", 1000, 0, 99, true, false},
+		{"bytes=100-", 1000, 100, 999, true, false},
+		{"bytes=990-5000", 1000, 990, 999, true, false},
+		{"bytes=-10", 1000, 990, 999, true, false},
+		{"bytes=-5000", 1000, 0, 999, true, false},
+		{" bytes = 5-5 ", 1000, 5, 5, true, false},
+		{"bytes=999-999", 1000, 999, 999, true, false},
+
+		// outside the object
+		{"bytes=1000-", 1000, 0, 0, false, true},
+		{"bytes=2000-3000", 1000, 0, 0, false, true},
+		{"bytes=-0", 1000, 0, 0, false, true},
+		{"bytes=-10", 0, 0, 0, false, true},
+		{"bytes=0-", 0, 0, 0, false, true},
+
+		// ignored
+		{"", 1000, 0, 0, false, false},
+		{"items=0-10", 1000, 0, 0, false, false},
+		{"bytes=0-10,20-30", 1000, 0, 0, false, false},
+		{"bytes=10", 1000, 0, 0, false, false},
+		{"bytes=10-5", 1000, 0, 0, false, false},
+		{"bytes=a-b", 1000, 0, 0, false, false},
+		{"bytes=-1-5", 1000, 0, 0, false, false},
+		{"bytes=--5", 1000, 0, 0, false, false},
+	} {
+		start, end, ok, err := parseRange(tc.spec, tc.size)
+		if (err != nil) != tc.err {
+			t.Errorf("%q of %d: err = %v, want error %v", tc.spec, tc.size, err, tc.err)
+			continue
+		}
+		if ok != tc.ok || start != tc.start || end != tc.end {
+			t.Errorf("%q of %d: %d-%d ok %v, want %d-%d ok %v", tc.spec, tc.size, start, end, ok, tc.start, tc.end, tc.ok)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc123"`
+	for header, want := range map[string]bool{
+		`"abc123"`:             true,
+		`W/"abc123"`:           true,
+		`"xyz", "abc123"`:      true,
+		` "xyz" ,W/"abc123" `:  true,
+		`*`:                    true,
+		`"abc123-160"`:         false,
+		`"xyz"`:                false,
+		`abc123`:               false,
+		``:                     false,
+		`"abc123"x, "another"`: false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("If-None-Match %q: match %v, want %v", header, got, want)
+		}
+	}
+}
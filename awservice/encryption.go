@@ -0,0 +1,617 @@
+package awservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrPresignUnsupported is returned by a BlobStore that cannot hand out
+// links to its objects, such as one that encrypts them.
+var ErrPresignUnsupported = errors.New("blob store cannot presign requests")
+
+// errCorruptObject means an encrypted object could not be parsed or failed
+// authentication.
+var errCorruptObject = errors.New("encrypted object is corrupt")
+
+// Encrypted objects are a sequence of segments, one per Put or uploaded
+// part. A segment starts with a header:
+//
+//	magic | master key fingerprint | wrapped data key | nonce prefix |
+//	segment index | segment flags
+//
+// and is followed by frames of at most encFrameSize bytes of plaintext,
+// each a big endian length, its top bit marking the last frame, and the
+// sealed frame. Frame nonces are the prefix, the frame counter and the last
+// flag, so frames cannot be reordered, dropped or truncated unnoticed
+// within a segment. The segment index and flags, which mark the final
+// segment, are the additional data of every frame, so whole segments
+// cannot be either: indexes must count up from 0 and the object must end
+// with its final segment. Nothing ties an object to its key, so one
+// encrypted object can still be swapped for another in its entirety.
+const (
+	encFrameSize      = 64 << 10
+	encLastFrame      = 1 << 31
+	encLengthSize     = 4
+	encTagSize        = 16
+	encNonceSize      = 12
+	encPrefixSize     = 7
+	encKeySize        = 32
+	encFingerprintLen = 8
+	encWrappedSize    = encNonceSize + encKeySize + encTagSize
+	encIndexSize      = 4
+	encPrefixOffset   = len(encMagic) + encFingerprintLen + encWrappedSize
+	encIndexOffset    = encPrefixOffset + encPrefixSize
+	encFlagsOffset    = encIndexOffset + encIndexSize
+	encHeaderSize     = encFlagsOffset + 1
+
+	encFinalSegment = 1
+)
+
+const encMagic = "\x89CDENC2\n"
+
+// encMagicFamily starts the magic of every version of the format, so that
+// an object in a version this build cannot read is refused rather than
+// served as if it were stored in the clear.
+const encMagicFamily = "\x89CDENC"
+
+// encryptedSize is how many bytes size bytes of plaintext take encrypted,
+// or -1 when size is unknown.
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	frames := (size + encFrameSize - 1) / encFrameSize
+	if frames == 0 {
+		frames = 1
+	}
+	return int64(encHeaderSize) + size + frames*(encLengthSize+encTagSize)
+}
+
+type masterKey struct {
+	fingerprint [encFingerprintLen]byte
+	aead        cipher.AEAD
+}
+
+// KeyRing holds the master keys data keys are wrapped with. The first is
+// current and wraps every new data key; the others can only unwrap, so that
+// objects written before a rotation stay readable until RotateKeys has
+// rewrapped them.
+type KeyRing struct {
+	keys []masterKey
+}
+
+// ParseKeyRing reads comma separated base64 encoded 32 byte master keys,
+// current first.
+func ParseKeyRing(spec string) (*KeyRing, error) {
+	ring := &KeyRing{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil || len(raw) != encKeySize {
+			return nil, fmt.Errorf("master key %d is not %d base64 encoded bytes", len(ring.keys)+1, encKeySize)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		key := masterKey{aead: aead}
+		sum := sha256.Sum256(raw)
+		copy(key.fingerprint[:], sum[:])
+		ring.keys = append(ring.keys, key)
+	}
+	if len(ring.keys) == 0 {
+		return nil, errors.New("no master keys given")
+	}
+	return ring, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (r *KeyRing) current() masterKey {
+	return r.keys[0]
+}
+
+// isCurrent reports whether a segment header was written with the current
+// master key.
+func (r *KeyRing) isCurrent(header []byte) bool {
+	fingerprint := r.current().fingerprint
+	return bytes.Equal(header[len(encMagic):len(encMagic)+encFingerprintLen], fingerprint[:])
+}
+
+// wrap seals dataKey with the current master key into the fingerprint and
+// wrapped key fields of a segment header.
+func (r *KeyRing) wrap(header, dataKey []byte) error {
+	key := r.current()
+	fields := header[len(encMagic):]
+	copy(fields, key.fingerprint[:])
+	nonce := fields[encFingerprintLen : encFingerprintLen+encNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// the fingerprint is authenticated so a wrapped key cannot be moved
+	// under another master key
+	key.aead.Seal(nonce[len(nonce):], nonce, dataKey, key.fingerprint[:])
+	return nil
+}
+
+// unwrap opens the data key of a segment header.
+func (r *KeyRing) unwrap(header []byte) ([]byte, error) {
+	fields := header[len(encMagic):]
+	fingerprint := fields[:encFingerprintLen]
+	nonce := fields[encFingerprintLen : encFingerprintLen+encNonceSize]
+	wrapped := fields[encFingerprintLen+encNonceSize : encFingerprintLen+encWrappedSize]
+	for _, key := range r.keys {
+		if !bytes.Equal(key.fingerprint[:], fingerprint) {
+			continue
+		}
+		dataKey, err := key.aead.Open(nil, nonce, wrapped, fingerprint)
+		if err != nil {
+			return nil, errCorruptObject
+		}
+		return dataKey, nil
+	}
+	return nil, fmt.Errorf("object is encrypted with unknown master key %x", fingerprint)
+}
+
+func frameNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], counter)
+	if last {
+		nonce[encNonceSize-1] = 1
+	}
+	return nonce
+}
+
+// EncryptedStore encrypts everything written to the BlobStore it wraps
+// with a fresh AES-256-GCM data key per object, or per part of a multipart
+// upload, wrapped by the current master key. Reads decrypt on the fly and
+// pass objects stored before encryption was turned on through unchanged.
+// Presigned requests would hand out ciphertext, so they are refused with
+// ErrPresignUnsupported and downloads have to go through the server.
+//
+// Stat and List report stored sizes. Get reports a Size of -1, since the
+// plaintext size is only known once the object has been read.
+type EncryptedStore struct {
+	BlobStore
+	keys *KeyRing
+}
+
+// NewEncryptedStore wraps inner so that its objects are encrypted at rest.
+func NewEncryptedStore(inner BlobStore, keys *KeyRing) *EncryptedStore {
+	return &EncryptedStore{BlobStore: inner, keys: keys}
+}
+
+func (e *EncryptedStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	enc, err := newEncryptReader(e.keys, body, 0, true)
+	if err != nil {
+		return err
+	}
+	return e.BlobStore.Put(ctx, key, enc, encryptedSize(size), contentType)
+}
+
+// UploadPart encrypts the part as segment number-1, so parts must be
+// numbered from 1 without gaps.
+func (e *EncryptedStore) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64, last bool) (string, error) {
+	if number < 1 {
+		return "", fmt.Errorf("part number %d is not positive", number)
+	}
+	enc, err := newEncryptReader(e.keys, body, uint32(number-1), last)
+	if err != nil {
+		return "", err
+	}
+	return e.BlobStore.UploadPart(ctx, key, uploadID, number, enc, encryptedSize(size), last)
+}
+
+func (e *EncryptedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := e.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := bufio.NewReader(body)
+	if !isEncrypted(src) {
+		return readCloser{src, body}, info, nil
+	}
+	plain := *info
+	plain.Size = -1
+	return readCloser{&decryptReader{src: src, keys: e.keys}, body}, &plain, nil
+}
+
+// GetRange decrypts from the start of the object, but frames wholly before
+// offset are skipped without being decrypted.
+func (e *EncryptedStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := e.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := bufio.NewReader(body)
+	if !isEncrypted(src) {
+		body.Close()
+		return e.BlobStore.GetRange(ctx, key, offset, length)
+	}
+	plain := *info
+	plain.Size = length
+	var r io.Reader = &decryptReader{src: src, keys: e.keys, skip: offset}
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	return readCloser{r, body}, &plain, nil
+}
+
+func (e *EncryptedStore) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (e *EncryptedStore) PresignPut(ctx context.Context, key string, size int64, contentType string, expires time.Duration) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+// Rotate rewraps the data keys of the object at key that are not wrapped by
+// the current master key, and encrypts the object if it is stored in the
+// clear. The data itself is not re-encrypted, so rewrapping keeps the size.
+// It reports whether the object needed rewriting; with dryRun nothing is
+// written.
+func (e *EncryptedStore) Rotate(ctx context.Context, key string, dryRun bool) (bool, error) {
+	stale, encrypted, err := e.staleSegments(ctx, key)
+	if err != nil || !stale || dryRun {
+		return stale, err
+	}
+
+	body, info, err := e.BlobStore.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	if !encrypted {
+		return true, e.Put(ctx, key, body, info.Size, info.ContentType)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copySegments(pw, bufio.NewReader(body), func(header []byte) error {
+			if e.keys.isCurrent(header) {
+				return nil
+			}
+			dataKey, err := e.keys.unwrap(header)
+			if err != nil {
+				return err
+			}
+			return e.keys.wrap(header, dataKey)
+		}))
+	}()
+	err = e.BlobStore.Put(ctx, key, pr, info.Size, info.ContentType)
+	pr.CloseWithError(err)
+	return true, err
+}
+
+// staleSegments reads the object at key and reports whether any part of it
+// is not encrypted with the current master key.
+func (e *EncryptedStore) staleSegments(ctx context.Context, key string) (stale, encrypted bool, err error) {
+	body, _, err := e.BlobStore.Get(ctx, key)
+	if err != nil {
+		return false, false, err
+	}
+	defer body.Close()
+	src := bufio.NewReader(body)
+	if !isEncrypted(src) {
+		return true, false, nil
+	}
+	err = copySegments(io.Discard, src, func(header []byte) error {
+		if !e.keys.isCurrent(header) {
+			stale = true
+		}
+		return nil
+	})
+	return stale, true, err
+}
+
+// copySegments copies an encrypted object from src to dst without
+// decrypting it, calling header on every segment header before it is
+// written, which may change it in place.
+func copySegments(dst io.Writer, src *bufio.Reader, header func([]byte) error) error {
+	buf := make([]byte, encHeaderSize)
+	for {
+		if _, err := io.ReadFull(src, buf); err == io.EOF {
+			return nil
+		} else if err != nil || string(buf[:len(encMagic)]) != encMagic {
+			return errCorruptObject
+		}
+		if err := header(buf); err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf); err != nil {
+			return err
+		}
+
+		for last := false; !last; {
+			var length [encLengthSize]byte
+			if _, err := io.ReadFull(src, length[:]); err != nil {
+				return errCorruptObject
+			}
+			n := binary.BigEndian.Uint32(length[:])
+			last = n&encLastFrame != 0
+			n &^= encLastFrame
+			if n > encFrameSize {
+				return errCorruptObject
+			}
+			if _, err := dst.Write(length[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(dst, src, int64(n)+encTagSize); err == io.EOF {
+				return errCorruptObject
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// isEncrypted reports whether the object read by src starts with the magic
+// of any version of the encrypted format.
+func isEncrypted(src *bufio.Reader) bool {
+	head, _ := src.Peek(len(encMagicFamily))
+	return string(head) == encMagicFamily
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// encryptReader encrypts src into a single segment as it is read.
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	ad      []byte // segment index and flags
+	counter uint32
+	// buf holds a frame of plaintext and one byte past it, which tells
+	// whether the frame is the last
+	buf  []byte
+	held int
+	out  []byte
+	next []byte
+	done bool
+}
+
+// newEncryptReader encrypts src as the segment index of an object, the
+// object's last when final.
+func newEncryptReader(keys *KeyRing, src io.Reader, index uint32, final bool) (*encryptReader, error) {
+	dataKey := make([]byte, encKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize, encHeaderSize+encLengthSize+encFrameSize+encTagSize)
+	copy(header, encMagic)
+	if err := keys.wrap(header, dataKey); err != nil {
+		return nil, err
+	}
+	prefix := header[encPrefixOffset:encIndexOffset]
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[encIndexOffset:], index)
+	if final {
+		header[encFlagsOffset] = encFinalSegment
+	}
+	return &encryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: bytes.Clone(prefix),
+		ad:     bytes.Clone(header[encIndexOffset:]),
+		buf:    make([]byte, encFrameSize+1),
+		out:    header,
+		next:   header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal reads and encrypts the next frame.
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.buf[e.held:])
+	n += e.held
+	last := false
+	switch err {
+	case nil:
+		n = encFrameSize
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	length := uint32(n)
+	if last {
+		length |= encLastFrame
+	}
+	frame := binary.BigEndian.AppendUint32(e.next[:0], length)
+	e.out = e.aead.Seal(frame, frameNonce(e.prefix, e.counter, last), e.buf[:n], e.ad)
+	e.next = e.out[:0]
+	e.counter++
+
+	if last {
+		e.done = true
+	} else {
+		e.buf[0] = e.buf[encFrameSize]
+		e.held = 1
+	}
+	return nil
+}
+
+// decryptReader decrypts the segments read from src one frame at a time.
+type decryptReader struct {
+	src     *bufio.Reader
+	keys    *KeyRing
+	aead    cipher.AEAD // nil between segments
+	prefix  []byte
+	ad      []byte // segment index and flags
+	counter uint32
+	frame   []byte
+	out     []byte
+	err     error
+	// skip is how much plaintext is still to be dropped before reading
+	skip int64
+	// segments counts the segments begun, final whether the last of them
+	// is marked as the object's final one
+	segments uint32
+	final    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// open decrypts the next frame, reading a segment header first when the
+// previous segment is done.
+func (d *decryptReader) open() error {
+	if d.aead == nil {
+		header := make([]byte, encHeaderSize)
+		if _, err := io.ReadFull(d.src, header); err == io.EOF && d.final {
+			return io.EOF
+		} else if err != nil || string(header[:len(encMagic)]) != encMagic {
+			// no segment after one that is not final is a truncation
+			return errCorruptObject
+		}
+		// the header is only authenticated once its first frame opens
+		flags := header[encFlagsOffset]
+		if d.final || binary.BigEndian.Uint32(header[encIndexOffset:]) != d.segments || flags&^encFinalSegment != 0 {
+			return errCorruptObject
+		}
+		dataKey, err := d.keys.unwrap(header)
+		if err != nil {
+			return err
+		}
+		if d.aead, err = newAEAD(dataKey); err != nil {
+			return err
+		}
+		d.prefix = header[encPrefixOffset:encIndexOffset]
+		d.ad = header[encIndexOffset:]
+		d.counter = 0
+		d.segments++
+		d.final = flags&encFinalSegment != 0
+	}
+
+	var length [encLengthSize]byte
+	if _, err := io.ReadFull(d.src, length[:]); err != nil {
+		return errCorruptObject
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	last := n&encLastFrame != 0
+	n &^= encLastFrame
+	if n > encFrameSize {
+		return errCorruptObject
+	}
+	if d.skip > 0 && d.skip >= int64(n) {
+		if _, err := d.src.Discard(int(n) + encTagSize); err != nil {
+			return errCorruptObject
+		}
+		d.skip -= int64(n)
+		d.next(last)
+		return nil
+	}
+	if cap(d.frame) < encFrameSize+encTagSize {
+		d.frame = make([]byte, encFrameSize+encTagSize)
+	}
+	sealed := d.frame[:n+encTagSize]
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return errCorruptObject
+	}
+	plain, err := d.aead.Open(sealed[:0], frameNonce(d.prefix, d.counter, last), sealed, d.ad)
+	if err != nil {
+		return errCorruptObject
+	}
+	d.out = plain[d.skip:]
+	d.skip = 0
+	d.next(last)
+	return nil
+}
+
+// next moves past a frame, and past the segment after its last frame.
+func (d *decryptReader) next(last bool) {
+	d.counter++
+	if last {
+		d.aead = nil
+	}
+}
+
+// RotationReport lists the objects RotateKeys rewrote, or would rewrite in
+// a dry run.
+type RotationReport struct {
+	DryRun  bool     `json:"dry_run"`
+	Checked int      `json:"checked"`
+	Objects []string `json:"objects"`
+}
+
+// RotateKeys brings every object the server owns under the current master
+// key, leaving the rest of a shared bucket alone. Once it has finished
+// without error, older keys can be dropped from the key ring.
+func RotateKeys(ctx context.Context, blobs *EncryptedStore, dryRun bool) (*RotationReport, error) {
+	report := &RotationReport{DryRun: dryRun, Objects: []string{}}
+	for _, prefix := range ownedPrefixes {
+		err := blobs.List(ctx, prefix, func(obj ObjectInfo) error {
+			rewritten, err := blobs.Rotate(ctx, obj.Key, dryRun)
+			if errors.Is(err, ErrBlobNotFound) {
+				// deleted since it was listed
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", obj.Key, err)
+			}
+			report.Checked++
+			if rewritten {
+				report.Objects = append(report.Objects, obj.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,247 @@
+package awservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testKeyRing(t *testing.T, raw ...[]byte) *KeyRing {
+	t.Helper()
+	encoded := make([]string, len(raw))
+	for i, key := range raw {
+		encoded[i] = base64.StdEncoding.EncodeToString(key)
+	}
+	ring, err := ParseKeyRing(strings.Join(encoded, ","))
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	return ring
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("random bytes: %v", err)
+	}
+	return b
+}
+
+// seal encrypts plain as segment index of an object.
+func seal(t *testing.T, keys *KeyRing, plain []byte, index uint32, final bool) []byte {
+	t.Helper()
+	enc, err := newEncryptReader(keys, bytes.NewReader(plain), index, final)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	sealed, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return sealed
+}
+
+func unseal(keys *KeyRing, sealed []byte, skip int64) ([]byte, error) {
+	return io.ReadAll(&decryptReader{src: bufio.NewReader(bytes.NewReader(sealed)), keys: keys, skip: skip})
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	keys := testKeyRing(t, randomBytes(t, encKeySize))
+	for _, size := range []int{0, 1, encFrameSize - 1, encFrameSize, encFrameSize + 1, 3*encFrameSize + 17} {
+		plain := randomBytes(t, size)
+		sealed := seal(t, keys, plain, 0, true)
+		if int64(len(sealed)) != encryptedSize(int64(size)) {
+			t.Errorf("%d bytes: encrypted to %d, encryptedSize says %d", size, len(sealed), encryptedSize(int64(size)))
+		}
+		got, err := unseal(keys, sealed, 0)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: round trip gave %d bytes, %v", size, len(got), err)
+		}
+		if size > 10 {
+			got, err := unseal(keys, sealed, int64(size-10))
+			if err != nil || !bytes.Equal(got, plain[size-10:]) {
+				t.Errorf("%d bytes: reading the last 10 gave %d bytes, %v", size, len(got), err)
+			}
+		}
+	}
+
+	// parts are segments of one object, read back as one
+	parts := [][]byte{randomBytes(t, encFrameSize+5), randomBytes(t, 3), randomBytes(t, 100)}
+	var sealed, plain []byte
+	for i, part := range parts {
+		sealed = append(sealed, seal(t, keys, part, uint32(i), i == len(parts)-1)...)
+		plain = append(plain, part...)
+	}
+	got, err := unseal(keys, sealed, 0)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("segments: round trip gave %d bytes, %v", len(got), err)
+	}
+	got, err = unseal(keys, sealed, encFrameSize+6)
+	if err != nil || !bytes.Equal(got, plain[encFrameSize+6:]) {
+		t.Errorf("segments: reading from the second gave %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEncryptionTamper(t *testing.T) {
+	keys := testKeyRing(t, randomBytes(t, encKeySize))
+	plain := randomBytes(t, encFrameSize+100)
+	sealed := seal(t, keys, plain, 0, true)
+
+	offsets := map[string]int{
+		"magic":        0,
+		"fingerprint":  len(encMagic),
+		"wrapped key":  len(encMagic) + encFingerprintLen + encNonceSize,
+		"nonce prefix": encPrefixOffset,
+		"index":        encIndexOffset + encIndexSize - 1,
+		"flags":        encFlagsOffset,
+		"length":       encHeaderSize + 1,
+		"ciphertext":   encHeaderSize + encLengthSize + 10,
+		"tag":          encHeaderSize + encLengthSize + encFrameSize + 1,
+		"last frame":   len(sealed) - 1,
+	}
+	for name, offset := range offsets {
+		tampered := bytes.Clone(sealed)
+		tampered[offset] ^= 0x01
+		if _, err := unseal(keys, tampered, 0); err == nil {
+			t.Errorf("%s: tampered object decrypted", name)
+		}
+	}
+
+	// a segment that is not final cannot be passed off as the last one
+	first := seal(t, keys, plain[:10], 0, false)
+	first[encFlagsOffset] = encFinalSegment
+	if _, err := unseal(keys, first, 0); err == nil {
+		t.Errorf("flipped final flag went unnoticed")
+	}
+
+	other := testKeyRing(t, randomBytes(t, encKeySize))
+	if _, err := unseal(other, sealed, 0); err == nil {
+		t.Errorf("decrypted with a key that is not in the ring")
+	}
+}
+
+func TestEncryptionTruncation(t *testing.T) {
+	keys := testKeyRing(t, randomBytes(t, encKeySize))
+	plain := randomBytes(t, 2*encFrameSize+100)
+	one := seal(t, keys, plain, 0, true)
+	frame := encLengthSize + encFrameSize + encTagSize
+
+	for name, data := range map[string][]byte{
+		"empty":               nil,
+		"header only":         one[:encHeaderSize],
+		"mid frame":           one[:encHeaderSize+frame+10],
+		"at a frame boundary": one[:encHeaderSize+2*frame],
+		"last byte":           one[:len(one)-1],
+	} {
+		if _, err := unseal(keys, data, 0); err == nil {
+			t.Errorf("%s: truncated object decrypted", name)
+		}
+	}
+
+	segments := [][]byte{
+		seal(t, keys, plain[:10], 0, false),
+		seal(t, keys, plain[10:20], 1, false),
+		seal(t, keys, plain[20:30], 2, true),
+	}
+	for name, parts := range map[string][][]byte{
+		"final segment dropped":  {segments[0], segments[1]},
+		"middle segment dropped": {segments[0], segments[2]},
+		"segments reordered":     {segments[1], segments[0], segments[2]},
+		"segment after final":    {segments[0], segments[1], segments[2], seal(t, keys, plain[:1], 3, true)},
+		"segment repeated":       {segments[0], segments[0], segments[1], segments[2]},
+	} {
+		if _, err := unseal(keys, bytes.Join(parts, nil), 0); err == nil {
+			t.Errorf("%s: decrypted", name)
+		}
+	}
+	if got, err := unseal(keys, bytes.Join(segments, nil), 0); err != nil || !bytes.Equal(got, plain[:30]) {
+		t.Errorf("intact segments: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := randomBytes(t, encKeySize), randomBytes(t, encKeySize)
+	local, err := NewLocalStore(t.TempDir(), "http://localhost", []byte("signing key"))
+	if err != nil {
+		t.Fatalf("local store: %v", err)
+	}
+	read := func(blobs BlobStore, key string) ([]byte, error) {
+		t.Helper()
+		body, _, err := blobs.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+
+	before := NewEncryptedStore(local, testKeyRing(t, oldKey))
+	plain := randomBytes(t, encFrameSize+1)
+	if err := before.Put(ctx, "content/old", bytes.NewReader(plain), int64(len(plain)), "application/octet-stream"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := local.Put(ctx, "content/clear", strings.NewReader("stored in the clear"), -1, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// another application's object in a shared bucket
+	if err := local.Put(ctx, "backups/db.sql", strings.NewReader("not ours"), -1, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	stored, err := read(local, "content/old")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	after := NewEncryptedStore(local, testKeyRing(t, newKey, oldKey))
+	report, err := RotateKeys(ctx, after, true)
+	if err != nil || len(report.Objects) != 2 {
+		t.Fatalf("dry run: %+v, %v", report, err)
+	}
+	if again, _ := read(local, "content/old"); !bytes.Equal(again, stored) {
+		t.Fatalf("dry run rewrote an object")
+	}
+	if report, err = RotateKeys(ctx, after, false); err != nil || len(report.Objects) != 2 {
+		t.Fatalf("rotate: %+v, %v", report, err)
+	}
+	if report, err = RotateKeys(ctx, after, false); err != nil || len(report.Objects) != 0 || report.Checked != 2 {
+		t.Fatalf("second rotation: %+v, %v", report, err)
+	}
+
+	// rewrapping keeps the data and its size, and the old key is no longer needed
+	rotated, err := read(local, "content/old")
+	if err != nil || len(rotated) != len(stored) || bytes.Equal(rotated, stored) {
+		t.Fatalf("rotated object is %d bytes, was %d: %v", len(rotated), len(stored), err)
+	}
+	onlyNew := NewEncryptedStore(local, testKeyRing(t, newKey))
+	if got, err := read(onlyNew, "content/old"); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("read after rotation: %d bytes, %v", len(got), err)
+	}
+	if got, err := read(onlyNew, "content/clear"); err != nil || string(got) != "stored in the clear" {
+		t.Fatalf("read of encrypted clear object: %q, %v", got, err)
+	}
+	if raw, _ := read(local, "content/clear"); !bytes.HasPrefix(raw, []byte(encMagic)) {
+		t.Fatalf("clear object was not encrypted")
+	}
+	if raw, _ := read(local, "backups/db.sql"); string(raw) != "not ours" {
+		t.Fatalf("object outside the server's prefixes was rewritten: %q", raw)
+	}
+	if _, err := read(NewEncryptedStore(local, testKeyRing(t, oldKey)), "content/old"); err == nil {
+		t.Fatalf("old key alone still reads the rotated object")
+	}
+
+	// another version of the format is refused, not served as plaintext
+	if err := local.Put(ctx, "content/v1", strings.NewReader("\x89CDENC1\nciphertext"), -1, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if got, err := read(onlyNew, "content/v1"); !errors.Is(err, errCorruptObject) {
+		t.Fatalf("read of another format version: %q, %v", got, err)
+	}
+}
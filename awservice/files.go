@@ -0,0 +1,301 @@
+package awservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/logging"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const presignExpiry = 5 * time.Minute
+
+// downloadExpiry is kept short because the link itself is not tied to the
+// caller; anyone holding it can fetch the object until it expires.
+const downloadExpiry = time.Minute
+
+// UploadFile stores the multipart "file" field under its content key and
+// records it as an attachment owned by the caller. The content must be of
+// an allowed type, which is checked against its magic bytes. Content that
+// is already stored and ready is shared rather than uploaded again, and the
+// attachment is ready straight away.
+func UploadFile(blobs BlobStore, attachments store.AttachmentStore, worker *AttachmentWorker, policy *UploadPolicy, quotas *Quotas, c *gin.Context) {
+
+	// Read the uploaded file
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		apierror.Abort(c, apierror.BadRequest("Failed to read uploaded file").Wrap(err))
+		return
+	}
+	defer file.Close()
+
+	// trust the bytes over the client: a missing or generic type is taken
+	// from the content, any other must agree with it
+	body := bufio.NewReaderSize(file, SniffLength)
+	head, _ := body.Peek(SniffLength)
+	contentType := normalizeType(header.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = SniffContentType(head)
+	} else if err := CheckContent(contentType, head); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := policy.Check(header.Filename, contentType, header.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := quotas.Check(c, c.GetString("userID"), header.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	// the form is already spooled by the server, so hash it before
+	// deciding whether it needs storing at all
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		apierror.Abort(c, apierror.BadRequest("Failed to read uploaded file").Wrap(err))
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	attachment := store.Attachment{
+		ID:          store.NewAttachmentID(),
+		Owner:       c.GetString("userID"),
+		Name:        SanitizeFilename(header.Filename),
+		Size:        header.Size,
+		ContentType: contentType,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+	}
+	attachment.Key = ContentKey(attachment.Checksum)
+
+	shared, err := shareContent(c, attachments, &attachment)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	if !shared {
+		// the attachment is saved pending before the object is looked at,
+		// so a release of the last other reference has either purged it
+		// already or waits for this one to be counted
+		attachment.Status = store.AttachmentPending
+		if err := attachments.CreateAttachment(c, &attachment); err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "attachment"))
+			return
+		}
+		// an object already under the key holds these bytes, perhaps
+		// cleaned by the worker, and must not be overwritten with them;
+		// processing records the size of what is stored
+		_, err := blobs.Stat(c, attachment.Key)
+		if errors.Is(err, ErrBlobNotFound) {
+			err = blobs.Put(c, attachment.Key, file, header.Size, contentType)
+		}
+		if err != nil {
+			if relErr := attachments.ReleaseAttachment(c, attachment.ID, purgeObjects(c, blobs)); relErr != nil {
+				logging.FromContext(c).Warn("failed to remove attachment after storing it failed", "attachment", attachment.ID, "error", relErr)
+			}
+			apierror.Abort(c, apierror.Upstream("Storage", err))
+			return
+		}
+		worker.markUploaded(&attachment)
+		if err := attachments.UpdateAttachment(c, &attachment); err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "attachment"))
+			return
+		}
+	}
+	if attachment.Status == store.AttachmentProcessing {
+		// no link until the original has been cleaned
+		worker.Enqueue(attachment.ID)
+		c.JSON(http.StatusCreated, gin.H{"id": attachment.ID, "attachment": attachment})
+		return
+	}
+
+	fileURL, err := blobs.Presign(c, attachment.Key, presignExpiry)
+	if errors.Is(err, ErrPresignUnsupported) {
+		fileURL, err = contentURL(attachment.ID, 0), nil
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": attachment.ID, "attachment": attachment, "url": fileURL})
+}
+
+// DownloadFile presigns a short lived link to an attachment. Callers who
+// neither own it nor share a channel with a message referencing it get the
+// same 404 as for a missing attachment, so IDs cannot be probed. With
+// ?size=N the smallest thumbnail at least N pixels across is linked
+// instead, falling back to the original. When the store cannot presign,
+// as when it encrypts, the link is to ServeAttachment instead.
+func DownloadFile(blobs BlobStore, attachments store.AttachmentStore, c *gin.Context) {
+	attachment, size, ok := downloadable(attachments, c)
+	if !ok {
+		return
+	}
+
+	presignedURL, err := blobs.Presign(c, variantKey(attachment, size), downloadExpiry)
+	if errors.Is(err, ErrPresignUnsupported) {
+		presignedURL, err = contentURL(attachment.ID, size), nil
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": presignedURL})
+}
+
+// downloadable loads the attachment named in the path for a download by the
+// caller, together with the ?size= asked for, or 0. It aborts with the
+// error to answer and reports false when there is nothing to download.
+func downloadable(attachments store.AttachmentStore, c *gin.Context) (*store.Attachment, int, bool) {
+	id := c.Param("id")
+	allowed, err := attachments.CanAccessAttachment(c, c.GetString("userID"), id)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return nil, 0, false
+	}
+	if !allowed {
+		apierror.Abort(c, apierror.NotFound("attachment"))
+		return nil, 0, false
+	}
+
+	attachment, err := attachments.GetAttachment(c, id)
+	if err == nil && attachment.Status != store.AttachmentReady && attachment.Status != store.AttachmentProcessing {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return nil, 0, false
+	}
+	if attachment.Status == store.AttachmentProcessing {
+		apierror.Abort(c, apierror.New(http.StatusConflict, apierror.CodeConflict, "Attachment is still being processed"))
+		return nil, 0, false
+	}
+
+	size := 0
+	if query := c.Query("size"); query != "" {
+		n, err := strconv.Atoi(query)
+		if err != nil || n <= 0 {
+			apierror.Abort(c, apierror.BadRequest("size must be a positive number of pixels"))
+			return nil, 0, false
+		}
+		size = n
+	}
+	return attachment, size, true
+}
+
+// contentURL is the path ServeAttachment serves attachment id from.
+func contentURL(id string, size int) string {
+	u := "/api/attachments/" + url.PathEscape(id) + "/content"
+	if size > 0 {
+		u += "?size=" + strconv.Itoa(size)
+	}
+	return u
+}
+
+// variant picks the smallest thumbnail covering size pixels, or nil for
+// the original.
+func variant(attachment *store.Attachment, size int) *store.Thumbnail {
+	if size <= 0 {
+		return nil
+	}
+	for i, t := range attachment.Thumbnails {
+		if t.Size >= size {
+			return &attachment.Thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// variantKey is the key of the variant of attachment for size pixels.
+func variantKey(attachment *store.Attachment, size int) string {
+	if thumbnail := variant(attachment, size); thumbnail != nil {
+		return thumbnail.Key
+	}
+	return attachment.Key
+}
+
+// shareContent points attachment at a ready attachment already stored under
+// its key, copying what the worker learned about the content, and saves it
+// ready, whether or not it was stored before. It reports false when there
+// is nothing to share, including when the last reference to the key was
+// released meanwhile.
+func shareContent(ctx context.Context, attachments store.AttachmentStore, attachment *store.Attachment) (bool, error) {
+	existing, err := attachments.FindAttachmentByKey(ctx, attachment.Key)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	shared := *attachment
+	shared.Size = existing.Size
+	shared.ContentType = existing.ContentType
+	shared.Checksum = existing.Checksum
+	shared.Width, shared.Height = existing.Width, existing.Height
+	shared.BlurHash = existing.BlurHash
+	shared.Thumbnails = existing.Thumbnails
+	shared.Status = store.AttachmentReady
+	if err := attachments.ShareAttachment(ctx, &shared); errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	*attachment = shared
+	return true, nil
+}
+
+// purgeObjects removes an attachment's object and thumbnails, for
+// ReleaseAttachment to call once nothing references them.
+func purgeObjects(ctx context.Context, blobs BlobStore) func(*store.Attachment) error {
+	return func(attachment *store.Attachment) error {
+		for _, key := range objectKeys(attachment) {
+			if err := blobs.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return fmt.Errorf("remove %s: %w", key, err)
+			}
+		}
+		return nil
+	}
+}
+
+// objectKeys lists the keys of an attachment's object and thumbnails.
+func objectKeys(attachment *store.Attachment) []string {
+	keys := []string{attachment.Key}
+	for _, t := range attachment.Thumbnails {
+		keys = append(keys, t.Key)
+	}
+	return keys
+}
+
+// DeleteAttachment deletes one of the caller's attachments. Its object and
+// thumbnails are removed once no other attachment references them; if that
+// fails the attachment is kept, so the delete can be retried.
+func DeleteAttachment(blobs BlobStore, attachments store.AttachmentStore, c *gin.Context) {
+	attachment, err := attachments.GetAttachment(c, c.Param("id"))
+	if err == nil && attachment.Owner != c.GetString("userID") {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+
+	if err := attachments.ReleaseAttachment(c, attachment.ID, purgeObjects(c, blobs)); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted!"})
+}
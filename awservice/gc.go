@@ -0,0 +1,158 @@
+package awservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"crispy-doodle/main.go/store"
+)
+
+// GCReport lists what a garbage collection removed, or would remove in a
+// dry run.
+type GCReport struct {
+	DryRun bool `json:"dry_run"`
+	// Attachments no message references.
+	Attachments []string `json:"attachments"`
+	// Objects no attachment references, by key.
+	Objects []string `json:"objects"`
+	// Bytes is the size of the removed objects.
+	Bytes int64 `json:"bytes"`
+}
+
+// CollectGarbage reconciles blob storage with the attachments and messages
+// that reference it. Attachments no message references are deleted, and so
+// are objects no attachment references. Only the prefixes this server
+// writes to are looked at, so anything else sharing the bucket, or left
+// there by older versions, is never touched. Only what is older than grace is
+// touched, so uploads that have not been sent in a message yet, and objects
+// whose attachment is still being written, are left alone. Attachments in
+// processing or with a resumable upload in progress are never collected.
+// With dryRun nothing is deleted.
+func CollectGarbage(ctx context.Context, blobs BlobStore, attachments store.AttachmentStore, messages store.MessageStore, uploads store.UploadSessionStore, grace time.Duration, dryRun bool) (*GCReport, error) {
+	cutoff := time.Now().Add(-grace)
+	report := &GCReport{DryRun: dryRun, Attachments: []string{}, Objects: []string{}}
+
+	referenced := map[string]bool{}
+	all, err := messages.ListMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range all {
+		for _, id := range m.Images {
+			referenced[id] = true
+		}
+	}
+	sessions, err := uploads.ListStaleUploadSessions(ctx, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		referenced[s.AttachmentID] = true
+	}
+
+	// keys of the attachments that stay, thumbnails included. Statuses are
+	// listed in the order attachments move through them, so one that moves
+	// on meanwhile is still seen.
+	live := map[string]bool{}
+	for _, status := range []string{store.AttachmentPending, store.AttachmentProcessing, store.AttachmentReady,
+		store.AttachmentQuarantined, store.AttachmentFailed} {
+		list, err := attachments.ListAttachmentsByStatus(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range list {
+			orphan := !referenced[a.ID] && a.Status != store.AttachmentProcessing && a.Created <= cutoff.Unix()
+			if !orphan {
+				live[a.Key] = true
+				for _, t := range a.Thumbnails {
+					live[t.Key] = true
+				}
+				continue
+			}
+			if !dryRun {
+				// the objects go while the store still holds off new
+				// references to the key, so a duplicate upload settling
+				// meanwhile either keeps them or writes them again
+				if err := attachments.ReleaseAttachment(ctx, a.ID, purgeReported(ctx, blobs, report)); err != nil {
+					return nil, fmt.Errorf("attachment %s: %w", a.ID, err)
+				}
+			}
+			report.Attachments = append(report.Attachments, a.ID)
+		}
+	}
+
+	for _, prefix := range ownedPrefixes {
+		err = blobs.List(ctx, prefix, func(object ObjectInfo) error {
+			if live[object.Key] || object.LastModified.After(cutoff) {
+				return nil
+			}
+			if !dryRun {
+				if err := blobs.Delete(ctx, object.Key); err != nil {
+					return fmt.Errorf("object %s: %w", object.Key, err)
+				}
+			}
+			report.Objects = append(report.Objects, object.Key)
+			report.Bytes += object.Size
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// purgeReported is purgeObjects for CollectGarbage, adding what it removes
+// to report.
+func purgeReported(ctx context.Context, blobs BlobStore, report *GCReport) func(*store.Attachment) error {
+	return func(attachment *store.Attachment) error {
+		for _, key := range objectKeys(attachment) {
+			info, err := blobs.Stat(ctx, key)
+			if errors.Is(err, ErrBlobNotFound) {
+				continue
+			}
+			if err == nil {
+				err = blobs.Delete(ctx, key)
+			}
+			if err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return fmt.Errorf("remove %s: %w", key, err)
+			}
+			report.Objects = append(report.Objects, key)
+			report.Bytes += info.Size
+		}
+		return nil
+	}
+}
+
+// StartGarbageCollector runs CollectGarbage every interval until ctx is
+// done. With dryRun it only logs what it would collect.
+func StartGarbageCollector(ctx context.Context, blobs BlobStore, attachments store.AttachmentStore, messages store.MessageStore, uploads store.UploadSessionStore, interval, grace time.Duration, dryRun bool, logger *slog.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			report, err := CollectGarbage(ctx, blobs, attachments, messages, uploads, grace, dryRun)
+			if err != nil {
+				logger.Error("garbage collection failed", "error", err)
+				continue
+			}
+			switch {
+			case len(report.Attachments) == 0 && len(report.Objects) == 0:
+			case dryRun:
+				logger.Info("garbage collection dry run, set GC_DELETE=true to delete", "attachments", len(report.Attachments),
+					"objects", len(report.Objects), "bytes", report.Bytes)
+			default:
+				logger.Info("garbage collected", "attachments", len(report.Attachments), "objects", len(report.Objects), "bytes", report.Bytes)
+			}
+		}
+	}()
+}
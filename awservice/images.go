@@ -0,0 +1,161 @@
+package awservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+
+	"crispy-doodle/main.go/imaging"
+	"crispy-doodle/main.go/store"
+)
+
+// ThumbnailSizes are the longest sides, in pixels, of the thumbnails made
+// for every image. Sizes the original is not larger than are skipped.
+var ThumbnailSizes = []int{160, 480, 1080}
+
+const (
+	// larger images are marked failed rather than decoded, which also
+	// guards against decompression bombs
+	maxImageBytes  = 64 << 20
+	maxImagePixels = 50_000_000
+
+	thumbnailQuality = 80
+	blurHashSize     = 32
+)
+
+// errNotAnImage marks content that claims to be an image but cannot be read
+// as one.
+var errNotAnImage = errors.New("not a readable image")
+
+// IsImage reports whether attachments of contentType get thumbnails.
+func IsImage(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// processImage strips metadata from an image attachment, stores its
+// thumbnails and fills in its dimensions and BlurHash. Content that cannot
+// be read as an image returns errNotAnImage.
+func (w *AttachmentWorker) processImage(ctx context.Context, attachment *store.Attachment) error {
+	body, _, err := w.blobs.Get(ctx, attachment.Key)
+	if err != nil {
+		return err
+	}
+	original, err := io.ReadAll(io.LimitReader(body, maxImageBytes+1))
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(original) > maxImageBytes {
+		return fmt.Errorf("%w: larger than %d bytes", errNotAnImage, maxImageBytes)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotAnImage, err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return fmt.Errorf("%w: %dx%d is too large", errNotAnImage, cfg.Width, cfg.Height)
+	}
+
+	// strip metadata without re-encoding where possible
+	stripped, orientation := original, 1
+	switch format {
+	case "jpeg":
+		orientation = imaging.JPEGOrientation(original)
+		stripped, err = imaging.StripJPEG(original)
+	case "png":
+		stripped, err = imaging.StripPNG(original)
+	case "gif":
+		// GIFs carry no EXIF, and re-encoding would drop animation
+	default:
+		err = fmt.Errorf("unsupported format %s", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotAnImage, err)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotAnImage, err)
+	}
+	img := imaging.ToRGBA(decoded)
+	if orientation != 1 {
+		// the orientation tag is gone with the EXIF data, so bake it in
+		img = imaging.Orient(img, orientation)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+			return err
+		}
+		stripped = buf.Bytes()
+	}
+
+	if !bytes.Equal(stripped, original) {
+		if err := w.blobs.Put(ctx, attachment.Key, bytes.NewReader(stripped), int64(len(stripped)), attachment.ContentType); err != nil {
+			return err
+		}
+	}
+	// describe the bytes actually stored, which differ from the upload when
+	// they were cleaned now or by an earlier upload of the same content
+	sum := sha256.Sum256(stripped)
+	attachment.Size = int64(len(stripped))
+	attachment.Checksum = hex.EncodeToString(sum[:])
+
+	attachment.Width, attachment.Height = img.Rect.Dx(), img.Rect.Dy()
+	attachment.BlurHash = imaging.BlurHash(imaging.Fit(img, blurHashSize), 4, 3)
+	attachment.Thumbnails = []store.Thumbnail{}
+	opaque := imaging.Opaque(img)
+	for _, size := range ThumbnailSizes {
+		if size >= max(attachment.Width, attachment.Height) {
+			break
+		}
+		thumbnail, err := w.storeThumbnail(ctx, attachment.Key, imaging.Fit(img, size), size, opaque)
+		if err != nil {
+			return err
+		}
+		attachment.Thumbnails = append(attachment.Thumbnails, *thumbnail)
+	}
+	return nil
+}
+
+// storeThumbnail writes img next to the original, as JPEG unless it has
+// transparency to keep.
+func (w *AttachmentWorker) storeThumbnail(ctx context.Context, key string, img *image.RGBA, size int, opaque bool) (*store.Thumbnail, error) {
+	var buf bytes.Buffer
+	contentType, ext := "image/jpeg", ".jpg"
+	if opaque {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return nil, err
+		}
+	} else {
+		contentType, ext = "image/png", ".png"
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	}
+
+	thumbKey := fmt.Sprintf("%s_%d%s", strings.TrimSuffix(key, path.Ext(key)), size, ext)
+	if err := w.blobs.Put(ctx, thumbKey, &buf, int64(buf.Len()), contentType); err != nil {
+		return nil, err
+	}
+	return &store.Thumbnail{
+		Size:        size,
+		Width:       img.Rect.Dx(),
+		Height:      img.Rect.Dy(),
+		ContentType: contentType,
+		Key:         thumbKey,
+	}, nil
+}
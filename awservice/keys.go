@@ -0,0 +1,77 @@
+package awservice
+
+import (
+	"path"
+	"strings"
+	"unicode"
+)
+
+// ObjectKey is where an attachment's bytes are stored: namespaced by owner
+// and named by attachment ID, so clients never choose the key. The original
+// extension is kept when it is a plain one, which helps anyone browsing the
+// bucket.
+func ObjectKey(owner, attachmentID, filename string) string {
+	return uploadsPrefix + owner + "/" + attachmentID + safeExtension(filename)
+}
+
+// ContentKey is where uploads whose SHA-256 is checksum are stored. The
+// same bytes uploaded again, by anyone, land on the same key and are kept
+// once.
+func ContentKey(checksum string) string {
+	return contentPrefix + checksum[:2] + "/" + checksum
+}
+
+// Every object the server stores, thumbnails included, is under one of
+// these prefixes, or QuarantinePrefix.
+const (
+	uploadsPrefix = "uploads/"
+	contentPrefix = "content/"
+)
+
+// ownedPrefixes are where the server's objects are. The bucket may be
+// shared, so anything walking it stays under these.
+var ownedPrefixes = []string{uploadsPrefix, contentPrefix, QuarantinePrefix}
+
+func safeExtension(filename string) string {
+	ext := strings.ToLower(path.Ext(SanitizeFilename(filename)))
+	if len(ext) < 2 || len(ext) > 10 {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// SanitizeFilename reduces a client supplied filename to a display name:
+// no directories, no control characters and at most 255 bytes.
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	for len(name) > 255 {
+		_, size := lastRune(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func lastRune(s string) (rune, int) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i]&0xC0 != 0x80 {
+			return rune(s[i]), len(s) - i
+		}
+	}
+	return 0, 1
+}
@@ -0,0 +1,456 @@
+package awservice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LocalRoute is where the local backend's signed URLs are served from.
+const LocalRoute = "/blobs"
+
+// LocalStore is the BlobStore that keeps objects on local disk. It signs its
+// own download URLs with an HMAC key and serves them through ServeSigned, so
+// development and CI need no AWS credentials.
+type LocalStore struct {
+	dir        string
+	baseURL    string
+	signingKey []byte
+}
+
+// NewLocalStore stores objects under dir. baseURL is the externally visible
+// address of this server, used to build signed URLs.
+func NewLocalStore(dir, baseURL string, signingKey []byte) (*LocalStore, error) {
+	if len(signingKey) == 0 {
+		return nil, errors.New("local blob store needs a signing key")
+	}
+	for _, sub := range []string{"objects", "meta", "multipart"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalStore{dir: dir, baseURL: strings.TrimRight(baseURL, "/"), signingKey: signingKey}, nil
+}
+
+type localMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+// paths maps key onto its object and metadata files, refusing keys that
+// would escape the store directory.
+func (l *LocalStore) paths(key string) (object, meta string, err error) {
+	clean := filepath.ToSlash(filepath.Clean("/" + key))[1:]
+	if key == "" || clean != key {
+		return "", "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(l.dir, "objects", filepath.FromSlash(key)),
+		filepath.Join(l.dir, "meta", filepath.FromSlash(key)+".json"), nil
+}
+
+func (l *LocalStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	object, meta, err := l.paths(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(object), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(meta), 0o755); err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(object), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	m, err := json.Marshal(localMeta{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(meta, m, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), object)
+}
+
+func (l *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, _, err := l.paths(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(object)
+	if err != nil {
+		return nil, nil, mapFSError(err)
+	}
+	return f, info, nil
+}
+
+func (l *LocalStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := body.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if length < 0 {
+		length = info.Size - offset
+	}
+	info.Size = length
+	return readCloser{io.LimitReader(f, length), f}, info, nil
+}
+
+func (l *LocalStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	object, meta, err := l.paths(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(object)
+	if err != nil {
+		return nil, mapFSError(err)
+	}
+	var m localMeta
+	if raw, err := os.ReadFile(meta); err == nil {
+		json.Unmarshal(raw, &m)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  m.ContentType,
+		ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (l *LocalStore) Copy(ctx context.Context, from, to string) error {
+	body, info, err := l.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return l.Put(ctx, to, body, info.Size, info.ContentType)
+}
+
+func (l *LocalStore) Delete(ctx context.Context, key string) error {
+	object, meta, err := l.paths(key)
+	if err != nil {
+		return err
+	}
+	os.Remove(meta)
+	return mapFSError(os.Remove(object))
+}
+
+func (l *LocalStore) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, _, err := l.paths(key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	q := url.Values{"expires": {exp}, "signature": {l.sign(http.MethodGet, key, exp)}}
+	return l.baseURL + LocalRoute + "/" + escapeKey(key) + "?" + q.Encode(), nil
+}
+
+// PresignPut signs the size and content type into the URL; ServePut refuses
+// uploads that do not match them.
+func (l *LocalStore) PresignPut(ctx context.Context, key string, size int64, contentType string, expires time.Duration) (*PresignedRequest, error) {
+	if _, _, err := l.paths(key); err != nil {
+		return nil, err
+	}
+	exp := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	length := strconv.FormatInt(size, 10)
+	q := url.Values{
+		"expires":   {exp},
+		"size":      {length},
+		"signature": {l.sign(http.MethodPut, key, exp, length, contentType)},
+	}
+	return &PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     l.baseURL + LocalRoute + "/" + escapeKey(key) + "?" + q.Encode(),
+		Headers: map[string]string{"Content-Type": contentType},
+	}, nil
+}
+
+// sign MACs the method, key, expiry and any extra conditions, one per line.
+func (l *LocalStore) sign(method, key, expires string, conditions ...string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, key, expires)
+	for _, c := range conditions {
+		fmt.Fprintf(mac, "\n%s", c)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a signature made by sign for method and key.
+func (l *LocalStore) verify(method, key, expires, signature string, conditions ...string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry")
+	}
+	if time.Now().Unix() > exp {
+		return errors.New("signature expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(l.sign(method, key, expires, conditions...))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// ServeSigned serves GET requests for URLs made by Presign.
+func (l *LocalStore) ServeSigned(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if err := l.verify(http.MethodGet, key, c.Query("expires"), c.Query("signature")); err != nil {
+		apierror.Abort(c, apierror.Forbidden("Invalid or expired link").Wrap(err))
+		return
+	}
+
+	body, info, err := l.Get(c, key)
+	if errors.Is(err, ErrBlobNotFound) {
+		apierror.Abort(c, apierror.NotFound("file"))
+		return
+	} else if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	defer body.Close()
+
+	if info.ContentType != "" {
+		c.Header("Content-Type", info.ContentType)
+	}
+	c.Header("ETag", info.ETag)
+	http.ServeContent(c.Writer, c.Request, filepath.Base(key), info.LastModified, body.(io.ReadSeeker))
+}
+
+// ServePut accepts uploads to URLs made by PresignPut. The body must be
+// exactly the signed size and carry the signed content type.
+func (l *LocalStore) ServePut(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	contentType := c.GetHeader("Content-Type")
+	if err := l.verify(http.MethodPut, key, c.Query("expires"), c.Query("signature"), c.Query("size"), contentType); err != nil {
+		apierror.Abort(c, apierror.Forbidden("Invalid or expired link").Wrap(err))
+		return
+	}
+	size, _ := strconv.ParseInt(c.Query("size"), 10, 64)
+	if c.Request.ContentLength != size {
+		apierror.Abort(c, apierror.BadRequest("Content-Length does not match the signed size"))
+		return
+	}
+
+	// the signature bounds the body, so a slow client may take as long as
+	// it needs instead of hitting the server wide timeouts
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, size)
+	if err := l.Put(c, key, body, size, contentType); err != nil {
+		apierror.Abort(c, apierror.BadRequest("Upload failed").Wrap(err))
+		return
+	}
+	info, err := l.Stat(c, key)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	c.Header("ETag", info.ETag)
+	c.Status(http.StatusOK)
+}
+
+func (l *LocalStore) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	root := filepath.Join(l.dir, "objects")
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed while walking
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".upload-") {
+			// a Put still in progress
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         fi.Size(),
+			ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+			LastModified: fi.ModTime(),
+		})
+	})
+}
+
+type localMultipart struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+}
+
+// multipartDir is where the parts of uploadID are kept until completion.
+func (l *LocalStore) multipartDir(uploadID string) (string, error) {
+	if len(uploadID) != 32 || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%w: invalid upload id %q", ErrBlobNotFound, uploadID)
+	}
+	return filepath.Join(l.dir, "multipart", uploadID), nil
+}
+
+// openMultipart checks uploadID exists and was started for key.
+func (l *LocalStore) openMultipart(key, uploadID string) (string, *localMultipart, error) {
+	dir, err := l.multipartDir(uploadID)
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", nil, mapFSError(err)
+	}
+	var m localMultipart
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return "", nil, err
+	}
+	if m.Key != key {
+		return "", nil, fmt.Errorf("%w: upload %s is not for %s", ErrBlobNotFound, uploadID, key)
+	}
+	return dir, &m, nil
+}
+
+func (l *LocalStore) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	if _, _, err := l.paths(key); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	uploadID := hex.EncodeToString(b)
+	dir, _ := l.multipartDir(uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(localMultipart{Key: key, ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	return uploadID, os.WriteFile(filepath.Join(dir, "upload.json"), m, 0o644)
+}
+
+// UploadPart stores the part under its number, replacing an earlier attempt
+// at the same part. The ETag is the hex SHA-256 of the part.
+func (l *LocalStore) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64, last bool) (string, error) {
+	dir, _, err := l.openMultipart(key, uploadID)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("part %d is %d bytes, expected %d", number, n, size)
+	}
+	etag := hex.EncodeToString(hash.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("%05d-%s", number, etag))); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+func (l *LocalStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, m, err := l.openMultipart(key, uploadID)
+	if err != nil {
+		return err
+	}
+	var readers []io.Reader
+	var size int64
+	for _, p := range parts {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%05d-%s", p.Number, p.ETag)))
+		if err != nil {
+			return fmt.Errorf("part %d: %w", p.Number, mapFSError(err))
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		readers = append(readers, f)
+	}
+	if err := l.Put(ctx, key, io.MultiReader(readers...), size, m.ContentType); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (l *LocalStore) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	dir, _, err := l.openMultipart(key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func mapFSError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package awservice
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	apierror "crispy-doodle/main.go/api-error"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SniffLength is how many leading bytes SniffContentType looks at.
+const SniffLength = 512
+
+// fileType is a content type the server can recognise from its magic bytes.
+type fileType struct {
+	extensions []string
+	maxSize    int64
+}
+
+// knownTypes are the only types an allowlist may contain, with the
+// extensions a file of that type may carry and a default size limit.
+var knownTypes = map[string]fileType{
+	"image/jpeg":      {[]string{".jpg", ".jpeg"}, 25 << 20},
+	"image/png":       {[]string{".png"}, 25 << 20},
+	"image/gif":       {[]string{".gif"}, 25 << 20},
+	"image/webp":      {[]string{".webp"}, 25 << 20},
+	"image/heic":      {[]string{".heic", ".heif"}, 25 << 20},
+	"video/mp4":       {[]string{".mp4", ".m4v"}, 2 << 30},
+	"video/quicktime": {[]string{".mov", ".qt"}, 2 << 30},
+	"video/webm":      {[]string{".webm"}, 2 << 30},
+	"audio/mpeg":      {[]string{".mp3"}, 100 << 20},
+	"audio/mp4":       {[]string{".m4a"}, 100 << 20},
+	"application/pdf": {[]string{".pdf"}, 50 << 20},
+	"text/plain":      {[]string{".txt", ".md", ".log"}, 5 << 20},
+}
+
+// unstrippedTypes are recognised but left out of the default allowlist:
+// the server cannot strip their metadata, so they are served with any
+// location EXIF they carry. UPLOAD_ALLOWED_TYPES can still list them.
+var unstrippedTypes = map[string]bool{
+	"image/webp": true,
+	"image/heic": true,
+}
+
+// UploadPolicy is the allowlist of content types and their size limits.
+type UploadPolicy struct {
+	limits map[string]int64
+}
+
+// DefaultUploadPolicy allows every known type whose metadata can be
+// stripped, at its default limit.
+func DefaultUploadPolicy() *UploadPolicy {
+	p := &UploadPolicy{limits: map[string]int64{}}
+	for t, ft := range knownTypes {
+		if !unstrippedTypes[t] {
+			p.limits[t] = ft.maxSize
+		}
+	}
+	return p
+}
+
+// ParseUploadPolicy reads a comma separated allowlist such as
+// "image/jpeg=10MiB,image/png,video/mp4=1GiB". Types without a limit get
+// their default one. An empty string gives DefaultUploadPolicy.
+func ParseUploadPolicy(spec string) (*UploadPolicy, error) {
+	if strings.TrimSpace(spec) == "" {
+		return DefaultUploadPolicy(), nil
+	}
+	p := &UploadPolicy{limits: map[string]int64{}}
+	for _, entry := range strings.Split(spec, ",") {
+		contentType, limit, hasLimit := strings.Cut(strings.TrimSpace(entry), "=")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		ft, ok := knownTypes[contentType]
+		if !ok {
+			return nil, fmt.Errorf("upload type %q is not one the server can recognise", contentType)
+		}
+		p.limits[contentType] = ft.maxSize
+		if hasLimit {
+			n, err := ParseSize(limit)
+			if err != nil {
+				return nil, fmt.Errorf("upload type %s: %w", contentType, err)
+			}
+			p.limits[contentType] = n
+		}
+	}
+	return p, nil
+}
+
+// ParseSize reads sizes like 512, 20KB, 10MiB or 2GiB.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
+
+// Allowed lists the allowed types and their limits, sorted by type.
+func (p *UploadPolicy) Allowed() []gin.H {
+	types := make([]string, 0, len(p.limits))
+	for t := range p.limits {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	allowed := make([]gin.H, len(types))
+	for i, t := range types {
+		allowed[i] = gin.H{"content_type": t, "max_size": p.limits[t]}
+	}
+	return allowed
+}
+
+// Check validates what a client declares about an upload: the type must be
+// allowed, the size within its limit and the filename's extension, if it
+// has one, must belong to the type.
+func (p *UploadPolicy) Check(filename, contentType string, size int64) *apierror.Error {
+	contentType = normalizeType(contentType)
+	limit, ok := p.limits[contentType]
+	if !ok {
+		return apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedType, "This type of file is not allowed").
+			WithDetails(gin.H{"content_type": contentType, "allowed": p.Allowed()})
+	}
+	if size > limit {
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeTooLarge, "File is too large").
+			WithDetails(gin.H{"content_type": contentType, "max_size": limit})
+	}
+	if ext := strings.ToLower(path.Ext(filename)); ext != "" {
+		for _, allowed := range knownTypes[contentType].extensions {
+			if ext == allowed {
+				return nil
+			}
+		}
+		return apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedType, "File extension does not match its type").
+			WithDetails(gin.H{"content_type": contentType, "extension": ext, "expected": knownTypes[contentType].extensions})
+	}
+	return nil
+}
+
+// CheckContent compares the declared type with the one found in the
+// leading bytes of the file.
+func CheckContent(declared string, head []byte) *apierror.Error {
+	declared = normalizeType(declared)
+	if detected := SniffContentType(head); detected != declared {
+		return apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedType, "File content does not match its type").
+			WithDetails(gin.H{"content_type": declared, "detected": detected})
+	}
+	return nil
+}
+
+// SniffContentType identifies content from its leading bytes. On top of
+// http.DetectContentType it reads the brand of ISO media files so HEIC and
+// QuickTime are told apart from MP4.
+func SniffContentType(head []byte) string {
+	if len(head) > SniffLength {
+		head = head[:SniffLength]
+	}
+	if len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) {
+		switch string(head[8:12]) {
+		case "heic", "heix", "hevc", "heim", "heis", "mif1", "msf1":
+			return "image/heic"
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ":
+			return "audio/mp4"
+		case "isom", "iso2", "mp41", "mp42", "avc1", "dash", "M4V ":
+			return "video/mp4"
+		}
+	}
+	return normalizeType(http.DetectContentType(head))
+}
+
+// normalizeType drops parameters and case, and maps common aliases.
+func normalizeType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	switch t {
+	case "image/jpg", "image/pjpeg":
+		return "image/jpeg"
+	case "image/heif":
+		return "image/heic"
+	}
+	return t
+}
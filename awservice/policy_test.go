@@ -0,0 +1,62 @@
+package awservice
+
+import "testing"
+
+func TestParseUploadPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want map[string]int64
+	}{
+		{"image/jpeg=10MiB,image/png", map[string]int64{"image/jpeg": 10 << 20, "image/png": 25 << 20}},
+		{" Image/JPEG = 2KB , video/mp4=1GiB ", map[string]int64{"image/jpeg": 2000, "video/mp4": 1 << 30}},
+		{"image/heic", map[string]int64{"image/heic": 25 << 20}},
+		{"text/plain=512", map[string]int64{"text/plain": 512}},
+	} {
+		p, err := ParseUploadPolicy(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if len(p.limits) != len(tc.want) {
+			t.Errorf("%q: limits %v, want %v", tc.spec, p.limits, tc.want)
+			continue
+		}
+		for contentType, limit := range tc.want {
+			if p.limits[contentType] != limit {
+				t.Errorf("%q: %s limit %d, want %d", tc.spec, contentType, p.limits[contentType], limit)
+			}
+		}
+	}
+
+	for _, spec := range []string{
+		"application/x-msdownload",
+		"image/jpeg=big",
+		"image/jpeg=0",
+		"image/jpeg=-5MiB",
+		"image/png,",
+	} {
+		if _, err := ParseUploadPolicy(spec); err == nil {
+			t.Errorf("%q: accepted", spec)
+		}
+	}
+}
+
+func TestDefaultUploadPolicy(t *testing.T) {
+	for _, spec := range []string{"", "  "} {
+		p, err := ParseUploadPolicy(spec)
+		if err != nil {
+			t.Fatalf("%q: %v", spec, err)
+		}
+		for contentType := range knownTypes {
+			if _, ok := p.limits[contentType]; ok == unstrippedTypes[contentType] {
+				t.Errorf("%q: %s allowed = %v", spec, contentType, ok)
+			}
+		}
+	}
+	if err := DefaultUploadPolicy().Check("photo.heic", "image/heif", 10); err == nil {
+		t.Errorf("HEIC is allowed by default")
+	}
+	if err := DefaultUploadPolicy().Check("photo.JPG", "image/jpg", 10); err != nil {
+		t.Errorf("JPEG rejected: %v", err)
+	}
+}
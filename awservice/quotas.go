@@ -0,0 +1,128 @@
+package awservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Unlimited is the quota of a role that may store any amount.
+const Unlimited = -1
+
+// largestFiles is how many of a user's biggest attachments usage lists.
+const largestFiles = 10
+
+// DefaultRoleQuotas are used for roles STORAGE_QUOTAS does not mention.
+var DefaultRoleQuotas = map[string]int64{
+	store.RoleUser:  5 << 30,
+	store.RoleAdmin: Unlimited,
+}
+
+// ParseRoleQuotas reads per role quotas such as "user=2GiB,admin=unlimited"
+// on top of DefaultRoleQuotas.
+func ParseRoleQuotas(spec string) (map[string]int64, error) {
+	quotas := map[string]int64{}
+	for role, quota := range DefaultRoleQuotas {
+		quotas[role] = quota
+	}
+	if strings.TrimSpace(spec) == "" {
+		return quotas, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		role, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		role = strings.TrimSpace(role)
+		if _, known := DefaultRoleQuotas[role]; !known || !ok {
+			return nil, fmt.Errorf("quota %q must be one of user or admin followed by =size", entry)
+		}
+		if strings.TrimSpace(limit) == "unlimited" {
+			quotas[role] = Unlimited
+			continue
+		}
+		n, err := ParseSize(limit)
+		if err != nil {
+			return nil, fmt.Errorf("quota for %s: %w", role, err)
+		}
+		quotas[role] = n
+	}
+	return quotas, nil
+}
+
+// Quotas enforces how much each user may store: the user's own quota when
+// an admin set one, otherwise the quota of the user's role.
+type Quotas struct {
+	users       store.UserStore
+	attachments store.AttachmentStore
+	roles       map[string]int64
+}
+
+// NewQuotas builds Quotas. Nil roles means DefaultRoleQuotas.
+func NewQuotas(users store.UserStore, attachments store.AttachmentStore, roles map[string]int64) *Quotas {
+	if roles == nil {
+		roles = DefaultRoleQuotas
+	}
+	return &Quotas{users: users, attachments: attachments, roles: roles}
+}
+
+// Limit is user's quota in bytes, or Unlimited.
+func (q *Quotas) Limit(user *store.User) int64 {
+	if user.Quota != nil {
+		return *user.Quota
+	}
+	if quota, ok := q.roles[user.Role]; ok {
+		return quota
+	}
+	return q.roles[store.RoleUser]
+}
+
+// Usage is a user's storage usage together with its quota.
+type Usage struct {
+	store.StorageUsage
+	// Quota is nil for users without a limit.
+	Quota *int64 `json:"quota"`
+}
+
+// Usage reports what userID stores and may store.
+func (q *Quotas) Usage(ctx context.Context, userID string) (*Usage, error) {
+	user, err := q.users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	used, err := q.attachments.GetStorageUsage(ctx, userID, largestFiles)
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{StorageUsage: *used}
+	if limit := q.Limit(user); limit != Unlimited {
+		usage.Quota = &limit
+	}
+	return usage, nil
+}
+
+// Check refuses an upload of size bytes that would take userID over its
+// quota. Pending uploads count, so space is reserved when an upload starts.
+// Concurrent uploads can still overshoot by one file each.
+func (q *Quotas) Check(ctx context.Context, userID string, size int64) error {
+	user, err := q.users.GetUser(ctx, userID)
+	if err != nil {
+		return apierror.FromStore(err, "user")
+	}
+	limit := q.Limit(user)
+	if limit == Unlimited {
+		return nil
+	}
+	used, err := q.attachments.GetStorageUsage(ctx, userID, 0)
+	if err != nil {
+		return apierror.Internal(err)
+	}
+	if used.Bytes+size > limit {
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeQuotaExceeded, "Storage quota exceeded").
+			WithDetails(gin.H{"used": used.Bytes, "quota": limit, "size": size})
+	}
+	return nil
+}
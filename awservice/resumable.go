@@ -0,0 +1,420 @@
+package awservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/logging"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads follow the shape of the tus protocol: the client
+// creates a session, sends the file in chunks with PATCH and, after a
+// dropped connection, asks for the current offset with HEAD and carries on
+// from there. Every chunk is stored as one part of a multipart upload.
+const (
+	UploadOffsetHeader = "Upload-Offset"
+	UploadLengthHeader = "Upload-Length"
+	ChunkContentType   = "application/offset+octet-stream"
+
+	// MaxChunkSize bounds a single PATCH, and so how much a client has to
+	// resend after losing a connection mid chunk.
+	MaxChunkSize = 64 << 20
+	// MaxResumableUploadSize keeps sessions well inside S3's 10000 part limit.
+	MaxResumableUploadSize = 100 << 30
+)
+
+const maxParts = 10000
+
+// CreateResumableUpload starts a session for a pending attachment.
+func CreateResumableUpload(blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, policy *UploadPolicy, quotas *Quotas, c *gin.Context) {
+	var req uploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if req.Size > MaxResumableUploadSize {
+		apierror.Abort(c, apierror.BadRequest("File is too large").
+			WithDetails(gin.H{"max_size": MaxResumableUploadSize}))
+		return
+	}
+	if err := policy.Check(req.Filename, req.ContentType, req.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := quotas.Check(c, c.GetString("userID"), req.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	req.ContentType = normalizeType(req.ContentType)
+
+	attachment := store.Attachment{
+		ID:          store.NewAttachmentID(),
+		Owner:       c.GetString("userID"),
+		Name:        SanitizeFilename(req.Filename),
+		Size:        req.Size,
+		ContentType: req.ContentType,
+		Status:      store.AttachmentPending,
+	}
+	attachment.Key = ObjectKey(attachment.Owner, attachment.ID, req.Filename)
+
+	uploadID, err := blobs.CreateMultipart(c, attachment.Key, attachment.ContentType)
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	if err := attachments.CreateAttachment(c, &attachment); err != nil {
+		abortMultipart(c, blobs, attachment.Key, uploadID)
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	session := store.UploadSession{
+		AttachmentID: attachment.ID,
+		Owner:        attachment.Owner,
+		Key:          attachment.Key,
+		UploadID:     uploadID,
+		Size:         attachment.Size,
+	}
+	if err := uploads.CreateUploadSession(c, &session); err != nil {
+		abortMultipart(c, blobs, attachment.Key, uploadID)
+		attachments.DeleteAttachment(c, attachment.ID)
+		apierror.Abort(c, apierror.FromStore(err, "upload"))
+		return
+	}
+
+	c.Header("Location", c.Request.URL.Path+"/"+session.ID)
+	c.Header(UploadOffsetHeader, "0")
+	c.JSON(http.StatusCreated, gin.H{
+		"id":             session.ID,
+		"attachment":     attachment,
+		"offset":         0,
+		"min_chunk_size": MinPartSize,
+		"max_chunk_size": MaxChunkSize,
+	})
+}
+
+// ResumableUploadOffset answers HEAD with how much of the file the server
+// already has.
+func ResumableUploadOffset(uploads store.UploadSessionStore, c *gin.Context) {
+	session, ok := ownSession(uploads, c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header(UploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	c.Header(UploadLengthHeader, strconv.FormatInt(session.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// AppendResumableUpload stores the request body as the next chunk. The
+// Upload-Offset header must match the server's offset, which makes a
+// retried chunk that already landed fail with 409 instead of duplicating
+// data. The last chunk completes the multipart upload and marks the
+// attachment ready, or hands it to the attachment worker.
+func AppendResumableUpload(blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, worker *AttachmentWorker, c *gin.Context) {
+	session, ok := ownSession(uploads, c)
+	if !ok {
+		return
+	}
+	if session.Offset == session.Size {
+		// every byte arrived but finishing failed last time, so try again.
+		// Settling copies the object, which may outlast the WriteTimeout.
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+		digest, err := resumeHash(session.HashState)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		respondFinished(c, blobs, uploads, attachments, worker, session, digest)
+		return
+	}
+	if c.ContentType() != ChunkContentType {
+		apierror.Abort(c, apierror.BadRequest("Chunks must be sent as "+ChunkContentType))
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		apierror.Abort(c, apierror.BadRequest("Missing or invalid "+UploadOffsetHeader+" header"))
+		return
+	}
+	if offset != session.Offset {
+		apierror.Abort(c, offsetMismatch(session.Offset))
+		return
+	}
+	if err := checkChunk(session, c.Request.ContentLength); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	size := c.Request.ContentLength
+
+	// chunks may be large, the bytes already bounded by Content-Length
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	digest, err := resumeHash(session.HashState)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	// spool the chunk first so a dropped connection never reaches storage
+	// as a short part
+	chunk, err := os.CreateTemp("", "chunk-*")
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	defer os.Remove(chunk.Name())
+	defer chunk.Close()
+	n, err := io.Copy(io.MultiWriter(chunk, digest), http.MaxBytesReader(c.Writer, c.Request.Body, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.BadRequest("Chunk was cut short").Wrap(err))
+		return
+	}
+	if offset == 0 {
+		if err := checkFirstChunk(c, attachments, session, chunk); err != nil {
+			apierror.Abort(c, err)
+			return
+		}
+	}
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	number := int32(len(session.Parts) + 1)
+	etag, err := blobs.UploadPart(c, session.Key, session.UploadID, number, chunk, size, session.Offset+size == session.Size)
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+
+	state, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	session.Parts = append(session.Parts, store.UploadPart{Number: number, ETag: etag, Size: size})
+	session.Offset += size
+	session.HashState = state
+	if err := uploads.AdvanceUploadSession(c, session, offset); errors.Is(err, store.ErrConflict) {
+		// a concurrent request stored this chunk first
+		current, err := uploads.GetUploadSession(c, session.ID)
+		if err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "upload"))
+			return
+		}
+		apierror.Abort(c, offsetMismatch(current.Offset))
+		return
+	} else if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "upload"))
+		return
+	}
+	c.Header(UploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+
+	if session.Offset < session.Size {
+		c.JSON(http.StatusOK, gin.H{"id": session.ID, "offset": session.Offset, "complete": false})
+		return
+	}
+
+	respondFinished(c, blobs, uploads, attachments, worker, session, digest)
+}
+
+func respondFinished(c *gin.Context, blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, worker *AttachmentWorker, session *store.UploadSession, digest hash.Hash) {
+	attachment, err := finishResumableUpload(c, blobs, uploads, attachments, worker, session, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": session.ID, "offset": session.Offset, "complete": true, "attachment": attachment})
+}
+
+// CancelResumableUpload discards the session, its parts and the pending
+// attachment.
+func CancelResumableUpload(blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, c *gin.Context) {
+	session, ok := ownSession(uploads, c)
+	if !ok {
+		return
+	}
+	if err := discardSession(c, blobs, uploads, attachments, session); err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Upload cancelled!"})
+}
+
+// CleanupUploads discards every session that has not received a chunk
+// since before and returns how many it removed.
+func CleanupUploads(ctx context.Context, blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, before time.Time) (int, error) {
+	stale, err := uploads.ListStaleUploadSessions(ctx, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range stale {
+		if err := discardSession(ctx, blobs, uploads, attachments, &stale[i]); err != nil {
+			return removed, fmt.Errorf("upload %s: %w", stale[i].ID, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// StartUploadJanitor runs CleanupUploads in the background until ctx is
+// done, dropping sessions idle for longer than ttl.
+func StartUploadJanitor(ctx context.Context, blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, ttl time.Duration, logger *slog.Logger) {
+	interval := max(ttl/4, time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			removed, err := CleanupUploads(ctx, blobs, uploads, attachments, time.Now().Add(-ttl))
+			if err != nil {
+				logger.Error("failed to clean up abandoned uploads", "removed", removed, "error", err)
+			} else if removed > 0 {
+				logger.Info("cleaned up abandoned uploads", "removed", removed)
+			}
+		}
+	}()
+}
+
+// ownSession loads the session named in the path, answering 404 when it
+// does not exist or belongs to someone else.
+func ownSession(uploads store.UploadSessionStore, c *gin.Context) (*store.UploadSession, bool) {
+	session, err := uploads.GetUploadSession(c, c.Param("id"))
+	if err == nil && session.Owner != c.GetString("userID") {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "upload"))
+		return nil, false
+	}
+	return session, true
+}
+
+// checkFirstChunk sniffs the start of the file against the type declared
+// when the session was created.
+func checkFirstChunk(ctx context.Context, attachments store.AttachmentStore, session *store.UploadSession, chunk io.ReaderAt) error {
+	attachment, err := attachments.GetAttachment(ctx, session.AttachmentID)
+	if err != nil {
+		return apierror.FromStore(err, "attachment")
+	}
+	head := make([]byte, SniffLength)
+	n, err := chunk.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return apierror.Internal(err)
+	}
+	if err := CheckContent(attachment.ContentType, head[:n]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func offsetMismatch(current int64) *apierror.Error {
+	return apierror.New(http.StatusConflict, apierror.CodeConflict, "Upload offset does not match").
+		WithDetails(gin.H{"offset": current})
+}
+
+func checkChunk(session *store.UploadSession, size int64) *apierror.Error {
+	remaining := session.Size - session.Offset
+	switch {
+	case size <= 0:
+		return apierror.BadRequest("Chunks need a Content-Length")
+	case size > remaining:
+		return apierror.BadRequest("Chunk runs past the end of the file").
+			WithDetails(gin.H{"remaining": remaining})
+	case size > MaxChunkSize:
+		return apierror.BadRequest("Chunk is too large").
+			WithDetails(gin.H{"max_chunk_size": MaxChunkSize})
+	case size < MinPartSize && size != remaining:
+		return apierror.BadRequest("Only the last chunk may be smaller than the minimum chunk size").
+			WithDetails(gin.H{"min_chunk_size": MinPartSize})
+	case len(session.Parts) >= maxParts-1 && size != remaining:
+		return apierror.BadRequest("Too many chunks, send the rest in one")
+	}
+	return nil
+}
+
+// resumeHash restores the SHA-256 of the chunks received so far.
+func resumeHash(state []byte) (hash.Hash, error) {
+	digest := sha256.New()
+	if len(state) > 0 {
+		if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, fmt.Errorf("restore upload checksum: %w", err)
+		}
+	}
+	return digest, nil
+}
+
+func finishResumableUpload(ctx context.Context, blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, worker *AttachmentWorker, session *store.UploadSession, checksum string) (*store.Attachment, error) {
+	attachment, err := attachments.GetAttachment(ctx, session.AttachmentID)
+	if err != nil {
+		return nil, apierror.FromStore(err, "attachment")
+	}
+	// parts are uploaded before the checksum is known, so the object can
+	// only be deduplicated now
+	if attachment.Status == store.AttachmentPending {
+		// a retry after finishing failed may find the multipart upload
+		// already completed, and storage no longer knows its ID
+		_, err := blobs.Stat(ctx, session.Key)
+		if errors.Is(err, ErrBlobNotFound) {
+			parts := make([]Part, len(session.Parts))
+			for i, p := range session.Parts {
+				parts[i] = Part{Number: p.Number, ETag: p.ETag}
+			}
+			err = blobs.CompleteMultipart(ctx, session.Key, session.UploadID, parts)
+		}
+		if err != nil {
+			return nil, apierror.Upstream("Storage", err)
+		}
+		if err := settleUpload(ctx, blobs, attachments, worker, attachment, checksum); err != nil {
+			return nil, err
+		}
+	}
+	if err := uploads.DeleteUploadSession(ctx, session.ID); err != nil {
+		logging.FromContext(ctx).Warn("failed to remove finished upload session", "upload", session.ID, "error", err)
+	}
+	return attachment, nil
+}
+
+func discardSession(ctx context.Context, blobs BlobStore, uploads store.UploadSessionStore, attachments store.AttachmentStore, session *store.UploadSession) error {
+	if err := blobs.AbortMultipart(ctx, session.Key, session.UploadID); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	if err := attachments.DeleteAttachment(ctx, session.AttachmentID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if err := uploads.DeleteUploadSession(ctx, session.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func abortMultipart(ctx context.Context, blobs BlobStore, key, uploadID string) {
+	if err := blobs.AbortMultipart(ctx, key, uploadID); err != nil {
+		logging.FromContext(ctx).Warn("failed to abort multipart upload", "key", key, "error", err)
+	}
+}
@@ -2,84 +2,320 @@ package awservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func ConnectS3(cfg aws.Config) *s3.Client {
-	s3Client := s3.NewFromConfig(cfg)
-	_, err := s3Client.ListBuckets(context.TODO(), &s3.ListBucketsInput{})
-	if err != nil {
-		log.Fatalf("unable to load S3 buckets, %v", err)
+// S3API is the part of *s3.Client the S3 backend uses.
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// Presigner is the part of *s3.PresignClient the S3 backend uses.
+type Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// S3Store is the BlobStore backed by an S3 bucket.
+type S3Store struct {
+	Client    S3API
+	Presigner Presigner
+	Bucket    string
+}
+
+func NewS3Store(client *s3.Client, bucket string) *S3Store {
+	return &S3Store{Client: client, Presigner: s3.NewPresignClient(client), Bucket: bucket}
+}
+
+// ConnectS3 builds an S3 client. When endpoint is set the client talks to
+// that S3 compatible server (MinIO, LocalStack, ...) with path style URLs.
+// A failing bucket listing is logged rather than fatal so the server can
+// still start while storage is unreachable.
+func ConnectS3(cfg aws.Config, endpoint string, logger *slog.Logger) *s3.Client {
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s3Client.ListBuckets(ctx, &s3.ListBucketsInput{}); err != nil {
+		logger.Warn("unable to list S3 buckets, storage may be unavailable", "endpoint", endpoint, "error", err)
+		return s3Client
 	}
-	log.Printf("[CONNECTED] to AWS S3 service")
+	logger.Info("connected to S3", "endpoint", endpoint)
 	return s3Client
 }
 
-func UploadFileToS3(s3Client *s3.Client, c *gin.Context) {
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+	if size >= 0 {
+		input.ContentLength = aws.Int64(size)
+	}
+	_, err := s.Client.PutObject(ctx, input)
+	return err
+}
 
-	bucketName := os.Getenv("AWS_BUCKET")
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, mapS3Error(err)
+	}
+	return out.Body, &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
 
-	// Read the uploaded file
-	file, header, err := c.Request.FormFile("file")
+func (s *S3Store) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rng),
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
-		return
+		return nil, nil, mapS3Error(err)
 	}
-	defer file.Close()
+	return out.Body, &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
 
-	// Use the filename from the uploaded file
-	filename := header.Filename
+func (s *S3Store) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s.Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
 
-	// Upload to S3
-	_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(filename),
-		Body:   file,
-	})
+// PresignPut signs Content-Length and Content-Type into the URL, so S3
+// rejects a body of any other size or type.
+func (s *S3Store) PresignPut(ctx context.Context, key string, size int64, contentType string, expires time.Duration) (*PresignedRequest, error) {
+	req, err := s.Presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	}, s3.WithPresignExpires(expires))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload file: %v", err)})
-		return
+		return nil, err
 	}
+	headers := map[string]string{}
+	for name, values := range req.SignedHeader {
+		// Host is set by every HTTP client from the URL
+		if len(values) > 0 && !strings.EqualFold(name, "Host") {
+			headers[http.CanonicalHeaderKey(name)] = values[0]
+		}
+	}
+	return &PresignedRequest{Method: req.Method, URL: req.URL, Headers: headers}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	return mapS3Error(err)
+}
 
-	fileURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, filename)
-	c.JSON(http.StatusOK, gin.H{"url": fileURL})
+func (s *S3Store) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	pages := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			err := fn(ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         aws.ToString(object.ETag),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func DownloadFileFromS3(s3Client *s3.Client, c *gin.Context) {
-	err := godotenv.Load()
+func (s *S3Store) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load .env file"})
-		return
+		return nil, mapS3Error(err)
 	}
-	bucketName := os.Getenv("AWS_BUCKET")
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// copyPartSize is the size of the parts an object too large for a single
+// CopyObject is copied in. The largest object S3 stores then takes well
+// under the 10,000 parts it allows.
+const copyPartSize = 1 << 30
 
-	filename := c.Param("filename")
-	if filename == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
-		return
+// Copy has S3 copy the object within the bucket, in parts when it is larger
+// than CopyObject accepts. Parts are only copied while the object still has
+// the ETag it started with.
+func (s *S3Store) Copy(ctx context.Context, from, to string) error {
+	info, err := s.Stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	source := aws.String(s.Bucket + "/" + escapeKey(from))
+	if info.Size <= MaxDirectUploadSize {
+		_, err := s.Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(s.Bucket),
+			Key:               aws.String(to),
+			CopySource:        source,
+			CopySourceIfMatch: aws.String(info.ETag),
+		})
+		return mapS3Error(err)
 	}
 
-	expiration := time.Duration(5) * time.Minute
-	presignClient := s3.NewPresignClient(s3Client)
+	uploadID, err := s.CreateMultipart(ctx, to, info.ContentType)
+	if err != nil {
+		return err
+	}
+	var parts []Part
+	for offset := int64(0); offset < info.Size; offset += copyPartSize {
+		number := int32(len(parts) + 1)
+		out, err := s.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(s.Bucket),
+			Key:               aws.String(to),
+			UploadId:          aws.String(uploadID),
+			PartNumber:        aws.Int32(number),
+			CopySource:        source,
+			CopySourceIfMatch: aws.String(info.ETag),
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+copyPartSize, info.Size)-1)),
+		})
+		if err != nil {
+			abortMultipart(ctx, s, to, uploadID)
+			return mapS3Error(err)
+		}
+		parts = append(parts, Part{Number: number, ETag: aws.ToString(out.CopyPartResult.ETag)})
+	}
+	if err := s.CompleteMultipart(ctx, to, uploadID, parts); err != nil {
+		abortMultipart(ctx, s, to, uploadID)
+		return err
+	}
+	return nil
+}
 
-	presignedURL, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(filename),
-	}, s3.WithPresignExpires(expiration))
+func (s *S3Store) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	out, err := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
 
+func (s *S3Store) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64, last bool) (string, error) {
+	out, err := s.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate presigned URL: %v", err)})
-		return
+		return "", mapS3Error(err)
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (s *S3Store) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)}
 	}
+	_, err := s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return mapS3Error(err)
+}
 
-	c.JSON(http.StatusOK, gin.H{"url": presignedURL.URL})
+func (s *S3Store) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := s.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return mapS3Error(err)
+}
+
+func mapS3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) || errors.As(err, &noSuchUpload) {
+		return fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+	}
+	return err
 }
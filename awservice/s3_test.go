@@ -0,0 +1,73 @@
+package awservice
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// copyingS3 records the copy requests S3Store.Copy makes for an object of
+// size bytes. Calls it does not expect panic on the nil S3API.
+type copyingS3 struct {
+	S3API
+	size      int64
+	copied    bool
+	ranges    []string
+	completed []int32
+}
+
+func (f *copyingS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(f.size), ContentType: aws.String("video/mp4"), ETag: aws.String(`"v1"`)}, nil
+}
+
+func (f *copyingS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copied = true
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *copyingS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (f *copyingS3) UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if aws.ToString(params.CopySource) != "bucket/uploads/u1/a1/big%20clip.mp4" || aws.ToString(params.CopySourceIfMatch) != `"v1"` {
+		panic("unexpected copy source " + aws.ToString(params.CopySource))
+	}
+	f.ranges = append(f.ranges, aws.ToString(params.CopySourceRange))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String("etag")}}, nil
+}
+
+func (f *copyingS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	for _, p := range params.MultipartUpload.Parts {
+		f.completed = append(f.completed, aws.ToInt32(p.PartNumber))
+	}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestS3Copy(t *testing.T) {
+	ctx := context.Background()
+	small := &copyingS3{size: MaxDirectUploadSize}
+	if err := (&S3Store{Client: small, Bucket: "bucket"}).Copy(ctx, "uploads/u1/a1/clip.mp4", "content/ab/abc"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if !small.copied || len(small.ranges) != 0 {
+		t.Fatalf("object of 5 GiB was not copied in one request: %+v", small)
+	}
+
+	// larger objects are copied in parts, S3 refusing CopyObject beyond 5 GiB
+	large := &copyingS3{size: MaxDirectUploadSize + copyPartSize/2}
+	if err := (&S3Store{Client: large, Bucket: "bucket"}).Copy(ctx, "uploads/u1/a1/big clip.mp4", "content/cd/cde"); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	want := []string{
+		"bytes=0-1073741823", "bytes=1073741824-2147483647", "bytes=2147483648-3221225471",
+		"bytes=3221225472-4294967295", "bytes=4294967296-5368709119", "bytes=5368709120-5905580031",
+	}
+	if large.copied || !slices.Equal(large.ranges, want) || !slices.Equal(large.completed, []int32{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("unexpected multipart copy: %+v", large)
+	}
+}
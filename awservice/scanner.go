@@ -0,0 +1,134 @@
+package awservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrTooLargeToScan is returned by a Scanner for objects over its size
+// limit. The worker lets such objects through unscanned.
+var ErrTooLargeToScan = errors.New("object too large to scan")
+
+// Verdict is the outcome of a scan.
+type Verdict struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner checks uploaded content for malware.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Verdict, error)
+}
+
+// NopScanner passes everything. It is used when no scanner is configured.
+type NopScanner struct{}
+
+func (NopScanner) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	return Verdict{}, nil
+}
+
+// ClamdScanner streams content to a ClamAV daemon with the INSTREAM
+// command.
+type ClamdScanner struct {
+	// Network and Address are passed to net.Dial, e.g. tcp and
+	// clamav:3310 or unix and /run/clamav/clamd.sock.
+	Network string
+	Address string
+	// MaxSize should not exceed clamd's StreamMaxLength (25 MiB by default).
+	MaxSize int64
+	Timeout time.Duration
+}
+
+// NewClamdScanner parses an address such as tcp://clamav:3310 or
+// unix:///run/clamav/clamd.sock.
+func NewClamdScanner(address string, maxSize int64) (*ClamdScanner, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	s := &ClamdScanner{Network: u.Scheme, MaxSize: maxSize, Timeout: time.Minute}
+	switch u.Scheme {
+	case "tcp":
+		s.Address = u.Host
+	case "unix":
+		s.Address = u.Path
+	default:
+		return nil, fmt.Errorf("clamd address %q must start with tcp:// or unix://", address)
+	}
+	return s, nil
+}
+
+// DefaultClamdMaxSize matches clamd's default StreamMaxLength.
+const DefaultClamdMaxSize = 25 << 20
+
+const clamdChunkSize = 64 << 10
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	var sent int64
+	for {
+		n, readErr := r.Read(buf[4:])
+		if n > 0 {
+			sent += int64(n)
+			if s.MaxSize > 0 && sent > s.MaxSize {
+				return Verdict{}, ErrTooLargeToScan
+			}
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return Verdict{}, fmt.Errorf("clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return Verdict{}, readErr
+		}
+	}
+	// a zero length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or
+// "<message> ERROR".
+func parseClamdReply(reply string) (Verdict, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return Verdict{}, fmt.Errorf("clamd: %s", result)
+	}
+}
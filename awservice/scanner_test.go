@@ -0,0 +1,28 @@
+package awservice
+
+import "testing"
+
+func TestParseClamdReply(t *testing.T) {
+	for _, tc := range []struct {
+		reply   string
+		want    Verdict
+		wantErr bool
+	}{
+		{"stream: OK", Verdict{}, false},
+		{"OK\n", Verdict{}, false},
+		{"stream: Eicar-Test-Signature FOUND", Verdict{Infected: true, Signature: "Eicar-Test-Signature"}, false},
+		{"stream: Win.Trojan.Agent-123 FOUND", Verdict{Infected: true, Signature: "Win.Trojan.Agent-123"}, false},
+		{"INSTREAM size limit exceeded. ERROR", Verdict{}, true},
+		{"stream: Can't allocate memory ERROR", Verdict{}, true},
+		{"", Verdict{}, true},
+	} {
+		got, err := parseClamdReply(tc.reply)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tc.reply, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: verdict %+v, want %+v", tc.reply, got, tc.want)
+		}
+	}
+}
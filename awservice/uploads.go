@@ -0,0 +1,221 @@
+package awservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/logging"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaxDirectUploadSize is the largest object S3 accepts in a single PUT, and
+// copies with a single CopyObject.
+const MaxDirectUploadSize = 5 << 30
+
+const uploadExpiry = 15 * time.Minute
+
+type uploadRequest struct {
+	Filename    string `json:"filename" binding:"required"`
+	Size        int64  `json:"size" binding:"required,min=1"`
+	ContentType string `json:"content_type" binding:"required"`
+}
+
+// CreateUpload records a pending attachment and hands back a presigned
+// request the client uses to send the bytes straight to storage, bypassing
+// this server. The upload is finished with CompleteUpload.
+func CreateUpload(blobs BlobStore, attachments store.AttachmentStore, policy *UploadPolicy, quotas *Quotas, c *gin.Context) {
+	var req uploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if req.Size > MaxDirectUploadSize {
+		apierror.Abort(c, apierror.BadRequest("File is too large").
+			WithDetails(gin.H{"max_size": MaxDirectUploadSize}))
+		return
+	}
+	if err := policy.Check(req.Filename, req.ContentType, req.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := quotas.Check(c, c.GetString("userID"), req.Size); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	req.ContentType = normalizeType(req.ContentType)
+
+	attachment := store.Attachment{
+		ID:          store.NewAttachmentID(),
+		Owner:       c.GetString("userID"),
+		Name:        SanitizeFilename(req.Filename),
+		Size:        req.Size,
+		ContentType: req.ContentType,
+		Status:      store.AttachmentPending,
+	}
+	attachment.Key = ObjectKey(attachment.Owner, attachment.ID, req.Filename)
+
+	upload, err := blobs.PresignPut(c, attachment.Key, attachment.Size, attachment.ContentType, uploadExpiry)
+	if errors.Is(err, ErrPresignUnsupported) {
+		apierror.Abort(c, apierror.BadRequest("Direct uploads are not available while storage is encrypted, use a resumable upload"))
+		return
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	if err := attachments.CreateAttachment(c, &attachment); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         attachment.ID,
+		"attachment": attachment,
+		"upload":     upload,
+		"expires_at": time.Now().Add(uploadExpiry).Unix(),
+	})
+}
+
+// CompleteUpload checks the object the client uploaded with a HEAD request,
+// moves it to its content key and marks the attachment ready, or hands it
+// to the attachment worker. An object of the wrong size or type is deleted
+// so the client can start over.
+func CompleteUpload(blobs BlobStore, attachments store.AttachmentStore, worker *AttachmentWorker, c *gin.Context) {
+	attachment, err := attachments.GetAttachment(c, c.Param("id"))
+	if err == nil && attachment.Owner != c.GetString("userID") {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	if attachment.Status != store.AttachmentPending {
+		c.JSON(http.StatusOK, gin.H{"id": attachment.ID, "attachment": attachment})
+		return
+	}
+
+	info, err := blobs.Stat(c, attachment.Key)
+	if errors.Is(err, ErrBlobNotFound) {
+		apierror.Abort(c, apierror.BadRequest("Nothing has been uploaded for this attachment yet"))
+		return
+	} else if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	if info.Size != attachment.Size || info.ContentType != attachment.ContentType {
+		discardUpload(c, blobs, attachment.Key)
+		apierror.Abort(c, apierror.BadRequest("Uploaded object does not match the declared size or content type").
+			WithDetails(gin.H{
+				"expected": gin.H{"size": attachment.Size, "content_type": attachment.ContentType},
+				"actual":   gin.H{"size": info.Size, "content_type": info.ContentType},
+			}))
+		return
+	}
+	head, err := readHead(c, blobs, attachment.Key)
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	if err := CheckContent(attachment.ContentType, head); err != nil {
+		discardUpload(c, blobs, attachment.Key)
+		apierror.Abort(c, err)
+		return
+	}
+
+	// hashing reads the whole object back, which takes longer than the
+	// server's WriteTimeout for large files
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	checksum, err := objectChecksum(c, blobs, attachment.Key)
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream("Storage", err))
+		return
+	}
+	if err := settleUpload(c, blobs, attachments, worker, attachment, checksum); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": attachment.ID, "attachment": attachment})
+}
+
+// settleUpload moves a pending attachment whose bytes arrived under a key
+// of their own onto the content key for checksum, so it is deduplicated
+// like a direct upload: it shares an object already stored there, or the
+// bytes are copied over. Either way the uploaded object is then deleted
+// and the attachment saved ready, or processing and queued.
+func settleUpload(ctx context.Context, blobs BlobStore, attachments store.AttachmentStore, worker *AttachmentWorker, attachment *store.Attachment, checksum string) error {
+	uploaded := *attachment
+	settled := *attachment
+	settled.Checksum = checksum
+	settled.Key = ContentKey(checksum)
+	shared, err := shareContent(ctx, attachments, &settled)
+	if err != nil {
+		return apierror.FromStore(err, "attachment")
+	}
+	if !shared {
+		// as in UploadFile, the reference is saved before the object is
+		// looked at
+		if err := attachments.UpdateAttachment(ctx, &settled); err != nil {
+			return apierror.FromStore(err, "attachment")
+		}
+		_, err := blobs.Stat(ctx, settled.Key)
+		if errors.Is(err, ErrBlobNotFound) {
+			err = blobs.Copy(ctx, uploaded.Key, settled.Key)
+		}
+		if err != nil {
+			if err := attachments.UpdateAttachment(ctx, &uploaded); err != nil {
+				logging.FromContext(ctx).Warn("failed to restore upload after moving it failed", "attachment", uploaded.ID, "error", err)
+			}
+			return apierror.Upstream("Storage", err)
+		}
+		worker.markUploaded(&settled)
+		if err := attachments.UpdateAttachment(ctx, &settled); err != nil {
+			return apierror.FromStore(err, "attachment")
+		}
+	}
+	if err := blobs.Delete(ctx, uploaded.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		logging.FromContext(ctx).Warn("failed to remove moved upload", "key", uploaded.Key, "error", err)
+	}
+	*attachment = settled
+	if attachment.Status == store.AttachmentProcessing {
+		worker.Enqueue(attachment.ID)
+	}
+	return nil
+}
+
+// objectChecksum hashes an object with SHA-256.
+func objectChecksum(ctx context.Context, blobs BlobStore, key string) (string, error) {
+	body, _, err := blobs.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readHead returns the first SniffLength bytes of an object.
+func readHead(ctx context.Context, blobs BlobStore, key string) ([]byte, error) {
+	body, _, err := blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, SniffLength))
+}
+
+func discardUpload(ctx context.Context, blobs BlobStore, key string) {
+	if err := blobs.Delete(ctx, key); err != nil {
+		logging.FromContext(ctx).Warn("failed to remove rejected upload", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,202 @@
+package awservice
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"crispy-doodle/main.go/store"
+)
+
+// QuarantinePrefix is where flagged objects are moved, out of the way of
+// the keys downloads are served from.
+const QuarantinePrefix = "quarantine/"
+
+// sweepInterval is how often attachments left processing, e.g. while the
+// scanner was down, are queued again.
+const sweepInterval = 10 * time.Minute
+
+// AttachmentWorker finishes uploads off the request path. Every attachment
+// is scanned when a Scanner is configured and flagged ones are quarantined;
+// images then have their metadata stripped and thumbnails made. Attachments
+// stay processing, and cannot be downloaded, until it is done.
+type AttachmentWorker struct {
+	blobs       BlobStore
+	attachments store.AttachmentStore
+	scanner     Scanner
+	logger      *slog.Logger
+	queue       chan string
+
+	// AllowUnscanned lets files too large for the scanner through
+	// unscanned, logging each at error level. Otherwise they are marked
+	// failed.
+	AllowUnscanned bool
+}
+
+// NewAttachmentWorker builds a worker. A nil scanner skips scanning.
+func NewAttachmentWorker(blobs BlobStore, attachments store.AttachmentStore, scanner Scanner, logger *slog.Logger) *AttachmentWorker {
+	if scanner == nil {
+		scanner = NopScanner{}
+	}
+	return &AttachmentWorker{
+		blobs:       blobs,
+		attachments: attachments,
+		scanner:     scanner,
+		logger:      logger,
+		queue:       make(chan string, 256),
+	}
+}
+
+// Start runs workers goroutines until ctx is done. Attachments left
+// processing by an earlier run or a failed attempt are picked up again
+// straight away and then every sweepInterval.
+func (w *AttachmentWorker) Start(ctx context.Context, workers int) {
+	for range max(workers, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-w.queue:
+					if err := w.Process(ctx, id); err != nil {
+						w.logger.Error("attachment processing failed", "attachment", id, "error", err)
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			leftover, err := w.attachments.ListAttachmentsByStatus(ctx, store.AttachmentProcessing)
+			if err != nil {
+				w.logger.Error("failed to list unprocessed attachments", "error", err)
+			}
+			for _, a := range leftover {
+				w.Enqueue(a.ID)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Enqueue schedules an attachment for processing without blocking the
+// caller. When the queue is full the ID is dropped; the attachment stays
+// processing and the next sweep queues it again. A nil worker does nothing.
+func (w *AttachmentWorker) Enqueue(id string) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- id:
+	default:
+		w.logger.Debug("attachment queue full, leaving it to the sweep", "attachment", id)
+	}
+}
+
+// markUploaded moves a freshly stored attachment on from pending: to
+// processing when the worker has something to do with it, otherwise
+// straight to ready.
+func (w *AttachmentWorker) markUploaded(attachment *store.Attachment) {
+	if w == nil {
+		attachment.Status = store.AttachmentReady
+		return
+	}
+	_, noScanner := w.scanner.(NopScanner)
+	if !noScanner || IsImage(attachment.ContentType) {
+		attachment.Status = store.AttachmentProcessing
+		return
+	}
+	attachment.Status = store.AttachmentReady
+}
+
+// Process handles one attachment. Errors from storage or the scanner are
+// returned and the attachment stays processing so a later sweep retries it;
+// images that cannot be parsed are marked failed.
+func (w *AttachmentWorker) Process(ctx context.Context, id string) error {
+	attachment, err := w.attachments.GetAttachment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if attachment.Status != store.AttachmentProcessing {
+		return nil
+	}
+
+	verdict, err := w.scan(ctx, attachment)
+	if errors.Is(err, ErrBlobNotFound) {
+		// an identical upload was quarantined and took the object with it
+		attachment.Status = store.AttachmentFailed
+		return w.attachments.UpdateAttachment(ctx, attachment)
+	} else if errors.Is(err, ErrTooLargeToScan) {
+		w.logger.Warn("attachment too large to scan, marking it failed", "attachment", id, "size", attachment.Size)
+		attachment.Status = store.AttachmentFailed
+		return w.attachments.UpdateAttachment(ctx, attachment)
+	} else if err != nil {
+		return err
+	}
+	if verdict.Infected {
+		return w.quarantine(ctx, attachment, verdict)
+	}
+
+	if IsImage(attachment.ContentType) {
+		err := w.processImage(ctx, attachment)
+		if errors.Is(err, errNotAnImage) || errors.Is(err, ErrBlobNotFound) {
+			w.logger.Warn("attachment is not a readable image", "attachment", id, "error", err)
+			attachment.Status = store.AttachmentFailed
+			return w.attachments.UpdateAttachment(ctx, attachment)
+		} else if err != nil {
+			return err
+		}
+	}
+	attachment.Status = store.AttachmentReady
+	return w.attachments.UpdateAttachment(ctx, attachment)
+}
+
+func (w *AttachmentWorker) scan(ctx context.Context, attachment *store.Attachment) (Verdict, error) {
+	if _, ok := w.scanner.(NopScanner); ok {
+		return Verdict{}, nil
+	}
+	body, _, err := w.blobs.Get(ctx, attachment.Key)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer body.Close()
+
+	verdict, err := w.scanner.Scan(ctx, body)
+	if errors.Is(err, ErrTooLargeToScan) && w.AllowUnscanned {
+		w.logger.Error("attachment too large to scan, letting it through unscanned", "attachment", attachment.ID,
+			"size", attachment.Size)
+		return Verdict{}, nil
+	}
+	return verdict, err
+}
+
+// quarantine moves a flagged object under QuarantinePrefix, where nothing
+// links to it, and marks the attachment quarantined.
+func (w *AttachmentWorker) quarantine(ctx context.Context, attachment *store.Attachment, verdict Verdict) error {
+	w.logger.Warn("upload flagged by malware scan", "attachment", attachment.ID, "owner", attachment.Owner, "signature", verdict.Signature)
+
+	body, _, err := w.blobs.Get(ctx, attachment.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	quarantined := QuarantinePrefix + attachment.Key
+	if err := w.blobs.Put(ctx, quarantined, body, attachment.Size, attachment.ContentType); err != nil {
+		return err
+	}
+	if err := w.blobs.Delete(ctx, attachment.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+
+	attachment.Key = quarantined
+	attachment.Status = store.AttachmentQuarantined
+	return w.attachments.UpdateAttachment(ctx, attachment)
+}
@@ -0,0 +1,2233 @@
+package ginserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/global"
+	ai "crispy-doodle/main.go/open-ai"
+	"crispy-doodle/main.go/store"
+)
+
+type session struct {
+	user    store.User
+	token   string
+	refresh string
+}
+
+// signUp registers and logs in a user, returning its tokens.
+func (h *harness) signUp(name, email, password string) session {
+	h.t.Helper()
+	h.expect(h.do(http.MethodPost, "/register", "", map[string]any{
+		"name": name, "email": email, "password": password,
+	}), http.StatusCreated, nil)
+	return h.login(email, password)
+}
+
+func (h *harness) login(email, password string) session {
+	h.t.Helper()
+	var login struct {
+		Token        string     `json:"token"`
+		RefreshToken string     `json:"refreshToken"`
+		User         store.User `json:"user"`
+	}
+	h.expect(h.do(http.MethodPost, "/login", "", map[string]any{
+		"email": email, "password": password,
+	}), http.StatusOK, &login)
+	if login.Token == "" || login.RefreshToken == "" {
+		h.t.Fatalf("login returned empty tokens")
+	}
+	return session{user: login.User, token: login.Token, refresh: login.RefreshToken}
+}
+
+func TestAuthFlow(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, newStores(t))
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+			if alice.user.ID == "" || alice.user.Email != "alice@example.com" {
+				t.Fatalf("unexpected user in login response: %+v", alice.user)
+			}
+			if alice.user.Password != "" {
+				t.Fatalf("login response leaked the password hash")
+			}
+
+			h.expectError(h.do(http.MethodPost, "/register", "", map[string]any{
+				"name": "alice2", "email": "alice@example.com", "password": "x",
+			}), http.StatusConflict, "conflict")
+			h.expectError(h.do(http.MethodPost, "/login", "", map[string]any{
+				"email": "alice@example.com", "password": "wrong",
+			}), http.StatusUnauthorized, "invalid_credentials")
+			h.expectError(h.do(http.MethodPost, "/login", "", map[string]any{
+				"email": "nobody@example.com", "password": "hunter2",
+			}), http.StatusUnauthorized, "invalid_credentials")
+
+			var refreshed struct {
+				AccessToken string `json:"access_token"`
+			}
+			h.expect(h.do(http.MethodPost, "/refresh", "", map[string]any{"refresh_token": alice.refresh}),
+				http.StatusOK, &refreshed)
+			h.expect(h.do(http.MethodGet, "/api/users/"+alice.user.ID, refreshed.AccessToken, nil), http.StatusOK, nil)
+
+			// an access token is not a refresh token
+			h.expectError(h.do(http.MethodPost, "/refresh", "", map[string]any{"refresh_token": alice.token}),
+				http.StatusUnauthorized, "invalid_token")
+			h.expectError(h.do(http.MethodGet, "/api/users", "", nil), http.StatusUnauthorized, "unauthorized")
+			h.expectError(h.do(http.MethodGet, "/api/users", "not-a-jwt", nil), http.StatusUnauthorized, "invalid_token")
+		})
+	}
+}
+
+func TestUserEndpoints(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, newStores(t))
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+
+			var users []store.User
+			h.expect(h.do(http.MethodGet, "/api/users", alice.token, nil), http.StatusOK, &users)
+			if len(users) != 2 {
+				t.Fatalf("got %d users, want 2", len(users))
+			}
+			for _, u := range users {
+				if u.Password != "" {
+					t.Fatalf("user list leaked a password hash")
+				}
+			}
+
+			h.expect(h.do(http.MethodPut, "/api/users", bob.token, map[string]any{
+				"id": bob.user.ID, "name": "bobby", "email": "bob@example.com", "password": "new-password", "online": true,
+			}), http.StatusOK, nil)
+			var updated store.User
+			h.expect(h.do(http.MethodGet, "/api/users/"+bob.user.ID, bob.token, nil), http.StatusOK, &updated)
+			if updated.Name != "bobby" || !updated.Online {
+				t.Fatalf("update not applied: %+v", updated)
+			}
+			// the new password is stored hashed and works for login
+			h.expect(h.do(http.MethodPost, "/login", "", map[string]any{
+				"email": "bob@example.com", "password": "new-password",
+			}), http.StatusOK, nil)
+
+			h.expectError(h.do(http.MethodPut, "/api/users", bob.token, map[string]any{
+				"id": bob.user.ID, "name": "alice", "email": "bob@example.com", "password": "x",
+			}), http.StatusConflict, "conflict")
+
+			// an update without a password keeps the current one
+			h.expect(h.do(http.MethodPut, "/api/users", bob.token, map[string]any{
+				"id": bob.user.ID, "name": "robert", "email": "bob@example.com",
+			}), http.StatusOK, nil)
+			h.expect(h.do(http.MethodPost, "/login", "", map[string]any{
+				"email": "bob@example.com", "password": "new-password",
+			}), http.StatusOK, nil)
+
+			// only the account itself or an admin may change or delete it
+			h.expectError(h.do(http.MethodPut, "/api/users", alice.token, map[string]any{
+				"id": bob.user.ID, "name": "mallory", "email": "bob@example.com",
+			}), http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodDelete, "/api/users/"+bob.user.ID, alice.token, nil), http.StatusForbidden, "forbidden")
+			global.AdminEmails = []string{"root@example.com"}
+			t.Cleanup(func() { global.AdminEmails = nil })
+			root := h.signUp("root", "root@example.com", "correct horse")
+			h.expect(h.do(http.MethodPut, "/api/users", root.token, map[string]any{
+				"id": bob.user.ID, "name": "bob", "email": "bob@example.com",
+			}), http.StatusOK, nil)
+
+			h.expect(h.do(http.MethodDelete, "/api/users/"+alice.user.ID, alice.token, nil), http.StatusOK, nil)
+			h.expect(h.do(http.MethodDelete, "/api/users/"+bob.user.ID, root.token, nil), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodGet, "/api/users/"+bob.user.ID, root.token, nil), http.StatusNotFound, "not_found")
+			h.expectError(h.do(http.MethodDelete, "/api/users/"+bob.user.ID, root.token, nil), http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestChannelAndMessageFlow(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, newStores(t))
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+			var created struct {
+				ID string `json:"id"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{"text": "general"}),
+				http.StatusCreated, &created)
+			channelID := created.ID
+			h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "hello", "images": []string{}, "channel": channelID,
+			}), http.StatusCreated, &created)
+			messageID := created.ID
+
+			attachmentID := h.upload(alice.token, "a.txt", []byte("some text"))
+			h.expect(h.do(http.MethodPut, "/api/messages/"+messageID, alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "hello, edited", "images": []string{attachmentID},
+			}), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodPut, "/api/messages/"+messageID, alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "hello", "images": []string{"a.png"},
+			}), http.StatusBadRequest, "bad_request")
+			var message store.Message
+			h.expect(h.do(http.MethodGet, "/api/messages/"+messageID, alice.token, nil), http.StatusOK, &message)
+			if message.Text != "hello, edited" || len(message.Images) != 1 {
+				t.Fatalf("message update not applied: %+v", message)
+			}
+
+			var channel store.Channel
+			h.expect(h.do(http.MethodGet, "/api/channels/"+channelID, alice.token, nil), http.StatusOK, &channel)
+			if channel.Title != "general" || channel.Owner != alice.user.ID || len(channel.Messages) != 1 ||
+				channel.Messages[0] != messageID {
+				t.Fatalf("unexpected channel: %+v", channel)
+			}
+
+			h.expect(h.do(http.MethodPut, "/api/channels/"+channelID, alice.token, map[string]any{
+				"text": "random", "messages": []string{messageID},
+			}), http.StatusOK, nil)
+			var channels []store.Channel
+			h.expect(h.do(http.MethodGet, "/api/channels", alice.token, nil), http.StatusOK, &channels)
+			if len(channels) != 1 || channels[0].Title != "random" {
+				t.Fatalf("unexpected channel list: %+v", channels)
+			}
+
+			// messages only get into a channel by being posted there
+			h.expectError(h.do(http.MethodPut, "/api/channels/"+channelID, alice.token, map[string]any{
+				"text": "random", "messages": []string{},
+			}), http.StatusBadRequest, "bad_request")
+			h.expectError(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{
+				"text": "stolen", "messages": []string{messageID},
+			}), http.StatusBadRequest, "bad_request")
+
+			h.expectError(h.do(http.MethodPut, "/api/channels/channel_missing", alice.token, map[string]any{"text": "x"}),
+				http.StatusNotFound, "not_found")
+			h.expectError(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{"messages": []string{}}),
+				http.StatusBadRequest, "invalid_body")
+
+			// signing up does not make anyone a member, and messages are sent as the caller
+			h.expect(h.do(http.MethodPost, "/register", "", map[string]any{
+				"name": "bob", "email": "bob@example.com", "password": "swordfish", "channels": []string{channelID},
+				"role": store.RoleAdmin, "quota": 1 << 40,
+			}), http.StatusCreated, nil)
+			bob := h.login("bob@example.com", "swordfish")
+			if len(bob.user.Channels) != 0 || bob.user.Role != store.RoleUser || bob.user.Quota != nil {
+				t.Fatalf("registered as %+v", bob.user)
+			}
+			h.expectError(h.do(http.MethodPost, "/api/messages", bob.token, map[string]any{
+				"sender": alice.user.ID, "text": "hi", "images": []string{}, "channel": channelID,
+			}), http.StatusForbidden, "forbidden")
+			h.expect(h.do(http.MethodPost, "/api/channels/"+channelID+"/members", alice.token, map[string]any{
+				"user_id": bob.user.ID,
+			}), http.StatusOK, nil)
+			h.expect(h.do(http.MethodPost, "/api/messages", bob.token, map[string]any{
+				"sender": alice.user.ID, "text": "it's alice, honest", "images": []string{}, "channel": channelID,
+			}), http.StatusCreated, &created)
+			var impostor store.Message
+			h.expect(h.do(http.MethodGet, "/api/messages/"+created.ID, bob.token, nil), http.StatusOK, &impostor)
+			if impostor.Sender != bob.user.ID {
+				t.Fatalf("message sent as %q", impostor.Sender)
+			}
+			// only the sender and the channel owner may delete a message
+			h.expectError(h.do(http.MethodDelete, "/api/messages/"+messageID, bob.token, nil), http.StatusForbidden, "forbidden")
+			h.expect(h.do(http.MethodDelete, "/api/messages/"+impostor.ID, alice.token, nil), http.StatusOK, nil)
+
+			h.expect(h.do(http.MethodDelete, "/api/messages/"+messageID, alice.token, nil), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodGet, "/api/messages/"+messageID, alice.token, nil), http.StatusNotFound, "not_found")
+			h.expect(h.do(http.MethodDelete, "/api/channels/"+channelID, alice.token, nil), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodDelete, "/api/channels/"+channelID, alice.token, nil), http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestMessageImageEdits(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			stores := newStores(t)
+			h := newHarness(t, stores)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+			carol := h.signUp("carol", "carol@example.com", "letmein")
+
+			// messages from before attachments hold S3 URLs
+			legacyURL := "https://bucket.s3.amazonaws.com/cat.png"
+			legacy := store.Message{Sender: alice.user.ID, Text: "old", Images: []string{legacyURL}}
+			if err := stores.Messages.CreateMessage(context.Background(), &legacy); err != nil {
+				t.Fatalf("create legacy message: %v", err)
+			}
+			h.expect(h.do(http.MethodPut, "/api/messages/"+legacy.ID, alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "old, edited", "images": []string{legacyURL},
+			}), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodPut, "/api/messages/"+legacy.ID, alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "old", "images": []string{legacyURL, "https://elsewhere/x.png"},
+			}), http.StatusBadRequest, "bad_request")
+
+			// images already on a message are not re-checked against the
+			// editor, here an admin; other members of its channel may not edit it
+			global.AdminEmails = []string{"root@example.com"}
+			t.Cleanup(func() { global.AdminEmails = nil })
+			root := h.signUp("root", "root@example.com", "correct horse")
+			imageID := h.upload(alice.token, "cat.txt", []byte("meow"))
+			var created struct {
+				ID string `json:"id"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{"text": "pets"}),
+				http.StatusCreated, &created)
+			channelID := created.ID
+			h.expect(h.do(http.MethodPost, "/api/channels/"+channelID+"/members", alice.token, map[string]any{
+				"user_id": bob.user.ID,
+			}), http.StatusOK, nil)
+			h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "look", "images": []string{imageID}, "channel": channelID,
+			}), http.StatusCreated, &created)
+			h.expectError(h.do(http.MethodPut, "/api/messages/"+created.ID, bob.token, map[string]any{
+				"sender": bob.user.ID, "text": "look, typo fixed", "images": []string{imageID},
+			}), http.StatusForbidden, "forbidden")
+			h.expect(h.do(http.MethodPut, "/api/messages/"+created.ID, root.token, map[string]any{
+				"sender": root.user.ID, "text": "look, typo fixed", "images": []string{imageID},
+			}), http.StatusOK, nil)
+			var message store.Message
+			h.expect(h.do(http.MethodGet, "/api/messages/"+created.ID, alice.token, nil), http.StatusOK, &message)
+			if message.Sender != alice.user.ID || message.Text != "look, typo fixed" {
+				t.Fatalf("edit changed the sender or was not applied: %+v", message)
+			}
+			h.expectError(h.do(http.MethodPut, "/api/messages/"+created.ID, carol.token, map[string]any{
+				"sender": carol.user.ID, "text": "mine now", "images": []string{},
+			}), http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodPut, "/api/messages/missing", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "x", "images": []string{},
+			}), http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestAttachmentAccess(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, newStores(t))
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+			carol := h.signUp("carol", "carol@example.com", "letmein")
+
+			imageID := h.upload(alice.token, "cat.txt", []byte("meow"))
+
+			// nobody but the owner can see an attachment that is not shared
+			h.expect(h.download(alice.token, imageID), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodGet, "/api/download/"+imageID, bob.token, nil), http.StatusNotFound, "not_found")
+
+			var created struct {
+				ID string `json:"id"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{"text": "pets"}),
+				http.StatusCreated, &created)
+			channelID := created.ID
+			h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "look", "images": []string{imageID}, "channel": channelID,
+			}), http.StatusCreated, &created)
+			messageID := created.ID
+
+			// alice adds bob to the channel
+			h.expect(h.do(http.MethodPost, "/api/channels/"+channelID+"/members", alice.token, map[string]any{
+				"user_id": bob.user.ID,
+			}), http.StatusOK, nil)
+			rec := h.download(bob.token, imageID)
+			h.expect(rec, http.StatusOK, nil)
+			if rec.Body.String() != "meow" {
+				t.Fatalf("downloaded %q", rec.Body.String())
+			}
+
+			// carol cannot let herself in: not by listing the channel on her
+			// account, adding herself, posting there or copying the message
+			// into a channel of her own
+			h.expectError(h.do(http.MethodPut, "/api/users", carol.token, map[string]any{
+				"id": carol.user.ID, "name": "carol", "email": "carol@example.com", "password": "letmein",
+				"channels": []string{channelID},
+			}), http.StatusBadRequest, "bad_request")
+			h.expectError(h.do(http.MethodPost, "/api/channels/"+channelID+"/members", carol.token, map[string]any{
+				"user_id": carol.user.ID,
+			}), http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodPost, "/api/messages", carol.token, map[string]any{
+				"sender": carol.user.ID, "text": "hi", "images": []string{}, "channel": channelID,
+			}), http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodPut, "/api/channels/"+channelID, carol.token, map[string]any{"text": "mine"}),
+				http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodPost, "/api/channels", carol.token, map[string]any{
+				"text": "loot", "messages": []string{messageID},
+			}), http.StatusBadRequest, "bad_request")
+			h.expectError(h.do(http.MethodGet, "/api/download/"+imageID, carol.token, nil), http.StatusNotFound, "not_found")
+
+			// only the owner removes others, and bob loses access once removed
+			h.expectError(h.do(http.MethodDelete, "/api/channels/"+channelID+"/members/"+alice.user.ID, bob.token, nil),
+				http.StatusForbidden, "forbidden")
+			h.expectError(h.do(http.MethodDelete, "/api/channels/"+channelID, bob.token, nil),
+				http.StatusForbidden, "forbidden")
+			h.expect(h.do(http.MethodDelete, "/api/channels/"+channelID+"/members/"+bob.user.ID, alice.token, nil),
+				http.StatusOK, nil)
+			h.expectError(h.do(http.MethodGet, "/api/download/"+imageID, bob.token, nil), http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			stores := newStores(t)
+			h := newHarness(t, stores)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+			content := mp4Clip([]byte("a large video, honestly"))
+
+			var started struct {
+				ID         string                     `json:"id"`
+				Attachment store.Attachment           `json:"attachment"`
+				Upload     awservice.PresignedRequest `json:"upload"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/uploads", alice.token, map[string]any{
+				"filename": "clip.mp4", "size": len(content), "content_type": "video/mp4",
+			}), http.StatusCreated, &started)
+			if started.Attachment.Status != store.AttachmentPending || started.Upload.Method != http.MethodPut {
+				t.Fatalf("unexpected upload: %+v", started)
+			}
+
+			// a pending attachment cannot be completed, downloaded or attached yet
+			h.expectError(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", alice.token, nil),
+				http.StatusBadRequest, "bad_request")
+			h.expectError(h.do(http.MethodGet, "/api/download/"+started.ID, alice.token, nil), http.StatusNotFound, "not_found")
+			h.expectError(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "soon", "images": []string{started.ID},
+			}), http.StatusBadRequest, "bad_request")
+
+			// the signature pins the size and the content type
+			h.expectError(h.presigned(started.Upload, append(content, '!')), http.StatusBadRequest, "bad_request")
+			wrongType := started.Upload
+			wrongType.Headers = map[string]string{"Content-Type": "text/html"}
+			h.expectError(h.presigned(wrongType, content), http.StatusForbidden, "forbidden")
+
+			h.expect(h.presigned(started.Upload, content), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", bob.token, nil),
+				http.StatusNotFound, "not_found")
+			var completed struct {
+				Attachment store.Attachment `json:"attachment"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", alice.token, nil),
+				http.StatusOK, &completed)
+			if completed.Attachment.Status != store.AttachmentReady {
+				t.Fatalf("attachment not ready: %+v", completed.Attachment)
+			}
+
+			rec := h.download(alice.token, started.ID)
+			h.expect(rec, http.StatusOK, nil)
+			if rec.Body.String() != string(content) || rec.Header().Get("Content-Type") != "video/mp4" {
+				t.Fatalf("downloaded %q as %q", rec.Body.String(), rec.Header().Get("Content-Type"))
+			}
+
+			// the object is moved to its content key, where a second upload
+			// of the same bytes finds and shares it
+			ctx := context.Background()
+			sum := sha256.Sum256(content)
+			contentKey := awservice.ContentKey(hex.EncodeToString(sum[:]))
+			stored := func(id string) *store.Attachment {
+				t.Helper()
+				a, err := stores.Attachments.GetAttachment(ctx, id)
+				if err != nil {
+					t.Fatalf("get attachment: %v", err)
+				}
+				return a
+			}
+			uploadedKey := awservice.ObjectKey(alice.user.ID, started.ID, "clip.mp4")
+			if a := stored(started.ID); a.Key != contentKey {
+				t.Fatalf("completed upload stored under %q, want %q", a.Key, contentKey)
+			}
+			if _, err := h.blobs.Stat(ctx, uploadedKey); !errors.Is(err, awservice.ErrBlobNotFound) {
+				t.Fatalf("uploaded object left behind: %v", err)
+			}
+			h.expect(h.do(http.MethodPost, "/api/uploads", bob.token, map[string]any{
+				"filename": "same.mp4", "size": len(content), "content_type": "video/mp4",
+			}), http.StatusCreated, &started)
+			h.expect(h.presigned(started.Upload, content), http.StatusOK, nil)
+			h.expect(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", bob.token, nil),
+				http.StatusOK, &completed)
+			if a := stored(started.ID); a.Key != contentKey || a.Status != store.AttachmentReady {
+				t.Fatalf("duplicate upload was not shared: %+v", a)
+			}
+			if _, err := h.blobs.Stat(ctx, awservice.ObjectKey(bob.user.ID, started.ID, "same.mp4")); !errors.Is(err, awservice.ErrBlobNotFound) {
+				t.Fatalf("duplicate object left behind: %v", err)
+			}
+			if rec := h.download(bob.token, started.ID); rec.Body.String() != string(content) {
+				t.Fatalf("shared upload downloaded as %q", rec.Body.String())
+			}
+
+			h.expectError(h.do(http.MethodPost, "/api/uploads", alice.token, map[string]any{
+				"filename": "huge.bin", "size": int64(awservice.MaxDirectUploadSize) + 1, "content_type": "application/octet-stream",
+			}), http.StatusBadRequest, "invalid_body")
+		})
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			stores := newStores(t)
+			h := newHarness(t, stores)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+
+			content := mp4Clip(bytes.Repeat([]byte("0123456789abcdef"), awservice.MinPartSize/16+1))
+			var started struct {
+				ID         string           `json:"id"`
+				Attachment store.Attachment `json:"attachment"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/uploads/resumable", alice.token, map[string]any{
+				"filename": "holiday.mp4", "size": len(content), "content_type": "video/mp4",
+			}), http.StatusCreated, &started)
+			sessionURL := "/api/uploads/resumable/" + started.ID
+
+			offset := func(token string) string {
+				t.Helper()
+				rec := h.do(http.MethodHead, sessionURL, token, nil)
+				if rec.Code != http.StatusOK {
+					return strconv.Itoa(rec.Code)
+				}
+				return rec.Header().Get(awservice.UploadOffsetHeader)
+			}
+			if got := offset(alice.token); got != "0" {
+				t.Fatalf("offset = %s, want 0", got)
+			}
+			if got := offset(bob.token); got != "404" {
+				t.Fatalf("bob got %s for alice's session", got)
+			}
+
+			// only the last chunk may be short
+			h.expectError(h.chunk(alice.token, sessionURL, 0, content[:16]), http.StatusBadRequest, "bad_request")
+
+			first := content[:awservice.MinPartSize]
+			h.expect(h.chunk(alice.token, sessionURL, 0, first), http.StatusOK, nil)
+			if got := offset(alice.token); got != strconv.Itoa(len(first)) {
+				t.Fatalf("offset = %s after the first chunk", got)
+			}
+
+			// a retried chunk that already landed is refused with the offset to resume from
+			var conflict struct {
+				Error struct {
+					Details struct {
+						Offset int `json:"offset"`
+					} `json:"details"`
+				} `json:"error"`
+			}
+			h.expect(h.chunk(alice.token, sessionURL, 0, first), http.StatusConflict, &conflict)
+			if conflict.Error.Details.Offset != len(first) {
+				t.Fatalf("conflict reported offset %d", conflict.Error.Details.Offset)
+			}
+
+			var done struct {
+				Complete   bool             `json:"complete"`
+				Attachment store.Attachment `json:"attachment"`
+			}
+			h.expect(h.chunk(alice.token, sessionURL, len(first), content[len(first):]), http.StatusOK, &done)
+			sum := sha256.Sum256(content)
+			if !done.Complete || done.Attachment.Status != store.AttachmentReady || done.Attachment.Checksum != hex.EncodeToString(sum[:]) {
+				t.Fatalf("upload not finished: %+v", done)
+			}
+			if got := offset(alice.token); got != "404" {
+				t.Fatalf("finished session still answers with %s", got)
+			}
+			rec := h.download(alice.token, started.Attachment.ID)
+			h.expect(rec, http.StatusOK, nil)
+			if !bytes.Equal(rec.Body.Bytes(), content) {
+				t.Fatalf("downloaded %d bytes, want %d", rec.Body.Len(), len(content))
+			}
+			if a, err := stores.Attachments.GetAttachment(context.Background(), started.Attachment.ID); err != nil ||
+				a.Key != awservice.ContentKey(done.Attachment.Checksum) {
+				t.Fatalf("finished upload is not under its content key: %+v, %v", a, err)
+			}
+
+			// cancelled and abandoned sessions take their pending attachment with them
+			for _, abandon := range []func(id string){
+				func(id string) {
+					h.expect(h.do(http.MethodDelete, "/api/uploads/resumable/"+id, alice.token, nil), http.StatusOK, nil)
+				},
+				func(string) {
+					removed, err := awservice.CleanupUploads(context.Background(), h.blobs, stores.Uploads, stores.Attachments, time.Now().Add(time.Hour))
+					if err != nil || removed != 1 {
+						t.Fatalf("cleanup removed %d: %v", removed, err)
+					}
+				},
+			} {
+				h.expect(h.do(http.MethodPost, "/api/uploads/resumable", alice.token, map[string]any{
+					"filename": "draft.mp4", "size": 10, "content_type": "video/mp4",
+				}), http.StatusCreated, &started)
+				abandon(started.ID)
+				h.expectError(h.do(http.MethodDelete, "/api/uploads/resumable/"+started.ID, alice.token, nil), http.StatusNotFound, "not_found")
+				if _, err := stores.Attachments.GetAttachment(context.Background(), started.Attachment.ID); !errors.Is(err, store.ErrNotFound) {
+					t.Fatalf("pending attachment survived: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestResumableUploadRetry(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			content := mp4Clip([]byte("every byte arrives but settling fails"))
+			sum := sha256.Sum256(content)
+			checksum := hex.EncodeToString(sum[:])
+			h := newHarnessWith(t, newStores(t), harnessOptions{
+				wrap: func(blobs awservice.BlobStore) awservice.BlobStore {
+					return &flakyStat{BlobStore: blobs, key: awservice.ContentKey(checksum)}
+				},
+			})
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+			var started struct {
+				ID         string           `json:"id"`
+				Attachment store.Attachment `json:"attachment"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/uploads/resumable", alice.token, map[string]any{
+				"filename": "clip.mp4", "size": len(content), "content_type": "video/mp4",
+			}), http.StatusCreated, &started)
+			sessionURL := "/api/uploads/resumable/" + started.ID
+
+			// the multipart upload completes, then settling it fails
+			h.expectError(h.chunk(alice.token, sessionURL, 0, content), http.StatusBadGateway, "upstream_error")
+
+			// the retry settles the completed object instead of completing it again
+			var done struct {
+				Complete   bool             `json:"complete"`
+				Attachment store.Attachment `json:"attachment"`
+			}
+			h.expect(h.chunk(alice.token, sessionURL, len(content), nil), http.StatusOK, &done)
+			if !done.Complete || done.Attachment.Status != store.AttachmentReady || done.Attachment.Checksum != checksum {
+				t.Fatalf("retry did not finish the upload: %+v", done)
+			}
+			body, _, err := h.blobs.Get(context.Background(), awservice.ContentKey(checksum))
+			if err != nil {
+				t.Fatalf("get object: %v", err)
+			}
+			defer body.Close()
+			if stored, err := io.ReadAll(body); err != nil || !bytes.Equal(stored, content) {
+				t.Fatalf("stored %q (%v)", stored, err)
+			}
+		})
+	}
+}
+
+func TestImageProcessing(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, newStores(t))
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+
+			// a 200x100 photo taken on its side (orientation 6) with a location in its EXIF
+			photo := jpegWithEXIF(t, 200, 100, 6, "GPS 51.5007N 0.1246W")
+			var uploaded struct {
+				ID         string           `json:"id"`
+				Attachment store.Attachment `json:"attachment"`
+				URL        string           `json:"url"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUploadAs(t, "file", "photo.jpg", "image/jpeg", photo)),
+				http.StatusCreated, &uploaded)
+			if uploaded.Attachment.Status != store.AttachmentProcessing || uploaded.URL != "" {
+				t.Fatalf("image was not held back for processing: %+v", uploaded)
+			}
+			h.expectError(h.do(http.MethodGet, "/api/attachments/"+uploaded.ID, bob.token, nil), http.StatusNotFound, "not_found")
+
+			attachment := h.waitForAttachment(alice.token, uploaded.ID)
+			if attachment.Status != store.AttachmentReady || attachment.Width != 100 || attachment.Height != 200 {
+				t.Fatalf("unexpected processed image: %+v", attachment)
+			}
+			if len(attachment.BlurHash) != 28 {
+				t.Fatalf("blurhash %q is not a 4x3 hash", attachment.BlurHash)
+			}
+			if len(attachment.Thumbnails) != 1 || attachment.Thumbnails[0].Size != 160 ||
+				attachment.Thumbnails[0].Width != 80 || attachment.Thumbnails[0].Height != 160 {
+				t.Fatalf("unexpected thumbnails: %+v", attachment.Thumbnails)
+			}
+
+			rec := h.download(alice.token, uploaded.ID)
+			h.expect(rec, http.StatusOK, nil)
+			if bytes.Contains(rec.Body.Bytes(), []byte("Exif")) || bytes.Contains(rec.Body.Bytes(), []byte("GPS")) {
+				t.Fatalf("downloaded image still carries its EXIF data")
+			}
+			if cfg, err := jpeg.DecodeConfig(rec.Body); err != nil || cfg.Width != 100 || cfg.Height != 200 {
+				t.Fatalf("downloaded image is %+v (%v), want 100x200", cfg, err)
+			}
+
+			var link struct {
+				URL string `json:"url"`
+			}
+			h.expect(h.do(http.MethodGet, "/api/download/"+uploaded.ID+"?size=100", alice.token, nil), http.StatusOK, &link)
+			if cfg, err := jpeg.DecodeConfig(h.fetch(link.URL).Body); err != nil || cfg.Width != 80 || cfg.Height != 160 {
+				t.Fatalf("thumbnail is %+v (%v), want 80x160", cfg, err)
+			}
+
+			// something that only looks like an image is never served
+			broken := append([]byte("\x89PNG\r\n\x1a\n"), "not really a png"...)
+			h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUploadAs(t, "file", "broken.png", "image/png", broken)),
+				http.StatusCreated, &uploaded)
+			if attachment := h.waitForAttachment(alice.token, uploaded.ID); attachment.Status != store.AttachmentFailed {
+				t.Fatalf("fake image ended up %s", attachment.Status)
+			}
+			h.expectError(h.do(http.MethodGet, "/api/download/"+uploaded.ID, alice.token, nil), http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			stores := newStores(t)
+			h := newHarness(t, stores)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			bob := h.signUp("bob", "bob@example.com", "swordfish")
+
+			meme := []byte("one does not simply upload a meme once")
+			aliceMeme := h.upload(alice.token, "meme.txt", meme)
+			bobMeme := h.upload(bob.token, "funny.txt", meme)
+			if aliceMeme == bobMeme {
+				t.Fatalf("duplicate upload reused the attachment id")
+			}
+			first, err := stores.Attachments.GetAttachment(context.Background(), aliceMeme)
+			if err != nil {
+				t.Fatalf("get attachment: %v", err)
+			}
+			second, err := stores.Attachments.GetAttachment(context.Background(), bobMeme)
+			if err != nil {
+				t.Fatalf("get attachment: %v", err)
+			}
+			if first.Key != second.Key || second.Owner != bob.user.ID || second.Name != "funny.txt" {
+				t.Fatalf("duplicate was not shared: %+v and %+v", first, second)
+			}
+
+			// the object outlives every reference but the last
+			h.expectError(h.do(http.MethodDelete, "/api/attachments/"+aliceMeme, bob.token, nil), http.StatusNotFound, "not_found")
+			h.expect(h.do(http.MethodDelete, "/api/attachments/"+aliceMeme, alice.token, nil), http.StatusOK, nil)
+			h.expectError(h.do(http.MethodGet, "/api/download/"+aliceMeme, alice.token, nil), http.StatusNotFound, "not_found")
+			if rec := h.download(bob.token, bobMeme); rec.Body.String() != string(meme) {
+				t.Fatalf("shared object went with the first delete: %q", rec.Body.String())
+			}
+			// nothing can share a key once its last reference is released,
+			// and a failed purge keeps the reference
+			ctx := context.Background()
+			if err := stores.Attachments.ReleaseAttachment(ctx, bobMeme, func(*store.Attachment) error {
+				return errors.New("storage is down")
+			}); err == nil {
+				t.Fatalf("release ignored a failed purge")
+			}
+			h.expect(h.do(http.MethodDelete, "/api/attachments/"+bobMeme, bob.token, nil), http.StatusOK, nil)
+			if _, err := h.blobs.Stat(ctx, first.Key); !errors.Is(err, awservice.ErrBlobNotFound) {
+				t.Fatalf("object survived its last reference: %v", err)
+			}
+			late := *second
+			late.ID = ""
+			if err := stores.Attachments.ShareAttachment(ctx, &late); !errors.Is(err, store.ErrNotFound) {
+				t.Fatalf("shared a released key: %v", err)
+			}
+
+			// a processed image is shared as it is, ready and with its thumbnails
+			photo := jpegWithEXIF(t, 400, 300, 1, "GPS 51.5007N 0.1246W")
+			var uploaded struct {
+				ID         string           `json:"id"`
+				Attachment store.Attachment `json:"attachment"`
+				URL        string           `json:"url"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUploadAs(t, "file", "photo.jpg", "image/jpeg", photo)),
+				http.StatusCreated, &uploaded)
+			processed := h.waitForAttachment(alice.token, uploaded.ID)
+			h.expect(h.do(http.MethodPost, "/api/upload", bob.token, fileUploadAs(t, "file", "same.jpg", "image/jpeg", photo)),
+				http.StatusCreated, &uploaded)
+			if a := uploaded.Attachment; a.Status != store.AttachmentReady || uploaded.URL == "" ||
+				a.Checksum != processed.Checksum || a.BlurHash != processed.BlurHash || len(a.Thumbnails) != len(processed.Thumbnails) {
+				t.Fatalf("duplicate image was not shared: %+v", uploaded)
+			}
+			if bytes.Contains(h.fetch(uploaded.URL).Body.Bytes(), []byte("GPS")) {
+				t.Fatalf("duplicate image is served with its EXIF data")
+			}
+
+			// with no ready attachment to share, the cleaned object already
+			// stored is reused and the size is that of its bytes, not the upload's
+			for _, id := range []string{processed.ID, uploaded.ID} {
+				a, err := stores.Attachments.GetAttachment(context.Background(), id)
+				if err != nil {
+					t.Fatalf("get attachment: %v", err)
+				}
+				a.Status = store.AttachmentProcessing
+				if err := stores.Attachments.UpdateAttachment(context.Background(), a); err != nil {
+					t.Fatalf("update attachment: %v", err)
+				}
+			}
+			h.expect(h.do(http.MethodPost, "/api/upload", bob.token, fileUploadAs(t, "file", "again.jpg", "image/jpeg", photo)),
+				http.StatusCreated, &uploaded)
+			if uploaded.Attachment.Status != store.AttachmentProcessing {
+				t.Fatalf("upload was shared: %+v", uploaded.Attachment)
+			}
+			reused := h.waitForAttachment(bob.token, uploaded.ID)
+			rec := h.download(bob.token, uploaded.ID)
+			if reused.Size != processed.Size || reused.Size != int64(rec.Body.Len()) || reused.Checksum != processed.Checksum {
+				t.Fatalf("reused object recorded as %d bytes (%s), stored %d (%s)", reused.Size, reused.Checksum,
+					rec.Body.Len(), processed.Checksum)
+			}
+		})
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			stores := newStores(t)
+			h := newHarness(t, stores)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			ctx := context.Background()
+
+			keep := h.upload(alice.token, "keep.txt", []byte("still in a message"))
+			gone := h.upload(alice.token, "gone.txt", []byte("its message was deleted"))
+			var kept, deleted struct {
+				ID string `json:"id"`
+			}
+			h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "keep", "images": []string{keep},
+			}), http.StatusCreated, &kept)
+			h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+				"sender": alice.user.ID, "text": "gone", "images": []string{gone},
+			}), http.StatusCreated, &deleted)
+			h.expect(h.do(http.MethodDelete, "/api/messages/"+deleted.ID, alice.token, nil), http.StatusOK, nil)
+			// objects outside the server's prefixes belong to someone else
+			for _, key := range []string{"uploads/stray.bin", "backups/db.sql"} {
+				if err := h.blobs.Put(ctx, key, strings.NewReader("not an attachment"), -1, "application/octet-stream"); err != nil {
+					t.Fatalf("put stray object: %v", err)
+				}
+			}
+			goneAttachment, err := stores.Attachments.GetAttachment(ctx, gone)
+			if err != nil {
+				t.Fatalf("get attachment: %v", err)
+			}
+
+			collect := func(grace time.Duration, dryRun bool) *awservice.GCReport {
+				t.Helper()
+				report, err := awservice.CollectGarbage(ctx, h.blobs, stores.Attachments, stores.Messages, stores.Uploads, grace, dryRun)
+				if err != nil {
+					t.Fatalf("collect garbage: %v", err)
+				}
+				return report
+			}
+
+			// nothing is old enough yet
+			if report := collect(time.Hour, false); len(report.Attachments) != 0 || len(report.Objects) != 0 {
+				t.Fatalf("collected within the grace period: %+v", report)
+			}
+
+			report := collect(0, true)
+			slices.Sort(report.Objects)
+			if !slices.Equal(report.Attachments, []string{gone}) ||
+				!slices.Equal(report.Objects, []string{goneAttachment.Key, "uploads/stray.bin"}) {
+				t.Fatalf("unexpected dry run report: %+v", report)
+			}
+			h.expect(h.download(alice.token, gone), http.StatusOK, nil)
+
+			report = collect(0, false)
+			slices.Sort(report.Objects)
+			if !slices.Equal(report.Attachments, []string{gone}) ||
+				!slices.Equal(report.Objects, []string{goneAttachment.Key, "uploads/stray.bin"}) || report.Bytes == 0 {
+				t.Fatalf("unexpected report: %+v", report)
+			}
+			h.expectError(h.do(http.MethodGet, "/api/download/"+gone, alice.token, nil), http.StatusNotFound, "not_found")
+			if _, err := h.blobs.Stat(ctx, "uploads/stray.bin"); !errors.Is(err, awservice.ErrBlobNotFound) {
+				t.Fatalf("stray object survived: %v", err)
+			}
+			if _, err := h.blobs.Stat(ctx, "backups/db.sql"); err != nil {
+				t.Fatalf("object outside the server's prefixes was collected: %v", err)
+			}
+			if rec := h.download(alice.token, keep); rec.Body.String() != "still in a message" {
+				t.Fatalf("referenced attachment was collected: %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStorageQuotas(t *testing.T) {
+	global.AdminEmails = []string{"root@example.com"}
+	t.Cleanup(func() { global.AdminEmails = nil })
+
+	for name, newStores := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newHarnessWith(t, newStores(t), harnessOptions{
+				quotas: map[string]int64{store.RoleUser: 100, store.RoleAdmin: awservice.Unlimited},
+			})
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+			root := h.signUp("root", "root@example.com", "toor")
+			if alice.user.Role != store.RoleUser || root.user.Role != store.RoleAdmin {
+				t.Fatalf("roles are %q and %q", alice.user.Role, root.user.Role)
+			}
+
+			small := bytes.Repeat([]byte("a"), 30)
+			large := bytes.Repeat([]byte("b"), 60)
+			smallID := h.upload(alice.token, "small.txt", small)
+			largeID := h.upload(alice.token, "large.txt", large)
+			h.expectError(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "more.txt", large)),
+				http.StatusRequestEntityTooLarge, "quota_exceeded")
+			// space is reserved as soon as a direct or resumable upload starts
+			for _, path := range []string{"/api/uploads", "/api/uploads/resumable"} {
+				h.expectError(h.do(http.MethodPost, path, alice.token, map[string]any{
+					"filename": "clip.mp4", "size": 20, "content_type": "video/mp4",
+				}), http.StatusRequestEntityTooLarge, "quota_exceeded")
+			}
+
+			var usage struct {
+				Bytes   int64              `json:"bytes"`
+				Files   int                `json:"files"`
+				Largest []store.Attachment `json:"largest"`
+				Quota   *int64             `json:"quota"`
+			}
+			h.expect(h.do(http.MethodGet, "/api/me/storage", alice.token, nil), http.StatusOK, &usage)
+			if usage.Bytes != 90 || usage.Files != 2 || usage.Quota == nil || *usage.Quota != 100 ||
+				len(usage.Largest) != 2 || usage.Largest[0].ID != largeID || usage.Largest[1].ID != smallID {
+				t.Fatalf("unexpected usage: %+v", usage)
+			}
+
+			// only admins set quotas, and a user's own quota replaces its role's
+			h.expectError(h.do(http.MethodPut, "/api/users/"+alice.user.ID+"/quota", alice.token, map[string]any{"quota": 1000}),
+				http.StatusForbidden, "forbidden")
+			var updated store.User
+			h.expect(h.do(http.MethodPut, "/api/users/"+alice.user.ID+"/quota", root.token, map[string]any{"quota": 1000}),
+				http.StatusOK, &updated)
+			if updated.Quota == nil || *updated.Quota != 1000 {
+				t.Fatalf("quota not set: %+v", updated)
+			}
+			h.upload(alice.token, "more.txt", large)
+			updated = store.User{}
+			h.expect(h.do(http.MethodPut, "/api/users/"+alice.user.ID+"/quota", root.token, map[string]any{"quota": nil}),
+				http.StatusOK, &updated)
+			if updated.Quota != nil {
+				t.Fatalf("quota not cleared: %+v", updated)
+			}
+			h.expectError(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "tiny.txt", []byte("x"))),
+				http.StatusRequestEntityTooLarge, "quota_exceeded")
+			h.expectError(h.do(http.MethodPut, "/api/users/user_missing/quota", root.token, map[string]any{"quota": 1}),
+				http.StatusNotFound, "not_found")
+
+			// updating a profile does not touch the role or quota
+			h.expect(h.do(http.MethodPut, "/api/users", root.token, map[string]any{
+				"id": root.user.ID, "name": "root", "email": "root@example.com", "password": "toor",
+			}), http.StatusOK, nil)
+			h.upload(root.token, "big.txt", bytes.Repeat(large, 10))
+			h.expect(h.do(http.MethodGet, "/api/me/storage", root.token, nil), http.StatusOK, &usage)
+			if usage.Quota != nil || usage.Bytes != 600 {
+				t.Fatalf("unexpected admin usage: %+v", usage)
+			}
+		})
+	}
+}
+
+func TestUploadValidation(t *testing.T) {
+	policy, err := awservice.ParseUploadPolicy("image/png=1KiB,text/plain,video/mp4")
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{policy: policy})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	png := []byte("\x89PNG\r\n\x1a\n")
+
+	h.upload(alice.token, "notes.txt", []byte("plain text is allowed"))
+	for _, tc := range []struct {
+		name, filename, contentType string
+		content                     []byte
+		status                      int
+		code                        string
+	}{
+		{"type not allowed", "paper.pdf", "application/pdf", []byte("%PDF-1.4 ..."), http.StatusUnsupportedMediaType, "unsupported_type"},
+		{"extension of another type", "notes.png", "application/octet-stream", []byte("just text"), http.StatusUnsupportedMediaType, "unsupported_type"},
+		{"content of another type", "fake.png", "image/png", []byte("not a png"), http.StatusUnsupportedMediaType, "unsupported_type"},
+		{"over the type's limit", "big.png", "image/png", append(png, make([]byte, 2<<10)...), http.StatusRequestEntityTooLarge, "too_large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h.expectError(h.do(http.MethodPost, "/api/upload", alice.token, fileUploadAs(t, "file", tc.filename, tc.contentType, tc.content)),
+				tc.status, tc.code)
+		})
+	}
+
+	// declared types are checked when an upload starts and the bytes when it lands
+	h.expectError(h.do(http.MethodPost, "/api/uploads", alice.token, map[string]any{
+		"filename": "setup.exe", "size": 10, "content_type": "application/x-msdownload",
+	}), http.StatusUnsupportedMediaType, "unsupported_type")
+
+	text := []byte("this is no video")
+	var started struct {
+		ID     string                     `json:"id"`
+		Upload awservice.PresignedRequest `json:"upload"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/uploads", alice.token, map[string]any{
+		"filename": "clip.mp4", "size": len(text), "content_type": "video/mp4",
+	}), http.StatusCreated, &started)
+	h.expect(h.presigned(started.Upload, text), http.StatusOK, nil)
+	h.expectError(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", alice.token, nil),
+		http.StatusUnsupportedMediaType, "unsupported_type")
+	// the rejected object is gone, so the upload can be retried
+	h.expectError(h.do(http.MethodPost, "/api/uploads/"+started.ID+"/complete", alice.token, nil),
+		http.StatusBadRequest, "bad_request")
+
+	h.expect(h.do(http.MethodPost, "/api/uploads/resumable", alice.token, map[string]any{
+		"filename": "clip.mp4", "size": len(text), "content_type": "video/mp4",
+	}), http.StatusCreated, &started)
+	h.expectError(h.chunk(alice.token, "/api/uploads/resumable/"+started.ID, 0, text),
+		http.StatusUnsupportedMediaType, "unsupported_type")
+}
+
+func TestMalwareScan(t *testing.T) {
+	stores := store.NewMemory().Stores()
+	scanner, err := awservice.NewClamdScanner("tcp://"+fakeClamd(t), awservice.DefaultClamdMaxSize)
+	if err != nil {
+		t.Fatalf("clamd scanner: %v", err)
+	}
+	h := newHarnessWith(t, stores, harnessOptions{scanner: scanner})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+	var uploaded struct {
+		ID         string           `json:"id"`
+		Attachment store.Attachment `json:"attachment"`
+		URL        string           `json:"url"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "clean.txt", []byte("nothing to see"))),
+		http.StatusCreated, &uploaded)
+	if uploaded.Attachment.Status != store.AttachmentProcessing || uploaded.URL != "" {
+		t.Fatalf("upload was not held back for scanning: %+v", uploaded)
+	}
+	if attachment := h.waitForAttachment(alice.token, uploaded.ID); attachment.Status != store.AttachmentReady {
+		t.Fatalf("clean upload ended up %s", attachment.Status)
+	}
+	h.expect(h.download(alice.token, uploaded.ID), http.StatusOK, nil)
+
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "totally-safe.txt", eicar)),
+		http.StatusCreated, &uploaded)
+	if attachment := h.waitForAttachment(alice.token, uploaded.ID); attachment.Status != store.AttachmentQuarantined {
+		t.Fatalf("infected upload ended up %s", attachment.Status)
+	}
+	h.expectError(h.do(http.MethodGet, "/api/download/"+uploaded.ID, alice.token, nil), http.StatusNotFound, "not_found")
+
+	attachment, err := stores.Attachments.GetAttachment(context.Background(), uploaded.ID)
+	if err != nil || !strings.HasPrefix(attachment.Key, awservice.QuarantinePrefix) {
+		t.Fatalf("object was not moved to quarantine: %+v (%v)", attachment, err)
+	}
+	if _, err := h.blobs.Stat(context.Background(), strings.TrimPrefix(attachment.Key, awservice.QuarantinePrefix)); !errors.Is(err, awservice.ErrBlobNotFound) {
+		t.Fatalf("infected object is still at its original key: %v", err)
+	}
+
+	// files the scanner cannot take fail, unless the operator opts in
+	small, err := awservice.NewClamdScanner("tcp://"+fakeClamd(t), 8)
+	if err != nil {
+		t.Fatalf("clamd scanner: %v", err)
+	}
+	for _, allow := range []bool{false, true} {
+		h := newHarnessWith(t, stores, harnessOptions{scanner: small, allowUnscanned: allow})
+		h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "big.txt", []byte("over eight bytes"))),
+			http.StatusCreated, &uploaded)
+		want := store.AttachmentFailed
+		if allow {
+			want = store.AttachmentReady
+		}
+		if attachment := h.waitForAttachment(alice.token, uploaded.ID); attachment.Status != want {
+			t.Fatalf("oversized upload ended up %s with allowUnscanned %v", attachment.Status, allow)
+		}
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	stores := store.NewMemory().Stores()
+	oldKey, newKey := testMasterKey(t), testMasterKey(t)
+	keys, err := awservice.ParseKeyRing(oldKey)
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	h := newHarnessWith(t, stores, harnessOptions{keys: keys})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "swordfish")
+	ctx := context.Background()
+
+	// several frames, the last one short
+	content := []byte(strings.Repeat("the eagle lands at midnight\n", 10000))
+	id := h.upload(alice.token, "plans.txt", content)
+	attachment, err := stores.Attachments.GetAttachment(ctx, id)
+	if err != nil {
+		t.Fatalf("get attachment: %v", err)
+	}
+	raw := func(key string) []byte {
+		t.Helper()
+		body, _, err := h.blobs.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("raw object %s: %v", key, err)
+		}
+		defer body.Close()
+		data, _ := io.ReadAll(body)
+		return data
+	}
+	if stored := raw(attachment.Key); bytes.Contains(stored, []byte("eagle")) || len(stored) <= len(content) {
+		t.Fatalf("object is stored in the clear (%d bytes)", len(stored))
+	}
+
+	// links go through the server, which decrypts
+	var link struct {
+		URL string `json:"url"`
+	}
+	h.expect(h.do(http.MethodGet, "/api/download/"+id, alice.token, nil), http.StatusOK, &link)
+	if link.URL != "/api/attachments/"+id+"/content" {
+		t.Fatalf("download link = %q", link.URL)
+	}
+	rec := h.download(alice.token, id)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Fatalf("download = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(content)) {
+		t.Fatalf("Content-Length = %s, want %d", got, len(content))
+	}
+	h.expectError(h.do(http.MethodGet, "/api/attachments/"+id+"/content", bob.token, nil), http.StatusNotFound, "not_found")
+
+	// presigned uploads would store plaintext
+	h.expectError(h.do(http.MethodPost, "/api/uploads", alice.token, map[string]any{
+		"filename": "big.mp4", "size": 1 << 20, "content_type": "video/mp4",
+	}), http.StatusBadRequest, "bad_request")
+
+	// every part of a resumable upload is encrypted on its own
+	clip := mp4Clip(bytes.Repeat([]byte("frame of a secret clip "), awservice.MinPartSize/20))
+	var started struct {
+		ID         string           `json:"id"`
+		Attachment store.Attachment `json:"attachment"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/uploads/resumable", alice.token, map[string]any{
+		"filename": "clip.mp4", "size": len(clip), "content_type": "video/mp4",
+	}), http.StatusCreated, &started)
+	session := "/api/uploads/resumable/" + started.ID
+	h.expect(h.chunk(alice.token, session, 0, clip[:awservice.MinPartSize]), http.StatusOK, nil)
+	h.expect(h.chunk(alice.token, session, awservice.MinPartSize, clip[awservice.MinPartSize:]), http.StatusOK, nil)
+	h.waitForAttachment(alice.token, started.Attachment.ID)
+	if rec := h.download(alice.token, started.Attachment.ID); !bytes.Equal(rec.Body.Bytes(), clip) {
+		t.Fatalf("resumable download differs from the upload (%d bytes)", rec.Body.Len())
+	}
+	resumed, err := stores.Attachments.GetAttachment(ctx, started.Attachment.ID)
+	if err != nil {
+		t.Fatalf("get attachment: %v", err)
+	}
+
+	read := func(blobs awservice.BlobStore, key string) ([]byte, error) {
+		body, _, err := blobs.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+
+	// tampering is detected rather than served
+	tampered := raw(attachment.Key)
+	tampered[len(tampered)/2] ^= 1
+	if err := h.blobs.Put(ctx, "tampered.txt", bytes.NewReader(tampered), int64(len(tampered)), "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := read(awservice.NewEncryptedStore(h.blobs, keys), "tampered.txt"); err == nil {
+		t.Fatalf("tampered object decrypted")
+	}
+	if err := h.blobs.Delete(ctx, "tampered.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// objects from before encryption was turned on are still served, and
+	// rotation encrypts them along with rewrapping the rest
+	legacy := []byte("written before encryption")
+	if err := h.blobs.Put(ctx, "uploads/legacy.txt", bytes.NewReader(legacy), int64(len(legacy)), "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	rotated, err := awservice.ParseKeyRing(newKey + "," + oldKey)
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	encrypted := awservice.NewEncryptedStore(h.blobs, rotated)
+	if got, err := read(encrypted, "uploads/legacy.txt"); err != nil || !bytes.Equal(got, legacy) {
+		t.Fatalf("legacy object = %q (%v)", got, err)
+	}
+	before := len(raw(resumed.Key))
+	for _, dryRun := range []bool{true, false} {
+		report, err := awservice.RotateKeys(ctx, encrypted, dryRun)
+		if err != nil {
+			t.Fatalf("rotate keys: %v", err)
+		}
+		if len(report.Objects) != report.Checked || !slices.Contains(report.Objects, "uploads/legacy.txt") ||
+			!slices.Contains(report.Objects, attachment.Key) {
+			t.Fatalf("dry run %v rotated %v of %d objects", dryRun, report.Objects, report.Checked)
+		}
+	}
+	if report, err := awservice.RotateKeys(ctx, encrypted, true); err != nil || len(report.Objects) != 0 {
+		t.Fatalf("objects left after rotation: %+v (%v)", report, err)
+	}
+	if after := len(raw(resumed.Key)); after != before {
+		t.Fatalf("rewrapping changed the size from %d to %d", before, after)
+	}
+
+	// the old key can go once everything is rewrapped
+	onlyNew, err := awservice.ParseKeyRing(newKey)
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	for key, want := range map[string][]byte{attachment.Key: content, resumed.Key: clip, "uploads/legacy.txt": legacy} {
+		if got, err := read(awservice.NewEncryptedStore(h.blobs, onlyNew), key); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s after rotation: %d bytes (%v)", key, len(got), err)
+		}
+	}
+	if _, err := read(awservice.NewEncryptedStore(h.blobs, keys), "uploads/legacy.txt"); err == nil {
+		t.Fatalf("object still readable with the retired key")
+	}
+}
+
+func TestContentStreaming(t *testing.T) {
+	keys, err := awservice.ParseKeyRing(testMasterKey(t))
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	for name, opts := range map[string]harnessOptions{"plain": {}, "encrypted": {keys: keys}} {
+		t.Run(name, func(t *testing.T) {
+			h := newHarnessWith(t, store.NewMemory().Stores(), opts)
+			alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+			// long enough to cross several encryption frames
+			content := make([]byte, 200_000)
+			for i := range content {
+				content[i] = 'a' + byte(i%26)
+			}
+			id := h.upload(alice.token, "Résumé draft.txt", content)
+			path := "/api/attachments/" + id + "/content"
+			get := func(path string, headers ...string) *httptest.ResponseRecorder {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Authorization", "Bearer "+alice.token)
+				for i := 0; i < len(headers); i += 2 {
+					req.Header.Set(headers[i], headers[i+1])
+				}
+				rec := httptest.NewRecorder()
+				h.router.ServeHTTP(rec, req)
+				return rec
+			}
+
+			rec := get(path)
+			h.expect(rec, http.StatusOK, nil)
+			etag := rec.Header().Get("ETag")
+			if !bytes.Equal(rec.Body.Bytes(), content) || etag == "" || rec.Header().Get("Accept-Ranges") != "bytes" {
+				t.Fatalf("full download: %d bytes, headers %v", rec.Body.Len(), rec.Header())
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != `inline; filename*=utf-8''R%C3%A9sum%C3%A9%20draft.txt` {
+				t.Fatalf("Content-Disposition = %q", got)
+			}
+			if got := get(path + "?download=true").Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+				t.Fatalf("Content-Disposition with ?download = %q", got)
+			}
+
+			if rec := get(path, "If-None-Match", `"stale", `+etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+				t.Fatalf("If-None-Match = %d with %d bytes", rec.Code, rec.Body.Len())
+			}
+			h.expect(get(path, "If-None-Match", `"stale"`), http.StatusOK, nil)
+
+			for spec, want := range map[string][2]int{
+				"bytes=0-9":            {0, 9},
+				"bytes=65530-65545":    {65530, 65545},
+				"bytes=150000-":        {150000, len(content) - 1},
+				"bytes=-100":           {len(content) - 100, len(content) - 1},
+				"bytes=199990-1000000": {199990, len(content) - 1},
+			} {
+				rec := get(path, "Range", spec)
+				h.expect(rec, http.StatusPartialContent, nil)
+				wantRange := fmt.Sprintf("bytes %d-%d/%d", want[0], want[1], len(content))
+				if !bytes.Equal(rec.Body.Bytes(), content[want[0]:want[1]+1]) || rec.Header().Get("Content-Range") != wantRange {
+					t.Fatalf("%s: %d bytes, Content-Range %q", spec, rec.Body.Len(), rec.Header().Get("Content-Range"))
+				}
+			}
+			rec = get(path, "Range", "bytes=200000-")
+			h.expectError(rec, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable")
+			if got := rec.Header().Get("Content-Range"); got != "bytes */200000" {
+				t.Fatalf("Content-Range = %q", got)
+			}
+			// several ranges, or a range of other content, get the whole file
+			h.expect(get(path, "Range", "bytes=0-1,5-6"), http.StatusOK, nil)
+			h.expect(get(path, "Range", "bytes=0-1", "If-Range", `"stale"`), http.StatusOK, nil)
+			h.expect(get(path, "Range", "bytes=0-1", "If-Range", etag), http.StatusPartialContent, nil)
+		})
+	}
+}
+
+// testMasterKey makes a random master key as ENCRYPTION_KEYS holds it.
+func testMasterKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// waitForAttachment polls until the attachment worker is done with an attachment.
+func (h *harness) waitForAttachment(token, id string) store.Attachment {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var attachment store.Attachment
+		h.expect(h.do(http.MethodGet, "/api/attachments/"+id, token, nil), http.StatusOK, &attachment)
+		if attachment.Status != store.AttachmentProcessing {
+			return attachment
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("attachment %s still processing", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// jpegWithEXIF encodes a w by h JPEG and inserts an EXIF segment holding an
+// orientation tag and note as an ImageDescription.
+func jpegWithEXIF(t *testing.T, w, h, orientation int, note string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+
+	// little endian TIFF with two IFD0 entries: orientation and description
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = le.AppendUint16(tiff, 0x0112)
+	tiff = le.AppendUint16(tiff, 3) // SHORT
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint16(tiff, uint16(orientation))
+	tiff = le.AppendUint16(tiff, 0)
+	tiff = le.AppendUint16(tiff, 0x010E)
+	tiff = le.AppendUint16(tiff, 2) // ASCII
+	tiff = le.AppendUint32(tiff, uint32(len(note)+1))
+	tiff = le.AppendUint32(tiff, uint32(8+2+2*12+4))
+	tiff = le.AppendUint32(tiff, 0) // no next IFD
+	tiff = append(append(tiff, note...), 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(segment)+2))
+	out := append([]byte{}, encoded.Bytes()[:2]...)
+	out = append(append(out, app1...), segment...)
+	return append(out, encoded.Bytes()[2:]...)
+}
+
+// mp4Clip prefixes payload with the ftyp box of an MP4 file, enough for
+// its type to be sniffed.
+func mp4Clip(payload []byte) []byte {
+	box := []byte("\x00\x00\x00\x14ftypisom\x00\x00\x02\x00isom")
+	return append(box, payload...)
+}
+
+// fakeClamd speaks enough of the clamd INSTREAM protocol to flag the EICAR
+// test string, and returns the address it listens on.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream []byte
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					stream = append(stream, chunk...)
+				}
+				if bytes.Contains(stream, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// chunk PATCHes part of a resumable upload at offset.
+func (h *harness) chunk(token, session string, offset int, data []byte) *httptest.ResponseRecorder {
+	h.t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, session, bytes.NewReader(data))
+	req.Header.Set("Content-Type", awservice.ChunkContentType)
+	req.Header.Set(awservice.UploadOffsetHeader, strconv.Itoa(offset))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// upload sends content as a multipart file and returns the attachment ID.
+func (h *harness) upload(token, filename string, content []byte) string {
+	h.t.Helper()
+	var uploaded struct {
+		ID         string           `json:"id"`
+		Attachment store.Attachment `json:"attachment"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/upload", token, fileUpload(h.t, "file", filename, content)),
+		http.StatusCreated, &uploaded)
+	if uploaded.ID == "" || uploaded.Attachment.ID != uploaded.ID {
+		h.t.Fatalf("upload returned no attachment id")
+	}
+	return uploaded.ID
+}
+
+// download resolves an attachment to a link and fetches it: a signed link
+// as is, a link back to the API with the caller's token.
+func (h *harness) download(token, attachmentID string) *httptest.ResponseRecorder {
+	h.t.Helper()
+	var link struct {
+		URL string `json:"url"`
+	}
+	h.expect(h.do(http.MethodGet, "/api/download/"+attachmentID, token, nil), http.StatusOK, &link)
+	if strings.HasPrefix(link.URL, "/api/") {
+		return h.do(http.MethodGet, link.URL, token, nil)
+	}
+	return h.fetch(link.URL)
+}
+
+func TestUploadDownloadAndAsk(t *testing.T) {
+	h := newHarness(t, store.NewMemory().Stores())
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "swordfish")
+
+	// the same filename from two users must not collide
+	aliceImage := h.upload(alice.token, "image.txt", []byte("alice's image"))
+	bobImage := h.upload(bob.token, "../../etc/image.txt", []byte("bob's image"))
+	if aliceImage == bobImage {
+		t.Fatalf("two uploads got the same attachment id")
+	}
+
+	var uploaded struct {
+		Attachment store.Attachment `json:"attachment"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "file", "dir/../notes.txt", []byte("hello"))),
+		http.StatusCreated, &uploaded)
+	if a := uploaded.Attachment; a.Owner != alice.user.ID || a.Name != "notes.txt" || a.Size != 5 ||
+		a.Checksum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected attachment metadata: %+v", a)
+	}
+
+	h.expectError(h.do(http.MethodPost, "/api/upload", alice.token, fileUpload(t, "wrong-field", "cat.png", nil)),
+		http.StatusBadRequest, "bad_request")
+
+	for _, tc := range []struct{ token, id, want string }{
+		{alice.token, aliceImage, "alice's image"},
+		{bob.token, bobImage, "bob's image"},
+	} {
+		rec := h.download(tc.token, tc.id)
+		h.expect(rec, http.StatusOK, nil)
+		if rec.Body.String() != tc.want {
+			t.Fatalf("downloaded %q, want %q", rec.Body.String(), tc.want)
+		}
+	}
+
+	var link struct {
+		URL string `json:"url"`
+	}
+	h.expect(h.do(http.MethodGet, "/api/download/"+aliceImage, alice.token, nil), http.StatusOK, &link)
+	if !strings.Contains(link.URL, "/content/") {
+		t.Fatalf("object key is not content addressed: %s", link.URL)
+	}
+	h.expectError(h.fetch(strings.Replace(link.URL, "signature=", "signature=0", 1)), http.StatusForbidden, "forbidden")
+	h.expectError(h.do(http.MethodGet, "/api/download/attachment_missing", alice.token, nil), http.StatusNotFound, "not_found")
+
+	var answer struct {
+		Response string `json:"response"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{"prompt": "ping"}), http.StatusOK, &answer)
+	if answer.Response != "echo: ping" {
+		t.Fatalf("unexpected answer %q", answer.Response)
+	}
+	h.expectError(h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{"prompt": ""}),
+		http.StatusBadRequest, "invalid_body")
+}
+
+func TestStreamingAnswer(t *testing.T) {
+	h := newHarness(t, store.NewMemory().Stores())
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+	rec := h.do(http.MethodPost, "/api/ask?stream=true", alice.token, map[string]any{"prompt": "tell me a story"})
+	h.expect(rec, http.StatusOK, nil)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	events := serverSentEvents(t, rec.Body.String())
+	var answer strings.Builder
+	for _, e := range events[:len(events)-1] {
+		var delta struct {
+			Content string `json:"content"`
+		}
+		if e.name != "delta" || json.Unmarshal([]byte(e.data), &delta) != nil {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		answer.WriteString(delta.Content)
+	}
+	if len(events) < 3 || answer.String() != "echo: tell me a story" {
+		t.Fatalf("streamed %q in %d events", answer.String(), len(events))
+	}
+	var usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}
+	final := events[len(events)-1]
+	if final.name != "usage" || json.Unmarshal([]byte(final.data), &usage) != nil || usage.TotalTokens != 2*len("tell me a story")+6 {
+		t.Fatalf("final event %+v", final)
+	}
+
+	// a client that goes away cancels the upstream request
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/api/ask?stream=true", strings.NewReader(`{"prompt":"hang"}`)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+alice.token)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, req)
+		done <- rec
+	}()
+	for len(h.ai.openStreams()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler kept streaming after the client left")
+	}
+	<-h.ai.openStreams()[1].closed
+	if strings.Contains(rec.Body.String(), "event:usage") || strings.Contains(rec.Body.String(), "event:error") {
+		t.Fatalf("events after the client left: %s", rec.Body.String())
+	}
+
+	h.expectError(h.do(http.MethodPost, "/api/ask?stream=maybe", alice.token, map[string]any{"prompt": "hi"}),
+		http.StatusBadRequest, "bad_request")
+}
+
+func TestChatSettings(t *testing.T) {
+	chat, err := ai.ParseChatSettings("llama3", "mistral, gpt-4o", 0.2, 100, 4000)
+	if err != nil {
+		t.Fatalf("parse settings: %v", err)
+	}
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{chat: chat})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+
+	// the defaults go with every request
+	h.expect(h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{"prompt": "hi"}), http.StatusOK, nil)
+	if req := h.ai.requests[len(h.ai.requests)-1]; req.Model != "llama3" || req.Temperature != 0.2 || req.MaxTokens != 100 {
+		t.Fatalf("request %+v", req)
+	}
+	// and a request may choose others within the limits
+	h.expect(h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{
+		"prompt": "hi", "model": "gpt-4o", "temperature": 0, "max_tokens": 50,
+	}), http.StatusOK, nil)
+	if req := h.ai.requests[len(h.ai.requests)-1]; req.Model != "gpt-4o" || req.Temperature != 0 || req.MaxTokens != 50 {
+		t.Fatalf("request %+v", req)
+	}
+
+	asked := len(h.ai.requests)
+	for _, tc := range []struct {
+		body map[string]any
+		code string
+	}{
+		{map[string]any{"prompt": "hi", "model": "gpt-4"}, "bad_request"},
+		{map[string]any{"prompt": "hi", "max_tokens": 101}, "bad_request"},
+		// the spec already bounds the temperature
+		{map[string]any{"prompt": "hi", "temperature": 2.5}, "invalid_body"},
+	} {
+		h.expectError(h.do(http.MethodPost, "/api/ask", alice.token, tc.body), http.StatusBadRequest, tc.code)
+	}
+	var conversation store.Conversation
+	h.expect(h.do(http.MethodPost, "/api/conversations", alice.token, nil), http.StatusCreated, &conversation)
+	h.expectError(h.do(http.MethodPost, "/api/conversations/"+conversation.ID+"/messages", alice.token,
+		map[string]any{"content": "hi", "model": "gpt-4"}), http.StatusBadRequest, "bad_request")
+	if len(h.ai.requests) != asked {
+		t.Fatalf("rejected requests reached the provider")
+	}
+
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, bad := range []func() error{
+		func() error { _, err := ai.ParseChatSettings("", "", 3, 0, 4000); return err },
+		func() error { _, err := ai.ParseChatSettings("", "", 0.7, 0, 0); return err },
+		func() error { _, err := ai.NewProvider("compatible", "", "", discard); return err },
+		func() error { _, err := ai.NewProvider("bard", "", "key", discard); return err },
+	} {
+		if bad() == nil {
+			t.Fatalf("invalid settings accepted")
+		}
+	}
+}
+
+func TestChannelSummary(t *testing.T) {
+	stores := store.NewMemory().Stores()
+	h := newHarness(t, stores)
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "hunter2")
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{"text": "general"}),
+		http.StatusCreated, &created)
+	channelID := created.ID
+	summaryPath := "/api/channels/" + channelID + "/summary"
+	post := func(text string) {
+		h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+			"sender": alice.user.ID, "text": text, "images": []string{}, "channel": channelID,
+		}), http.StatusCreated, &created)
+	}
+	post("the release is on friday")
+	post("who is on call?")
+
+	type summary struct {
+		store.ChannelSummary
+		Since  int64 `json:"since"`
+		Cached bool  `json:"cached"`
+	}
+	var got summary
+	h.expect(h.do(http.MethodPost, summaryPath, alice.token, nil), http.StatusOK, &got)
+	if got.Messages != 2 || got.Cached || !strings.Contains(got.Summary, "alice: the release is on friday\nalice: who is on call?") {
+		t.Fatalf("summary %+v", got)
+	}
+	if sent := h.ai.requests[len(h.ai.requests)-1].Messages; len(sent) != 2 || sent[0].Role != "system" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	// the summary is cached until the messages change
+	asked := len(h.ai.requests)
+	h.expect(h.do(http.MethodPost, summaryPath, alice.token, nil), http.StatusOK, &got)
+	if !got.Cached || got.Messages != 2 || len(h.ai.requests) != asked {
+		t.Fatalf("not cached: %+v", got)
+	}
+	post("me")
+	h.expect(h.do(http.MethodPost, summaryPath, alice.token, nil), http.StatusOK, &got)
+	if got.Cached || got.Messages != 3 || !strings.HasSuffix(got.Summary, "alice: me") {
+		t.Fatalf("summary after a new message %+v", got)
+	}
+
+	// marking the channel read leaves nothing to catch up on, unless a
+	// window is asked for
+	h.expect(h.do(http.MethodPut, "/api/channels/"+channelID+"/read", alice.token, nil), http.StatusOK, nil)
+	h.expect(h.do(http.MethodPost, summaryPath, alice.token, nil), http.StatusOK, &got)
+	if got.Messages != 0 || got.Summary != "" {
+		t.Fatalf("summary after reading %+v", got)
+	}
+	h.expect(h.do(http.MethodPost, summaryPath, alice.token, map[string]any{"window": "1h"}), http.StatusOK, &got)
+	if got.Messages != 3 || !got.Cached {
+		t.Fatalf("summary of the last hour %+v", got)
+	}
+	h.expectError(h.do(http.MethodPost, summaryPath, alice.token, map[string]any{"window": "soon"}),
+		http.StatusBadRequest, "bad_request")
+
+	h.expectError(h.do(http.MethodPost, summaryPath, bob.token, nil), http.StatusForbidden, "forbidden")
+	h.expectError(h.do(http.MethodPut, "/api/channels/"+channelID+"/read", bob.token, nil), http.StatusForbidden, "forbidden")
+	h.expectError(h.do(http.MethodPost, "/api/channels/channel_missing/summary", alice.token, nil), http.StatusNotFound, "not_found")
+	h.expectError(h.do(http.MethodPut, "/api/channels/channel_missing/read", alice.token, nil), http.StatusNotFound, "not_found")
+
+	// messages that don't fit the context are summarized in parts
+	small := newHarnessWith(t, stores, harnessOptions{chat: &ai.ChatSettings{
+		Model: "llama3", Models: []string{"llama3"}, Temperature: 0.7, ContextTokens: 50,
+	}})
+	h.expect(small.do(http.MethodPost, summaryPath, alice.token, map[string]any{"window": "1h"}), http.StatusOK, &got)
+	if got.Cached || got.Messages != 3 || got.Summary == "" || len(small.ai.requests) < 3 {
+		t.Fatalf("summarized in %d requests: %+v", len(small.ai.requests), got)
+	}
+	for _, req := range small.ai.requests[:len(small.ai.requests)-1] {
+		if req.MaxTokens == 0 {
+			t.Fatalf("partial summary without a length limit: %+v", req)
+		}
+	}
+}
+
+func TestAssistant(t *testing.T) {
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{
+		assistant: &ai.AssistantLimits{PerUser: 2, PerChannel: 3, Window: time.Hour},
+		// only the fake provider's answers say echo
+		moderator: ai.NewRuleModerator([]ai.ModerationRule{{Category: "spam", Term: "echo"}}),
+	})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "hunter2")
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{
+		"text": "general", "messages": []string{}, "assistant": true,
+	}), http.StatusCreated, &created)
+	channelID := created.ID
+	h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{
+		"text": "quiet", "messages": []string{},
+	}), http.StatusCreated, &created)
+	quietID := created.ID
+	h.expect(h.do(http.MethodPost, "/api/channels/"+channelID+"/members", alice.token, map[string]any{
+		"user_id": bob.user.ID,
+	}), http.StatusOK, nil)
+
+	var bot store.User
+	h.expect(h.do(http.MethodGet, "/api/users/"+store.AssistantUserID, alice.token, nil), http.StatusOK, &bot)
+	if bot.Role != store.RoleBot || !slices.Equal(bot.Channels, []string{channelID}) {
+		t.Fatalf("assistant account %+v", bot)
+	}
+
+	post := func(token, sender, channel, text string) map[string]any {
+		t.Helper()
+		var resp map[string]any
+		h.expect(h.do(http.MethodPost, "/api/messages", token, map[string]any{
+			"sender": sender, "text": text, "images": []string{}, "channel": channel, "ai": true,
+		}), http.StatusCreated, &resp)
+		return resp
+	}
+	if resp := post(alice.token, alice.user.ID, channelID, "the release is on friday"); resp["assistant"] != nil {
+		t.Fatalf("answered a message without a mention: %v", resp)
+	}
+	if resp := post(alice.token, alice.user.ID, quietID, "@assistant are you there?"); resp["assistant"] != nil {
+		t.Fatalf("answered in a channel that did not opt in: %v", resp)
+	}
+	if resp := post(alice.token, alice.user.ID, channelID, "@Assistant when is the release?"); resp["assistant"] != ai.AssistantQueued {
+		t.Fatalf("mention not queued: %v", resp)
+	}
+
+	// the answer is posted to the channel, flagged as the assistant's
+	var channel store.Channel
+	deadline := time.Now().Add(5 * time.Second)
+	for len(channel.Messages) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no answer in %+v", channel)
+		}
+		time.Sleep(10 * time.Millisecond)
+		h.expect(h.do(http.MethodGet, "/api/channels/"+channelID, alice.token, nil), http.StatusOK, &channel)
+	}
+	var messages [3]store.Message
+	for i, id := range channel.Messages {
+		h.expect(h.do(http.MethodGet, "/api/messages/"+id, alice.token, nil), http.StatusOK, &messages[i])
+	}
+	if messages[0].AI || messages[1].AI {
+		t.Fatalf("clients set the AI flag: %+v", messages[:2])
+	}
+	answer := messages[2]
+	if !answer.AI || answer.Sender != store.AssistantUserID || answer.Text != "echo: alice: @Assistant when is the release?" {
+		t.Fatalf("answer %+v", answer)
+	}
+	// answers are moderated like any other message
+	if answer.Moderation == nil || answer.Moderation.Status != store.ModerationFlagged {
+		t.Fatalf("answer was not moderated: %+v", answer.Moderation)
+	}
+	// nobody puts words in the assistant's mouth, nor in other members'
+	h.expectError(h.do(http.MethodPut, "/api/messages/"+answer.ID, alice.token, map[string]any{
+		"sender": store.AssistantUserID, "text": "the release is cancelled", "images": []string{},
+	}), http.StatusForbidden, "forbidden")
+	h.expectError(h.do(http.MethodPut, "/api/messages/"+messages[1].ID, bob.token, map[string]any{
+		"sender": alice.user.ID, "text": "@Assistant when is the party?", "images": []string{},
+	}), http.StatusForbidden, "forbidden")
+	sent := h.ai.requests[len(h.ai.requests)-1].Messages
+	if len(sent) != 3 || sent[0].Role != "system" || sent[1].Content != "alice: the release is on friday" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	// mentions are rate limited per user, then per channel
+	if resp := post(alice.token, alice.user.ID, channelID, "thanks @assistant"); resp["assistant"] != ai.AssistantQueued {
+		t.Fatalf("second mention %v", resp)
+	}
+	if resp := post(alice.token, alice.user.ID, channelID, "@assistant one more"); resp["assistant"] != ai.AssistantRateLimited {
+		t.Fatalf("third mention by alice %v", resp)
+	}
+	if resp := post(bob.token, bob.user.ID, channelID, "@assistant hi"); resp["assistant"] != ai.AssistantQueued {
+		t.Fatalf("first mention by bob %v", resp)
+	}
+	if resp := post(bob.token, bob.user.ID, channelID, "@assistant hi again"); resp["assistant"] != ai.AssistantRateLimited {
+		t.Fatalf("mention over the channel limit %v", resp)
+	}
+	if resp := post(bob.token, bob.user.ID, channelID, "mail me at bob@assistant"); resp["assistant"] != nil {
+		t.Fatalf("an address counted as a mention: %v", resp)
+	}
+	h.expectError(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+		"sender": alice.user.ID, "text": "hi", "images": []string{}, "channel": "channel_missing",
+	}), http.StatusNotFound, "not_found")
+
+	// only the owner opts the channel in or out, though members may edit it
+	h.expectError(h.do(http.MethodPut, "/api/channels/"+channelID, bob.token, map[string]any{
+		"text": "general", "assistant": false,
+	}), http.StatusForbidden, "forbidden")
+	h.expect(h.do(http.MethodPut, "/api/channels/"+channelID, bob.token, map[string]any{
+		"text": "general", "assistant": true,
+	}), http.StatusOK, nil)
+
+	// opting out takes the assistant out of the channel
+	h.expect(h.do(http.MethodPut, "/api/channels/"+channelID, alice.token, map[string]any{
+		"text": "general", "assistant": false,
+	}), http.StatusOK, nil)
+	h.expect(h.do(http.MethodGet, "/api/users/"+store.AssistantUserID, alice.token, nil), http.StatusOK, &bot)
+	if len(bot.Channels) != 0 {
+		t.Fatalf("assistant still in %v", bot.Channels)
+	}
+}
+
+func TestSemanticSearch(t *testing.T) {
+	ctx := context.Background()
+	stores := store.NewMemory().Stores()
+	// written before the indexer ran, so only a backfill embeds it
+	old := store.Message{Sender: "user_old", Text: "the deploy pipeline is broken again", Images: []string{}}
+	if err := stores.Messages.CreateMessage(ctx, &old); err != nil {
+		t.Fatalf("old message: %v", err)
+	}
+	h := newHarnessWith(t, stores, harnessOptions{
+		index:     true,
+		moderator: ai.NewRuleModerator([]ai.ModerationRule{{Category: "spam", Term: "buy followers"}}),
+	})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "hunter2")
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	channel := func(token, text string) string {
+		h.expect(h.do(http.MethodPost, "/api/channels", token, map[string]any{"text": text}), http.StatusCreated, &created)
+		return created.ID
+	}
+	post := func(token, sender, channel, text string) string {
+		h.expect(h.do(http.MethodPost, "/api/messages", token, map[string]any{
+			"sender": sender, "text": text, "images": []string{}, "channel": channel,
+		}), http.StatusCreated, &created)
+		return created.ID
+	}
+	opsID := channel(alice.token, "ops")
+	if err := stores.Channels.AddChannelMessage(ctx, opsID, old.ID); err != nil {
+		t.Fatalf("old message: %v", err)
+	}
+	randomID := channel(bob.token, "random")
+	lunch := post(alice.token, alice.user.ID, opsID, "who wants lunch today")
+	post(bob.token, bob.user.ID, randomID, "my deploy pipeline works fine")
+
+	// results wait for the indexer, so search until the top one is right
+	search := func(q, want string) []store.MessageMatch {
+		t.Helper()
+		var matches []store.MessageMatch
+		deadline := time.Now().Add(5 * time.Second)
+		for len(matches) == 0 || matches[0].ID != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("search %q: %+v", q, matches)
+			}
+			time.Sleep(10 * time.Millisecond)
+			h.expect(h.do(http.MethodGet, "/api/search/semantic?q="+url.QueryEscape(q), alice.token, nil), http.StatusOK, &matches)
+		}
+		return matches
+	}
+	matches := search("is the deploy pipeline broken?", old.ID)
+	if len(matches) != 2 || matches[0].ChannelID != opsID || matches[0].Score <= matches[1].Score {
+		t.Fatalf("matches %+v", matches)
+	}
+
+	// edits are embedded again
+	h.expect(h.do(http.MethodPut, "/api/messages/"+lunch, alice.token, map[string]any{
+		"sender": alice.user.ID, "text": "pizza for lunch?", "images": []string{},
+	}), http.StatusOK, nil)
+	search("pizza", lunch)
+
+	// messages flagged for review are not found, even once embedded
+	spam := post(alice.token, alice.user.ID, opsID, "buy followers for the deploy pipeline")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pending, err := stores.Embeddings.ListUnembeddedMessages(ctx, ai.FakeEmbedder{}.Model(), 10)
+		if err != nil || len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not embedded: %+v", pending)
+		}
+	}
+	for _, match := range search("buy followers for the deploy pipeline", old.ID) {
+		if match.ID == spam {
+			t.Fatalf("found the flagged message %+v", match)
+		}
+	}
+
+	// members of no channel find nothing
+	carol := h.signUp("carol", "carol@example.com", "hunter2")
+	h.expect(h.do(http.MethodGet, "/api/search/semantic?q=deploy", carol.token, nil), http.StatusOK, &matches)
+	if len(matches) != 0 {
+		t.Fatalf("found %+v outside the caller's channels", matches)
+	}
+	h.expectError(h.do(http.MethodGet, "/api/search/semantic", alice.token, nil), http.StatusBadRequest, "bad_request")
+	h.expectError(h.do(http.MethodGet, "/api/search/semantic?q=deploy&limit=0", alice.token, nil), http.StatusBadRequest, "bad_request")
+}
+
+func TestModeration(t *testing.T) {
+	global.ModeratorEmails = []string{"mod@example.com"}
+	t.Cleanup(func() { global.ModeratorEmails = nil })
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{
+		moderator: ai.NewRuleModerator([]ai.ModerationRule{
+			{Category: "spam", Term: "buy followers"},
+			{Category: "harassment", Term: "idiot"},
+		}),
+	})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	mod := h.signUp("mod", "mod@example.com", "hunter2")
+	if mod.user.Role != store.RoleModerator {
+		t.Fatalf("moderator registered as %q", mod.user.Role)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	channel := func(token, text, policy string) string {
+		h.expect(h.do(http.MethodPost, "/api/channels", token, map[string]any{
+			"text": text, "messages": []string{}, "moderation": policy,
+		}), http.StatusCreated, &created)
+		return created.ID
+	}
+	// only moderators set policies, on the channels alice posts to here
+	strict, open := channel(mod.token, "strict", store.PolicyBlock), channel(mod.token, "open", store.PolicyAllow)
+	general := channel(alice.token, "general", "")
+	for _, id := range []string{strict, open} {
+		h.expect(h.do(http.MethodPost, "/api/channels/"+id+"/members", mod.token, map[string]any{
+			"user_id": alice.user.ID,
+		}), http.StatusOK, nil)
+	}
+	h.expectError(h.do(http.MethodPost, "/api/channels", mod.token, map[string]any{
+		"text": "odd", "messages": []string{}, "moderation": "maybe",
+	}), http.StatusBadRequest, "invalid_body")
+	h.expectError(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{
+		"text": "lax", "messages": []string{}, "moderation": store.PolicyAllow,
+	}), http.StatusForbidden, "forbidden")
+	h.expectError(h.do(http.MethodPut, "/api/channels/"+general, alice.token, map[string]any{
+		"text": "general", "moderation": store.PolicyAllow,
+	}), http.StatusForbidden, "forbidden")
+	h.expect(h.do(http.MethodPut, "/api/channels/"+strict, mod.token, map[string]any{
+		"text": "strict", "moderation": store.PolicyBlock,
+	}), http.StatusOK, nil)
+
+	post := func(channel, text string) *httptest.ResponseRecorder {
+		return h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+			"sender": alice.user.ID, "text": text, "images": []string{}, "channel": channel,
+			"moderation": map[string]any{"status": store.ModerationApproved},
+		})
+	}
+	verdict := func(id string) *store.Moderation {
+		t.Helper()
+		var message store.Message
+		h.expect(h.do(http.MethodGet, "/api/messages/"+id, alice.token, nil), http.StatusOK, &message)
+		return message.Moderation
+	}
+
+	h.expect(post("", "hello there"), http.StatusCreated, &created)
+	if v := verdict(created.ID); v == nil || v.Status != store.ModerationAllowed || v.Flagged || v.Provider != ai.ModerationRules {
+		t.Fatalf("clean message verdict %+v", v)
+	}
+
+	// messages only get into a channel by being posted, and so moderated
+	h.expectError(h.do(http.MethodPut, "/api/channels/"+general, alice.token, map[string]any{
+		"text": "general", "messages": []string{created.ID},
+	}), http.StatusBadRequest, "bad_request")
+	var unchanged store.Channel
+	h.expect(h.do(http.MethodGet, "/api/channels/"+general, alice.token, nil), http.StatusOK, &unchanged)
+	if len(unchanged.Messages) != 0 {
+		t.Fatalf("update added messages: %+v", unchanged)
+	}
+
+	// the channel's policy decides what becomes of flagged messages
+	rec := post(strict, "Buy followers today!")
+	h.expectError(rec, http.StatusUnprocessableEntity, "content_blocked")
+	if !strings.Contains(rec.Body.String(), `"categories":["spam"]`) {
+		t.Fatalf("blocked response %s", rec.Body)
+	}
+	h.expect(post(open, "buy followers here"), http.StatusCreated, &created)
+	if v := verdict(created.ID); v.Status != store.ModerationAllowed || !v.Flagged || !slices.Equal(v.Categories, []string{"spam"}) {
+		t.Fatalf("allowed verdict %+v", v)
+	}
+	h.expect(post(general, "what an idiot"), http.StatusCreated, &created)
+	flagged := created.ID
+	if v := verdict(flagged); v.Status != store.ModerationFlagged {
+		t.Fatalf("default policy verdict %+v", v)
+	}
+	h.expect(post(general, "see you at lunch"), http.StatusCreated, &created)
+	edited := created.ID
+
+	// edits are moderated again
+	edit := func(id, text string) {
+		h.expect(h.do(http.MethodPut, "/api/messages/"+id, alice.token, map[string]any{
+			"sender": alice.user.ID, "text": text, "images": []string{},
+		}), http.StatusOK, nil)
+	}
+	edit(edited, "lunch with that idiot")
+	edit(flagged, "what a day")
+	if v := verdict(flagged); v.Status != store.ModerationAllowed {
+		t.Fatalf("verdict after a clean edit %+v", v)
+	}
+
+	h.expectError(h.do(http.MethodGet, "/api/moderation/queue", alice.token, nil), http.StatusForbidden, "forbidden")
+	var queue []struct {
+		store.Message
+		ChannelID string `json:"channel_id"`
+	}
+	h.expect(h.do(http.MethodGet, "/api/moderation/queue", mod.token, nil), http.StatusOK, &queue)
+	if len(queue) != 1 || queue[0].ID != edited || queue[0].ChannelID != general {
+		t.Fatalf("queue %+v", queue)
+	}
+
+	review := func(id, action string) *httptest.ResponseRecorder {
+		return h.do(http.MethodPost, "/api/moderation/queue/"+id, mod.token, map[string]any{"action": action})
+	}
+	h.expectError(review(edited, "ignore"), http.StatusBadRequest, "invalid_body")
+	h.expect(review(edited, "approve"), http.StatusOK, nil)
+	if v := verdict(edited); v.Status != store.ModerationApproved || v.ReviewedBy != mod.user.ID || v.Reviewed == 0 {
+		t.Fatalf("approved verdict %+v", v)
+	}
+	h.expectError(review(edited, "approve"), http.StatusConflict, "conflict")
+
+	edit(edited, "still an idiot")
+	h.expect(review(edited, "remove"), http.StatusOK, nil)
+	h.expectError(h.do(http.MethodGet, "/api/messages/"+edited, alice.token, nil), http.StatusNotFound, "not_found")
+	h.expect(h.do(http.MethodGet, "/api/moderation/queue", mod.token, nil), http.StatusOK, &queue)
+	if len(queue) != 0 {
+		t.Fatalf("queue after review %+v", queue)
+	}
+}
+
+func TestAIUsage(t *testing.T) {
+	chat, err := ai.ParseChatSettings("gpt-4", "llama3", 0.7, 0, 4000)
+	if err != nil {
+		t.Fatalf("parse settings: %v", err)
+	}
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{
+		chat:      chat,
+		budgets:   map[string]ai.TokenBudget{store.RoleUser: {Daily: 40, Monthly: 1000}},
+		assistant: &ai.AssistantLimits{PerUser: 10, PerChannel: 10, Window: time.Hour},
+	})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "hunter2")
+
+	// the fake counts a token a byte: 5 for "hello", 11 for "echo: hello"
+	h.expect(h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{"prompt": "hello"}), http.StatusOK, nil)
+	var usage ai.UsageReport
+	h.expect(h.do(http.MethodGet, "/api/me/ai-usage", alice.token, nil), http.StatusOK, &usage)
+	if usage.Day.Used != 16 || usage.Day.Limit == nil || *usage.Day.Limit != 40 || usage.Month.Used != 16 ||
+		*usage.Month.Limit != 1000 || usage.Day.Resets <= time.Now().Unix() {
+		t.Fatalf("usage %+v", usage)
+	}
+	want := store.AIUsageTotal{Model: "gpt-4", Requests: 1, PromptTokens: 5, CompletionTokens: 11, TotalTokens: 16,
+		Cost: (5*30 + 11*60) / 1e6}
+	if len(usage.Models) != 1 || usage.Models[0] != want {
+		t.Fatalf("models %+v", usage.Models)
+	}
+
+	// streamed answers count too, and take alice over her daily budget
+	rec := h.do(http.MethodPost, "/api/ask?stream=true", alice.token, map[string]any{"prompt": "hello world"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stream status %d", rec.Code)
+	}
+	asked := len(h.ai.requests)
+	rec = h.do(http.MethodPost, "/api/ask", alice.token, map[string]any{"prompt": "hello"})
+	h.expectError(rec, http.StatusTooManyRequests, "ai_budget_exceeded")
+	if rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), `"period":"day"`) {
+		t.Fatalf("budget response %v %s", rec.Header(), rec.Body)
+	}
+	var conversation store.Conversation
+	h.expect(h.do(http.MethodPost, "/api/conversations", alice.token, nil), http.StatusCreated, &conversation)
+	h.expectError(h.do(http.MethodPost, "/api/conversations/"+conversation.ID+"/messages", alice.token,
+		map[string]any{"content": "hi"}), http.StatusTooManyRequests, "ai_budget_exceeded")
+	if len(h.ai.requests) != asked {
+		t.Fatalf("requests over budget reached the provider")
+	}
+	// nor does the assistant answer her mentions
+	var created struct {
+		ID string `json:"id"`
+	}
+	h.expect(h.do(http.MethodPost, "/api/channels", alice.token, map[string]any{
+		"text": "general", "messages": []string{}, "assistant": true,
+	}), http.StatusCreated, &created)
+	var resp map[string]any
+	h.expect(h.do(http.MethodPost, "/api/messages", alice.token, map[string]any{
+		"sender": alice.user.ID, "text": "@assistant hi", "images": []string{}, "channel": created.ID,
+	}), http.StatusCreated, &resp)
+	if resp["assistant"] != ai.AssistantBudgetExceeded {
+		t.Fatalf("mention over budget %v", resp)
+	}
+	if len(h.ai.requests) != asked {
+		t.Fatalf("requests over budget reached the provider")
+	}
+	h.expect(h.do(http.MethodGet, "/api/me/ai-usage", alice.token, nil), http.StatusOK, &usage)
+	if usage.Day.Used != 44 || usage.Models[0].Requests != 2 {
+		t.Fatalf("usage over budget %+v", usage)
+	}
+
+	// budgets are per user, and models without a price cost nothing
+	h.expect(h.do(http.MethodPost, "/api/ask", bob.token, map[string]any{"prompt": "hi", "model": "llama3"}), http.StatusOK, nil)
+	h.expect(h.do(http.MethodGet, "/api/me/ai-usage", bob.token, nil), http.StatusOK, &usage)
+	if len(usage.Models) != 1 || usage.Models[0].Model != "llama3" || usage.Models[0].Cost != 0 || usage.Day.Used != 10 {
+		t.Fatalf("bob's usage %+v", usage)
+	}
+
+	for _, bad := range []string{"user=10", "guest=1/2", "user=ten/20", "admin=-1/5"} {
+		if _, err := ai.ParseRoleBudgets(bad); err == nil {
+			t.Fatalf("budget %q accepted", bad)
+		}
+	}
+	budgets, err := ai.ParseRoleBudgets("user=100/unlimited, admin=unlimited")
+	if err != nil || budgets[store.RoleUser] != (ai.TokenBudget{Daily: 100, Monthly: ai.Unlimited}) {
+		t.Fatalf("budgets %v, %v", budgets, err)
+	}
+	if _, err := ai.ParseModelPrices("gpt-4o=cheap"); err == nil {
+		t.Fatalf("invalid price accepted")
+	}
+}
+
+func TestConversations(t *testing.T) {
+	h := newHarnessWith(t, store.NewMemory().Stores(), harnessOptions{chat: &ai.ChatSettings{
+		Model: "gpt-4", Models: []string{"gpt-4"}, Temperature: 0.7, ContextTokens: 40,
+	}})
+	alice := h.signUp("alice", "alice@example.com", "hunter2")
+	bob := h.signUp("bob", "bob@example.com", "hunter2")
+
+	var conversation store.Conversation
+	h.expect(h.do(http.MethodPost, "/api/conversations", alice.token, nil), http.StatusCreated, &conversation)
+	if conversation.ID == "" || conversation.Owner != alice.user.ID || conversation.Title != "" {
+		t.Fatalf("created %+v", conversation)
+	}
+	turnPath := "/api/conversations/" + conversation.ID + "/messages"
+
+	type turnResponse struct {
+		Messages []store.AIMessage `json:"messages"`
+		Trimmed  int               `json:"trimmed"`
+	}
+	var turn turnResponse
+	h.expect(h.do(http.MethodPost, turnPath, alice.token, map[string]any{"content": "first question"}), http.StatusCreated, &turn)
+	if len(turn.Messages) != 2 || turn.Messages[1].Role != store.AIRoleAssistant || turn.Messages[1].Content != "echo: first question" {
+		t.Fatalf("turn %+v", turn)
+	}
+
+	// earlier turns go with the next one while they fit
+	h.expect(h.do(http.MethodPost, turnPath, alice.token, map[string]any{"content": "second"}), http.StatusCreated, &turn)
+	if sent := h.ai.requests[len(h.ai.requests)-1].Messages; len(sent) != 3 || sent[0].Content != "first question" || turn.Trimmed != 0 {
+		t.Fatalf("sent %+v, trimmed %d", sent, turn.Trimmed)
+	}
+	// and the oldest are left out once they don't
+	h.expect(h.do(http.MethodPost, turnPath, alice.token, map[string]any{"content": "third"}), http.StatusCreated, &turn)
+	if sent := h.ai.requests[len(h.ai.requests)-1].Messages; len(sent) != 3 || sent[0].Content != "second" || turn.Trimmed != 2 {
+		t.Fatalf("sent %+v, trimmed %d", sent, turn.Trimmed)
+	}
+
+	// streamed turns are saved too
+	rec := h.do(http.MethodPost, turnPath+"?stream=true", alice.token, map[string]any{"content": "fourth"})
+	h.expect(rec, http.StatusOK, nil)
+	events := serverSentEvents(t, rec.Body.String())
+	if len(events) < 3 || events[len(events)-2].name != "turn" || events[len(events)-1].name != "usage" {
+		t.Fatalf("events %+v", events)
+	}
+
+	var full struct {
+		Conversation store.Conversation `json:"conversation"`
+		Messages     []store.AIMessage  `json:"messages"`
+	}
+	h.expect(h.do(http.MethodGet, "/api/conversations/"+conversation.ID, alice.token, nil), http.StatusOK, &full)
+	if full.Conversation.Title != "first question" || len(full.Messages) != 8 || full.Messages[7].Content != "echo: fourth" {
+		t.Fatalf("conversation %+v", full)
+	}
+
+	var other store.Conversation
+	h.expect(h.do(http.MethodPost, "/api/conversations", alice.token, map[string]any{"title": "Plans"}), http.StatusCreated, &other)
+	h.expect(h.do(http.MethodPost, "/api/conversations/"+other.ID+"/messages", alice.token, map[string]any{"content": "hello"}), http.StatusCreated, nil)
+	var list []store.Conversation
+	h.expect(h.do(http.MethodGet, "/api/conversations", alice.token, nil), http.StatusOK, &list)
+	// the timestamps are in seconds, so both may have been updated at once
+	if len(list) != 2 || list[0].Updated < list[1].Updated ||
+		!slices.ContainsFunc(list, func(c store.Conversation) bool { return c.ID == other.ID && c.Title == "Plans" }) {
+		t.Fatalf("list %+v", list)
+	}
+
+	// other users can't see or touch them
+	h.expect(h.do(http.MethodGet, "/api/conversations", bob.token, nil), http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Fatalf("bob sees %+v", list)
+	}
+	h.expectError(h.do(http.MethodGet, "/api/conversations/"+conversation.ID, bob.token, nil), http.StatusNotFound, "not_found")
+	h.expectError(h.do(http.MethodPost, turnPath, bob.token, map[string]any{"content": "hi"}), http.StatusNotFound, "not_found")
+	h.expectError(h.do(http.MethodDelete, "/api/conversations/"+conversation.ID, bob.token, nil), http.StatusNotFound, "not_found")
+	h.expectError(h.do(http.MethodPost, turnPath, alice.token, map[string]any{}), http.StatusBadRequest, "invalid_body")
+
+	h.expect(h.do(http.MethodDelete, "/api/conversations/"+conversation.ID, alice.token, nil), http.StatusOK, nil)
+	h.expectError(h.do(http.MethodGet, "/api/conversations/"+conversation.ID, alice.token, nil), http.StatusNotFound, "not_found")
+}
+
+type serverSentEvent struct {
+	name, data string
+}
+
+// serverSentEvents splits an event stream into its events.
+func serverSentEvents(t *testing.T, body string) []serverSentEvent {
+	t.Helper()
+	var events []serverSentEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var e serverSentEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ":")
+			switch field {
+			case "event":
+				e.name = value
+			case "data":
+				e.data = value
+			}
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestRequestIDAndUnknownRoutes(t *testing.T) {
+	h := newHarness(t, store.NewMemory().Stores())
+
+	rec := h.do(http.MethodGet, "/health", "", nil)
+	h.expect(rec, http.StatusOK, nil)
+	if rec.Header().Get("X-Request-ID") == "" {
+		t.Fatalf("missing X-Request-ID header")
+	}
+
+	h.expectError(h.do(http.MethodGet, "/does-not-exist", "", nil), http.StatusNotFound, "route_not_found")
+	h.expectError(h.do(http.MethodPatch, "/login", "", nil), http.StatusMethodNotAllowed, "method_not_allowed")
+	h.expectError(h.do(http.MethodPost, "/login", "", strings.NewReader("{not json")), http.StatusBadRequest, "invalid_body")
+}
@@ -0,0 +1,43 @@
+package ginserver
+
+import (
+	"net/http"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getAttachmentByID returns an attachment's metadata to anyone who may
+// download it, and 404 to everyone else.
+func getAttachmentByID(attachments store.AttachmentStore, c *gin.Context) {
+	id := c.Param("id")
+	allowed, err := attachments.CanAccessAttachment(c, c.GetString("userID"), id)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	if !allowed {
+		apierror.Abort(c, apierror.NotFound("attachment"))
+		return
+	}
+
+	attachment, err := attachments.GetAttachment(c, id)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "attachment"))
+		return
+	}
+	c.JSON(http.StatusOK, attachment)
+}
+
+// getStorageUsage reports the caller's storage usage and quota.
+func getStorageUsage(quotas *awservice.Quotas, c *gin.Context) {
+	usage, err := quotas.Usage(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
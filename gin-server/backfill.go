@@ -0,0 +1,42 @@
+package ginserver
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"crispy-doodle/main.go/global"
+	openai "crispy-doodle/main.go/open-ai"
+)
+
+// RunEmbeddingBackfill is the backfill-embeddings subcommand: it embeds
+// every message whose text has no up to date embedding, such as those
+// written before semantic search existed, and prints how many as JSON.
+func RunEmbeddingBackfill(args []string) {
+	// stdout is for the report
+	logger := global.Load(os.Stderr)
+
+	flags := flag.NewFlagSet("backfill-embeddings", flag.ExitOnError)
+	batch := flags.Int("batch", 64, "how many messages to embed per request")
+	flags.Parse(args)
+
+	embedder, err := openai.NewEmbedder(global.AIProvider, global.AIBaseURL, global.OpenAIKey, global.AIEmbeddingModel)
+	if err != nil {
+		logger.Error("error connecting to the embedding model", "error", err)
+		os.Exit(1)
+	}
+	stores, closeStores := connectStores(logger)
+	defer closeStores()
+
+	indexer := openai.NewIndexer(embedder, stores.Messages, stores.Embeddings, logger)
+	embedded, err := indexer.Backfill(context.Background(), *batch)
+	if err != nil {
+		logger.Error("embedding backfill failed", "embedded", embedded, "error", err)
+		closeStores()
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]any{"model": embedder.Model(), "embedded": embedded})
+}
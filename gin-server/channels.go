@@ -0,0 +1,261 @@
+package ginserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	ai "crispy-doodle/main.go/open-ai"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createChannel makes the caller the owner and first member of a new,
+// empty channel. Messages get into it by being posted there. Only
+// moderators and admins may give it a moderation policy.
+func createChannel(channels store.ChannelStore, users store.UserStore, assistant *ai.Assistant, c *gin.Context) {
+	var channel store.Channel
+	if err := c.ShouldBindJSON(&channel); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if len(channel.Messages) > 0 {
+		apierror.Abort(c, errPostMessages)
+		return
+	}
+	if err := checkModerationPolicy(channel.Moderation); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if channel.Moderation != "" {
+		caller, err := users.GetUser(c, c.GetString("userID"))
+		if err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "user"))
+			return
+		}
+		if !isModerator(caller) {
+			apierror.Abort(c, errSetModeration)
+			return
+		}
+	}
+
+	channel.ID, channel.Owner, channel.Messages = "", c.GetString("userID"), nil
+	if err := channels.CreateChannel(c, &channel); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	if err := users.AddUserChannel(c, channel.Owner, channel.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if err := assistant.SyncMembership(c, &channel); err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Channel created!", "id": channel.ID})
+}
+
+func getChannels(channels store.ChannelStore, c *gin.Context) {
+	list, err := channels.ListChannels(c)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getChannelByID(channels store.ChannelStore, c *gin.Context) {
+	channel, err := channels.GetChannel(c, c.Param("id"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	c.JSON(http.StatusOK, channel)
+}
+
+// updateChannelByID lets a member, or an admin, change a channel's
+// settings. Its messages cannot be changed this way; leaving them out, or
+// sending them unchanged, keeps them. Only the owner, or an admin, may opt
+// the channel in or out of the assistant, and only moderators and admins may
+// change its moderation policy.
+func updateChannelByID(channels store.ChannelStore, users store.UserStore, assistant *ai.Assistant, c *gin.Context) {
+	var channel store.Channel
+	if err := c.ShouldBindJSON(&channel); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if err := checkModerationPolicy(channel.Moderation); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	channel.ID = c.Param("id")
+	current, caller, err := channelAndCaller(channels, users, channel.ID, c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if !isMember(caller, current.ID) && caller.Role != store.RoleAdmin {
+		apierror.Abort(c, apierror.Forbidden("Only channel members can edit it"))
+		return
+	}
+	if channel.Messages != nil && !slices.Equal(channel.Messages, current.Messages) {
+		apierror.Abort(c, errPostMessages)
+		return
+	}
+	if channel.Assistant != current.Assistant && !ownerOrAdmin(caller, current) {
+		apierror.Abort(c, apierror.Forbidden("Only the channel owner can opt it in or out of the assistant"))
+		return
+	}
+	if channel.Moderation != current.Moderation && !isModerator(caller) {
+		apierror.Abort(c, errSetModeration)
+		return
+	}
+	if err := channels.UpdateChannel(c, &channel); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	if err := assistant.SyncMembership(c, &channel); err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Channel updated!"})
+}
+
+// deleteChannelByID lets the channel's owner, or an admin, delete it.
+func deleteChannelByID(channels store.ChannelStore, users store.UserStore, c *gin.Context) {
+	channel, caller, err := channelAndCaller(channels, users, c.Param("id"), c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if !ownerOrAdmin(caller, channel) {
+		apierror.Abort(c, apierror.Forbidden("Only the channel owner can delete it"))
+		return
+	}
+	if err := channels.DeleteChannel(c, channel.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted!"})
+}
+
+// addChannelMember lets a member, or an admin, add another user to a
+// channel. Membership is only ever granted this way, or by creating the
+// channel.
+func addChannelMember(channels store.ChannelStore, users store.UserStore, c *gin.Context) {
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	channel, caller, err := channelAndCaller(channels, users, c.Param("id"), c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if !isMember(caller, channel.ID) && caller.Role != store.RoleAdmin {
+		apierror.Abort(c, apierror.Forbidden("Only channel members can add members"))
+		return
+	}
+	if err := users.AddUserChannel(c, req.UserID, channel.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member added!"})
+}
+
+// removeChannelMember lets users leave a channel, and its owner or an admin
+// remove anyone from it.
+func removeChannelMember(channels store.ChannelStore, users store.UserStore, c *gin.Context) {
+	channel, caller, err := channelAndCaller(channels, users, c.Param("id"), c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	userID := c.Param("userID")
+	if userID != caller.ID && !ownerOrAdmin(caller, channel) {
+		apierror.Abort(c, apierror.Forbidden("Only the channel owner can remove other members"))
+		return
+	}
+	if err := users.RemoveUserChannel(c, userID, channel.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed!"})
+}
+
+// errPostMessages refuses a channel body that tries to set the channel's
+// messages.
+var errPostMessages = apierror.BadRequest("Post messages to a channel through /api/messages")
+
+var errSetModeration = apierror.Forbidden("Only moderators can set a channel's moderation policy")
+
+// channelAndCaller loads the channel id and the user making the request.
+func channelAndCaller(channels store.ChannelStore, users store.UserStore, id string, c *gin.Context) (*store.Channel,
+	*store.User, error) {
+	channel, err := channels.GetChannel(c, id)
+	if err != nil {
+		return nil, nil, apierror.FromStore(err, "channel")
+	}
+	caller, err := users.GetUser(c, c.GetString("userID"))
+	if err != nil {
+		return nil, nil, apierror.FromStore(err, "user")
+	}
+	return channel, caller, nil
+}
+
+// isMember reports whether user belongs to the channel.
+func isMember(user *store.User, channelID string) bool {
+	return slices.Contains(user.Channels, channelID)
+}
+
+// isModerator reports whether user is a moderator or an admin.
+func isModerator(user *store.User) bool {
+	return user.Role == store.RoleModerator || user.Role == store.RoleAdmin
+}
+
+// ownerOrAdmin reports whether user owns channel or is an admin. Channels
+// from before owners were recorded have none, and only admins own them.
+func ownerOrAdmin(user *store.User, channel *store.Channel) bool {
+	return (channel.Owner != "" && channel.Owner == user.ID) || user.Role == store.RoleAdmin
+}
+
+// markChannelRead records how far the caller has read a channel, now unless
+// the body gives another Unix time. Summaries start from here. Only members,
+// and admins, have a read position.
+func markChannelRead(channels store.ChannelStore, users store.UserStore, c *gin.Context) {
+	// the body is optional
+	var req struct {
+		At int64 `json:"at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if req.At == 0 {
+		req.At = time.Now().Unix()
+	}
+	channel, caller, err := channelAndCaller(channels, users, c.Param("id"), c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if !isMember(caller, channel.ID) && caller.Role != store.RoleAdmin {
+		apierror.Abort(c, apierror.Forbidden("Only channel members can mark it read"))
+		return
+	}
+	if err := channels.SetReadPosition(c, caller.ID, channel.ID, req.At); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Channel marked read!", "read_at": req.At})
+}
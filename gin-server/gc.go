@@ -0,0 +1,38 @@
+package ginserver
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/global"
+)
+
+// RunGarbageCollector is the gc subcommand: one garbage collection against
+// the configured stores, with the report printed as JSON on stdout. It is a
+// dry run unless -delete is given.
+func RunGarbageCollector(args []string) {
+	// stdout is for the report
+	logger := global.Load(os.Stderr)
+
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	del := flags.Bool("delete", false, "delete what is found; without it, only report what would be deleted")
+	grace := flags.Duration("grace", global.GCGrace, "only collect attachments and objects older than this")
+	flags.Parse(args)
+
+	blobs := connectBlobStore(logger)
+	stores, closeStores := connectStores(logger)
+	defer closeStores()
+
+	report, err := awservice.CollectGarbage(context.Background(), blobs, stores.Attachments, stores.Messages, stores.Uploads, *grace, !*del)
+	if err != nil {
+		logger.Error("garbage collection failed", "error", err)
+		closeStores()
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
@@ -0,0 +1,374 @@
+package ginserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/global"
+	ai "crispy-doodle/main.go/open-ai"
+	postgresdb "crispy-doodle/main.go/postgres-db"
+	"crispy-doodle/main.go/store"
+)
+
+func TestMain(m *testing.M) {
+	global.TokenSecret = "test-access-secret"
+	global.RefreshTokenSecret = "test-refresh-secret"
+	os.Exit(m.Run())
+}
+
+// backends returns a constructor for every store the API suite runs
+// against. Postgres is only used when TEST_DATABASE_URL points at a server
+// the tests may create and drop schemas in.
+func backends(t *testing.T) map[string]func(t *testing.T) store.Stores {
+	b := map[string]func(t *testing.T) store.Stores{
+		"memory": func(t *testing.T) store.Stores { return store.NewMemory().Stores() },
+	}
+	if dsn := os.Getenv("TEST_DATABASE_URL"); dsn != "" {
+		b["postgres"] = func(t *testing.T) store.Stores { return disposablePostgres(t, dsn) }
+	}
+	return b
+}
+
+// disposablePostgres creates a fresh schema, migrates it and drops it when
+// the test ends.
+func disposablePostgres(t *testing.T, dsn string) store.Stores {
+	t.Helper()
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	// pgvector goes in public, where every schema sees it and dropping a
+	// test schema does not take it along
+	if _, err := admin.Exec(`CREATE EXTENSION IF NOT EXISTS vector SCHEMA public`); err != nil {
+		t.Fatalf("create pgvector extension: %v", err)
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", dsn+sep+"search_path="+schema+",public")
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		admin.Close()
+	})
+	if err := postgresdb.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return postgresdb.NewStore(db).Stores()
+}
+
+type harness struct {
+	t      *testing.T
+	router http.Handler
+	blobs  *awservice.LocalStore
+	ai     *fakeChat
+}
+
+const testBaseURL = "http://crispy-doodle.test"
+
+func newHarness(t *testing.T, stores store.Stores) *harness {
+	return newHarnessWith(t, stores, harnessOptions{})
+}
+
+// harnessOptions replace the defaults of the upload pipeline when set.
+type harnessOptions struct {
+	scanner awservice.Scanner
+	// allowUnscanned lets files too large for the scanner through
+	allowUnscanned bool
+	policy         *awservice.UploadPolicy
+	quotas         map[string]int64
+	// keys encrypt the blob store; h.blobs still reads the raw objects
+	keys *awservice.KeyRing
+	// wrap sits between the server and the blob store
+	wrap func(awservice.BlobStore) awservice.BlobStore
+	chat *ai.ChatSettings
+	// assistant starts the assistant with these limits
+	assistant *ai.AssistantLimits
+	// index embeds messages with the fake embedder as they are written
+	index bool
+	// moderator moderates messages under moderationPolicy
+	moderator        ai.Moderator
+	moderationPolicy string
+	// budgets replace the default AI token budgets
+	budgets map[string]ai.TokenBudget
+}
+
+func newHarnessWith(t *testing.T, stores store.Stores, opts harnessOptions) *harness {
+	blobs, err := awservice.NewLocalStore(t.TempDir(), testBaseURL, []byte("test-signing-key"))
+	if err != nil {
+		t.Fatalf("local blob store: %v", err)
+	}
+	var served awservice.BlobStore = blobs
+	if opts.keys != nil {
+		served = awservice.NewEncryptedStore(blobs, opts.keys)
+	}
+	if opts.wrap != nil {
+		served = opts.wrap(served)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	worker := awservice.NewAttachmentWorker(served, stores.Attachments, opts.scanner, logger)
+	worker.AllowUnscanned = opts.allowUnscanned
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	worker.Start(ctx, 1)
+
+	h := &harness{t: t, blobs: blobs, ai: &fakeChat{}}
+	meter := ai.NewMeter(stores.AIUsage, stores.Users, opts.budgets, nil, logger)
+	var assistant *ai.Assistant
+	if opts.assistant != nil {
+		chat := opts.chat
+		if chat == nil {
+			chat = ai.DefaultChatSettings()
+		}
+		assistant = ai.NewAssistant(h.ai, meter, chat, stores, "assistant", *opts.assistant, logger)
+		if err := assistant.EnsureUser(ctx); err != nil {
+			t.Fatalf("assistant account: %v", err)
+		}
+		assistant.Start(ctx, 1)
+	}
+	var indexer *ai.Indexer
+	if opts.index {
+		indexer = ai.NewIndexer(ai.FakeEmbedder{}, stores.Messages, stores.Embeddings, logger)
+		indexer.Start(ctx, 1)
+	}
+	h.router = NewRouter(Deps{
+		Logger: logger,
+		Stores: stores,
+		Blobs:  served,
+		Worker: worker,
+		Policy: opts.policy,
+		Quotas: opts.quotas,
+		AI:     h.ai,
+		Chat:   opts.chat,
+		Meter:  meter,
+
+		Assistant: assistant,
+		Indexer:   indexer,
+
+		Moderator:        opts.moderator,
+		ModerationPolicy: opts.moderationPolicy,
+	})
+	return h
+}
+
+// fetch GETs an absolute URL handed out by the API, such as a signed
+// download link, against the router.
+func (h *harness) fetch(rawURL string) *httptest.ResponseRecorder {
+	h.t.Helper()
+	if !strings.HasPrefix(rawURL, testBaseURL) {
+		h.t.Fatalf("url %q is not served by this server", rawURL)
+	}
+	return h.do(http.MethodGet, strings.TrimPrefix(rawURL, testBaseURL), "", nil)
+}
+
+// presigned sends body with a presigned request handed out by the API.
+func (h *harness) presigned(req awservice.PresignedRequest, body []byte) *httptest.ResponseRecorder {
+	h.t.Helper()
+	if !strings.HasPrefix(req.URL, testBaseURL) {
+		h.t.Fatalf("url %q is not served by this server", req.URL)
+	}
+	r := httptest.NewRequest(req.Method, strings.TrimPrefix(req.URL, testBaseURL), bytes.NewReader(body))
+	for name, value := range req.Headers {
+		r.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, r)
+	return rec
+}
+
+// do sends body as JSON (or as-is when it is an io.Reader) and returns the
+// recorded response.
+func (h *harness) do(method, path, token string, body any) *httptest.ResponseRecorder {
+	h.t.Helper()
+	var reader io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case *multipartBody:
+		reader, contentType = b.buf, b.contentType
+	case io.Reader:
+		reader = b
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			h.t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// expect fails the test unless rec has the given status, then decodes the
+// body into out when out is non-nil.
+func (h *harness) expect(rec *httptest.ResponseRecorder, status int, out any) {
+	h.t.Helper()
+	if rec.Code != status {
+		h.t.Fatalf("status = %d, want %d; body: %s", rec.Code, status, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			h.t.Fatalf("decode %T: %v; body: %s", out, err, rec.Body.String())
+		}
+	}
+}
+
+// expectError checks the status and the machine readable error code.
+func (h *harness) expectError(rec *httptest.ResponseRecorder, status int, code string) {
+	h.t.Helper()
+	var envelope struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	h.expect(rec, status, &envelope)
+	if envelope.Error.Code != code {
+		h.t.Fatalf("error code = %q, want %q; body: %s", envelope.Error.Code, code, rec.Body.String())
+	}
+	if envelope.Error.RequestID == "" || envelope.Error.RequestID != rec.Header().Get("X-Request-ID") {
+		h.t.Fatalf("request_id %q does not match X-Request-ID %q", envelope.Error.RequestID, rec.Header().Get("X-Request-ID"))
+	}
+}
+
+type multipartBody struct {
+	buf         *bytes.Buffer
+	contentType string
+}
+
+func fileUpload(t *testing.T, field, filename string, content []byte) *multipartBody {
+	t.Helper()
+	return fileUploadAs(t, field, filename, "application/octet-stream", content)
+}
+
+// fileUploadAs is fileUpload with the part's Content-Type set.
+func fileUploadAs(t *testing.T, field, filename, contentType string, content []byte) *multipartBody {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, filename))
+	header.Set("Content-Type", contentType)
+	part, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	part.Write(content)
+	w.Close()
+	return &multipartBody{buf: buf, contentType: w.FormDataContentType()}
+}
+
+// fakeChat is ai.Fake recording what it is asked.
+// flakyStat fails the first Stat of key, as storage having a bad moment.
+type flakyStat struct {
+	awservice.BlobStore
+	key    string
+	failed atomic.Bool
+}
+
+func (f *flakyStat) Stat(ctx context.Context, key string) (*awservice.ObjectInfo, error) {
+	if key == f.key && f.failed.CompareAndSwap(false, true) {
+		return nil, errors.New("storage unavailable")
+	}
+	return f.BlobStore.Stat(ctx, key)
+}
+
+type fakeChat struct {
+	ai.Fake
+	mu       sync.Mutex
+	requests []ai.ChatRequest
+	streams  []*fakeStream
+}
+
+func (f *fakeChat) Complete(ctx context.Context, req ai.ChatRequest) (ai.ChatResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	return f.Fake.Complete(ctx, req)
+}
+
+// Stream is ai.Fake's stream, except that a last message of "hang" stops
+// after the first word until ctx is done.
+func (f *fakeChat) Stream(ctx context.Context, req ai.ChatRequest) (ai.ChatStream, error) {
+	inner, err := f.Fake.Stream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	stream := &fakeStream{
+		ChatStream: inner,
+		ctx:        ctx,
+		hang:       req.Messages[len(req.Messages)-1].Content == "hang",
+		closed:     make(chan struct{}),
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.streams = append(f.streams, stream)
+	f.mu.Unlock()
+	return stream, nil
+}
+
+// openStreams are the streams handed out so far.
+func (f *fakeChat) openStreams() []*fakeStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.streams)
+}
+
+type fakeStream struct {
+	ai.ChatStream
+	ctx    context.Context
+	sent   int
+	hang   bool
+	closed chan struct{}
+}
+
+func (s *fakeStream) Recv() (ai.ChatChunk, error) {
+	if s.hang && s.sent == 1 {
+		<-s.ctx.Done()
+		return ai.ChatChunk{}, s.ctx.Err()
+	}
+	s.sent++
+	return s.ChatStream.Recv()
+}
+
+func (s *fakeStream) Close() error {
+	close(s.closed)
+	return s.ChatStream.Close()
+}
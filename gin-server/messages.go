@@ -0,0 +1,217 @@
+package ginserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	apierror "crispy-doodle/main.go/api-error"
+	ai "crispy-doodle/main.go/open-ai"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createMessage stores a message from the caller and, when the body names
+// a channel the caller is a member of, posts it there. Mentions of the assistant in a channel that opts in are queued
+// for an answer, and the response says whether they were. The text is
+// moderated first, under the channel's policy, and queued for embedding.
+func createMessage(messages store.MessageStore, channels store.ChannelStore, users store.UserStore,
+	attachments store.AttachmentStore, moderation moderation, assistant *ai.Assistant, indexer *ai.Indexer, c *gin.Context) {
+	var req struct {
+		store.Message
+		Channel string `json:"channel"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	message := req.Message
+	if err := checkImages(attachments, message.Images, nil, c); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	var channel *store.Channel
+	if req.Channel != "" {
+		var caller *store.User
+		var err error
+		if channel, caller, err = channelAndCaller(channels, users, req.Channel, c); err != nil {
+			apierror.Abort(c, err)
+			return
+		}
+		if !isMember(caller, channel.ID) {
+			apierror.Abort(c, apierror.Forbidden("Only channel members can post to it"))
+			return
+		}
+	}
+
+	message.ID, message.Sender, message.AI = "", c.GetString("userID"), false
+	if err := postMessage(messages, channels, moderation, indexer, channel, &message, c); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	resp := gin.H{"message": "Message sent!", "id": message.ID}
+	if channel != nil {
+		if outcome := assistant.Notice(c, c.GetString("userID"), channel, &message); outcome != "" {
+			resp["assistant"] = outcome
+		}
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// postMessage moderates message under the policy of channel, which may be
+// nil, then stores it, queues it for indexing and adds it to channel. It is
+// the one way messages are posted, by users and the assistant alike.
+func postMessage(messages store.MessageStore, channels store.ChannelStore, moderation moderation, indexer *ai.Indexer,
+	channel *store.Channel, message *store.Message, ctx context.Context) error {
+	verdict, err := moderation.check(ctx, channel, message.Text)
+	if err != nil {
+		return err
+	}
+	message.Moderation = verdict
+	if err := messages.CreateMessage(ctx, message); err != nil {
+		return apierror.FromStore(err, "message")
+	}
+	indexer.Enqueue(message.ID)
+	if channel != nil {
+		if err := channels.AddChannelMessage(ctx, channel.ID, message.ID); err != nil {
+			return apierror.FromStore(err, "channel")
+		}
+	}
+	return nil
+}
+
+func getMessages(messages store.MessageStore, c *gin.Context) {
+	list, err := messages.ListMessages(c)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getMessageByID(messages store.MessageStore, c *gin.Context) {
+	message, err := messages.GetMessage(c, c.Param("id"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	c.JSON(http.StatusOK, message)
+}
+
+// updateMessageByID replaces a message's text and images, moderating the new
+// text under the policy of the channel it is in. Only its sender, or an
+// admin, may edit it, and nobody edits the assistant's answers.
+func updateMessageByID(messages store.MessageStore, channels store.ChannelStore, users store.UserStore,
+	attachments store.AttachmentStore, moderation moderation, indexer *ai.Indexer, c *gin.Context) {
+	var message store.Message
+	if err := c.ShouldBindJSON(&message); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	message.ID = c.Param("id")
+	current, err := messages.GetMessage(c, message.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	channel, err := channels.FindMessageChannel(c, message.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	caller, err := users.GetUser(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if current.AI {
+		apierror.Abort(c, apierror.Forbidden("The assistant's answers cannot be edited"))
+		return
+	}
+	if current.Sender != caller.ID && caller.Role != store.RoleAdmin {
+		apierror.Abort(c, apierror.Forbidden("Only the sender can edit a message"))
+		return
+	}
+	if err := checkImages(attachments, message.Images, current.Images, c); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	message.Sender = current.Sender
+	if message.Moderation, err = moderation.check(c, channel, message.Text); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := messages.UpdateMessage(c, &message); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	indexer.Enqueue(message.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message updated!"})
+}
+
+// deleteMessageByID lets a message's sender, the owner of its channel or an
+// admin delete it.
+func deleteMessageByID(messages store.MessageStore, channels store.ChannelStore, users store.UserStore, c *gin.Context) {
+	current, err := messages.GetMessage(c, c.Param("id"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	channel, err := channels.FindMessageChannel(c, current.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	caller, err := users.GetUser(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if current.Sender != caller.ID && (channel == nil || !ownerOrAdmin(caller, channel)) && caller.Role != store.RoleAdmin {
+		apierror.Abort(c, apierror.Forbidden("Only the sender and the channel owner can delete a message"))
+		return
+	}
+	if err := messages.DeleteMessage(c, current.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted!"})
+}
+
+// checkImages makes sure every entry in Message.Images that is not already
+// in existing is an attachment the caller uploaded and finished uploading.
+// Entries the message already has are kept as they are, so anyone allowed
+// to edit it can, and legacy URL values from before attachments survive an
+// edit. Unknown IDs and other users' attachments look the same.
+func checkImages(attachments store.AttachmentStore, images, existing []string, c *gin.Context) error {
+	var unknown []string
+	for _, id := range images {
+		if slices.Contains(existing, id) {
+			continue
+		}
+		attachment, err := attachments.GetAttachment(c, id)
+		if errors.Is(err, store.ErrNotFound) ||
+			(err == nil && (attachment.Owner != c.GetString("userID") || !usable(attachment.Status))) {
+			unknown = append(unknown, id)
+			continue
+		} else if err != nil {
+			return apierror.Internal(err)
+		}
+	}
+	if len(unknown) > 0 {
+		return apierror.BadRequest("Images must be attachment IDs returned by /api/upload").
+			WithDetails(gin.H{"unknown_attachments": unknown})
+	}
+	return nil
+}
+
+// usable reports whether an attachment in status can go into a message.
+// Images still being processed can, they just cannot be downloaded yet.
+func usable(status string) bool {
+	return status == store.AttachmentReady || status == store.AttachmentProcessing
+}
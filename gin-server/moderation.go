@@ -0,0 +1,147 @@
+package ginserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	ai "crispy-doodle/main.go/open-ai"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Review actions a moderator may take on a flagged message.
+const (
+	reviewApprove = "approve"
+	reviewRemove  = "remove"
+)
+
+// moderation is the moderation step of creating and editing messages. With
+// no moderator nothing is checked.
+type moderation struct {
+	moderator ai.Moderator
+	// policy applies to channels without one and messages outside channels
+	policy string
+}
+
+// check moderates a message's text under the policy of channel, which may
+// be nil. It returns the verdict to store with the message, nil when
+// nothing was checked, or a content_blocked error when the policy blocks
+// what was flagged.
+func (m moderation) check(ctx context.Context, channel *store.Channel, text string) (*store.Moderation, error) {
+	if m.moderator == nil || text == "" {
+		return nil, nil
+	}
+	result, err := m.moderator.Moderate(ctx, text)
+	if err != nil {
+		return nil, apierror.Upstream("Moderation provider", err)
+	}
+	verdict := &store.Moderation{
+		Status:     store.ModerationAllowed,
+		Flagged:    result.Flagged,
+		Categories: result.Categories,
+		Provider:   result.Provider,
+		Checked:    time.Now().Unix(),
+	}
+	if verdict.Categories == nil {
+		verdict.Categories = []string{}
+	}
+	if !result.Flagged {
+		return verdict, nil
+	}
+	policy := m.policy
+	if channel != nil && channel.Moderation != "" {
+		policy = channel.Moderation
+	}
+	switch policy {
+	case store.PolicyBlock:
+		return nil, apierror.New(http.StatusUnprocessableEntity, apierror.CodeContentBlocked, "Message blocked by moderation").
+			WithDetails(gin.H{"categories": verdict.Categories})
+	case store.PolicyFlag:
+		verdict.Status = store.ModerationFlagged
+	}
+	return verdict, nil
+}
+
+// checkModerationPolicy accepts the policies a channel may set.
+func checkModerationPolicy(policy string) error {
+	switch policy {
+	case "", store.PolicyAllow, store.PolicyFlag, store.PolicyBlock:
+		return nil
+	}
+	return apierror.BadRequest("moderation must be allow, flag or block").
+		WithDetails(gin.H{"moderation": policy})
+}
+
+type queuedMessage struct {
+	store.Message
+	ChannelID string `json:"channel_id,omitempty"`
+}
+
+// getModerationQueue lists the flagged messages awaiting review, oldest
+// first, with the channel each was posted to.
+func getModerationQueue(messages store.MessageStore, channels store.ChannelStore, c *gin.Context) {
+	flagged, err := messages.ListMessagesByModeration(c, store.ModerationFlagged)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	queue := make([]queuedMessage, len(flagged))
+	for i, message := range flagged {
+		queue[i].Message = message
+		channel, err := channels.FindMessageChannel(c, message.ID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		if channel != nil {
+			queue[i].ChannelID = channel.ID
+		}
+	}
+	c.JSON(http.StatusOK, queue)
+}
+
+// reviewMessage settles a flagged message: approve keeps it and takes it
+// off the queue, remove deletes it.
+func reviewMessage(messages store.MessageStore, c *gin.Context) {
+	var req struct {
+		Action string `json:"action"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if req.Action != reviewApprove && req.Action != reviewRemove {
+		apierror.Abort(c, apierror.BadRequest("action must be approve or remove"))
+		return
+	}
+	message, err := messages.GetMessage(c, c.Param("id"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	if message.Moderation == nil || message.Moderation.Status != store.ModerationFlagged {
+		apierror.Abort(c, apierror.New(http.StatusConflict, apierror.CodeConflict, "Message is not awaiting review"))
+		return
+	}
+
+	if req.Action == reviewRemove {
+		if err := messages.DeleteMessage(c, message.ID); err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "message"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Message removed!"})
+		return
+	}
+	verdict := message.Moderation
+	verdict.Status = store.ModerationApproved
+	verdict.ReviewedBy, verdict.Reviewed = c.GetString("userID"), time.Now().Unix()
+	if err := messages.SetMessageModeration(c, message.ID, verdict); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "message"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Message approved!", "moderation": verdict})
+}
@@ -0,0 +1,38 @@
+package ginserver
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/global"
+)
+
+// RunKeyRotation is the rotate-keys subcommand: it rewraps every object in
+// blob storage under the first key of ENCRYPTION_KEYS and prints the report
+// as JSON on stdout.
+func RunKeyRotation(args []string) {
+	// stdout is for the report
+	logger := global.Load(os.Stderr)
+
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be rewritten without writing it")
+	flags.Parse(args)
+
+	blobs, ok := connectBlobStore(logger).(*awservice.EncryptedStore)
+	if !ok {
+		logger.Error("ENCRYPTION_KEYS is not set")
+		os.Exit(1)
+	}
+
+	report, err := awservice.RotateKeys(context.Background(), blobs, *dryRun)
+	if err != nil {
+		logger.Error("key rotation failed", "error", err)
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
@@ -3,89 +3,175 @@ package ginserver
 import (
 	"crispy-doodle/main.go/awservice"
 	ai "crispy-doodle/main.go/open-ai"
-	postgresdb "crispy-doodle/main.go/postgres-db"
-	"database/sql"
+	"crispy-doodle/main.go/openapi"
+	"crispy-doodle/main.go/store"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
-	openai "github.com/sashabaranov/go-openai"
 )
 
-func addOpenUserRoutes(r *gin.Engine, db *sql.DB) {
+func addOpenUserRoutes(r *gin.RouterGroup, users store.UserStore) {
 	r.POST("/login", func(c *gin.Context) {
-		postgresdb.Login(db, c)
+		login(users, c)
 	})
 	r.POST("/register", func(c *gin.Context) {
-		postgresdb.RegisterUser(db, c)
+		registerUser(users, c)
 	})
 	r.GET("/refresh", func(c *gin.Context) {
-		postgresdb.Refresh(c)
+		refresh(c)
 	})
+	r.POST("/refresh", func(c *gin.Context) {
+		refresh(c)
+	})
+}
+
+func addDocsRoutes(r *gin.Engine) {
+	r.GET("/openapi.json", openapi.ServeSpec)
+	r.GET("/docs", openapi.ServeDocs)
+	r.GET("/docs/assets/:file", openapi.ServeDocsAsset)
 }
 
-func addProtectedUserRoutes(r *gin.RouterGroup, db *sql.DB) {
+func addProtectedUserRoutes(r *gin.RouterGroup, users store.UserStore) {
 
 	r.GET("/users", func(c *gin.Context) {
-		postgresdb.GetUsers(db, c)
+		getUsers(users, c)
 	})
 	r.GET("/users/:id", func(c *gin.Context) {
-		postgresdb.GetUserByID(db, c)
+		getUserByID(users, c)
 	})
 	r.PUT("/users", func(c *gin.Context) {
-		postgresdb.UpdateUser(db, c)
+		updateUser(users, c)
 	})
 	r.DELETE("/users/:id", func(c *gin.Context) {
-		postgresdb.DeleteUserByID(db, c)
+		deleteUserByID(users, c)
+	})
+	r.PUT("/users/:id/quota", requireAdmin(users), func(c *gin.Context) {
+		setUserQuota(users, c)
 	})
 }
 
-func addMessageRoutes(r *gin.RouterGroup, db *sql.DB) {
+func addMessageRoutes(r *gin.RouterGroup, messages store.MessageStore, channels store.ChannelStore, users store.UserStore,
+	attachments store.AttachmentStore, moderation moderation, assistant *ai.Assistant, indexer *ai.Indexer) {
 	r.POST("/messages", func(c *gin.Context) {
-		postgresdb.CreateMessage(db, c)
+		createMessage(messages, channels, users, attachments, moderation, assistant, indexer, c)
 	})
 	r.GET("/messages", func(c *gin.Context) {
-		postgresdb.GetMessages(db, c)
+		getMessages(messages, c)
 	})
 	r.GET("/messages/:id", func(c *gin.Context) {
-		postgresdb.GetMessageById(db, c)
+		getMessageByID(messages, c)
 	})
 	r.PUT("/messages/:id", func(c *gin.Context) {
-		postgresdb.UpdateMessageByID(db, c)
+		updateMessageByID(messages, channels, users, attachments, moderation, indexer, c)
 	})
 	r.DELETE("/messages/:id", func(c *gin.Context) {
-		postgresdb.DeleteMessageByID(db, c)
+		deleteMessageByID(messages, channels, users, c)
+	})
+}
+
+func addModerationRoutes(r *gin.RouterGroup, users store.UserStore, messages store.MessageStore, channels store.ChannelStore) {
+	r.GET("/moderation/queue", requireModerator(users), func(c *gin.Context) {
+		getModerationQueue(messages, channels, c)
+	})
+	r.POST("/moderation/queue/:id", requireModerator(users), func(c *gin.Context) {
+		reviewMessage(messages, c)
 	})
 }
 
-func addAWSRoutes(r *gin.RouterGroup, s3Client *s3.Client) {
+func addAWSRoutes(r *gin.RouterGroup, blobs awservice.BlobStore, attachments store.AttachmentStore, uploads store.UploadSessionStore, worker *awservice.AttachmentWorker, policy *awservice.UploadPolicy, quotas *awservice.Quotas) {
 	r.POST("/upload", func(c *gin.Context) {
-		awservice.UploadFileToS3(s3Client, c)
+		awservice.UploadFile(blobs, attachments, worker, policy, quotas, c)
+	})
+	r.GET("/attachments/:id", func(c *gin.Context) {
+		getAttachmentByID(attachments, c)
+	})
+	r.DELETE("/attachments/:id", func(c *gin.Context) {
+		awservice.DeleteAttachment(blobs, attachments, c)
+	})
+	r.GET("/me/storage", func(c *gin.Context) {
+		getStorageUsage(quotas, c)
+	})
+	r.GET("/download/:id", func(c *gin.Context) {
+		awservice.DownloadFile(blobs, attachments, c)
+	})
+	r.GET("/attachments/:id/content", func(c *gin.Context) {
+		awservice.ServeAttachment(blobs, attachments, c)
+	})
+	r.POST("/uploads", func(c *gin.Context) {
+		awservice.CreateUpload(blobs, attachments, policy, quotas, c)
+	})
+	r.POST("/uploads/:id/complete", func(c *gin.Context) {
+		awservice.CompleteUpload(blobs, attachments, worker, c)
 	})
-	r.GET("/download/:filename", func(c *gin.Context) {
-		awservice.DownloadFileFromS3(s3Client, c)
+	r.POST("/uploads/resumable", func(c *gin.Context) {
+		awservice.CreateResumableUpload(blobs, uploads, attachments, policy, quotas, c)
+	})
+	r.HEAD("/uploads/resumable/:id", func(c *gin.Context) {
+		awservice.ResumableUploadOffset(uploads, c)
+	})
+	r.PATCH("/uploads/resumable/:id", func(c *gin.Context) {
+		awservice.AppendResumableUpload(blobs, uploads, attachments, worker, c)
+	})
+	r.DELETE("/uploads/resumable/:id", func(c *gin.Context) {
+		awservice.CancelResumableUpload(blobs, uploads, attachments, c)
 	})
 }
 
-func addChannelRoutes(r *gin.RouterGroup, db *sql.DB) {
+func addChannelRoutes(r *gin.RouterGroup, channels store.ChannelStore, users store.UserStore, assistant *ai.Assistant) {
 	r.POST("/channels", func(c *gin.Context) {
-		postgresdb.CreateChannel(db, c)
+		createChannel(channels, users, assistant, c)
 	})
 	r.GET("/channels", func(c *gin.Context) {
-		postgresdb.GetChannels(db, c)
+		getChannels(channels, c)
 	})
 	r.GET("/channels/:id", func(c *gin.Context) {
-		postgresdb.GetChannelByID(db, c)
+		getChannelByID(channels, c)
 	})
 	r.PUT("/channels/:id", func(c *gin.Context) {
-		postgresdb.UpdateChannelByID(db, c)
+		updateChannelByID(channels, users, assistant, c)
 	})
 	r.DELETE("/channels/:id", func(c *gin.Context) {
-		postgresdb.DeleteChannelByID(db, c)
+		deleteChannelByID(channels, users, c)
+	})
+	r.POST("/channels/:id/members", func(c *gin.Context) {
+		addChannelMember(channels, users, c)
+	})
+	r.DELETE("/channels/:id/members/:userID", func(c *gin.Context) {
+		removeChannelMember(channels, users, c)
+	})
+	r.PUT("/channels/:id/read", func(c *gin.Context) {
+		markChannelRead(channels, users, c)
 	})
 }
 
-func addProtectedOpenAIRoutes(r *gin.RouterGroup, openaiClient *openai.Client) {
-	r.POST("/ask", func(c *gin.Context) {
-		ai.QueryOpenAI(openaiClient, c)
+func addProtectedOpenAIRoutes(r *gin.RouterGroup, provider ai.ChatProvider, chat *ai.ChatSettings, embedder ai.Embedder,
+	meter *ai.Meter, stores store.Stores) {
+	conversations := stores.Conversations
+	budget := ai.RequireBudget(meter)
+	r.POST("/ask", budget, func(c *gin.Context) {
+		ai.QueryOpenAI(provider, chat, c)
+	})
+	r.POST("/conversations", func(c *gin.Context) {
+		ai.CreateConversation(conversations, c)
+	})
+	r.GET("/conversations", func(c *gin.Context) {
+		ai.ListConversations(conversations, c)
+	})
+	r.GET("/conversations/:id", func(c *gin.Context) {
+		ai.GetConversation(conversations, c)
+	})
+	r.DELETE("/conversations/:id", func(c *gin.Context) {
+		ai.DeleteConversation(conversations, c)
+	})
+	r.POST("/conversations/:id/messages", budget, func(c *gin.Context) {
+		ai.SendTurn(provider, chat, conversations, c)
+	})
+	r.POST("/channels/:id/summary", budget, func(c *gin.Context) {
+		ai.SummarizeChannel(provider, chat, stores.Users, stores.Channels, stores.Summaries, c)
+	})
+	r.GET("/search/semantic", func(c *gin.Context) {
+		ai.SearchMessages(embedder, stores.Users, stores.Embeddings, c)
+	})
+	r.GET("/me/ai-usage", func(c *gin.Context) {
+		ai.GetUsage(meter, c)
 	})
 }
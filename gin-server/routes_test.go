@@ -0,0 +1,33 @@
+package ginserver
+
+import (
+	"strings"
+	"testing"
+
+	"crispy-doodle/main.go/openapi"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEveryRouteIsInOpenAPISpec(t *testing.T) {
+	router := newHarness(t, store.NewMemory().Stores()).router.(*gin.Engine)
+	spec := openapi.Spec()
+
+	registered := map[string]bool{}
+	for _, route := range router.Routes() {
+		path := openapi.PathFromRoute(route.Path)
+		registered[strings.ToLower(route.Method)+" "+path] = true
+		if _, ok := spec.Operation(route.Method, route.Path); !ok {
+			t.Errorf("%s %s is registered but missing from openapi.json", route.Method, path)
+		}
+	}
+
+	for path, item := range spec.Paths {
+		for method := range item {
+			if !registered[method+" "+path] {
+				t.Errorf("%s %s is in openapi.json but not registered", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
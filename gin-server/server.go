@@ -1,50 +1,241 @@
 package ginserver
 
 import (
-	"database/sql"
-	"log"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"runtime"
 	"time"
 
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/auth"
 	"crispy-doodle/main.go/awservice"
+	"crispy-doodle/main.go/global"
+	"crispy-doodle/main.go/logging"
 	openai "crispy-doodle/main.go/open-ai"
+	"crispy-doodle/main.go/openapi"
 	postgresdb "crispy-doodle/main.go/postgres-db"
+	"crispy-doodle/main.go/store"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
 )
 
-var db *sql.DB
-
 func StartGinServer() {
 
-	// connect to AWS
-	cfg := awservice.StartAws()
+	logger := global.Load(os.Stdout)
+
+	// connect to blob storage
+	blobs := connectBlobStore(logger)
 
-	// connect to AWS S3
-	s3Client := awservice.ConnectS3(cfg)
+	// connecting to the chat model
+	ai, err := openai.NewProvider(global.AIProvider, global.AIBaseURL, global.OpenAIKey, logger)
+	if err != nil {
+		logger.Error("error connecting to the AI provider", "error", err)
+		os.Exit(1)
+	}
+	embedder, err := openai.NewEmbedder(global.AIProvider, global.AIBaseURL, global.OpenAIKey, global.AIEmbeddingModel)
+	if err != nil {
+		logger.Error("error connecting to the embedding model", "error", err)
+		os.Exit(1)
+	}
+	chat, err := openai.ParseChatSettings(global.AIModel, global.AIModels, global.AITemperature, global.AIMaxTokens, global.AIContextTokens)
+	if err != nil {
+		logger.Error("invalid AI settings", "error", err)
+		os.Exit(1)
+	}
 
-	// connecting to OpenAI
-	ai := openai.OpenAI()
-	if ai == nil {
-		log.Fatal("Error connecting to OpenAI")
+	rules, err := openai.ParseModerationRules(global.ModerationRules)
+	if err != nil {
+		logger.Error("invalid MODERATION_RULES", "error", err)
+		os.Exit(1)
+	}
+	moderator, err := openai.NewModerator(global.ModerationProvider, global.OpenAIKey, rules, logger)
+	if err != nil {
+		logger.Error("error setting up moderation", "error", err)
+		os.Exit(1)
+	}
+
+	budgets, err := openai.ParseRoleBudgets(global.AIBudgets)
+	if err != nil {
+		logger.Error("invalid AI_BUDGETS", "error", err)
+		os.Exit(1)
+	}
+	prices, err := openai.ParseModelPrices(global.AIPrices)
+	if err != nil {
+		logger.Error("invalid AI_PRICES", "error", err)
+		os.Exit(1)
 	}
 
-	// connecting to Postgres
-	db := postgresdb.ConnectPSQL(db)
-	err := db.Ping()
+	// connecting to the data store
+	stores, closeStores := connectStores(logger)
+	defer closeStores()
+	meter := openai.NewMeter(stores.AIUsage, stores.Users, budgets, prices, logger)
+
+	awservice.StartUploadJanitor(context.Background(), blobs, stores.Uploads, stores.Attachments, global.UploadSessionTTL, logger)
+	if global.GCInterval > 0 {
+		awservice.StartGarbageCollector(context.Background(), blobs, stores.Attachments, stores.Messages, stores.Uploads,
+			global.GCInterval, global.GCGrace, !global.GCDelete, logger)
+	}
+	policy, err := awservice.ParseUploadPolicy(global.UploadAllowedTypes)
+	if err != nil {
+		logger.Error("invalid UPLOAD_ALLOWED_TYPES", "error", err)
+		os.Exit(1)
+	}
+	var scanner awservice.Scanner
+	if global.ClamdAddress != "" {
+		maxSize := int64(awservice.DefaultClamdMaxSize)
+		if global.ClamdMaxSize != "" {
+			if maxSize, err = awservice.ParseSize(global.ClamdMaxSize); err != nil {
+				logger.Error("invalid CLAMD_MAX_SIZE", "error", err)
+				os.Exit(1)
+			}
+		}
+		clamd, err := awservice.NewClamdScanner(global.ClamdAddress, maxSize)
+		if err != nil {
+			logger.Error("invalid CLAMD_ADDRESS", "error", err)
+			os.Exit(1)
+		}
+		scanner = clamd
+		if global.ClamdAllowUnscanned {
+			logger.Warn("CLAMD_ALLOW_UNSCANNED is set, files over CLAMD_MAX_SIZE will be served unscanned")
+		}
+	} else {
+		logger.Warn("CLAMD_ADDRESS is not set, uploads will not be scanned for malware")
+	}
+	quotas, err := awservice.ParseRoleQuotas(global.StorageQuotas)
 	if err != nil {
-		log.Fatal("Error connecting to the database:", err)
+		logger.Error("invalid STORAGE_QUOTAS", "error", err)
+		os.Exit(1)
+	}
+	worker := awservice.NewAttachmentWorker(blobs, stores.Attachments, scanner, logger)
+	worker.AllowUnscanned = global.ClamdAllowUnscanned
+	worker.Start(context.Background(), runtime.NumCPU())
+
+	limits := openai.DefaultAssistantLimits()
+	limits.PerUser, limits.PerChannel = global.AIBotUserLimit, global.AIBotChannelLimit
+	assistant := openai.NewAssistant(ai, meter, chat, stores, global.AIBotName, limits, logger)
+	if err := assistant.EnsureUser(context.Background()); err != nil {
+		logger.Error("error creating the assistant's account", "error", err)
+		os.Exit(1)
 	}
-	defer db.Close()
+	assistant.Start(context.Background(), 2)
+	indexer := openai.NewIndexer(embedder, stores.Messages, stores.Embeddings, logger)
+	indexer.Start(context.Background(), 2)
 
-	postgresdb.CreateUsersTable(db)
+	s := &http.Server{
+		Addr: ":8080",
+		Handler: NewRouter(Deps{
+			Logger: logger,
+			Stores: stores,
+			Blobs:  blobs,
+			Worker: worker,
+			Policy: policy,
+			Quotas: quotas,
+			AI:     ai,
+			Chat:   chat,
+			Meter:  meter,
+
+			Assistant: assistant,
+			Embedder:  embedder,
+			Indexer:   indexer,
+
+			Moderator:        moderator,
+			ModerationPolicy: global.ModerationPolicy,
+		}),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 0,
+	}
+
+	logger.Info("gin server listening", "addr", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		logger.Error("gin server stopped", "error", err)
+	}
+}
+
+// Deps are the services the router is built from. StartGinServer wires the
+// real ones; tests pass fakes.
+type Deps struct {
+	Logger *slog.Logger
+	Stores store.Stores
+	Blobs  awservice.BlobStore
+	// Worker scans uploads and processes images; when nil attachments are
+	// ready as uploaded.
+	Worker *awservice.AttachmentWorker
+	// Policy restricts upload types and sizes, DefaultUploadPolicy when nil.
+	Policy *awservice.UploadPolicy
+	// Quotas are the storage quotas per role, DefaultRoleQuotas when nil.
+	Quotas map[string]int64
+	AI     openai.ChatProvider
+	// Chat are the model defaults and limits, DefaultChatSettings when nil.
+	Chat *openai.ChatSettings
+	// Meter records AI's usage and holds users to their token budgets; when
+	// nil DefaultRoleBudgets and DefaultModelPrices apply.
+	Meter *openai.Meter
+	// Assistant answers mentions in channels; when nil nobody does.
+	Assistant *openai.Assistant
+	// Embedder embeds semantic search queries, FakeEmbedder when nil.
+	Embedder openai.Embedder
+	// Indexer embeds messages as they are written; when nil only a
+	// backfill does.
+	Indexer *openai.Indexer
+	// Moderator checks messages as they are written; when nil nothing is
+	// moderated.
+	Moderator openai.Moderator
+	// ModerationPolicy applies to channels without a policy of their own,
+	// store.PolicyFlag when empty.
+	ModerationPolicy string
+}
+
+// NewRouter builds the gin engine with every route registered.
+func NewRouter(deps Deps) *gin.Engine {
+	logger := deps.Logger
+	stores := deps.Stores
+	policy := deps.Policy
+	if policy == nil {
+		policy = awservice.DefaultUploadPolicy()
+	}
+	chat := deps.Chat
+	if chat == nil {
+		chat = openai.DefaultChatSettings()
+	}
+	moderation := moderation{moderator: deps.Moderator, policy: deps.ModerationPolicy}
+	if moderation.policy == "" {
+		moderation.policy = store.PolicyFlag
+	}
+	meter := deps.Meter
+	if meter == nil {
+		meter = openai.NewMeter(stores.AIUsage, stores.Users, nil, nil, logger)
+	}
+	embedder := deps.Embedder
+	if embedder == nil {
+		embedder = openai.FakeEmbedder{}
+	}
+	if deps.Assistant != nil {
+		deps.Assistant.Post = func(ctx context.Context, channel *store.Channel, message *store.Message) error {
+			return postMessage(stores.Messages, stores.Channels, moderation, deps.Indexer, channel, message, ctx)
+		}
+	}
 
-	// creating gin server
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
-	protected := router.Group("/api")
-	protected.Use(postgresdb.JWTMiddleware())
+	router := gin.New()
+	router.ContextWithFallback = true
+	router.HandleMethodNotAllowed = true
+	router.Use(logging.Middleware(logger), gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		apierror.Abort(c, apierror.Internal(fmt.Errorf("panic: %v", recovered)))
+	}))
+	router.NoRoute(func(c *gin.Context) {
+		apierror.Abort(c, apierror.New(http.StatusNotFound, apierror.CodeRouteNotFound, "Route not found"))
+	})
+	router.NoMethod(func(c *gin.Context) {
+		apierror.Abort(c, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllow, "Method not allowed"))
+	})
+	public := router.Group("/", openapi.Validator())
+	protected := router.Group("/api", auth.JWTMiddleware(), openapi.Validator())
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"msg": "crispy-doodle",
@@ -58,21 +249,80 @@ func StartGinServer() {
 			"server":   "Gin server running",
 		})
 	})
-	s := &http.Server{
-		Addr:           ":8080",
-		Handler:        router,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 0,
+
+	addDocsRoutes(router)
+	addOpenUserRoutes(public, stores.Users)
+	addProtectedUserRoutes(protected, stores.Users)
+	addChannelRoutes(protected, stores.Channels, stores.Users, deps.Assistant)
+	addMessageRoutes(protected, stores.Messages, stores.Channels, stores.Users, stores.Attachments, moderation, deps.Assistant,
+		deps.Indexer)
+	addModerationRoutes(protected, stores.Users, stores.Messages, stores.Channels)
+	addAWSRoutes(protected, deps.Blobs, stores.Attachments, stores.Uploads, deps.Worker, policy,
+		awservice.NewQuotas(stores.Users, stores.Attachments, deps.Quotas))
+	if local, ok := deps.Blobs.(*awservice.LocalStore); ok {
+		router.GET(awservice.LocalRoute+"/*key", local.ServeSigned)
+		router.PUT(awservice.LocalRoute+"/*key", local.ServePut)
+	}
+	addProtectedOpenAIRoutes(protected, meter.Wrap(deps.AI), chat, embedder, meter, stores)
+
+	return router
+}
+
+// connectStores opens the data store picked by DATA_STORE. The returned
+// func closes it.
+func connectStores(logger *slog.Logger) (store.Stores, func()) {
+	switch global.DataStore {
+	case "memory":
+		logger.Warn("using the in-memory data store, nothing will be persisted")
+		return store.NewMemory().Stores(), func() {}
+	default:
+		db := postgresdb.ConnectPSQL(logger)
+		err := postgresdb.Migrate(db)
+		if errors.Is(err, postgresdb.ErrNoPGVector) {
+			logger.Warn("semantic search is unavailable", "error", err)
+		} else if err != nil {
+			logger.Error("error creating tables", "error", err)
+			os.Exit(1)
+		}
+		return postgresdb.NewStore(db).Stores(), func() { db.Close() }
 	}
+}
 
-	addOpenUserRoutes(router, db)
-	addProtectedUserRoutes(protected, db)
-	addChannelRoutes(protected, db)
-	addMessageRoutes(protected, db)
-	addAWSRoutes(protected, s3Client)
-	addProtectedOpenAIRoutes(protected, ai)
+// connectBlobStore builds the storage backend chosen by STORAGE_BACKEND,
+// encrypting it when ENCRYPTION_KEYS is set.
+func connectBlobStore(logger *slog.Logger) awservice.BlobStore {
+	blobs := connectBackend(logger)
+	if global.EncryptionKeys == "" {
+		return blobs
+	}
+	keys, err := awservice.ParseKeyRing(global.EncryptionKeys)
+	if err != nil {
+		logger.Error("invalid ENCRYPTION_KEYS", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("encrypting blobs at rest")
+	return awservice.NewEncryptedStore(blobs, keys)
+}
 
-	log.Println("[CONNECTED] Gin server on :8080")
-	s.ListenAndServe()
+func connectBackend(logger *slog.Logger) awservice.BlobStore {
+	switch global.StorageBackend {
+	case "local":
+		key := []byte(global.StorageSigningKey)
+		if len(key) == 0 {
+			logger.Warn("STORAGE_SIGNING_KEY is not set, download links will not survive a restart")
+			key = make([]byte, 32)
+			rand.Read(key)
+		}
+		local, err := awservice.NewLocalStore(global.StorageLocalDir, global.PublicURL, key)
+		if err != nil {
+			logger.Error("error opening local blob store", "dir", global.StorageLocalDir, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("storing blobs on local disk", "dir", global.StorageLocalDir)
+		return local
+	default:
+		cfg := awservice.StartAws(logger)
+		s3Client := awservice.ConnectS3(cfg, global.StorageEndpoint, logger)
+		return awservice.NewS3Store(s3Client, global.AwsBucket)
+	}
 }
@@ -0,0 +1,279 @@
+package ginserver
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/auth"
+	"crispy-doodle/main.go/global"
+	"crispy-doodle/main.go/logging"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// unknown emails and wrong passwords are deliberately indistinguishable
+var invalidCredentials = apierror.New(http.StatusUnauthorized, apierror.CodeInvalidLogin, "Invalid email or password")
+
+func registerUser(users store.UserStore, c *gin.Context) {
+	var user store.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+
+	hashedPassword, err := auth.HashedPassword(user.Password)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	user.ID = store.NewUserID(user.Email)
+	user.Password = hashedPassword
+	user.Role = store.RoleUser
+	if slices.Contains(global.AdminEmails, user.Email) {
+		user.Role = store.RoleAdmin
+	} else if slices.Contains(global.ModeratorEmails, user.Email) {
+		user.Role = store.RoleModerator
+	}
+	// membership, presence and quotas are the server's to grant
+	user.Channels, user.Online, user.Quota = []string{}, false, nil
+
+	if err := users.CreateUser(c, &user); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+
+	logging.FromContext(c).Info("user registered", "user_id", user.ID)
+	c.JSON(http.StatusCreated, gin.H{"message": "User created!"})
+}
+
+func login(users store.UserStore, c *gin.Context) {
+	logger := logging.FromContext(c)
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+
+	user, err := users.GetUserByEmail(c, req.Email)
+	if errors.Is(err, store.ErrNotFound) {
+		logger.Info("login for unknown email", "email", req.Email)
+		apierror.Abort(c, invalidCredentials)
+		return
+	} else if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	logger = logger.With("user_id", user.ID)
+
+	if !auth.CheckPasswordHash(req.Password, user.Password) {
+		logger.Info("password verification failed")
+		apierror.Abort(c, invalidCredentials)
+		return
+	}
+
+	access, refresh, err := auth.GenerateTokens(user.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	logger.Info("login succeeded")
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Login Success",
+		"token":        access,
+		"refreshToken": refresh,
+		"user":         publicUser(*user),
+	})
+}
+
+func refresh(c *gin.Context) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.RefreshToken == "" {
+		apierror.Abort(c, apierror.BadRequest("Missing refresh token"))
+		return
+	}
+
+	claims, err := auth.ValidateToken(body.RefreshToken, true)
+	if err != nil {
+		apierror.Abort(c, apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid refresh token").Wrap(err))
+		return
+	}
+
+	newAccess, _, err := auth.GenerateTokens(claims.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"access_token": newAccess})
+}
+
+func getUsers(users store.UserStore, c *gin.Context) {
+	list, err := users.ListUsers(c)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	for i := range list {
+		list[i] = publicUser(list[i])
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getUserByID(users store.UserStore, c *gin.Context) {
+	user, err := users.GetUser(c, c.Param("id"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	c.JSON(http.StatusOK, publicUser(*user))
+}
+
+// updateUser replaces the caller's own profile. Channel memberships are
+// the server's to change, so the body may only repeat them.
+func updateUser(users store.UserStore, c *gin.Context) {
+	var user store.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if err := selfOrAdmin(users, user.ID, "You can only update your own account", c); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	current, err := users.GetUser(c, user.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if user.Channels != nil && !slices.Equal(user.Channels, current.Channels) {
+		apierror.Abort(c, apierror.BadRequest("Join channels through /api/channels/{id}/members"))
+		return
+	}
+
+	// an omitted password keeps the current one
+	if user.Password == "" {
+		user.Password = current.Password
+	} else {
+		hashedPassword, err := auth.HashedPassword(user.Password)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		user.Password = hashedPassword
+	}
+
+	if err := users.UpdateUser(c, &user); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+
+	logging.FromContext(c).Info("user updated", "target_user_id", user.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "User updated!"})
+}
+
+func deleteUserByID(users store.UserStore, c *gin.Context) {
+	id := c.Param("id")
+	if err := selfOrAdmin(users, id, "You can only delete your own account", c); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	if err := users.DeleteUser(c, id); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+
+	logging.FromContext(c).Info("user deleted", "target_user_id", id)
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted!"})
+}
+
+// selfOrAdmin lets the caller act on the account id only if it is their
+// own or they are an admin, and returns the error to answer otherwise.
+func selfOrAdmin(users store.UserStore, id, denied string, c *gin.Context) error {
+	callerID := c.GetString("userID")
+	if id == callerID {
+		return nil
+	}
+	caller, err := users.GetUser(c, callerID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return apierror.Internal(err)
+	}
+	if err != nil || caller.Role != store.RoleAdmin {
+		return apierror.Forbidden(denied)
+	}
+	return nil
+}
+
+// requireAdmin lets only users with the admin role through.
+func requireAdmin(users store.UserStore) gin.HandlerFunc {
+	return requireRole(users, "Admins only", store.RoleAdmin)
+}
+
+// requireModerator lets moderators and admins through.
+func requireModerator(users store.UserStore) gin.HandlerFunc {
+	return requireRole(users, "Moderators only", store.RoleModerator, store.RoleAdmin)
+}
+
+func requireRole(users store.UserStore, denied string, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := users.GetUser(c, c.GetString("userID"))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		if err != nil || !slices.Contains(roles, user.Role) {
+			apierror.Abort(c, apierror.Forbidden(denied))
+			return
+		}
+		c.Next()
+	}
+}
+
+// setUserQuota gives a user its own storage quota in bytes, or with a null
+// quota puts it back on its role's.
+func setUserQuota(users store.UserStore, c *gin.Context) {
+	var body struct {
+		Quota *int64 `json:"quota"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	if body.Quota != nil && *body.Quota < 0 {
+		apierror.Abort(c, apierror.BadRequest("Quota must not be negative"))
+		return
+	}
+
+	id := c.Param("id")
+	if err := users.SetUserQuota(c, id, body.Quota); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	user, err := users.GetUser(c, id)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+
+	logging.FromContext(c).Info("user quota set", "target_user_id", id, "quota", body.Quota)
+	c.JSON(http.StatusOK, publicUser(*user))
+}
+
+// publicUser strips the password hash before a user is serialized.
+func publicUser(user store.User) store.User {
+	user.Password = ""
+	if user.Channels == nil {
+		user.Channels = []string{}
+	}
+	return user
+}
@@ -1,12 +1,22 @@
 package global
 
 import (
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"crispy-doodle/main.go/logging"
 
 	"github.com/joho/godotenv"
 )
 
+// DataStore selects the repository backend, postgres (default) or memory.
+var DataStore string
+
 var PostgresUser string
 var PostgresPassword string
 var PostgresDBName string
@@ -15,47 +25,215 @@ var PostgresPort string
 
 var OpenAIKey string
 
+// AIProvider is the chat model backend: openai (the default), compatible
+// for the OpenAI API at AIBaseURL, or fake.
+var AIProvider string
+var AIBaseURL string
+
+// AIModel is the default model and AIModels the comma separated others a
+// request may choose, from AI_MODEL (default gpt-4) and AI_MODELS.
+var AIModel string
+var AIModels string
+
+// AITemperature is the default temperature, from AI_TEMPERATURE (default
+// 0.7). AIMaxTokens caps answers, from AI_MAX_TOKENS (default unlimited).
+var AITemperature float32
+var AIMaxTokens int
+
+// AIBotName is what the assistant is called and answers to as @name in
+// channels, from AI_BOT_NAME (default assistant). AIBotUserLimit and
+// AIBotChannelLimit are how many mentions it answers an hour per user and
+// per channel, from AI_BOT_USER_LIMIT (default 10) and AI_BOT_CHANNEL_LIMIT
+// (default 60).
+var AIBotName string
+var AIBotUserLimit int
+var AIBotChannelLimit int
+
+// AIContextTokens is how many tokens of conversation history are sent with
+// each turn, from AI_CONTEXT_TOKENS (default 4000).
+var AIContextTokens int
+
+// AIBudgets overrides the per role daily and monthly token budgets, e.g.
+// "user=50000/1000000,admin=unlimited", from AI_BUDGETS. AIPrices adds or
+// overrides model prices in dollars per million prompt and completion
+// tokens, e.g. "gpt-4o=2.5/10", from AI_PRICES.
+var AIBudgets string
+var AIPrices string
+
+// AIEmbeddingModel embeds messages for semantic search, from
+// AI_EMBEDDING_MODEL (default text-embedding-3-small).
+var AIEmbeddingModel string
+
+var TokenSecret string
+var RefreshTokenSecret string
+
+// LogLevel is one of debug, info, warn or error, defaulting to info.
+var LogLevel string
+
+// AdminEmails are given the admin role when they register, from the comma
+// separated ADMIN_EMAILS.
+var AdminEmails []string
+
+// ModeratorEmails are given the moderator role when they register, from the
+// comma separated MODERATOR_EMAILS.
+var ModeratorEmails []string
+
+// ModerationProvider checks messages as they are written: openai, rules, or
+// empty (the default) to not moderate, from MODERATION_PROVIDER.
+// ModerationRules are the comma separated category:term pairs of the rules
+// provider, which OpenAI's falls back to, from MODERATION_RULES.
+var ModerationProvider string
+var ModerationRules string
+
+// ModerationPolicy is what becomes of flagged messages in channels that set
+// no policy and outside channels: allow, flag (the default) or block, from
+// MODERATION_POLICY.
+var ModerationPolicy string
+
 var AwsAccessKey string
 var AwsSecretKey string
 var AwsRegion string
 var AwsBucket string
 
+// StorageBackend is s3 (default), minio for any S3 compatible endpoint, or
+// local for files on disk.
+var StorageBackend string
+var StorageEndpoint string
+var StorageLocalDir string
+var StorageSigningKey string
+
+// PublicURL is the externally visible base URL of this server.
+var PublicURL string
+
+// UploadSessionTTL is how long a resumable upload may sit idle before it is
+// discarded, from UPLOAD_SESSION_TTL (default 24h).
+var UploadSessionTTL time.Duration
+
+// GCInterval is how often unreferenced attachments and objects are
+// collected, from GC_INTERVAL (default 6h, 0 to only run it by hand).
+var GCInterval time.Duration
+
+// GCGrace is how old an unreferenced attachment or object must be before it
+// is collected, from GC_GRACE (default 72h).
+var GCGrace time.Duration
+
+// GCDelete lets the background garbage collector delete what it finds,
+// from GC_DELETE. Until an operator sets it, it only reports.
+var GCDelete bool
+
+// UploadAllowedTypes is the allowlist of upload content types with optional
+// size limits, e.g. "image/jpeg=10MiB,image/png". Empty allows every type
+// the server recognises at its default limit.
+var UploadAllowedTypes string
+
+// ClamdAddress is the ClamAV daemon uploads are scanned with, e.g.
+// tcp://clamav:3310. Uploads are not scanned when it is empty.
+var ClamdAddress string
+
+// ClamdMaxSize is the largest file sent to clamd, e.g. "2GiB", from
+// CLAMD_MAX_SIZE. Empty means clamd's default StreamMaxLength of 25 MiB;
+// raise both together.
+var ClamdMaxSize string
+
+// ClamdAllowUnscanned lets files over ClamdMaxSize through unscanned,
+// from CLAMD_ALLOW_UNSCANNED. By default they are marked failed.
+var ClamdAllowUnscanned bool
+
+// EncryptionKeys turns on encryption at rest for blob storage: comma
+// separated base64 encoded 32 byte master keys, the current one first.
+var EncryptionKeys string
+
+// StorageQuotas overrides the per role storage quotas, e.g.
+// "user=2GiB,admin=unlimited".
+var StorageQuotas string
+
+// envFileErr is why no .env file was loaded, logged once Load has set up
+// logging.
+var envFileErr error
+
 func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	// a missing .env is fine when the environment is set by the container
+	envFileErr = godotenv.Load()
+
+	TokenSecret = os.Getenv("TOKEN_SECRET")
+	RefreshTokenSecret = os.Getenv("REFRESH_TOKEN_SECRET")
+}
+
+// Load reads and checks the environment the server needs, exiting when a
+// required variable is missing. It first sets up the JSON logger writing to
+// w at LOG_LEVEL, makes it the default and returns it, so everything logged
+// from here on is redacted.
+func Load(w io.Writer) *slog.Logger {
+	LogLevel = os.Getenv("LOG_LEVEL")
+	logger := logging.New(w, LogLevel)
+	slog.SetDefault(logger)
+	if envFileErr != nil {
+		logger.Debug("no .env file loaded", "error", envFileErr)
 	}
 
-	getPostgresEnvs()
-	getAWSEnvs()
+	DataStore = os.Getenv("DATA_STORE")
+	if DataStore == "" {
+		DataStore = "postgres"
+	}
+	if DataStore == "postgres" {
+		getPostgresEnvs()
+	}
+	getStorageEnvs()
 	getOpenAIEnvs()
 
+	AdminEmails = emailList("ADMIN_EMAILS")
+	ModeratorEmails = emailList("MODERATOR_EMAILS")
+	getModerationEnvs()
+	return logger
+}
+
+func emailList(name string) []string {
+	var emails []string
+	for _, email := range strings.Split(os.Getenv(name), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func getModerationEnvs() {
+	ModerationProvider = os.Getenv("MODERATION_PROVIDER")
+	ModerationRules = os.Getenv("MODERATION_RULES")
+	ModerationPolicy = os.Getenv("MODERATION_POLICY")
+	switch ModerationPolicy {
+	case "":
+		ModerationPolicy = "flag"
+	case "allow", "flag", "block":
+	default:
+		log.Fatalf("MODERATION_POLICY %q is not allow, flag or block", ModerationPolicy)
+	}
 }
 
 func getPostgresEnvs() {
 
 	PostgresPassword = os.Getenv("PSQL_PASSWORD")
 	if PostgresPassword == "" {
-		log.Fatal("PSQL_PASSWORD is not set in .env file")
+		log.Fatal("PSQL_PASSWORD is not set")
 	}
 	PostgresUser = os.Getenv("PSQL_USER")
 	if PostgresUser == "" {
-		log.Fatal("PSQL_USER is not set in .env file")
+		log.Fatal("PSQL_USER is not set")
 	}
 	PostgresDBName = os.Getenv("PSQL_DBNAME")
 	if PostgresDBName == "" {
-		log.Fatal("PSQL_DBNAME is not set in .env file")
+		log.Fatal("PSQL_DBNAME is not set")
 	}
 	PostgresHost = os.Getenv("PSQL_HOST")
 	if PostgresHost == "" {
-		log.Fatal("PSQL_HOST is not set in .env file")
+		log.Fatal("PSQL_HOST is not set")
 	}
 	PostgresPort = os.Getenv("PSQL_PORT")
 	if PostgresPort == "" {
-		log.Fatal("PSQL_PORT is not set in .env file")
+		log.Fatal("PSQL_PORT is not set")
 	}
 
-	log.Println("Postgres Environment Variables Loaded")
+	slog.Info("Postgres environment variables loaded")
 
 }
 
@@ -63,32 +241,165 @@ func getAWSEnvs() {
 
 	AwsAccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
 	if AwsAccessKey == "" {
-		log.Fatal("AWS_ACCESS_KEY_ID is not set in .env file")
+		log.Fatal("AWS_ACCESS_KEY_ID is not set")
 	}
 	AwsSecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	if AwsSecretKey == "" {
-		log.Fatal("AWS_SECRET_ACCESS_KEY is not set in .env file")
+		log.Fatal("AWS_SECRET_ACCESS_KEY is not set")
 	}
 	AwsRegion = os.Getenv("AWS_REGION")
 	if AwsRegion == "" {
-		log.Fatal("AWS_REGION is not set in .env file")
+		log.Fatal("AWS_REGION is not set")
 	}
 	AwsBucket = os.Getenv("AWS_BUCKET")
 	if AwsBucket == "" {
-		log.Fatal("AWS_BUCKET is not set in .env file")
+		log.Fatal("AWS_BUCKET is not set")
+	}
+
+	slog.Info("AWS environment variables loaded")
+
+}
+
+func getStorageEnvs() {
+
+	StorageBackend = os.Getenv("STORAGE_BACKEND")
+	if StorageBackend == "" {
+		StorageBackend = "s3"
+	}
+	PublicURL = os.Getenv("PUBLIC_URL")
+	if PublicURL == "" {
+		PublicURL = "http://localhost:8080"
+	}
+	StorageSigningKey = os.Getenv("STORAGE_SIGNING_KEY")
+	UploadAllowedTypes = os.Getenv("UPLOAD_ALLOWED_TYPES")
+	ClamdAddress = os.Getenv("CLAMD_ADDRESS")
+	ClamdMaxSize = os.Getenv("CLAMD_MAX_SIZE")
+	if allow := os.Getenv("CLAMD_ALLOW_UNSCANNED"); allow != "" {
+		b, err := strconv.ParseBool(allow)
+		if err != nil {
+			log.Fatalf("CLAMD_ALLOW_UNSCANNED %q is not true or false", allow)
+		}
+		ClamdAllowUnscanned = b
+	}
+	StorageQuotas = os.Getenv("STORAGE_QUOTAS")
+	EncryptionKeys = os.Getenv("ENCRYPTION_KEYS")
+
+	UploadSessionTTL = 24 * time.Hour
+	if ttl := os.Getenv("UPLOAD_SESSION_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("UPLOAD_SESSION_TTL %q is not a positive duration", ttl)
+		}
+		UploadSessionTTL = d
+	}
+
+	GCInterval = 6 * time.Hour
+	if interval := os.Getenv("GC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			log.Fatalf("GC_INTERVAL %q is not a duration", interval)
+		}
+		GCInterval = d
+	}
+	GCGrace = 72 * time.Hour
+	if grace := os.Getenv("GC_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d <= 0 {
+			log.Fatalf("GC_GRACE %q is not a positive duration", grace)
+		}
+		GCGrace = d
+	}
+	if gcDelete := os.Getenv("GC_DELETE"); gcDelete != "" {
+		b, err := strconv.ParseBool(gcDelete)
+		if err != nil {
+			log.Fatalf("GC_DELETE %q is not true or false", gcDelete)
+		}
+		GCDelete = b
 	}
 
-	log.Println("AWS Environment Variables Loaded")
+	switch StorageBackend {
+	case "s3":
+		getAWSEnvs()
+	case "minio":
+		StorageEndpoint = os.Getenv("STORAGE_ENDPOINT")
+		if StorageEndpoint == "" {
+			log.Fatal("STORAGE_ENDPOINT is not set")
+		}
+		if os.Getenv("AWS_REGION") == "" {
+			os.Setenv("AWS_REGION", "us-east-1")
+		}
+		getAWSEnvs()
+	case "local":
+		StorageLocalDir = os.Getenv("STORAGE_LOCAL_DIR")
+		if StorageLocalDir == "" {
+			StorageLocalDir = "data/blobs"
+		}
+	default:
+		log.Fatalf("STORAGE_BACKEND %q is not one of s3, minio or local", StorageBackend)
+	}
 
 }
 
 func getOpenAIEnvs() {
 
 	OpenAIKey = os.Getenv("OPENAI_API_KEY")
-	if OpenAIKey == "" {
-		log.Fatal("OPENAI_API_KEY is not set in .env file")
+	AIProvider = os.Getenv("AI_PROVIDER")
+	AIBaseURL = os.Getenv("AI_BASE_URL")
+	if OpenAIKey == "" && (AIProvider == "" || AIProvider == "openai") {
+		log.Fatal("OPENAI_API_KEY is not set")
+	}
+	AIModel = os.Getenv("AI_MODEL")
+	AIModels = os.Getenv("AI_MODELS")
+
+	AITemperature = 0.7
+	if temperature := os.Getenv("AI_TEMPERATURE"); temperature != "" {
+		t, err := strconv.ParseFloat(temperature, 32)
+		if err != nil {
+			log.Fatalf("AI_TEMPERATURE %q is not a number", temperature)
+		}
+		AITemperature = float32(t)
+	}
+	if tokens := os.Getenv("AI_MAX_TOKENS"); tokens != "" {
+		n, err := strconv.Atoi(tokens)
+		if err != nil || n <= 0 {
+			log.Fatalf("AI_MAX_TOKENS %q is not a positive number", tokens)
+		}
+		AIMaxTokens = n
+	}
+
+	AIContextTokens = 4000
+	if tokens := os.Getenv("AI_CONTEXT_TOKENS"); tokens != "" {
+		n, err := strconv.Atoi(tokens)
+		if err != nil || n <= 0 {
+			log.Fatalf("AI_CONTEXT_TOKENS %q is not a positive number", tokens)
+		}
+		AIContextTokens = n
+	}
+
+	AIEmbeddingModel = os.Getenv("AI_EMBEDDING_MODEL")
+	AIBudgets = os.Getenv("AI_BUDGETS")
+	AIPrices = os.Getenv("AI_PRICES")
+
+	AIBotName = os.Getenv("AI_BOT_NAME")
+	if AIBotName == "" {
+		AIBotName = "assistant"
+	}
+	AIBotUserLimit, AIBotChannelLimit = 10, 60
+	if limit := os.Getenv("AI_BOT_USER_LIMIT"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			log.Fatalf("AI_BOT_USER_LIMIT %q is not a positive number", limit)
+		}
+		AIBotUserLimit = n
+	}
+	if limit := os.Getenv("AI_BOT_CHANNEL_LIMIT"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			log.Fatalf("AI_BOT_CHANNEL_LIMIT %q is not a positive number", limit)
+		}
+		AIBotChannelLimit = n
 	}
 
-	log.Println("AI Environment Variables Loaded")
+	slog.Info("AI environment variables loaded")
 
 }
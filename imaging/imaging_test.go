@@ -0,0 +1,232 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testJPEG encodes a small gradient as a baseline JPEG.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// withSegments inserts marker segments right after the SOI of a JPEG.
+func withSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[2:]...)
+}
+
+func segment(marker byte, payload string) []byte {
+	s := binary.BigEndian.AppendUint16([]byte{0xFF, marker}, uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// exifSegment is an APP1 segment whose IFD0 holds only an orientation tag.
+func exifSegment(order binary.AppendByteOrder, orientation uint16) []byte {
+	tiff := []byte("II*\x00")
+	if order == binary.AppendByteOrder(binary.BigEndian) {
+		tiff = []byte("MM\x00*")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = order.AppendUint16(tiff, 0)
+	tiff = order.AppendUint32(tiff, 0)
+	return segment(0xE1, "Exif\x00\x00"+string(tiff))
+}
+
+func TestStripJPEG(t *testing.T) {
+	plain := testJPEG(t)
+	icc := segment(0xE2, "ICC_PROFILE\x00keep me")
+	tagged := withSegments(plain,
+		exifSegment(binary.LittleEndian, 6),
+		segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00GPS 51.5N"),
+		segment(0xED, "Photoshop 3.0\x00GPS 51.5N"),
+		segment(0xFE, "GPS 51.5N"),
+		icc,
+	)
+
+	stripped, err := StripJPEG(tagged)
+	if err != nil {
+		t.Fatalf("StripJPEG: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) || bytes.Contains(stripped, []byte("Exif")) {
+		t.Errorf("metadata survived stripping")
+	}
+	if !bytes.Contains(stripped, icc) {
+		t.Errorf("ICC profile was stripped")
+	}
+	if want := withSegments(plain, icc); !bytes.Equal(stripped, want) {
+		t.Errorf("image data changed: got %d bytes, want %d", len(stripped), len(want))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"not jpeg":  []byte("GIF89a......"),
+		"truncated": withSegments(plain, []byte{0xFF, 0xE1, 0xFF, 0xFF, 'E'})[:8],
+		"no marker": append([]byte{0xFF, 0xD8}, "garbage"...),
+	} {
+		if _, err := StripJPEG(data); err == nil {
+			t.Errorf("%s: StripJPEG accepted corrupt input", name)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := testJPEG(t)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"none", plain, 1},
+		{"little endian", withSegments(plain, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big endian", withSegments(plain, exifSegment(binary.BigEndian, 3)), 3},
+		{"out of range", withSegments(plain, exifSegment(binary.LittleEndian, 9)), 1},
+		{"after other segments", withSegments(plain, segment(0xFE, "hi"), exifSegment(binary.BigEndian, 8)), 8},
+		{"not exif", withSegments(plain, segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00")), 1},
+		{"not jpeg", []byte("\x89PNG"), 1},
+	} {
+		if got := JPEGOrientation(tc.data); got != tc.want {
+			t.Errorf("%s: orientation %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// pngChunk frames data as a PNG chunk with a valid CRC.
+func pngChunk(typ, data string) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(append(c, typ...), data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestStripPNG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.NRGBA{255, 0, 0, 128})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	plain := buf.Bytes()
+	// after IHDR: signature, then 4+4+13+4 bytes
+	ihdrEnd := len(pngSignature) + 25
+	insert := func(chunks ...[]byte) []byte {
+		out := append([]byte{}, plain[:ihdrEnd]...)
+		for _, c := range chunks {
+			out = append(out, c...)
+		}
+		return append(out, plain[ihdrEnd:]...)
+	}
+	gamma := pngChunk("gAMA", "\x00\x00\xb1\x8f")
+	tagged := insert(
+		pngChunk("tEXt", "Comment\x00GPS 51.5N"),
+		pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00GPS 51.5N"),
+		pngChunk("eXIf", "MM\x00*GPS 51.5N"),
+		pngChunk("tIME", "\x07\xe8\x01\x02\x03\x04\x05"),
+		gamma,
+	)
+
+	stripped, err := StripPNG(tagged)
+	if err != nil {
+		t.Fatalf("StripPNG: %v", err)
+	}
+	if want := insert(gamma); !bytes.Equal(stripped, want) {
+		t.Errorf("stripped PNG is %d bytes, want %d with only gAMA added", len(stripped), len(want))
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+
+	badCRC := insert(pngChunk("tEXt", "a\x00b"))
+	badCRC[ihdrEnd+8] ^= 0xFF
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"not png":   testJPEG(t),
+		"bad crc":   badCRC,
+		"truncated": plain[:len(plain)-6],
+	} {
+		if _, err := StripPNG(data); err == nil {
+			t.Errorf("%s: StripPNG accepted corrupt input", name)
+		}
+	}
+}
+
+func decode83(s string) int {
+	v := 0
+	for _, r := range s {
+		v = v*83 + strings.IndexRune(base83, r)
+	}
+	return v
+}
+
+func TestBlurHash(t *testing.T) {
+	solid := func(c color.RGBA) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+		for i := 0; i < len(img.Pix); i += 4 {
+			copy(img.Pix[i:], []uint8{c.R, c.G, c.B, c.A})
+		}
+		return img
+	}
+	gradient := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 32), 0, uint8(255 - y*40), 255})
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		img    *image.RGBA
+		x, y   int
+		length int
+		dc     int // packed sRGB of the average colour, -1 to skip
+	}{
+		{"solid 4x3", solid(color.RGBA{200, 100, 50, 255}), 4, 3, 28, 200<<16 | 100<<8 | 50},
+		{"solid 1x1", solid(color.RGBA{0, 0, 0, 255}), 1, 1, 6, 0},
+		{"components clamped", solid(color.RGBA{255, 255, 255, 255}), 12, 0, 6 + 2*(9*1-1), 0xFFFFFF},
+		{"gradient", gradient, 4, 3, 28, -1},
+	} {
+		hash := BlurHash(tc.img, tc.x, tc.y)
+		if len(hash) != tc.length {
+			t.Errorf("%s: %q has length %d, want %d", tc.name, hash, len(hash), tc.length)
+			continue
+		}
+		x, y := min(max(tc.x, 1), 9), min(max(tc.y, 1), 9)
+		if size := decode83(hash[:1]); size != (x-1)+(y-1)*9 {
+			t.Errorf("%s: size flag %d for %dx%d", tc.name, size, x, y)
+		}
+		if tc.dc >= 0 && decode83(hash[2:6]) != tc.dc {
+			t.Errorf("%s: average colour %06x, want %06x", tc.name, decode83(hash[2:6]), tc.dc)
+		}
+	}
+	if BlurHash(gradient, 4, 3) == BlurHash(solid(color.RGBA{128, 0, 128, 255}), 4, 3) {
+		t.Errorf("a gradient hashes like a solid colour")
+	}
+}
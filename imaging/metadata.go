@@ -0,0 +1,159 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var errCorrupt = errors.New("imaging: corrupt image")
+
+// StripJPEG removes EXIF, XMP, IPTC and comment segments from a JPEG
+// without touching the compressed image data. JFIF (APP0), ICC profiles
+// (APP2) and Adobe colour transform markers (APP14) are kept because they
+// change how the pixels are decoded.
+func StripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, errCorrupt
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA {
+			// start of scan: everything after is entropy coded data
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errCorrupt
+		}
+		if keepJPEGSegment(marker) {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+func keepJPEGSegment(marker byte) bool {
+	switch {
+	case marker == 0xFE: // COM
+		return false
+	case marker >= 0xE0 && marker <= 0xEF: // APPn
+		return marker == 0xE0 || marker == 0xE2 || marker == 0xEE
+	default:
+		return true
+	}
+}
+
+// JPEGOrientation returns the EXIF orientation (1 to 8) of a JPEG, or 1
+// when it has none.
+func JPEGOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if seg := data[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		e := ifd + 2 + n*12
+		if e+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG chunks that carry text, timestamps or EXIF rather than pixels.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true,
+}
+
+// StripPNG drops text, time and EXIF chunks from a PNG, leaving every
+// chunk that affects rendering in place.
+func StripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errCorrupt
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errCorrupt
+		}
+		chunk := data[i:end]
+		typ := string(chunk[4:8])
+		if binary.BigEndian.Uint32(chunk[8+length:]) != crc32.ChecksumIEEE(chunk[4:8+length]) {
+			return nil, errCorrupt
+		}
+		if !pngMetadataChunks[typ] {
+			out.Write(chunk)
+		}
+		i = end
+		if typ == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
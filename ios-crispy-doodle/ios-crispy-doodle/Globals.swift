@@ -15,6 +15,22 @@ struct Global {
         let access_token: String
     }
 
+    /// The server's error envelope, `{"error": {...}}`. Branch on `code`;
+    /// `message` is for display only.
+    struct APIError: Codable, Error {
+        let code: String
+        let message: String
+        let request_id: String?
+    }
+
+    struct APIErrorEnvelope: Codable {
+        let error: APIError
+    }
+
+    static func decodeAPIError(from data: Data) -> APIError? {
+        try? JSONDecoder().decode(APIErrorEnvelope.self, from: data).error
+    }
+
     static func refreshAccessToken(completion: @escaping (Result<String, Error>) async -> Void) {
         guard let refreshToken = UserDefaults.standard.string(forKey: "refreshToken") else {
             Task {
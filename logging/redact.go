@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const redacted = "[REDACTED]"
+
+// words of attribute keys whose values are never written. Keys are split
+// into words, so access_token and apiKey are sensitive but prompt_tokens is
+// not.
+var sensitiveWords = []string{"token", "password", "secret", "authorization", "cookie", "apikey"}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/\-]+=*`)
+)
+
+// Redact is a slog ReplaceAttr func. Attributes with sensitive keys are
+// replaced outright and any email address, bearer token or JWT appearing in
+// a string value (including the message) is masked.
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) || strings.EqualFold(a.Key, "email") {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactString(err.Error()))
+		}
+	}
+	return a
+}
+
+// sensitiveKey reports whether key has a sensitive word, alone or made of
+// two words such as api_key.
+func sensitiveKey(key string) bool {
+	words := keyWords(key)
+	for i, w := range words {
+		if slices.Contains(sensitiveWords, w) || (i > 0 && slices.Contains(sensitiveWords, words[i-1]+w)) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWords splits key into lower case words at anything but letters and
+// digits, and where a lower case letter is followed by an upper case one.
+func keyWords(key string) []string {
+	var words []string
+	start, prev := -1, rune(0)
+	for i, r := range key {
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if start >= 0 && (!alnum || (unicode.IsUpper(r) && unicode.IsLower(prev))) {
+			words = append(words, strings.ToLower(key[start:i]))
+			start = -1
+		}
+		if alnum && start < 0 {
+			start = i
+		}
+		prev = r
+	}
+	if start >= 0 {
+		words = append(words, strings.ToLower(key[start:]))
+	}
+	return words
+}
+
+// RedactString masks emails, bearer tokens and JWTs inside s.
+func RedactString(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	return emailPattern.ReplaceAllString(s, redacted)
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for key, sensitive := range map[string]bool{
+		"token":             true,
+		"access_token":      true,
+		"refreshToken":      true,
+		"X-Api-Key":         true,
+		"api_key":           true,
+		"apiKey":            true,
+		"Authorization":     true,
+		"set-cookie":        true,
+		"db.password":       true,
+		"client_secret":     true,
+		"email":             true,
+		"tokens":            false,
+		"prompt_tokens":     false,
+		"completion_tokens": false,
+		"total_tokens":      false,
+		"max_tokens":        false,
+		"apikeys_rotated":   false,
+		"key":               false,
+		"user":              false,
+	} {
+		if got := Redact(nil, slog.String(key, "value")).Value.String() == redacted; got != sensitive {
+			t.Errorf("%q redacted: %v, want %v", key, got, sensitive)
+		}
+	}
+
+	// token counts survive a logger set up like the server's
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: Redact}))
+	logger.Info("AI usage", "tokens", 42, "prompt_tokens", 30, "token", "abc", "note", "mail bob@example.com")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry %s: %v", buf.Bytes(), err)
+	}
+	if entry["tokens"] != 42.0 || entry["prompt_tokens"] != 30.0 || entry["token"] != redacted ||
+		entry["note"] != "mail "+redacted {
+		t.Errorf("logged %s", buf.Bytes())
+	}
+}
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"os"
+
 	ginserver "crispy-doodle/main.go/gin-server"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			ginserver.RunGarbageCollector(os.Args[2:])
+			return
+		case "rotate-keys":
+			ginserver.RunKeyRotation(os.Args[2:])
+			return
+		case "backfill-embeddings":
+			ginserver.RunEmbeddingBackfill(os.Args[2:])
+			return
+		}
+	}
 	ginserver.StartGinServer()
 }
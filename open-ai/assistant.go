@@ -0,0 +1,267 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"crispy-doodle/main.go/store"
+)
+
+// assistantHistory is how many of a channel's latest messages the assistant
+// reads before answering, fewer when they do not fit in the context budget.
+const assistantHistory = 20
+
+// Outcomes of Assistant.Notice, reported to the sender.
+const (
+	AssistantQueued         = "queued"
+	AssistantRateLimited    = "rate_limited"
+	AssistantBudgetExceeded = "budget_exceeded"
+)
+
+// AssistantLimits bound how many mentions the assistant answers within
+// Window, for each user and for each channel.
+type AssistantLimits struct {
+	PerUser    int
+	PerChannel int
+	Window     time.Duration
+}
+
+// DefaultAssistantLimits answer 10 mentions an hour per user and 60 per
+// channel.
+func DefaultAssistantLimits() AssistantLimits {
+	return AssistantLimits{PerUser: 10, PerChannel: 60, Window: time.Hour}
+}
+
+// PostFunc posts message to channel the way any other message is posted.
+type PostFunc func(ctx context.Context, channel *store.Channel, message *store.Message) error
+
+// Assistant is the bot account that answers mentions in the channels that
+// opt in, from a queue worked through in the background.
+type Assistant struct {
+	// Post posts the assistant's answers, so they are moderated and indexed
+	// like everyone else's messages. When nil they are stored as they are.
+	Post PostFunc
+
+	provider ChatProvider
+	meter    *Meter
+	settings *ChatSettings
+	stores   store.Stores
+	limits   AssistantLimits
+	logger   *slog.Logger
+	name     string
+	mention  *regexp.Regexp
+	queue    chan mention
+
+	mu sync.Mutex
+	// answered holds when recent mentions were answered, by "user:" or
+	// "channel:" and ID
+	answered map[string][]time.Time
+}
+
+type mention struct {
+	channelID string
+	messageID string
+	// callerID is billed for the answer
+	callerID string
+}
+
+// NewAssistant builds the assistant, which goes by name and answers to
+// "@name". Its answers are billed by meter to whoever mentioned it.
+func NewAssistant(provider ChatProvider, meter *Meter, settings *ChatSettings, stores store.Stores, name string, limits AssistantLimits,
+	logger *slog.Logger) *Assistant {
+	return &Assistant{
+		provider: meter.Wrap(provider),
+		meter:    meter,
+		settings: settings,
+		stores:   stores,
+		limits:   limits,
+		logger:   logger,
+		name:     name,
+		mention:  regexp.MustCompile(`(?i)(^|[^\w@])@` + regexp.QuoteMeta(name) + `\b`),
+		queue:    make(chan mention, 256),
+		answered: map[string][]time.Time{},
+	}
+}
+
+// EnsureUser creates the assistant's account when it does not exist yet.
+// It has no password, so nobody can log in as it.
+func (a *Assistant) EnsureUser(ctx context.Context) error {
+	_, err := a.stores.Users.GetUser(ctx, store.AssistantUserID)
+	if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	err = a.stores.Users.CreateUser(ctx, &store.User{
+		ID:       store.AssistantUserID,
+		Name:     a.name,
+		Email:    a.name + "@assistant.invalid",
+		Channels: []string{},
+		Role:     store.RoleBot,
+	})
+	var conflict *store.ConflictError
+	if errors.As(err, &conflict) && conflict.Field == "id" {
+		// another instance got there first
+		return nil
+	}
+	return err
+}
+
+// Start runs workers goroutines answering mentions until ctx is done.
+func (a *Assistant) Start(ctx context.Context, workers int) {
+	for range max(workers, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-a.queue:
+					if err := a.answer(ctx, m); err != nil {
+						a.logger.Error("assistant failed to answer", "channel", m.channelID, "message", m.messageID, "error", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// SyncMembership makes the assistant a member of channel while it opts in,
+// and no longer one once it opts out.
+func (a *Assistant) SyncMembership(ctx context.Context, channel *store.Channel) error {
+	if a == nil {
+		return nil
+	}
+	bot, err := a.stores.Users.GetUser(ctx, store.AssistantUserID)
+	if err != nil {
+		return err
+	}
+	member := slices.Contains(bot.Channels, channel.ID)
+	switch {
+	case channel.Assistant && !member:
+		return a.stores.Users.AddUserChannel(ctx, bot.ID, channel.ID)
+	case !channel.Assistant && member:
+		return a.stores.Users.RemoveUserChannel(ctx, bot.ID, channel.ID)
+	}
+	return nil
+}
+
+// Notice queues an answer when message, posted to channel by callerID,
+// mentions the assistant and the channel opts in. It returns "" when there
+// is nothing to answer, otherwise whether the answer was queued, is over the
+// rate limits or would be over callerID's token budget.
+func (a *Assistant) Notice(ctx context.Context, callerID string, channel *store.Channel, message *store.Message) string {
+	if a == nil || !channel.Assistant || message.AI || !a.mention.MatchString(message.Text) {
+		return ""
+	}
+	over, err := a.overBudget(ctx, callerID)
+	if err != nil {
+		// the message is posted either way; it just goes unanswered
+		a.logger.Error("assistant failed to check the token budget", "user", callerID, "error", err)
+		return ""
+	}
+	if over {
+		return AssistantBudgetExceeded
+	}
+	if !a.allow(callerID, channel.ID) {
+		return AssistantRateLimited
+	}
+	select {
+	case a.queue <- mention{channelID: channel.ID, messageID: message.ID, callerID: callerID}:
+		return AssistantQueued
+	default:
+		return AssistantRateLimited
+	}
+}
+
+// overBudget reports whether userID has used up their daily or monthly
+// token budget, as RequireBudget would refuse them.
+func (a *Assistant) overBudget(ctx context.Context, userID string) (bool, error) {
+	report, err := a.meter.Report(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return report.Day.exhausted() || report.Month.exhausted(), nil
+}
+
+// allow counts a mention against the limits unless it is over them.
+func (a *Assistant) allow(userID, channelID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	recent := func(key string) []time.Time {
+		times := slices.DeleteFunc(a.answered[key], func(t time.Time) bool { return now.Sub(t) >= a.limits.Window })
+		if len(times) == 0 {
+			delete(a.answered, key)
+		}
+		return times
+	}
+	userKey, channelKey := "user:"+userID, "channel:"+channelID
+	users, channels := recent(userKey), recent(channelKey)
+	if len(users) >= a.limits.PerUser || len(channels) >= a.limits.PerChannel {
+		return false
+	}
+	a.answered[userKey] = append(users, now)
+	a.answered[channelKey] = append(channels, now)
+	return true
+}
+
+// answer replies to a mention in its channel, seeing the channel's latest
+// messages up to the mention.
+func (a *Assistant) answer(ctx context.Context, m mention) error {
+	messages, err := a.stores.Channels.ListChannelMessages(ctx, m.channelID, 0)
+	if err != nil {
+		return err
+	}
+	end := slices.IndexFunc(messages, func(msg store.Message) bool { return msg.ID == m.messageID })
+	if end < 0 {
+		// deleted before it could be answered
+		return nil
+	}
+	messages = messages[max(end+1-assistantHistory, 0) : end+1]
+	// mentions queued before the budget ran out are dropped, as
+	// RequireBudget would refuse them
+	if over, err := a.overBudget(ctx, m.callerID); err != nil || over {
+		return err
+	}
+
+	names := map[string]string{store.AssistantUserID: a.name}
+	history := make([]store.AIMessage, len(messages))
+	for i, msg := range messages {
+		turn := store.AIMessage{Role: store.AIRoleAssistant, Content: msg.Text}
+		if !msg.AI {
+			turn.Role, turn.Content = store.AIRoleUser, senderName(ctx, a.stores.Users, names, msg.Sender)+": "+msg.Text
+		}
+		turn.Tokens = estimateTokens(turn.Content)
+		history[i] = turn
+	}
+	prompt := fmt.Sprintf("You are %s, an assistant in a team chat channel. Messages are shown as \"name: text\". "+
+		"Answer the last one, which mentions you, briefly.", a.name)
+	window, _ := contextWindow(history[:len(history)-1], history[len(history)-1], a.settings.ContextTokens-estimateTokens(prompt))
+	req, err := a.settings.request(ChatOptions{}, append([]ChatMessage{{Role: "system", Content: prompt}}, window...)...)
+	if err != nil {
+		return err
+	}
+	resp, err := a.provider.Complete(WithUsageUser(ctx, m.callerID), req)
+	if err != nil {
+		return err
+	}
+
+	reply := store.Message{Sender: store.AssistantUserID, Text: strings.TrimSpace(resp.Content), Images: []string{}, AI: true}
+	if a.Post != nil {
+		channel, err := a.stores.Channels.GetChannel(ctx, m.channelID)
+		if err != nil {
+			return err
+		}
+		return a.Post(ctx, channel, &reply)
+	}
+	if err := a.stores.Messages.CreateMessage(ctx, &reply); err != nil {
+		return err
+	}
+	return a.stores.Channels.AddChannelMessage(ctx, m.channelID, reply.ID)
+}
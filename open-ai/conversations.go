@@ -0,0 +1,205 @@
+package ai
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// titleLength is how many characters of the first turn become the title of
+// an untitled conversation.
+const titleLength = 60
+
+type conversationRequest struct {
+	Title string `json:"title"`
+}
+
+type turnRequest struct {
+	Content string `json:"content" binding:"required"`
+	ChatOptions
+}
+
+func CreateConversation(conversations store.ConversationStore, c *gin.Context) {
+	// the body is optional
+	var req conversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+
+	conversation := store.Conversation{Owner: c.GetString("userID"), Title: strings.TrimSpace(req.Title)}
+	if err := conversations.CreateConversation(c, &conversation); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+	c.JSON(http.StatusCreated, conversation)
+}
+
+// ListConversations lists the caller's conversations, most recent first.
+func ListConversations(conversations store.ConversationStore, c *gin.Context) {
+	list, err := conversations.ListConversations(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetConversation returns one of the caller's conversations with every turn.
+func GetConversation(conversations store.ConversationStore, c *gin.Context) {
+	conversation, ok := loadConversation(conversations, c)
+	if !ok {
+		return
+	}
+	messages, err := conversations.ListAIMessages(c, conversation.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversation": conversation, "messages": messages})
+}
+
+func DeleteConversation(conversations store.ConversationStore, c *gin.Context) {
+	conversation, ok := loadConversation(conversations, c)
+	if !ok {
+		return
+	}
+	if err := conversations.DeleteConversation(c, conversation.ID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation deleted!"})
+}
+
+// SendTurn adds a user turn to a conversation and answers it. The model
+// sees as many of the latest turns as fit in settings.ContextTokens; older
+// ones are left out. Both turns are saved once the answer is complete, so a
+// failed or abandoned answer can simply be asked again. With ?stream=true
+// the answer arrives as for QueryOpenAI, with a "turn" event holding the
+// saved turns before the final "usage".
+func SendTurn(provider ChatProvider, settings *ChatSettings, conversations store.ConversationStore, c *gin.Context) {
+	var req turnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	stream, ok := streamRequested(c)
+	if !ok {
+		return
+	}
+	conversation, ok := loadConversation(conversations, c)
+	if !ok {
+		return
+	}
+	history, err := conversations.ListAIMessages(c, conversation.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+
+	turn := store.AIMessage{Role: store.AIRoleUser, Content: req.Content, Tokens: estimateTokens(req.Content)}
+	messages, trimmed := contextWindow(history, turn, settings.ContextTokens)
+	chat, err := settings.request(req.ChatOptions, messages...)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	var content string
+	var usage Usage
+	if stream {
+		if content, usage, ok = relayStream(provider, chat, c); !ok {
+			return
+		}
+	} else {
+		extendWriteDeadline(c)
+		resp, err := complete(provider, chat, c)
+		if err != nil {
+			apierror.Abort(c, err)
+			return
+		}
+		content, usage = resp.Content, resp.Usage
+	}
+
+	reply := store.AIMessage{Role: store.AIRoleAssistant, Content: content, Tokens: usage.CompletionTokens}
+	if reply.Tokens == 0 {
+		reply.Tokens = estimateTokens(content)
+	}
+	err = conversations.AddAIMessages(c, conversation.ID, &turn, &reply)
+	if err == nil && conversation.Title == "" {
+		conversation.Title = titleFrom(req.Content)
+		err = conversations.UpdateConversation(c, conversation)
+	}
+	result := gin.H{"messages": []store.AIMessage{turn, reply}, "trimmed": trimmed}
+	if stream {
+		if err != nil {
+			apierror.AbortStream(c, apierror.FromStore(err, "conversation"))
+			return
+		}
+		c.SSEvent("turn", result)
+		sendUsage(c, usage)
+		return
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// loadConversation loads the conversation in the path. Other users'
+// conversations are reported missing.
+func loadConversation(conversations store.ConversationStore, c *gin.Context) (*store.Conversation, bool) {
+	conversation, err := conversations.GetConversation(c, c.Param("id"))
+	if err == nil && conversation.Owner != c.GetString("userID") {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "conversation"))
+		return nil, false
+	}
+	return conversation, true
+}
+
+// contextWindow returns the latest turns of history that fit in budget
+// tokens together with next, followed by next, and how many of the oldest
+// turns were left out. The window never opens with an answer to a turn it
+// left out.
+func contextWindow(history []store.AIMessage, next store.AIMessage, budget int) ([]ChatMessage, int) {
+	used, start := next.Tokens, len(history)
+	for start > 0 && used+history[start-1].Tokens <= budget {
+		start--
+		used += history[start].Tokens
+	}
+	for start < len(history) && history[start].Role != store.AIRoleUser {
+		start++
+	}
+
+	messages := make([]ChatMessage, 0, len(history)-start+1)
+	for _, m := range append(history[start:len(history):len(history)], next) {
+		messages = append(messages, ChatMessage{Role: m.Role, Content: m.Content})
+	}
+	return messages, start
+}
+
+// estimateTokens approximates the tokens text costs, at about four
+// characters a token plus the overhead of a message.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text)+3)/4 + 4
+}
+
+// titleFrom makes a title of the first line of a turn.
+func titleFrom(content string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(content), "\n")
+	if utf8.RuneCountInString(title) <= titleLength {
+		return title
+	}
+	return strings.TrimSpace(string([]rune(title)[:titleLength])) + "…"
+}
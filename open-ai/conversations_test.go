@@ -0,0 +1,69 @@
+package ai
+
+import (
+	"strings"
+	"testing"
+
+	"crispy-doodle/main.go/store"
+)
+
+func TestContextWindow(t *testing.T) {
+	turn := func(role, content string, tokens int) store.AIMessage {
+		return store.AIMessage{Role: role, Content: content, Tokens: tokens}
+	}
+	history := []store.AIMessage{
+		turn(store.AIRoleUser, "q1", 10),
+		turn(store.AIRoleAssistant, "a1", 20),
+		turn(store.AIRoleUser, "q2", 10),
+		turn(store.AIRoleAssistant, "a2", 20),
+	}
+	next := turn(store.AIRoleUser, "q3", 5)
+
+	for _, tc := range []struct {
+		name    string
+		history []store.AIMessage
+		budget  int
+		want    []string
+		dropped int
+	}{
+		{"everything fits", history, 100, []string{"q1", "a1", "q2", "a2", "q3"}, 0},
+		{"exactly fits", history, 65, []string{"q1", "a1", "q2", "a2", "q3"}, 0},
+		{"oldest turn dropped", history, 64, []string{"q2", "a2", "q3"}, 2},
+		{"answer without its question dropped", history, 55, []string{"q2", "a2", "q3"}, 2},
+		{"only the next turn", history, 30, []string{"q3"}, 4},
+		{"next turn over budget", history, 1, []string{"q3"}, 4},
+		{"no history", nil, 10, []string{"q3"}, 0},
+	} {
+		messages, dropped := contextWindow(tc.history, next, tc.budget)
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.Content)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") || dropped != tc.dropped {
+			t.Errorf("%s: window %v dropping %d, want %v dropping %d", tc.name, got, dropped, tc.want, tc.dropped)
+		}
+		if len(messages) > 0 && messages[0].Role != store.AIRoleUser {
+			t.Errorf("%s: window opens with %s", tc.name, messages[0].Role)
+		}
+	}
+
+	// a window is built without touching the history behind it
+	backing := append(make([]store.AIMessage, 0, len(history)+1), history...)
+	contextWindow(backing, next, 100)
+	if extra := backing[:len(backing)+1][len(backing)]; extra.Content != "" {
+		t.Errorf("next turn was written into the history's spare capacity")
+	}
+}
+
+func TestTitleFrom(t *testing.T) {
+	long := strings.Repeat("é", titleLength+5)
+	for content, want := range map[string]string{
+		"  What is Go?\nAnd why?": "What is Go?",
+		"short":                   "short",
+		long:                      strings.Repeat("é", titleLength) + "…",
+	} {
+		if got := titleFrom(content); got != want {
+			t.Errorf("titleFrom(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
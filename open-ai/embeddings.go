@@ -0,0 +1,121 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// DefaultEmbeddingModel is the embedding model used unless
+// AI_EMBEDDING_MODEL names another.
+const DefaultEmbeddingModel = "text-embedding-3-small"
+
+// Embedder turns texts into vectors that are near each other when the texts
+// mean similar things.
+type Embedder interface {
+	// Model names the vectors' model; vectors of different models cannot be
+	// compared.
+	Model() string
+	// Embed returns one vector per text, in order.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// NewEmbedder connects to the embedding model of the provider called name,
+// taking the same names and settings as NewProvider.
+func NewEmbedder(name, baseURL, apiKey, model string) (Embedder, error) {
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	switch name {
+	case ProviderOpenAI, "":
+		if apiKey == "" {
+			return nil, errors.New("the openai provider needs OPENAI_API_KEY")
+		}
+		return openAIEmbedder{openai.NewClient(apiKey), model}, nil
+	case ProviderCompatible:
+		if baseURL == "" {
+			return nil, errors.New("the compatible provider needs AI_BASE_URL")
+		}
+		config := openai.DefaultConfig(apiKey)
+		config.BaseURL = baseURL
+		return openAIEmbedder{openai.NewClientWithConfig(config), model}, nil
+	case ProviderFake:
+		return FakeEmbedder{}, nil
+	}
+	return nil, fmt.Errorf("unknown AI provider %q", name)
+}
+
+// openAIEmbedder speaks the OpenAI embeddings API.
+type openAIEmbedder struct {
+	client *openai.Client
+	model  string
+}
+
+func (e openAIEmbedder) Model() string {
+	return e.model
+}
+
+func (e openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{Input: texts, Model: openai.EmbeddingModel(e.model)})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(resp.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// fakeDimensions is the length of FakeEmbedder's vectors.
+const fakeDimensions = 64
+
+// FakeEmbedder is a deterministic Embedder for tests and offline
+// development. Each word is hashed to a dimension, so texts sharing words
+// are near each other and texts sharing none are not.
+type FakeEmbedder struct{}
+
+func (FakeEmbedder) Model() string {
+	return "fake"
+}
+
+func (FakeEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, fakeDimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			v[h.Sum32()%fakeDimensions]++
+		}
+		var norm float64
+		for _, x := range v {
+			norm += float64(x) * float64(x)
+		}
+		if norm > 0 {
+			for j := range v {
+				v[j] /= float32(math.Sqrt(norm))
+			}
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
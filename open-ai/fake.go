@@ -0,0 +1,66 @@
+package ai
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// Fake is a deterministic ChatProvider for tests and offline development.
+// It answers "echo: " followed by the last message, streamed a word at a
+// time, and counts a token per byte: the last message is the prompt and
+// the answer the completion.
+type Fake struct{}
+
+func (Fake) Complete(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return ChatResponse{}, err
+	}
+	answer := fakeAnswer(request)
+	return ChatResponse{Content: answer, Usage: fakeUsage(answer)}, nil
+}
+
+func (Fake) Stream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	answer := fakeAnswer(request)
+	var chunks []ChatChunk
+	for _, word := range strings.SplitAfter(answer, " ") {
+		chunks = append(chunks, ChatChunk{Content: word})
+	}
+	usage := fakeUsage(answer)
+	chunks = append(chunks, ChatChunk{Usage: &usage})
+	return &fakeStream{ctx: ctx, chunks: chunks}, nil
+}
+
+func fakeAnswer(request ChatRequest) string {
+	var last string
+	if len(request.Messages) > 0 {
+		last = request.Messages[len(request.Messages)-1].Content
+	}
+	return "echo: " + last
+}
+
+func fakeUsage(answer string) Usage {
+	prompt := len(answer) - len("echo: ")
+	return Usage{PromptTokens: prompt, CompletionTokens: len(answer), TotalTokens: prompt + len(answer)}
+}
+
+type fakeStream struct {
+	ctx    context.Context
+	chunks []ChatChunk
+}
+
+func (s *fakeStream) Recv() (ChatChunk, error) {
+	if err := s.ctx.Err(); err != nil {
+		return ChatChunk{}, err
+	}
+	if len(s.chunks) == 0 {
+		return ChatChunk{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *fakeStream) Close() error {
+	return nil
+}
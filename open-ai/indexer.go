@@ -0,0 +1,144 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"crispy-doodle/main.go/store"
+)
+
+// indexBatch is how many messages a backfill embeds per request.
+const indexBatch = 64
+
+// indexSweepInterval is how often messages missed by the queue, e.g. while
+// the provider was down, are embedded.
+const indexSweepInterval = 10 * time.Minute
+
+// Indexer embeds messages' text off the request path so they can be found
+// by meaning. Messages are queued when created or edited, and whatever the
+// queue missed is caught up on by a periodic backfill.
+type Indexer struct {
+	embedder   Embedder
+	messages   store.MessageStore
+	embeddings store.EmbeddingStore
+	logger     *slog.Logger
+	queue      chan string
+}
+
+func NewIndexer(embedder Embedder, messages store.MessageStore, embeddings store.EmbeddingStore, logger *slog.Logger) *Indexer {
+	return &Indexer{
+		embedder:   embedder,
+		messages:   messages,
+		embeddings: embeddings,
+		logger:     logger,
+		queue:      make(chan string, 256),
+	}
+}
+
+// Start runs workers goroutines until ctx is done. Messages not embedded
+// yet are backfilled straight away and then every indexSweepInterval.
+func (x *Indexer) Start(ctx context.Context, workers int) {
+	for range max(workers, 1) {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-x.queue:
+					// without pgvector there is nowhere to keep embeddings,
+					// which the server warns about when it starts
+					if err := x.Index(ctx, id); err != nil && !errors.Is(err, store.ErrUnavailable) {
+						x.logger.Error("message embedding failed", "message", id, "error", err)
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(indexSweepInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := x.Backfill(ctx, indexBatch); err != nil && ctx.Err() == nil && !errors.Is(err, store.ErrUnavailable) {
+				x.logger.Error("message embedding backfill failed", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Enqueue schedules a message for embedding without blocking the caller.
+// A nil indexer does nothing.
+func (x *Indexer) Enqueue(id string) {
+	if x == nil {
+		return
+	}
+	select {
+	case x.queue <- id:
+	default:
+		// the next backfill gets to it
+	}
+}
+
+// Index embeds one message. Messages deleted meanwhile or without text are
+// skipped.
+func (x *Indexer) Index(ctx context.Context, id string) error {
+	message, err := x.messages.GetMessage(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if message.Text == "" {
+		return nil
+	}
+	return x.embed(ctx, []store.Message{*message})
+}
+
+// Backfill embeds every message whose text has no up to date embedding, in
+// batches of batch, and returns how many it embedded.
+func (x *Indexer) Backfill(ctx context.Context, batch int) (int, error) {
+	model := x.embedder.Model()
+	done := 0
+	for {
+		messages, err := x.embeddings.ListUnembeddedMessages(ctx, model, max(batch, 1))
+		if err != nil || len(messages) == 0 {
+			return done, err
+		}
+		if err := x.embed(ctx, messages); err != nil {
+			return done, err
+		}
+		done += len(messages)
+	}
+}
+
+func (x *Indexer) embed(ctx context.Context, messages []store.Message) error {
+	texts := make([]string, len(messages))
+	for i, m := range messages {
+		texts[i] = m.Text
+	}
+	vectors, err := x.embedder.Embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	for i, m := range messages {
+		err := x.embeddings.SaveEmbedding(ctx, &store.MessageEmbedding{
+			MessageID: m.ID,
+			Model:     x.embedder.Model(),
+			Vector:    vectors[i],
+			Version:   m.Updated,
+		})
+		// deleted while it was embedded
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
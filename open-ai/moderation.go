@@ -0,0 +1,159 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Moderation providers MODERATION_PROVIDER may name.
+const (
+	ModerationOpenAI = "openai"
+	ModerationRules  = "rules"
+)
+
+// Moderator checks text against content policies.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (ModerationResult, error)
+}
+
+// ModerationResult is a Moderator's opinion of a text. Categories name what
+// it was flagged for.
+type ModerationResult struct {
+	Provider   string
+	Flagged    bool
+	Categories []string
+}
+
+// NewModerator builds the moderation provider called name, or returns nil
+// when name is empty and nothing is moderated. OpenAI's moderation endpoint
+// falls back to rules when it cannot be reached, so messages are never held
+// up by it.
+func NewModerator(name, apiKey string, rules []ModerationRule, logger *slog.Logger) (Moderator, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case ModerationOpenAI:
+		if apiKey == "" {
+			return nil, errors.New("the openai moderation provider needs OPENAI_API_KEY")
+		}
+		return fallbackModerator{
+			primary:  openAIModerator{openai.NewClient(apiKey)},
+			fallback: NewRuleModerator(rules),
+			logger:   logger,
+		}, nil
+	case ModerationRules:
+		if len(rules) == 0 {
+			logger.Warn("MODERATION_RULES is empty, no message will be flagged")
+		}
+		return NewRuleModerator(rules), nil
+	}
+	return nil, fmt.Errorf("unknown moderation provider %q", name)
+}
+
+// openAIModerator asks OpenAI's moderation endpoint.
+type openAIModerator struct {
+	client *openai.Client
+}
+
+func (m openAIModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	resp, err := m.client.Moderations(ctx, openai.ModerationRequest{Input: text, Model: openai.ModerationOmniLatest})
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	result := ModerationResult{Provider: ModerationOpenAI, Categories: []string{}}
+	for _, r := range resp.Results {
+		result.Flagged = result.Flagged || r.Flagged
+		// the categories are a struct of flags named by their json tags
+		raw, err := json.Marshal(r.Categories)
+		if err != nil {
+			return ModerationResult{}, err
+		}
+		var categories map[string]bool
+		if err := json.Unmarshal(raw, &categories); err != nil {
+			return ModerationResult{}, err
+		}
+		for category, flagged := range categories {
+			if flagged && !slices.Contains(result.Categories, category) {
+				result.Categories = append(result.Categories, category)
+			}
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
+
+type fallbackModerator struct {
+	primary, fallback Moderator
+	logger            *slog.Logger
+}
+
+func (m fallbackModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	result, err := m.primary.Moderate(ctx, text)
+	if err == nil || ctx.Err() != nil {
+		return result, err
+	}
+	m.logger.Warn("moderation provider failed, falling back to rules", "error", err)
+	return m.fallback.Moderate(ctx, text)
+}
+
+// ModerationRule flags texts containing Term, as a whole word or phrase in
+// any case, for Category.
+type ModerationRule struct {
+	Category string
+	Term     string
+}
+
+// ParseModerationRules reads comma separated category:term pairs, e.g.
+// "spam:buy followers,harassment:idiot".
+func ParseModerationRules(s string) ([]ModerationRule, error) {
+	var rules []ModerationRule
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		category, term, ok := strings.Cut(pair, ":")
+		category, term = strings.TrimSpace(category), strings.TrimSpace(term)
+		if !ok || category == "" || term == "" {
+			return nil, fmt.Errorf("moderation rule %q is not category:term", pair)
+		}
+		rules = append(rules, ModerationRule{Category: category, Term: term})
+	}
+	return rules, nil
+}
+
+// RuleModerator is the local moderation provider: it flags texts matching
+// any of its rules.
+type RuleModerator struct {
+	rules    []ModerationRule
+	patterns []*regexp.Regexp
+}
+
+func NewRuleModerator(rules []ModerationRule) *RuleModerator {
+	m := &RuleModerator{rules: rules}
+	for _, r := range rules {
+		m.patterns = append(m.patterns, regexp.MustCompile(`(?i)(^|\W)`+regexp.QuoteMeta(r.Term)+`($|\W)`))
+	}
+	return m
+}
+
+func (m *RuleModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	result := ModerationResult{Provider: ModerationRules, Categories: []string{}}
+	for i, p := range m.patterns {
+		category := m.rules[i].Category
+		if p.MatchString(text) && !slices.Contains(result.Categories, category) {
+			result.Flagged = true
+			result.Categories = append(result.Categories, category)
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
@@ -1,50 +1,149 @@
 package ai
 
 import (
-	"context"
-	"log"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"crispy-doodle/main.go/global"
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/logging"
 
 	"github.com/gin-gonic/gin"
-	openai "github.com/sashabaranov/go-openai"
 )
 
-func OpenAI() *openai.Client {
+// answerTimeout replaces the server's WriteTimeout for a whole answer, and
+// for the gap between two events of a streamed one.
+const answerTimeout = 2 * time.Minute
 
-	client := openai.NewClient(global.OpenAIKey)
-
-	log.Printf("[CONNECTED] to OpenAI")
-	return client
-}
+// upstream names the model in errors, whichever provider serves it.
+const upstream = "AI provider"
 
 type UserPrompt struct {
 	Prompt string `json:"prompt"`
+	ChatOptions
 }
 
-func QueryOpenAI(client *openai.Client, c *gin.Context) {
+// QueryOpenAI answers a prompt. With ?stream=true the answer is sent as
+// server-sent events as it is generated: "delta" events carry pieces of
+// content, and a final "usage" event the token counts.
+func QueryOpenAI(provider ChatProvider, settings *ChatSettings, c *gin.Context) {
 	var input UserPrompt
 	if err := c.ShouldBindJSON(&input); err != nil || input.Prompt == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid prompt"})
+		apierror.Abort(c, apierror.BadRequest("Missing or invalid prompt"))
+		return
+	}
+	stream, ok := streamRequested(c)
+	if !ok {
+		return
+	}
+	req, err := settings.request(input.ChatOptions, ChatMessage{Role: "user", Content: input.Prompt})
+	if err != nil {
+		apierror.Abort(c, err)
 		return
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model: openai.GPT4, // or GPT3Dot5Turbo
-		Messages: []openai.ChatCompletionMessage{
-			{Role: openai.ChatMessageRoleUser, Content: input.Prompt},
-		},
-		Temperature: 0.7,
+	if stream {
+		if _, usage, ok := relayStream(provider, req, c); ok {
+			sendUsage(c, usage)
+		}
+		return
 	}
 
-	resp, err := client.CreateChatCompletion(context.Background(), req)
+	extendWriteDeadline(c)
+	resp, err := complete(provider, req, c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apierror.Abort(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"response": resp.Choices[0].Message.Content,
+		"response": resp.Content,
 	})
 }
+
+// complete asks for the whole completion at once.
+func complete(provider ChatProvider, req ChatRequest, c *gin.Context) (*ChatResponse, error) {
+	resp, err := provider.Complete(c, req)
+	if err != nil {
+		return nil, apierror.Upstream(upstream, err)
+	}
+	return &resp, nil
+}
+
+// streamRequested reads ?stream, answering with an error and returning
+// false when it is not a boolean.
+func streamRequested(c *gin.Context) (stream, ok bool) {
+	s := c.Query("stream")
+	if s == "" {
+		return false, true
+	}
+	stream, err := strconv.ParseBool(s)
+	if err != nil {
+		apierror.Abort(c, apierror.BadRequest("stream must be true or false"))
+		return false, false
+	}
+	return stream, true
+}
+
+// relayStream sends the completion to the client as "delta" events while
+// it arrives and returns it whole. The upstream request is made with the
+// client's context, so it is cancelled as soon as the client goes away.
+// It returns false when the completion did not finish, after answering with
+// the error unless the client left.
+func relayStream(provider ChatProvider, req ChatRequest, c *gin.Context) (string, Usage, bool) {
+	var content strings.Builder
+	var usage Usage
+
+	stream, err := provider.Stream(c, req)
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream(upstream, err))
+		return "", usage, false
+	}
+	defer stream.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	// keep reverse proxies from buffering the events
+	c.Header("X-Accel-Buffering", "no")
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return content.String(), usage, true
+		}
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				logging.FromContext(c).Info("client went away during a streamed answer")
+			} else if !c.Writer.Written() {
+				apierror.Abort(c, apierror.Upstream(upstream, err))
+			} else {
+				apierror.AbortStream(c, apierror.Upstream(upstream, err))
+			}
+			return "", usage, false
+		}
+
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if chunk.Content != "" {
+			content.WriteString(chunk.Content)
+			extendWriteDeadline(c)
+			c.SSEvent("delta", gin.H{"content": chunk.Content})
+			c.Writer.Flush()
+		}
+	}
+}
+
+// sendUsage ends an event stream with the token counts.
+func sendUsage(c *gin.Context, usage Usage) {
+	extendWriteDeadline(c)
+	c.SSEvent("usage", usage)
+	c.Writer.Flush()
+}
+
+// extendWriteDeadline lets a slow answer outlive the server's WriteTimeout.
+func extendWriteDeadline(c *gin.Context) {
+	// not every ResponseWriter supports deadlines, test recorders among them
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(answerTimeout))
+}
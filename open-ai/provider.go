@@ -0,0 +1,161 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatProvider is a model the handlers can chat with.
+type ChatProvider interface {
+	Complete(ctx context.Context, request ChatRequest) (ChatResponse, error)
+	// Stream returns the completion in chunks, the last of which carries
+	// the usage when the provider reports it.
+	Stream(ctx context.Context, request ChatRequest) (ChatStream, error)
+}
+
+// ChatStream is a completion arriving in chunks. Recv returns io.EOF after
+// the last one.
+type ChatStream interface {
+	Recv() (ChatChunk, error)
+	Close() error
+}
+
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+// ChatRequest is one completion request. A MaxTokens of zero leaves the
+// length to the provider.
+type ChatRequest struct {
+	Model       string
+	Messages    []ChatMessage
+	Temperature float32
+	MaxTokens   int
+}
+
+type ChatResponse struct {
+	Content string
+	Usage   Usage
+}
+
+type ChatChunk struct {
+	Content string
+	Usage   *Usage
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Providers AI_PROVIDER may name.
+const (
+	ProviderOpenAI     = "openai"
+	ProviderCompatible = "compatible"
+	ProviderFake       = "fake"
+)
+
+// NewProvider connects to the provider called name. compatible talks to
+// the OpenAI API at baseURL, such as a local Ollama or llama.cpp server,
+// where apiKey may be empty.
+func NewProvider(name, baseURL, apiKey string, logger *slog.Logger) (ChatProvider, error) {
+	switch name {
+	case ProviderOpenAI, "":
+		if apiKey == "" {
+			return nil, errors.New("the openai provider needs OPENAI_API_KEY")
+		}
+		logger.Info("connected to OpenAI")
+		return NewOpenAI(apiKey), nil
+	case ProviderCompatible:
+		if baseURL == "" {
+			return nil, errors.New("the compatible provider needs AI_BASE_URL")
+		}
+		logger.Info("connected to an OpenAI compatible server", "url", baseURL)
+		return NewOpenAICompatible(baseURL, apiKey), nil
+	case ProviderFake:
+		logger.Warn("AI_PROVIDER is fake, answers only echo the prompt")
+		return Fake{}, nil
+	}
+	return nil, fmt.Errorf("unknown AI provider %q", name)
+}
+
+// openAIProvider speaks the OpenAI chat completions API.
+type openAIProvider struct {
+	client *openai.Client
+}
+
+func NewOpenAI(apiKey string) ChatProvider {
+	return openAIProvider{openai.NewClient(apiKey)}
+}
+
+// NewOpenAICompatible is NewOpenAI for another server implementing the
+// same API, with baseURL being e.g. http://localhost:11434/v1.
+func NewOpenAICompatible(baseURL, apiKey string) ChatProvider {
+	config := openai.DefaultConfig(apiKey)
+	config.BaseURL = baseURL
+	return openAIProvider{openai.NewClientWithConfig(config)}
+}
+
+func (p openAIProvider) Complete(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	resp, err := p.client.CreateChatCompletion(ctx, completionRequest(request))
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return ChatResponse{}, errors.New("no choices in completion")
+	}
+	return ChatResponse{Content: resp.Choices[0].Message.Content, Usage: usageOf(resp.Usage)}, nil
+}
+
+func (p openAIProvider) Stream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	req := completionRequest(request)
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return openAIStream{stream}, nil
+}
+
+func completionRequest(request ChatRequest) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, len(request.Messages))
+	for i, m := range request.Messages {
+		messages[i] = openai.ChatCompletionMessage{Role: m.Role, Content: m.Content}
+	}
+	return openai.ChatCompletionRequest{
+		Model:       request.Model,
+		Messages:    messages,
+		Temperature: request.Temperature,
+		MaxTokens:   request.MaxTokens,
+	}
+}
+
+func usageOf(u openai.Usage) Usage {
+	return Usage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+}
+
+type openAIStream struct {
+	*openai.ChatCompletionStream
+}
+
+func (s openAIStream) Recv() (ChatChunk, error) {
+	resp, err := s.ChatCompletionStream.Recv()
+	if err != nil {
+		return ChatChunk{}, err
+	}
+	var chunk ChatChunk
+	for _, choice := range resp.Choices {
+		chunk.Content += choice.Delta.Content
+	}
+	if resp.Usage != nil {
+		usage := usageOf(*resp.Usage)
+		chunk.Usage = &usage
+	}
+	return chunk, nil
+}
@@ -0,0 +1,63 @@
+package ai
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSearchLimit and maxSearchLimit bound ?limit on semantic search.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchMessages finds the messages nearest in meaning to ?q in the
+// channels the caller belongs to, nearest first. Messages are found once
+// the Indexer has embedded them, and not while they are flagged for review.
+func SearchMessages(embedder Embedder, users store.UserStore, embeddings store.EmbeddingStore, c *gin.Context) {
+	q := c.Query("q")
+	if q == "" {
+		apierror.Abort(c, apierror.BadRequest("Missing query q"))
+		return
+	}
+	limit := defaultSearchLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			apierror.Abort(c, apierror.BadRequest("limit must be between 1 and "+strconv.Itoa(maxSearchLimit)))
+			return
+		}
+		limit = n
+	}
+	caller, err := users.GetUser(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if len(caller.Channels) == 0 {
+		c.JSON(http.StatusOK, []store.MessageMatch{})
+		return
+	}
+
+	vectors, err := embedder.Embed(c, []string{q})
+	if err != nil {
+		apierror.Abort(c, apierror.Upstream(upstream, err))
+		return
+	}
+	matches, err := embeddings.SearchMessages(c, embedder.Model(), vectors[0], caller.ID, limit)
+	if errors.Is(err, store.ErrUnavailable) {
+		apierror.Abort(c, apierror.Unavailable("Search is not available").Wrap(err))
+		return
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	c.JSON(http.StatusOK, matches)
+}
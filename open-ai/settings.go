@@ -0,0 +1,93 @@
+package ai
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	apierror "crispy-doodle/main.go/api-error"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTemperature is the highest temperature OpenAI accepts.
+const maxTemperature = 2
+
+// ChatSettings are the defaults for chat requests and the limits on what a
+// request may ask for instead.
+type ChatSettings struct {
+	Model string
+	// Models are the models a request may choose; Model is always one.
+	Models      []string
+	Temperature float32
+	// MaxTokens caps the length of an answer, unlimited when zero.
+	MaxTokens int
+	// ContextTokens is how much conversation history goes with a turn.
+	ContextTokens int
+}
+
+// DefaultChatSettings use GPT-4 and nothing else.
+func DefaultChatSettings() *ChatSettings {
+	return &ChatSettings{
+		Model:         "gpt-4",
+		Models:        []string{"gpt-4"},
+		Temperature:   0.7,
+		ContextTokens: 4000,
+	}
+}
+
+// ParseChatSettings checks settings read from the environment: model is the
+// default and models a comma separated allowlist the default is added to.
+func ParseChatSettings(model, models string, temperature float32, maxTokens, contextTokens int) (*ChatSettings, error) {
+	s := DefaultChatSettings()
+	if model != "" {
+		s.Model = model
+	}
+	s.Models = []string{s.Model}
+	for _, m := range strings.Split(models, ",") {
+		if m = strings.TrimSpace(m); m != "" && !slices.Contains(s.Models, m) {
+			s.Models = append(s.Models, m)
+		}
+	}
+	if temperature < 0 || temperature > maxTemperature {
+		return nil, fmt.Errorf("temperature %v is not between 0 and %d", temperature, maxTemperature)
+	}
+	if maxTokens < 0 || contextTokens <= 0 {
+		return nil, fmt.Errorf("token limits must be positive")
+	}
+	s.Temperature, s.MaxTokens, s.ContextTokens = temperature, maxTokens, contextTokens
+	return s, nil
+}
+
+// ChatOptions are what a request body may set instead of the defaults.
+type ChatOptions struct {
+	Model       string   `json:"model"`
+	Temperature *float32 `json:"temperature"`
+	MaxTokens   int      `json:"max_tokens"`
+}
+
+// request builds a ChatRequest for messages from the defaults and opts,
+// which must stay within the allowlist and limits.
+func (s *ChatSettings) request(opts ChatOptions, messages ...ChatMessage) (ChatRequest, error) {
+	req := ChatRequest{Model: s.Model, Messages: messages, Temperature: s.Temperature, MaxTokens: s.MaxTokens}
+	if opts.Model != "" {
+		if !slices.Contains(s.Models, opts.Model) {
+			return req, apierror.BadRequest("Model is not allowed").WithDetails(gin.H{"models": s.Models})
+		}
+		req.Model = opts.Model
+	}
+	if opts.Temperature != nil {
+		if *opts.Temperature < 0 || *opts.Temperature > maxTemperature {
+			return req, apierror.BadRequest(fmt.Sprintf("temperature must be between 0 and %d", maxTemperature))
+		}
+		req.Temperature = *opts.Temperature
+	}
+	if opts.MaxTokens != 0 {
+		if opts.MaxTokens < 0 || (s.MaxTokens > 0 && opts.MaxTokens > s.MaxTokens) {
+			return req, apierror.BadRequest("max_tokens is out of range").
+				WithDetails(gin.H{"max_tokens": s.MaxTokens})
+		}
+		req.MaxTokens = opts.MaxTokens
+	}
+	return req, nil
+}
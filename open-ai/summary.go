@@ -0,0 +1,254 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSummaryWindow is how far back a summary goes for callers who have
+// never marked the channel read.
+const defaultSummaryWindow = 24 * time.Hour
+
+// maxSummaryRounds bounds how often summaries of parts are summarized
+// again before the oldest parts are dropped to fit.
+const maxSummaryRounds = 3
+
+const summaryPrompt = "You summarize chat messages for someone catching up on a channel. " +
+	"Be brief, group related points, and name who said what when it matters."
+
+const partialSummaryPrompt = "These are summaries of consecutive parts of a channel, oldest first. " +
+	"Merge them into one."
+
+type summaryRequest struct {
+	// Since is a Unix time to summarize from instead of the read position.
+	Since int64 `json:"since"`
+	// Window is a duration such as "48h" to look back instead.
+	Window string `json:"window"`
+}
+
+type summaryResponse struct {
+	store.ChannelSummary
+	Since  int64 `json:"since"`
+	Cached bool  `json:"cached"`
+}
+
+// SummarizeChannel summarizes a channel's messages since the caller last
+// marked it read, or since a time or within a window given in the body,
+// the last day when there is neither. Messages that do not fit in
+// settings.ContextTokens together are summarized in parts first. Summaries
+// are cached until the messages they cover change.
+func SummarizeChannel(provider ChatProvider, settings *ChatSettings, users store.UserStore, channels store.ChannelStore,
+	summaries store.SummaryStore, c *gin.Context) {
+	// the body is optional
+	var req summaryRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Abort(c, apierror.InvalidBody(err))
+		return
+	}
+	channelID := c.Param("id")
+	if _, err := channels.GetChannel(c, channelID); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	caller, err := users.GetUser(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	if !slices.Contains(caller.Channels, channelID) {
+		apierror.Abort(c, apierror.Forbidden("Only channel members can summarize it"))
+		return
+	}
+
+	since, err := summarySince(req, channels, caller.ID, channelID, c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	messages, err := channels.ListChannelMessages(c, channelID, since)
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	resp := summaryResponse{ChannelSummary: store.ChannelSummary{ChannelID: channelID}, Since: since}
+	if len(messages) == 0 {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	digest := summaryDigest(settings.Model, messages)
+	cached, err := summaries.GetChannelSummary(c, channelID, messages[0].ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+	if err == nil && cached.Digest == digest {
+		resp.ChannelSummary, resp.Cached = *cached, true
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	extendWriteDeadline(c)
+	summary, err := summarize(provider, settings, transcript(users, messages, c), c)
+	if err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	resp.ChannelSummary = store.ChannelSummary{
+		ChannelID: channelID,
+		From:      messages[0].ID,
+		Digest:    digest,
+		Summary:   summary,
+		Messages:  len(messages),
+	}
+	if err := summaries.SaveChannelSummary(c, &resp.ChannelSummary); err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "channel"))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// summarySince picks the Unix time a summary starts after.
+func summarySince(req summaryRequest, channels store.ChannelStore, userID, channelID string, c *gin.Context) (int64, error) {
+	if req.Since > 0 {
+		return req.Since, nil
+	}
+	if req.Window != "" {
+		window, err := time.ParseDuration(req.Window)
+		if err != nil || window <= 0 {
+			return 0, apierror.BadRequest("window must be a positive duration such as 48h")
+		}
+		return time.Now().Add(-window).Unix(), nil
+	}
+	at, err := channels.GetReadPosition(c, userID, channelID)
+	if errors.Is(err, store.ErrNotFound) {
+		return time.Now().Add(-defaultSummaryWindow).Unix(), nil
+	}
+	if err != nil {
+		return 0, apierror.Internal(err)
+	}
+	return at, nil
+}
+
+// summaryDigest identifies the messages a summary covers, in the versions
+// it saw, and the model that wrote it.
+func summaryDigest(model string, messages []store.Message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", model)
+	for _, m := range messages {
+		fmt.Fprintf(h, "%s %d\n", m.ID, m.Updated)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transcript renders messages as "name: text" lines.
+func transcript(users store.UserStore, messages []store.Message, c *gin.Context) []string {
+	names := map[string]string{}
+	lines := make([]string, 0, len(messages))
+	for _, m := range messages {
+		name := senderName(c, users, names, m.Sender)
+		text := m.Text
+		if len(m.Images) > 0 {
+			text += fmt.Sprintf(" [%d attachments]", len(m.Images))
+		}
+		lines = append(lines, name+": "+text)
+	}
+	return lines
+}
+
+// senderName looks up the name of a message's sender, remembering it in
+// names. Senders that cannot be looked up go by their ID.
+func senderName(ctx context.Context, users store.UserStore, names map[string]string, id string) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	name := id
+	if user, err := users.GetUser(ctx, id); err == nil {
+		name = user.Name
+	}
+	names[id] = name
+	return name
+}
+
+// summarize asks for a summary of texts. Texts that do not fit in the
+// context budget together are split into parts that do, each part is
+// summarized, and the summaries are merged the same way. After
+// maxSummaryRounds only the latest texts that fit are kept.
+func summarize(provider ChatProvider, settings *ChatSettings, texts []string, c *gin.Context) (string, error) {
+	prompt := summaryPrompt
+	budget := max(settings.ContextTokens-estimateTokens(summaryPrompt), 8)
+	for round := 1; ; round++ {
+		parts := chunkTexts(texts, budget)
+		if len(parts) > 1 && round == maxSummaryRounds {
+			parts = parts[len(parts)-1:]
+		}
+		if len(parts) == 1 {
+			return summarizePart(provider, settings, prompt, parts[0], 0, c)
+		}
+
+		// leave room for every part's summary in the next round
+		maxTokens := max(budget/len(parts), 1)
+		summaries := make([]string, len(parts))
+		for i, part := range parts {
+			summary, err := summarizePart(provider, settings, prompt, part, maxTokens, c)
+			if err != nil {
+				return "", err
+			}
+			summaries[i] = summary
+		}
+		texts, prompt = summaries, partialSummaryPrompt
+	}
+}
+
+func summarizePart(provider ChatProvider, settings *ChatSettings, prompt string, texts []string, maxTokens int, c *gin.Context) (string, error) {
+	req, err := settings.request(ChatOptions{},
+		ChatMessage{Role: "system", Content: prompt},
+		ChatMessage{Role: "user", Content: strings.Join(texts, "\n")})
+	if err != nil {
+		return "", err
+	}
+	if maxTokens > 0 && (req.MaxTokens == 0 || maxTokens < req.MaxTokens) {
+		req.MaxTokens = maxTokens
+	}
+	resp, err := complete(provider, req, c)
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
+// chunkTexts splits texts into runs that fit in budget tokens each, cutting
+// texts too long for any run.
+func chunkTexts(texts []string, budget int) [][]string {
+	var chunks [][]string
+	var chunk []string
+	used := 0
+	for _, text := range texts {
+		tokens := estimateTokens(text)
+		if tokens > budget {
+			text = string([]rune(text)[:min(utf8.RuneCountInString(text), max(budget-4, 1)*4)])
+			tokens = estimateTokens(text)
+		}
+		if len(chunk) > 0 && used+tokens > budget {
+			chunks = append(chunks, chunk)
+			chunk, used = nil, 0
+		}
+		chunk = append(chunk, text)
+		used += tokens
+	}
+	return append(chunks, chunk)
+}
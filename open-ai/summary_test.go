@@ -0,0 +1,52 @@
+package ai
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunkTexts(t *testing.T) {
+	// each of these costs 4 + 4 = 8 tokens
+	short := []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc", "dddddddddddddddd", "eeeeeeeeeeeeeeee"}
+
+	for _, tc := range []struct {
+		name   string
+		texts  []string
+		budget int
+		want   [][]string
+	}{
+		{"all in one", short, 100, [][]string{short}},
+		{"exactly fits", short[:2], 16, [][]string{short[:2]}},
+		{"split in order", short, 16, [][]string{short[0:2], short[2:4], short[4:5]}},
+		{"one a chunk", short, 8, [][]string{short[0:1], short[1:2], short[2:3], short[3:4], short[4:5]}},
+	} {
+		got := chunkTexts(tc.texts, tc.budget)
+		if !slices.EqualFunc(got, tc.want, slices.Equal[[]string]) {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// a text over the budget is cut to fit, keeping its start
+	long := strings.Repeat("é", 1000)
+	chunks := chunkTexts([]string{"hi", long, "bye"}, 50)
+	if len(chunks) != 3 {
+		t.Fatalf("long text: %d chunks, want 3", len(chunks))
+	}
+	cut := chunks[1][0]
+	if !strings.HasPrefix(long, cut) || len(cut) == len(long) {
+		t.Errorf("long text cut to %d bytes", len(cut))
+	}
+	for _, chunk := range chunks {
+		used := 0
+		for _, text := range chunk {
+			used += estimateTokens(text)
+		}
+		if used > 50 {
+			t.Errorf("chunk %q costs %d tokens, over the budget", chunk, used)
+		}
+	}
+	if chunks[0][0] != "hi" || chunks[2][0] != "bye" {
+		t.Errorf("texts around the long one moved: %q", chunks)
+	}
+}
@@ -0,0 +1,371 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	apierror "crispy-doodle/main.go/api-error"
+	"crispy-doodle/main.go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Unlimited is the budget of a role that may use any number of tokens.
+const Unlimited = -1
+
+// TokenBudget is how many tokens a user may use per UTC day and month.
+type TokenBudget struct {
+	Daily   int64
+	Monthly int64
+}
+
+// DefaultRoleBudgets are used for roles AI_BUDGETS does not mention. Roles
+// in neither get the user role's.
+var DefaultRoleBudgets = map[string]TokenBudget{
+	store.RoleUser:      {Daily: 100_000, Monthly: 2_000_000},
+	store.RoleModerator: {Daily: 100_000, Monthly: 2_000_000},
+	store.RoleAdmin:     {Daily: Unlimited, Monthly: Unlimited},
+}
+
+// ParseRoleBudgets reads per role budgets such as
+// "user=50000/1000000,admin=unlimited", daily then monthly, on top of
+// DefaultRoleBudgets. Either half may be unlimited.
+func ParseRoleBudgets(spec string) (map[string]TokenBudget, error) {
+	budgets := map[string]TokenBudget{}
+	for role, budget := range DefaultRoleBudgets {
+		budgets[role] = budget
+	}
+	if strings.TrimSpace(spec) == "" {
+		return budgets, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		role, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		role = strings.TrimSpace(role)
+		if _, known := DefaultRoleBudgets[role]; !known || !ok {
+			return nil, fmt.Errorf("budget %q must be one of user, moderator or admin followed by =daily/monthly", entry)
+		}
+		if strings.TrimSpace(limits) == "unlimited" {
+			budgets[role] = TokenBudget{Daily: Unlimited, Monthly: Unlimited}
+			continue
+		}
+		daily, monthly, ok := strings.Cut(limits, "/")
+		if !ok {
+			return nil, fmt.Errorf("budget for %s must be daily/monthly tokens", role)
+		}
+		var budget TokenBudget
+		for _, limit := range []struct {
+			s string
+			n *int64
+		}{{daily, &budget.Daily}, {monthly, &budget.Monthly}} {
+			limit.s = strings.TrimSpace(limit.s)
+			if limit.s == "unlimited" {
+				*limit.n = Unlimited
+				continue
+			}
+			n, err := strconv.ParseInt(limit.s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("budget for %s: %q is not a number of tokens", role, limit.s)
+			}
+			*limit.n = n
+		}
+		budgets[role] = budget
+	}
+	return budgets, nil
+}
+
+// ModelPrice is what a model costs in US dollars per million prompt and
+// completion tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// DefaultModelPrices are OpenAI's list prices. Models without a price, such
+// as local ones, cost nothing.
+var DefaultModelPrices = map[string]ModelPrice{
+	"gpt-4":         {Prompt: 30, Completion: 60},
+	"gpt-4-turbo":   {Prompt: 10, Completion: 30},
+	"gpt-4o":        {Prompt: 2.5, Completion: 10},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.6},
+	"gpt-3.5-turbo": {Prompt: 0.5, Completion: 1.5},
+}
+
+// ParseModelPrices reads prices such as "gpt-4o=2.5/10,llama3=0/0", prompt
+// then completion dollars per million tokens, on top of DefaultModelPrices.
+func ParseModelPrices(spec string) (map[string]ModelPrice, error) {
+	prices := map[string]ModelPrice{}
+	for model, price := range DefaultModelPrices {
+		prices[model] = price
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		model, price, ok := strings.Cut(entry, "=")
+		prompt, completion, ok2 := strings.Cut(price, "/")
+		p, err1 := strconv.ParseFloat(strings.TrimSpace(prompt), 64)
+		c, err2 := strconv.ParseFloat(strings.TrimSpace(completion), 64)
+		if !ok || !ok2 || err1 != nil || err2 != nil || p < 0 || c < 0 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("price %q must be model=prompt/completion dollars per million tokens", entry)
+		}
+		prices[strings.TrimSpace(model)] = ModelPrice{Prompt: p, Completion: c}
+	}
+	return prices, nil
+}
+
+type usageUserKey struct{}
+
+// WithUsageUser bills completions made with ctx to userID, for work done
+// outside a request such as the assistant's answers.
+func WithUsageUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, usageUserKey{}, userID)
+}
+
+// usageUser is who completions made with ctx are billed to: the one named
+// by WithUsageUser, otherwise the caller of the request ctx comes from.
+func usageUser(ctx context.Context) string {
+	if id, ok := ctx.Value(usageUserKey{}).(string); ok {
+		return id
+	}
+	// set on gin contexts by the JWT middleware
+	id, _ := ctx.Value("userID").(string)
+	return id
+}
+
+// Meter records every completion's usage per user and model, and holds
+// users to the token budget of their role.
+type Meter struct {
+	usage   store.AIUsageStore
+	users   store.UserStore
+	budgets map[string]TokenBudget
+	prices  map[string]ModelPrice
+	logger  *slog.Logger
+}
+
+// NewMeter builds a Meter. Nil budgets and prices mean DefaultRoleBudgets and
+// DefaultModelPrices.
+func NewMeter(usage store.AIUsageStore, users store.UserStore, budgets map[string]TokenBudget, prices map[string]ModelPrice,
+	logger *slog.Logger) *Meter {
+	if budgets == nil {
+		budgets = DefaultRoleBudgets
+	}
+	if prices == nil {
+		prices = DefaultModelPrices
+	}
+	return &Meter{usage: usage, users: users, budgets: budgets, prices: prices, logger: logger}
+}
+
+// Wrap returns provider recording the usage of each completion it makes.
+func (m *Meter) Wrap(provider ChatProvider) ChatProvider {
+	return meteredProvider{ChatProvider: provider, meter: m}
+}
+
+// Budget is user's token budget.
+func (m *Meter) Budget(user *store.User) TokenBudget {
+	if budget, ok := m.budgets[user.Role]; ok {
+		return budget
+	}
+	return m.budgets[store.RoleUser]
+}
+
+// record saves usage of model by the user ctx is billed to. Failures are
+// logged rather than failing a completion that already happened.
+func (m *Meter) record(ctx context.Context, model string, usage Usage) {
+	userID := usageUser(ctx)
+	if userID == "" {
+		m.logger.Warn("AI usage with no user to bill", "model", model, "tokens", usage.TotalTokens)
+		return
+	}
+	price := m.prices[model]
+	err := m.usage.RecordAIUsage(context.WithoutCancel(ctx), &store.AIUsage{
+		UserID:           userID,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		Cost:             (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6,
+	})
+	if err != nil {
+		m.logger.Error("failed to record AI usage", "user", userID, "model", model, "error", err)
+	}
+}
+
+// BudgetPeriod is a user's consumption within the current day or month.
+type BudgetPeriod struct {
+	Since  int64 `json:"since"`
+	Resets int64 `json:"resets"`
+	Used   int64 `json:"used"`
+	// Limit is nil for users without one.
+	Limit *int64  `json:"limit"`
+	Cost  float64 `json:"cost_usd"`
+}
+
+func (p BudgetPeriod) exhausted() bool {
+	return p.Limit != nil && p.Used >= *p.Limit
+}
+
+// UsageReport is a user's consumption against their budget, with this
+// month's per model.
+type UsageReport struct {
+	Day    BudgetPeriod         `json:"day"`
+	Month  BudgetPeriod         `json:"month"`
+	Models []store.AIUsageTotal `json:"models"`
+}
+
+// Report sums userID's usage in the current UTC day and month.
+func (m *Meter) Report(ctx context.Context, userID string) (*UsageReport, error) {
+	user, err := m.users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	budget := m.Budget(user)
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	report := &UsageReport{}
+	for _, p := range []struct {
+		period *BudgetPeriod
+		since  time.Time
+		resets time.Time
+		limit  int64
+	}{
+		{&report.Day, day, day.AddDate(0, 0, 1), budget.Daily},
+		{&report.Month, month, month.AddDate(0, 1, 0), budget.Monthly},
+	} {
+		totals, err := m.usage.SumAIUsage(ctx, userID, p.since.Unix())
+		if err != nil {
+			return nil, err
+		}
+		*p.period = BudgetPeriod{Since: p.since.Unix(), Resets: p.resets.Unix()}
+		if p.limit != Unlimited {
+			p.period.Limit = &p.limit
+		}
+		for _, t := range totals {
+			p.period.Used += t.TotalTokens
+			p.period.Cost += t.Cost
+		}
+		if p.period == &report.Month {
+			report.Models = totals
+		}
+	}
+	return report, nil
+}
+
+// RequireBudget refuses AI requests with 429 once the caller has used up
+// their daily or monthly token budget. A request is let through as long as
+// any budget is left, so the last one may overshoot it.
+func RequireBudget(meter *Meter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := meter.Report(c, c.GetString("userID"))
+		if err != nil {
+			apierror.Abort(c, apierror.FromStore(err, "user"))
+			return
+		}
+		for _, p := range []struct {
+			name   string
+			period BudgetPeriod
+		}{{"day", report.Day}, {"month", report.Month}} {
+			if !p.period.exhausted() {
+				continue
+			}
+			c.Header("Retry-After", strconv.FormatInt(max(p.period.Resets-time.Now().Unix(), 1), 10))
+			apierror.Abort(c, apierror.New(http.StatusTooManyRequests, apierror.CodeBudgetExceeded, "AI token budget exhausted").
+				WithDetails(gin.H{"period": p.name, "used": p.period.Used, "limit": *p.period.Limit, "resets": p.period.Resets}))
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetUsage reports the caller's AI usage and budget.
+func GetUsage(meter *Meter, c *gin.Context) {
+	report, err := meter.Report(c, c.GetString("userID"))
+	if err != nil {
+		apierror.Abort(c, apierror.FromStore(err, "user"))
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+type meteredProvider struct {
+	ChatProvider
+	meter *Meter
+}
+
+func (p meteredProvider) Complete(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	resp, err := p.ChatProvider.Complete(ctx, request)
+	if err == nil {
+		p.meter.record(ctx, request.Model, resp.Usage)
+	}
+	return resp, err
+}
+
+func (p meteredProvider) Stream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	stream, err := p.ChatProvider.Stream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredStream{ChatStream: stream, ctx: ctx, meter: p.meter, request: request}, nil
+}
+
+// meteredStream records a streamed completion's usage when it ends. When
+// the provider reports none, as some compatible servers do not, or the
+// stream is abandoned, the tokens are estimated.
+type meteredStream struct {
+	ChatStream
+	ctx      context.Context
+	meter    *Meter
+	request  ChatRequest
+	content  strings.Builder
+	usage    *Usage
+	recorded bool
+}
+
+func (s *meteredStream) Recv() (ChatChunk, error) {
+	chunk, err := s.ChatStream.Recv()
+	if errors.Is(err, io.EOF) {
+		s.finish()
+	}
+	if err != nil {
+		return chunk, err
+	}
+	s.content.WriteString(chunk.Content)
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	return chunk, nil
+}
+
+func (s *meteredStream) Close() error {
+	s.finish()
+	return s.ChatStream.Close()
+}
+
+func (s *meteredStream) finish() {
+	if s.recorded {
+		return
+	}
+	s.recorded = true
+	usage := s.usage
+	if usage == nil {
+		if s.content.Len() == 0 {
+			// failed before anything was generated
+			return
+		}
+		estimate := Usage{CompletionTokens: estimateTokens(s.content.String())}
+		for _, m := range s.request.Messages {
+			estimate.PromptTokens += estimateTokens(m.Content)
+		}
+		estimate.TotalTokens = estimate.PromptTokens + estimate.CompletionTokens
+		usage = &estimate
+	}
+	s.meter.record(s.ctx, s.request.Model, *usage)
+}
@@ -0,0 +1,48 @@
+package ai
+
+import (
+	"maps"
+	"testing"
+
+	"crispy-doodle/main.go/store"
+)
+
+func TestParseRoleBudgets(t *testing.T) {
+	with := func(changes map[string]TokenBudget) map[string]TokenBudget {
+		budgets := maps.Clone(DefaultRoleBudgets)
+		maps.Copy(budgets, changes)
+		return budgets
+	}
+	for _, tc := range []struct {
+		spec string
+		want map[string]TokenBudget
+	}{
+		{"", DefaultRoleBudgets},
+		{"  ", DefaultRoleBudgets},
+		{"user=50000/1000000", with(map[string]TokenBudget{store.RoleUser: {Daily: 50000, Monthly: 1000000}})},
+		{"user=0/0", with(map[string]TokenBudget{store.RoleUser: {}})},
+		{"admin=10/20, moderator=unlimited", with(map[string]TokenBudget{
+			store.RoleAdmin:     {Daily: 10, Monthly: 20},
+			store.RoleModerator: {Daily: Unlimited, Monthly: Unlimited},
+		})},
+		{" user = unlimited / 300 ", with(map[string]TokenBudget{store.RoleUser: {Daily: Unlimited, Monthly: 300}})},
+		{"user=1/2,user=3/4", with(map[string]TokenBudget{store.RoleUser: {Daily: 3, Monthly: 4}})},
+	} {
+		got, err := ParseRoleBudgets(tc.spec)
+		if err != nil || !maps.Equal(got, tc.want) {
+			t.Errorf("%q: %v, %v", tc.spec, got, err)
+		}
+	}
+
+	for _, spec := range []string{"user", "user=10", "guest=1/2", "bot=1/2", "user=ten/20", "admin=-1/5", "user=1/2,", "=1/2",
+		"user=1/2/3"} {
+		if budgets, err := ParseRoleBudgets(spec); err == nil {
+			t.Errorf("%q accepted as %v", spec, budgets)
+		}
+	}
+
+	// parsing leaves the defaults alone
+	if _, err := ParseRoleBudgets("user=1/1"); err != nil || DefaultRoleBudgets[store.RoleUser].Daily != 100_000 {
+		t.Errorf("defaults changed to %v", DefaultRoleBudgets)
+	}
+}
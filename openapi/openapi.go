@@ -0,0 +1,114 @@
+package openapi
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+//go:embed docs.html
+var docsHTML []byte
+
+// swaggerUI holds the vendored swagger-ui-dist files; see
+// swagger-ui/fetch.sh.
+//
+//go:generate sh swagger-ui/fetch.sh
+//go:embed swagger-ui
+var swaggerUI embed.FS
+
+// Document is the subset of an OpenAPI 3 document the server reads back.
+type Document struct {
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+var spec = mustParse(specJSON)
+
+func mustParse(b []byte) *Document {
+	var doc Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		panic("openapi: invalid embedded spec: " + err.Error())
+	}
+	return &doc
+}
+
+// Spec returns the parsed embedded document.
+func Spec() *Document {
+	return spec
+}
+
+// Operation looks up the operation for a gin route, e.g. ("PUT",
+// "/api/users/:id").
+func (d *Document) Operation(method, route string) (Operation, bool) {
+	item, ok := d.Paths[PathFromRoute(route)]
+	if !ok {
+		return Operation{}, false
+	}
+	op, ok := item[strings.ToLower(method)]
+	return op, ok
+}
+
+// PathFromRoute converts gin's :param and *param segments to OpenAPI's
+// {param} form.
+func PathFromRoute(route string) string {
+	segments := strings.Split(route, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// ServeSpec writes the raw OpenAPI document.
+func ServeSpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", specJSON)
+}
+
+// ServeDocs writes a Swagger UI page pointed at /openapi.json.
+func ServeDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", docsHTML)
+}
+
+// ServeDocsAsset writes one of the embedded Swagger UI stylesheets or
+// scripts named by the :file parameter.
+func ServeDocsAsset(c *gin.Context) {
+	name := c.Param("file")
+	ext := path.Ext(name)
+	if ext != ".css" && ext != ".js" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	b, err := fs.ReadFile(swaggerUI, "swagger-ui/"+path.Base(name))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, mime.TypeByExtension(ext), b)
+}
@@ -0,0 +1,60 @@
+package openapi
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDocsLoadNothingFromCDN(t *testing.T) {
+	if bytes.Contains(docsHTML, []byte("://")) {
+		t.Fatalf("docs.html references an external URL:\n%s", docsHTML)
+	}
+}
+
+func TestServeDocsAsset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/docs/assets/:file", ServeDocsAsset)
+
+	for _, tc := range []struct {
+		file string
+		want int
+	}{
+		{"fetch.sh", http.StatusNotFound},
+		{"LICENSE", http.StatusNotFound},
+		{"missing.js", http.StatusNotFound},
+		{"..%2Fdocs.html", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs/assets/"+tc.file, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.file, w.Code, tc.want)
+		}
+	}
+}
+
+func TestDocsAssetsVendored(t *testing.T) {
+	if _, err := fs.Stat(swaggerUI, "swagger-ui/VERSION"); err != nil {
+		t.Skip("Swagger UI is not vendored yet, run go generate ./openapi")
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/docs/assets/:file", ServeDocsAsset)
+
+	// everything docs.html loads is embedded
+	for _, file := range []string{"swagger-ui.css", "swagger-ui-bundle.js"} {
+		if !bytes.Contains(docsHTML, []byte("/docs/assets/"+file)) {
+			t.Fatalf("docs.html no longer loads %s", file)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs/assets/"+file, nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s: status %d with %d bytes", file, w.Code, w.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,18 @@
+#!/bin/sh
+# Vendors the Swagger UI assets served at /docs/assets so the docs page
+# loads nothing from a CDN. Run through `go generate ./openapi` and commit
+# the downloaded files; they are embedded into the binary at build time.
+set -eu
+
+VERSION=5.17.14
+BASE="https://registry.npmjs.org/swagger-ui-dist/-/swagger-ui-dist-$VERSION.tgz"
+
+cd "$(dirname "$0")"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+curl -fsSL "$BASE" | tar -xz -C "$tmp"
+for f in swagger-ui.css swagger-ui-bundle.js LICENSE; do
+	cp "$tmp/package/$f" "$f"
+done
+echo "$VERSION" > VERSION
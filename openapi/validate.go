@@ -0,0 +1,216 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+
+	apierror "crispy-doodle/main.go/api-error"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Schema is the subset of JSON Schema used by the embedded spec.
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Required   []string           `json:"required"`
+	Properties map[string]*Schema `json:"properties"`
+	Items      *Schema            `json:"items"`
+	Enum       []any              `json:"enum"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+	Nullable   bool               `json:"nullable"`
+}
+
+// FieldError describes one way a body failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// Validator checks JSON request bodies against the schema the spec declares
+// for the matched route. Routes without a JSON request body pass through.
+// It must run after routing so c.FullPath is known.
+func Validator() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		op, ok := spec.Operation(c.Request.Method, c.FullPath())
+		if !ok || op.RequestBody == nil {
+			c.Next()
+			return
+		}
+		media, ok := op.RequestBody.Content["application/json"]
+		if !ok || media.Schema == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			apierror.Abort(c, apierror.InvalidBody(err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		if len(bytes.TrimSpace(body)) == 0 {
+			if op.RequestBody.Required {
+				apierror.Abort(c, apierror.InvalidBody(errors.New("request body is required")))
+				return
+			}
+			c.Next()
+			return
+		}
+
+		var value any
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			apierror.Abort(c, apierror.InvalidBody(err))
+			return
+		}
+
+		if problems := spec.Validate(media.Schema, value); len(problems) > 0 {
+			apierror.Abort(c, apierror.InvalidBody(nil).WithDetails(problems))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Validate checks a decoded JSON value against schema, resolving $refs
+// against the document's components.
+func (d *Document) Validate(schema *Schema, value any) []FieldError {
+	var problems []FieldError
+	d.validate(schema, value, "", &problems)
+	return problems
+}
+
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+func (d *Document) validate(schema *Schema, value any, path string, problems *[]FieldError) {
+	s := d.resolve(schema)
+	if s == nil {
+		return
+	}
+	fail := func(format string, args ...any) {
+		field := path
+		if field == "" {
+			field = "(body)"
+		}
+		*problems = append(*problems, FieldError{Field: field, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	if value == nil {
+		if !s.Nullable && s.Type != "" {
+			fail("must not be null")
+		}
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*problems = append(*problems, FieldError{Field: joinPath(path, name), Problem: "is required"})
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v, ok := obj[name]; ok {
+				d.validate(s.Properties[name], v, joinPath(path, name), problems)
+			}
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		for i, v := range arr {
+			d.validate(s.Items, v, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Format == "email" {
+			if addr, err := mail.ParseAddress(str); err != nil || addr.Address != str {
+				fail("must be an email address")
+			}
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			fail("must be a %s", s.Type)
+			return
+		}
+		f, err := num.Float64()
+		if err != nil {
+			fail("must be a %s", s.Type)
+			return
+		}
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				fail("must be an integer")
+				return
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return
+			}
+		}
+		fail("must be one of %v", s.Enum)
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,331 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"crispy-doodle/main.go/store"
+)
+
+func CreateAttachmentsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		content_type TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'ready',
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		width INT NOT NULL DEFAULT 0,
+		height INT NOT NULL DEFAULT 0,
+		blurhash TEXT NOT NULL DEFAULT '',
+		thumbnails JSONB NOT NULL DEFAULT '[]'
+	);
+	ALTER TABLE attachments ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'ready';
+	ALTER TABLE attachments ADD COLUMN IF NOT EXISTS width INT NOT NULL DEFAULT 0;
+	ALTER TABLE attachments ADD COLUMN IF NOT EXISTS height INT NOT NULL DEFAULT 0;
+	ALTER TABLE attachments ADD COLUMN IF NOT EXISTS blurhash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnails JSONB NOT NULL DEFAULT '[]';
+	CREATE INDEX IF NOT EXISTS attachments_status_idx ON attachments (status) WHERE status <> 'ready';
+	CREATE INDEX IF NOT EXISTS attachments_owner_idx ON attachments (owner);
+	-- identical uploads share one object, so keys repeat
+	ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_object_key_key;
+	CREATE INDEX IF NOT EXISTS attachments_object_key_idx ON attachments (object_key);
+	-- how many attachments reference each object key. Writers lock the row,
+	-- so sharing a key and releasing its last reference are serialised.
+	CREATE TABLE IF NOT EXISTS content_refs (
+		object_key TEXT NOT NULL PRIMARY KEY,
+		refs INT NOT NULL
+	);
+	INSERT INTO content_refs (object_key, refs)
+		SELECT object_key, count(*) FROM attachments GROUP BY object_key
+		ON CONFLICT (object_key) DO NOTHING;`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+// addContentRef counts one more attachment referencing key.
+func addContentRef(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO content_refs (object_key, refs) VALUES ($1, 1)
+		ON CONFLICT (object_key) DO UPDATE SET refs = content_refs.refs + 1`, key)
+	return err
+}
+
+// dropContentRef counts one attachment fewer referencing key and returns
+// how many are left. The row stays locked until tx ends, and is deleted
+// once nothing references the key.
+func dropContentRef(ctx context.Context, tx *sql.Tx, key string) (int, error) {
+	var refs int
+	err := tx.QueryRowContext(ctx, `UPDATE content_refs SET refs = refs - 1 WHERE object_key = $1 RETURNING refs`, key).
+		Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if refs <= 0 {
+		_, err = tx.ExecContext(ctx, `DELETE FROM content_refs WHERE object_key = $1`, key)
+	}
+	return refs, err
+}
+
+const attachmentColumns = `id, owner, object_key, name, size, content_type, checksum, status, created, width, height, blurhash, thumbnails`
+
+// dbThumbnail is how a thumbnail is stored in the thumbnails column. It
+// keeps the object key, which the API representation hides.
+type dbThumbnail struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	Key         string `json:"key"`
+}
+
+func marshalThumbnails(thumbnails []store.Thumbnail) ([]byte, error) {
+	rows := make([]dbThumbnail, len(thumbnails))
+	for i, t := range thumbnails {
+		rows[i] = dbThumbnail(t)
+	}
+	return json.Marshal(rows)
+}
+
+func scanAttachment(row interface{ Scan(...any) error }) (*store.Attachment, error) {
+	var a store.Attachment
+	var thumbnails []byte
+	err := row.Scan(&a.ID, &a.Owner, &a.Key, &a.Name, &a.Size, &a.ContentType, &a.Checksum, &a.Status, &a.Created,
+		&a.Width, &a.Height, &a.BlurHash, &thumbnails)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	var rows []dbThumbnail
+	if err := json.Unmarshal(thumbnails, &rows); err != nil {
+		return nil, err
+	}
+	a.Thumbnails = make([]store.Thumbnail, len(rows))
+	for i, t := range rows {
+		a.Thumbnails[i] = store.Thumbnail(t)
+	}
+	return &a, nil
+}
+
+func (s *Store) CreateAttachment(ctx context.Context, a *store.Attachment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertAttachment(ctx, tx, a); err != nil {
+		return err
+	}
+	if err := addContentRef(ctx, tx, a.Key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertAttachment(ctx context.Context, tx *sql.Tx, a *store.Attachment) error {
+	if a.ID == "" {
+		a.ID = store.NewAttachmentID()
+	}
+	if a.Status == "" {
+		a.Status = store.AttachmentReady
+	}
+	if a.Thumbnails == nil {
+		a.Thumbnails = []store.Thumbnail{}
+	}
+	thumbnails, err := marshalThumbnails(a.Thumbnails)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO attachments (id, owner, object_key, name, size, content_type, checksum, status, width, height, blurhash, thumbnails)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING created`
+	err = tx.QueryRowContext(ctx, query, a.ID, a.Owner, a.Key, a.Name, a.Size, a.ContentType, a.Checksum, a.Status,
+		a.Width, a.Height, a.BlurHash, thumbnails).
+		Scan(&a.Created)
+	return mapError(err)
+}
+
+func (s *Store) UpdateAttachment(ctx context.Context, a *store.Attachment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRowContext(ctx, `SELECT object_key FROM attachments WHERE id = $1 FOR UPDATE`, a.ID).Scan(&key)
+	if err != nil {
+		return mapError(err)
+	}
+	if err := updateAttachment(ctx, tx, a); err != nil {
+		return err
+	}
+	if key != a.Key {
+		if err := addContentRef(ctx, tx, a.Key); err != nil {
+			return err
+		}
+		if _, err := dropContentRef(ctx, tx, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func updateAttachment(ctx context.Context, tx *sql.Tx, a *store.Attachment) error {
+	thumbnails, err := marshalThumbnails(a.Thumbnails)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE attachments SET object_key=$1, name=$2, size=$3, content_type=$4, checksum=$5, status=$6,
+			width=$7, height=$8, blurhash=$9, thumbnails=$10
+		WHERE id=$11
+		RETURNING owner, created`
+	err = tx.QueryRowContext(ctx, query, a.Key, a.Name, a.Size, a.ContentType, a.Checksum, a.Status,
+		a.Width, a.Height, a.BlurHash, thumbnails, a.ID).
+		Scan(&a.Owner, &a.Created)
+	return mapError(err)
+}
+
+func (s *Store) ListAttachmentsByStatus(ctx context.Context, status string) ([]store.Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE status = $1 ORDER BY id`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []store.Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *a)
+	}
+	return attachments, rows.Err()
+}
+
+func (s *Store) GetAttachment(ctx context.Context, id string) (*store.Attachment, error) {
+	return scanAttachment(s.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE id = $1`, id))
+}
+
+func (s *Store) CanAccessAttachment(ctx context.Context, userID, id string) (bool, error) {
+	query := `SELECT EXISTS (
+		SELECT 1 FROM attachments WHERE id = $2 AND owner = $1
+	) OR EXISTS (
+		SELECT 1 FROM users u
+		JOIN channels c ON c.id = ANY(u.channels)
+		JOIN messages m ON m.id = ANY(c.messages)
+		WHERE u.id = $1 AND $2 = ANY(m.images)
+	)`
+	var ok bool
+	err := s.db.QueryRowContext(ctx, query, userID, id).Scan(&ok)
+	return ok, err
+}
+
+func (s *Store) DeleteAttachment(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRowContext(ctx, `DELETE FROM attachments WHERE id = $1 RETURNING object_key`, id).Scan(&key)
+	if err != nil {
+		return mapError(err)
+	}
+	if _, err := dropContentRef(ctx, tx, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) FindAttachmentByKey(ctx context.Context, key string) (*store.Attachment, error) {
+	query := `SELECT ` + attachmentColumns + ` FROM attachments
+		WHERE object_key = $1 AND status = 'ready'
+		ORDER BY created LIMIT 1`
+	return scanAttachment(s.db.QueryRowContext(ctx, query, key))
+}
+
+func (s *Store) ShareAttachment(ctx context.Context, a *store.Attachment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// waits for a release holding the row, then sees whether it was the last
+	if err := execOne(tx.ExecContext(ctx, `UPDATE content_refs SET refs = refs + 1
+		WHERE object_key = $1 AND refs > 0`, a.Key)); err != nil {
+		return err
+	}
+	var key string
+	err = tx.QueryRowContext(ctx, `SELECT object_key FROM attachments WHERE id = $1 FOR UPDATE`, a.ID).Scan(&key)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = insertAttachment(ctx, tx, a)
+	case err == nil:
+		if err = updateAttachment(ctx, tx, a); err == nil {
+			_, err = dropContentRef(ctx, tx, key)
+		}
+	}
+	if err != nil {
+		return mapError(err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ReleaseAttachment(ctx context.Context, id string, purge func(*store.Attachment) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	a, err := scanAttachment(tx.QueryRowContext(ctx, `DELETE FROM attachments WHERE id = $1 RETURNING `+attachmentColumns, id))
+	if err != nil {
+		return err
+	}
+	refs, err := dropContentRef(ctx, tx, a.Key)
+	if err != nil {
+		return err
+	}
+	if refs <= 0 && purge != nil {
+		if err := purge(a); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetStorageUsage(ctx context.Context, owner string, largest int) (*store.StorageUsage, error) {
+	usage := &store.StorageUsage{Largest: []store.Attachment{}}
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(size), 0), COUNT(*) FROM attachments WHERE owner = $1`, owner).
+		Scan(&usage.Bytes, &usage.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM attachments
+		WHERE owner = $1 ORDER BY size DESC, id LIMIT $2`, owner, largest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		usage.Largest = append(usage.Largest, *a)
+	}
+	return usage, rows.Err()
+}
@@ -1,154 +1,161 @@
 package postgresdb
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"net/http"
-	"time"
 
-	"github.com/gin-gonic/gin"
+	"crispy-doodle/main.go/store"
+
 	"github.com/lib/pq"
 )
 
-type Channel struct {
-	ID       string   `json:"id"`
-	Title    string   `json:"text"`
-	Messages []string `json:"messages"`
-	Created  int64    `json:"created"`
-	Updated  int64    `json:"updated"`
-}
-
 func CreateChannelsTable(db *sql.DB) error {
 	query := `
 	CREATE TABLE IF NOT EXISTS channels (
 		id TEXT UNIQUE NOT NULL PRIMARY KEY,
-		Title TEXT,
-		Messages TEXT[], 
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW()
-	);`
+		title TEXT,
+		owner TEXT NOT NULL DEFAULT '',
+		messages TEXT[],
+		assistant BOOL NOT NULL DEFAULT false,
+		moderation TEXT NOT NULL DEFAULT '',
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);` + epochColumnsMigration("channels") + `
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS assistant BOOL NOT NULL DEFAULT false;
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS moderation TEXT NOT NULL DEFAULT '';
+	ALTER TABLE channels ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';`
 
 	_, err := db.Exec(query)
 	return err
 }
 
-func GenerateChannelID() string {
-	timestamp := time.Now().UnixNano()
-	return fmt.Sprintf("channel_%d", timestamp)
-}
-
-func CreateChannel(db *sql.DB, c *gin.Context) {
-	var channel Channel
+// CreateChannelReadsTable holds how far each user has read each channel.
+func CreateChannelReadsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS channel_reads (
+		user_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+		read_at BIGINT NOT NULL,
+		PRIMARY KEY (user_id, channel_id)
+	);`
 
-	if err := c.ShouldBindJSON(&channel); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+	_, err := db.Exec(query)
+	return err
+}
 
-	channelID := GenerateChannelID()
+const channelColumns = `id, COALESCE(title, ''), owner, messages, assistant, moderation, created, updated`
 
-	query := `INSERT INTO channels (id, title, messages)
-		VALUES ($1, $2, $3)`
-	_, err := db.ExecContext(c, query, channelID, channel.Title, pq.Array(channel.Messages))
+func scanChannel(row interface{ Scan(...any) error }) (*store.Channel, error) {
+	var channel store.Channel
+	var messages pq.StringArray
+	err := row.Scan(&channel.ID, &channel.Title, &channel.Owner, &messages, &channel.Assistant, &channel.Moderation, &channel.Created, &channel.Updated)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, mapError(err)
+	}
+	channel.Messages = messages
+	if channel.Messages == nil {
+		channel.Messages = []string{}
 	}
+	return &channel, nil
+}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Message sent!"})
+func (s *Store) CreateChannel(ctx context.Context, channel *store.Channel) error {
+	if channel.ID == "" {
+		channel.ID = store.NewChannelID()
+	}
+	query := `INSERT INTO channels (id, title, owner, messages, assistant, moderation)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created, updated`
+	err := s.db.QueryRowContext(ctx, query, channel.ID, channel.Title, channel.Owner, pq.Array(channel.Messages),
+		channel.Assistant, channel.Moderation).
+		Scan(&channel.Created, &channel.Updated)
+	return mapError(err)
 }
 
-func GetChannels(db *sql.DB, c *gin.Context) {
-	rows, err := db.QueryContext(c, "SELECT id, title, messages, created, updated FROM channels;")
+func (s *Store) ListChannels(ctx context.Context) ([]store.Channel, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+channelColumns+` FROM channels ORDER BY created, id`)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	var channels []Channel
+	channels := []store.Channel{}
 	for rows.Next() {
-		var channel Channel
-		if err := rows.Scan(&channel.ID, &channel.Title, &channel.Messages, &channel.Created, &channel.Updated); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
 		}
-		channels = append(channels, channel)
+		channels = append(channels, *channel)
 	}
-
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, channels)
+	return channels, rows.Err()
 }
 
-func GetChannelByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	var channel Channel
-	query := `SELECT id, title, messages, created, updated FROM channels WHERE id = $1`
-
-	err := db.QueryRowContext(c, query, id).Scan(&channel.ID, &channel.Title, &channel.Messages, &channel.Created, &channel.Updated)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
-		return
-	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, channel)
+func (s *Store) GetChannel(ctx context.Context, id string) (*store.Channel, error) {
+	return scanChannel(s.db.QueryRowContext(ctx, `SELECT `+channelColumns+` FROM channels WHERE id = $1`, id))
 }
 
-func UpdateChannelByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	var channel Channel
-	if err := c.ShouldBindJSON(&channel); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	query := `UPDATE channels SET title=$1, messages=$2, updated=EXTRACT(EPOCH FROM now()) WHERE id=$3`
-	result, err := db.ExecContext(c, query, channel.Title, channel.Messages, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+func (s *Store) UpdateChannel(ctx context.Context, channel *store.Channel) error {
+	query := `UPDATE channels SET title=$1, assistant=$2, moderation=$3, updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$4
+		RETURNING owner, messages, created, updated`
+	var messages pq.StringArray
+	err := s.db.QueryRowContext(ctx, query, channel.Title, channel.Assistant, channel.Moderation, channel.ID).
+		Scan(&channel.Owner, &messages, &channel.Created, &channel.Updated)
+	channel.Messages = messages
+	if channel.Messages == nil {
+		channel.Messages = []string{}
 	}
+	return mapError(err)
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+func (s *Store) DeleteChannel(ctx context.Context, id string) error {
+	return execOne(s.db.ExecContext(ctx, `DELETE FROM channels WHERE id = $1`, id))
+}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-		return
-	}
+func (s *Store) AddChannelMessage(ctx context.Context, channelID, messageID string) error {
+	return execOne(s.db.ExecContext(ctx, `UPDATE channels
+		SET messages = array_append(messages, $1), updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2`, messageID, channelID))
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Channel updated!"})
+func (s *Store) FindMessageChannel(ctx context.Context, messageID string) (*store.Channel, error) {
+	return scanChannel(s.db.QueryRowContext(ctx, `SELECT `+channelColumns+` FROM channels
+		WHERE $1 = ANY(messages) ORDER BY id LIMIT 1`, messageID))
 }
 
-func DeleteChannelByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	query := `DELETE FROM channels WHERE id = $1`
-	result, err := db.ExecContext(c, query, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+func (s *Store) ListChannelMessages(ctx context.Context, channelID string, since int64) ([]store.Message, error) {
+	if _, err := s.GetChannel(ctx, channelID); err != nil {
+		return nil, err
 	}
-
-	rowsAffected, err := result.RowsAffected()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE id = ANY(SELECT unnest(messages) FROM channels WHERE id = $1) AND created > $2
+		ORDER BY created, id`, channelID, since)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
-		return
+	messages := []store.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
 	}
+	return messages, rows.Err()
+}
+
+func (s *Store) GetReadPosition(ctx context.Context, userID, channelID string) (int64, error) {
+	var at int64
+	err := s.db.QueryRowContext(ctx, `SELECT read_at FROM channel_reads WHERE user_id = $1 AND channel_id = $2`,
+		userID, channelID).Scan(&at)
+	return at, mapError(err)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted!"})
+func (s *Store) SetReadPosition(ctx context.Context, userID, channelID string, at int64) error {
+	query := `INSERT INTO channel_reads (user_id, channel_id, read_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, channel_id) DO UPDATE SET read_at = EXCLUDED.read_at`
+	_, err := s.db.ExecContext(ctx, query, userID, channelID, at)
+	return mapError(err)
 }
@@ -0,0 +1,139 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+
+	"crispy-doodle/main.go/store"
+)
+
+func CreateConversationsTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS ai_conversations (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);
+	CREATE INDEX IF NOT EXISTS ai_conversations_owner_idx ON ai_conversations (owner, updated DESC);
+	CREATE TABLE IF NOT EXISTS ai_messages (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		conversation_id TEXT NOT NULL REFERENCES ai_conversations (id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		tokens INT NOT NULL DEFAULT 0,
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);
+	CREATE INDEX IF NOT EXISTS ai_messages_conversation_idx ON ai_messages (conversation_id, created, id);`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+const conversationColumns = `id, owner, title, created, updated`
+
+func scanConversation(row interface{ Scan(...any) error }) (*store.Conversation, error) {
+	var c store.Conversation
+	if err := row.Scan(&c.ID, &c.Owner, &c.Title, &c.Created, &c.Updated); err != nil {
+		return nil, mapError(err)
+	}
+	return &c, nil
+}
+
+func (s *Store) CreateConversation(ctx context.Context, c *store.Conversation) error {
+	if c.ID == "" {
+		c.ID = store.NewConversationID()
+	}
+	query := `INSERT INTO ai_conversations (id, owner, title)
+		VALUES ($1, $2, $3)
+		RETURNING created, updated`
+	err := s.db.QueryRowContext(ctx, query, c.ID, c.Owner, c.Title).Scan(&c.Created, &c.Updated)
+	return mapError(err)
+}
+
+func (s *Store) GetConversation(ctx context.Context, id string) (*store.Conversation, error) {
+	return scanConversation(s.db.QueryRowContext(ctx, `SELECT `+conversationColumns+` FROM ai_conversations WHERE id = $1`, id))
+}
+
+func (s *Store) UpdateConversation(ctx context.Context, c *store.Conversation) error {
+	query := `UPDATE ai_conversations SET title=$1, updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$2
+		RETURNING owner, created, updated`
+	err := s.db.QueryRowContext(ctx, query, c.Title, c.ID).Scan(&c.Owner, &c.Created, &c.Updated)
+	return mapError(err)
+}
+
+func (s *Store) ListConversations(ctx context.Context, owner string) ([]store.Conversation, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+conversationColumns+` FROM ai_conversations
+		WHERE owner = $1 ORDER BY updated DESC, id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []store.Conversation{}
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, *c)
+	}
+	return conversations, rows.Err()
+}
+
+func (s *Store) DeleteConversation(ctx context.Context, id string) error {
+	// the messages go with it through ON DELETE CASCADE
+	return execOne(s.db.ExecContext(ctx, `DELETE FROM ai_conversations WHERE id = $1`, id))
+}
+
+func (s *Store) AddAIMessages(ctx context.Context, conversationID string, messages ...*store.AIMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var now int64
+	err = tx.QueryRowContext(ctx, `UPDATE ai_conversations SET updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$1 RETURNING updated`, conversationID).Scan(&now)
+	if err != nil {
+		return mapError(err)
+	}
+	for _, m := range messages {
+		if m.ID == "" {
+			m.ID = store.NewAIMessageID()
+		}
+		m.ConversationID = conversationID
+		m.Created = now
+		_, err := tx.ExecContext(ctx, `INSERT INTO ai_messages (id, conversation_id, role, content, tokens, created)
+			VALUES ($1, $2, $3, $4, $5, $6)`, m.ID, conversationID, m.Role, m.Content, m.Tokens, m.Created)
+		if err != nil {
+			return mapError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListAIMessages(ctx context.Context, conversationID string) ([]store.AIMessage, error) {
+	if _, err := s.GetConversation(ctx, conversationID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, conversation_id, role, content, tokens, created FROM ai_messages
+		WHERE conversation_id = $1 ORDER BY created, id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []store.AIMessage{}
+	for rows.Next() {
+		var m store.AIMessage
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &m.Content, &m.Tokens, &m.Created); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
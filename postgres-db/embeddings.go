@@ -0,0 +1,162 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"crispy-doodle/main.go/store"
+
+	"github.com/lib/pq"
+)
+
+// ErrNoPGVector is returned by Migrate when the pgvector extension cannot be
+// created. Every other table is migrated; only semantic search is
+// unavailable until the extension is installed and Migrate runs again.
+var ErrNoPGVector = errors.New("the pgvector extension is not available")
+
+// hnswMaxDimensions is the most dimensions pgvector's HNSW index takes.
+// Embeddings of models with more are searched without an index.
+const hnswMaxDimensions = 2000
+
+// CreateEmbeddingsTable needs the pgvector extension. The column has no
+// fixed dimension so the embedding model can change; each model gets its
+// dimension, and its index, from its first embedding, see embeddingIndex.
+func CreateEmbeddingsTable(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`); err != nil {
+		return fmt.Errorf("%w: %v", ErrNoPGVector, err)
+	}
+	query := `
+	CREATE TABLE IF NOT EXISTS message_embeddings (
+		message_id TEXT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		model TEXT NOT NULL,
+		embedding vector NOT NULL,
+		version BIGINT NOT NULL,
+		PRIMARY KEY (message_id, model)
+	);`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+// vectorError maps the errors of a database without pgvector, or without
+// the table Migrate could then not create, to store.ErrUnavailable.
+func vectorError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && (pqErr.Code == "42P01" || pqErr.Code == "42704") {
+		return fmt.Errorf("%w: %v", store.ErrUnavailable, err)
+	}
+	return mapError(err)
+}
+
+// embeddingIndex creates the HNSW index on model's embeddings, which have
+// dims dimensions, unless s already did. Postgres only indexes vectors of
+// one dimension, so each model's index is a partial one over its
+// embeddings cast to that dimension. The cast also rejects an embedding of
+// the model with any other dimension.
+func (s *Store) embeddingIndex(ctx context.Context, model string, dims int) error {
+	if dims > hnswMaxDimensions {
+		return nil
+	}
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexed[model] == dims {
+		return nil
+	}
+	name := fmt.Sprintf("message_embeddings_hnsw_%08x", crc32.ChecksumIEEE([]byte(model)))
+	query := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON message_embeddings
+		USING hnsw ((embedding::vector(%d)) vector_cosine_ops) WHERE model = %s`,
+		pq.QuoteIdentifier(name), dims, pq.QuoteLiteral(model))
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return vectorError(err)
+	}
+	if s.indexed == nil {
+		s.indexed = map[string]int{}
+	}
+	s.indexed[model] = dims
+	return nil
+}
+
+// vectorLiteral renders v in pgvector's text format, e.g. [0.1,0.2].
+func vectorLiteral(v []float32) string {
+	parts := make([]string, len(v))
+	for i, x := range v {
+		parts[i] = strconv.FormatFloat(float64(x), 'g', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func (s *Store) SaveEmbedding(ctx context.Context, embedding *store.MessageEmbedding) error {
+	if err := s.embeddingIndex(ctx, embedding.Model, len(embedding.Vector)); err != nil {
+		return err
+	}
+	query := `INSERT INTO message_embeddings (message_id, model, embedding, version)
+		VALUES ($1, $2, $3::vector, $4)
+		ON CONFLICT (message_id, model) DO UPDATE
+		SET embedding = EXCLUDED.embedding, version = EXCLUDED.version`
+	_, err := s.db.ExecContext(ctx, query, embedding.MessageID, embedding.Model, vectorLiteral(embedding.Vector), embedding.Version)
+	return vectorError(err)
+}
+
+func (s *Store) ListUnembeddedMessages(ctx context.Context, model string, limit int) ([]store.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages
+		LEFT JOIN message_embeddings e ON e.message_id = messages.id AND e.model = $1
+		WHERE COALESCE(messages.text, '') <> '' AND (e.message_id IS NULL OR e.version < messages.updated)
+		ORDER BY messages.created, messages.id
+		LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, query, model, limit)
+	if err != nil {
+		return nil, vectorError(err)
+	}
+	defer rows.Close()
+
+	messages := []store.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+	return messages, rows.Err()
+}
+
+// SearchMessages orders by cosine distance, <=> in pgvector, between
+// vectors cast to the query's dimension so the model's HNSW index serves
+// it. The caller's channels are read from the users table in the same
+// query. A message in several of them is reported in the first by ID.
+func (s *Store) SearchMessages(ctx context.Context, model string, vector []float32, userID string, limit int) ([]store.MessageMatch, error) {
+	distance := fmt.Sprintf(`(e.embedding::vector(%[1]d) <=> $1::vector(%[1]d))`, len(vector))
+	query := `SELECT ` + messageColumns + `, ch.channel_id, 1 - ` + distance + `
+		FROM message_embeddings e
+		JOIN messages ON messages.id = e.message_id
+		CROSS JOIN LATERAL (
+			SELECT c.id AS channel_id FROM users u JOIN channels c ON c.id = ANY(u.channels)
+			WHERE u.id = $3 AND messages.id = ANY(c.messages)
+			ORDER BY c.id LIMIT 1
+		) ch
+		WHERE e.model = $2 AND messages.moderation_status IS DISTINCT FROM $4
+		ORDER BY ` + distance + `
+		LIMIT $5`
+	rows, err := s.db.QueryContext(ctx, query, vectorLiteral(vector), model, userID, store.ModerationFlagged, limit)
+	if err != nil {
+		return nil, vectorError(err)
+	}
+	defer rows.Close()
+
+	matches := []store.MessageMatch{}
+	for rows.Next() {
+		var match store.MessageMatch
+		message, err := scanMessage(rows, &match.ChannelID, &match.Score)
+		if err != nil {
+			return nil, err
+		}
+		match.Message = *message
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
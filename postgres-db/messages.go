@@ -1,156 +1,154 @@
 package postgresdb
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"net/http"
-	"time"
+	"encoding/json"
+
+	"crispy-doodle/main.go/store"
 
-	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
 )
 
-type Message struct {
-	ID      string   `json:"id"`
-	Sender  string   `json:"sender"`
-	Text    string   `json:"text"`
-	Images  []string `json:"images"`
-	Created int64    `json:"created"`
-	Updated int64    `json:"updated"`
-}
-
 func CreateMessagesTable(db *sql.DB) error {
 	query := `
 	CREATE TABLE IF NOT EXISTS messages (
 		id TEXT UNIQUE NOT NULL PRIMARY KEY,
 		sender TEXT NOT NULL,
 		text TEXT,
-		images TEXT[], 
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW()
-	);`
+		images TEXT[],
+		ai BOOL NOT NULL DEFAULT false,
+		moderation JSONB,
+		moderation_status TEXT,
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);` + epochColumnsMigration("messages") + `
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS ai BOOL NOT NULL DEFAULT false;
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS moderation JSONB;
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS moderation_status TEXT;
+	CREATE INDEX IF NOT EXISTS messages_moderation_status ON messages (moderation_status, created)
+		WHERE moderation_status IS NOT NULL;`
 
 	_, err := db.Exec(query)
 	return err
 }
 
-func GenerateMessageID() string {
-	timestamp := time.Now().UnixNano()
-	return fmt.Sprintf("message_%d", timestamp)
+const messageColumns = `id, sender, COALESCE(text, ''), images, ai, moderation, created, updated`
+
+// scanMessage scans messageColumns followed by any extra columns.
+func scanMessage(row interface{ Scan(...any) error }, extra ...any) (*store.Message, error) {
+	var message store.Message
+	var images pq.StringArray
+	var moderation []byte
+	dest := append([]any{&message.ID, &message.Sender, &message.Text, &images, &message.AI, &moderation,
+		&message.Created, &message.Updated}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, mapError(err)
+	}
+	message.Images = images
+	if message.Images == nil {
+		message.Images = []string{}
+	}
+	if moderation != nil {
+		if err := json.Unmarshal(moderation, &message.Moderation); err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
 }
 
-func CreateMessage(db *sql.DB, c *gin.Context) {
-	var message Message
-
-	if err := c.ShouldBindJSON(&message); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// moderationColumns are the values of the moderation and
+// moderation_status columns for m.
+func moderationColumns(m *store.Moderation) (moderation []byte, status sql.NullString, err error) {
+	if m == nil {
+		return nil, status, nil
 	}
+	moderation, err = json.Marshal(m)
+	return moderation, sql.NullString{String: m.Status, Valid: true}, err
+}
 
-	messageId := GenerateMessageID()
-
-	query := `INSERT INTO messages (id, sender, text, images)
-		VALUES ($1, $2, $3, $4)`
-	_, err := db.ExecContext(c, query, messageId, message.Sender, message.Text, pq.Array(message.Images))
+func (s *Store) CreateMessage(ctx context.Context, message *store.Message) error {
+	if message.ID == "" {
+		message.ID = store.NewMessageID()
+	}
+	moderation, status, err := moderationColumns(message.Moderation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return err
 	}
-
-	c.JSON(http.StatusCreated, gin.H{"message": "Message sent!"})
+	query := `INSERT INTO messages (id, sender, text, images, ai, moderation, moderation_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created, updated`
+	err = s.db.QueryRowContext(ctx, query, message.ID, message.Sender, message.Text, pq.Array(message.Images), message.AI,
+		moderation, status).
+		Scan(&message.Created, &message.Updated)
+	return mapError(err)
 }
 
-func GetMessages(db *sql.DB, c *gin.Context) {
-	rows, err := db.QueryContext(c, "SELECT id, sender, text, images, created, updated FROM messages;")
+func (s *Store) ListMessages(ctx context.Context) ([]store.Message, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages ORDER BY created, id`)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []Message
+	messages := []store.Message{}
 	for rows.Next() {
-		var message Message
-		if err := rows.Scan(&message.ID, &message.Sender, &message.Text, &message.Images, &message.Created, &message.Updated); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
 		}
-		messages = append(messages, message)
+		messages = append(messages, *message)
 	}
-
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, messages)
+	return messages, rows.Err()
 }
 
-func GetMessageById(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	var message Message
-	query := `SELECT id, sender, text, images, created, updated FROM messages WHERE id = $1`
-
-	err := db.QueryRowContext(c, query, id).Scan(&message.ID, &message.Sender, &message.Text, &message.Images, &message.Created, &message.Updated)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-		return
-	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, message)
+func (s *Store) GetMessage(ctx context.Context, id string) (*store.Message, error) {
+	return scanMessage(s.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = $1`, id))
 }
 
-func UpdateMessageByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	var message Message
-	if err := c.ShouldBindJSON(&message); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	query := `UPDATE messages SET sender=$1, text=$2, images=$3, updated=EXTRACT(EPOCH FROM now()) WHERE id=$5`
-	result, err := db.ExecContext(c, query, message.Sender, message.Text, message.Images, id)
+func (s *Store) UpdateMessage(ctx context.Context, message *store.Message) error {
+	moderation, status, err := moderationColumns(message.Moderation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return err
 	}
+	query := `UPDATE messages SET sender=$1, text=$2, images=$3, moderation=$4, moderation_status=$5,
+			updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$6
+		RETURNING ai, created, updated`
+	err = s.db.QueryRowContext(ctx, query, message.Sender, message.Text, pq.Array(message.Images), moderation, status,
+		message.ID).
+		Scan(&message.AI, &message.Created, &message.Updated)
+	return mapError(err)
+}
 
-	rowsAffected, err := result.RowsAffected()
+func (s *Store) ListMessagesByModeration(ctx context.Context, status string) ([]store.Message, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE moderation_status = $1 ORDER BY created, id`, status)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-		return
+	messages := []store.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Message updated!"})
+	return messages, rows.Err()
 }
 
-func DeleteMessageByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	query := `DELETE FROM messages WHERE id = $1`
-	result, err := db.ExecContext(c, query, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	rowsAffected, err := result.RowsAffected()
+func (s *Store) SetMessageModeration(ctx context.Context, id string, moderation *store.Moderation) error {
+	value, status, err := moderationColumns(moderation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-		return
+		return err
 	}
+	return execOne(s.db.ExecContext(ctx, `UPDATE messages SET moderation = $1, moderation_status = $2 WHERE id = $3`,
+		value, status, id))
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message deleted!"})
+func (s *Store) DeleteMessage(ctx context.Context, id string) error {
+	return execOne(s.db.ExecContext(ctx, `DELETE FROM messages WHERE id = $1`, id))
 }
@@ -2,13 +2,19 @@ package postgresdb
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"sync"
 
 	"crispy-doodle/main.go/global"
+	"crispy-doodle/main.go/store"
+
+	"github.com/lib/pq"
 )
 
-func ConnectPSQL(db *sql.DB) *sql.DB {
+func ConnectPSQL(logger *slog.Logger) *sql.DB {
 
 	host := global.PostgresHost
 	port := global.PostgresPort
@@ -18,7 +24,6 @@ func ConnectPSQL(db *sql.DB) *sql.DB {
 	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
-	// fmt.Println("Connecting with:", psqlInfo)
 
 	mydb, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
@@ -30,6 +35,116 @@ func ConnectPSQL(db *sql.DB) *sql.DB {
 		panic(err)
 	}
 
-	log.Printf("[CONNECTED] to Postgres on :%s", port)
+	logger.Info("connected to Postgres", "host", host, "port", port)
 	return mydb
 }
+
+// Store implements the store interfaces on top of Postgres.
+type Store struct {
+	db *sql.DB
+
+	indexMu sync.Mutex
+	// indexed holds the dimension of each embedding model whose index exists
+	indexed map[string]int
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Stores returns s wired up as every repository.
+func (s *Store) Stores() store.Stores {
+	return store.Stores{Users: s, Messages: s, Channels: s, Attachments: s, Uploads: s, Conversations: s, Summaries: s,
+		Embeddings: s, AIUsage: s}
+}
+
+// Migrate creates any missing tables. Without pgvector it migrates the rest
+// and returns ErrNoPGVector.
+func Migrate(db *sql.DB) error {
+	var noVector error
+	for _, create := range []func(*sql.DB) error{
+		CreateUsersTable,
+		CreateMessagesTable,
+		CreateChannelsTable,
+		CreateChannelReadsTable,
+		CreateAttachmentsTable,
+		CreateUploadSessionsTable,
+		CreateConversationsTables,
+		CreateSummariesTable,
+		CreateEmbeddingsTable,
+		CreateAIUsageTable,
+	} {
+		err := create(db)
+		if errors.Is(err, ErrNoPGVector) {
+			noVector = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return noVector
+}
+
+// epochColumnsMigration brings a table created before the store interfaces
+// up to date: it adds the BIGINT created/updated columns, copies the old
+// created_at/updated_at timestamps into them and drops the old columns, so
+// it only does work once.
+func epochColumnsMigration(table string) string {
+	return fmt.Sprintf(`
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS created BIGINT DEFAULT (EXTRACT(EPOCH FROM now()));
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()));
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = '%[1]s' AND column_name = 'created_at') THEN
+			UPDATE %[1]s SET
+				created = COALESCE(EXTRACT(EPOCH FROM created_at)::BIGINT, created),
+				updated = COALESCE(EXTRACT(EPOCH FROM updated_at)::BIGINT, updated);
+			ALTER TABLE %[1]s DROP COLUMN created_at, DROP COLUMN IF EXISTS updated_at;
+		END IF;
+	END $$;`, table)
+}
+
+// mapError translates driver errors into the store's sentinel errors.
+func mapError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.ErrNotFound
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return &store.ConflictError{Field: constraintField(pqErr.Table, pqErr.Constraint)}
+	}
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		// a reference to a row that does not exist
+		return store.ErrNotFound
+	}
+	return err
+}
+
+// constraintField recovers the column from Postgres' default unique
+// constraint name, <table>_<column>_key.
+func constraintField(table, constraint string) string {
+	if constraint == table+"_pkey" {
+		return "id"
+	}
+	if !strings.HasPrefix(constraint, table+"_") || !strings.HasSuffix(constraint, "_key") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(constraint, table+"_"), "_key")
+}
+
+// execOne runs a write that must touch exactly one row.
+func execOne(result sql.Result, err error) error {
+	if err != nil {
+		return mapError(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
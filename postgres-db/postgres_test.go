@@ -0,0 +1,92 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacySchema is the messages and channels tables as the first release
+// created them, before the store interfaces.
+const legacySchema = `
+	CREATE TABLE messages (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		sender TEXT NOT NULL,
+		text TEXT,
+		images TEXT[],
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	CREATE TABLE channels (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		Title TEXT,
+		Messages TEXT[],
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	INSERT INTO messages (id, sender, text, images, created_at, updated_at)
+		VALUES ('message_1', 'user_1', 'hello', '{}', '2023-01-02 03:04:05', '2023-01-02 03:04:06');
+	INSERT INTO channels (id, Title, Messages, created_at, updated_at)
+		VALUES ('channel_1', 'general', '{message_1}', '2023-01-02 03:04:05', '2023-01-02 03:04:06');`
+
+func TestMigrateLegacySchema(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	defer admin.Close()
+	if _, err := admin.Exec(`CREATE EXTENSION IF NOT EXISTS vector SCHEMA public`); err != nil {
+		t.Fatalf("create pgvector extension: %v", err)
+	}
+	schema := fmt.Sprintf("test_legacy_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	defer admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", dsn+sep+"search_path="+schema+",public")
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+
+	// twice, to check the migration is a no-op once applied
+	for i := 0; i < 2; i++ {
+		if err := Migrate(db); err != nil {
+			t.Fatalf("migrate #%d: %v", i+1, err)
+		}
+	}
+
+	s := NewStore(db)
+	ctx := context.Background()
+	want := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	message, err := s.GetMessage(ctx, "message_1")
+	if err != nil {
+		t.Fatalf("get migrated message: %v", err)
+	}
+	if message.Created != want || message.Updated != want+1 || message.Text != "hello" {
+		t.Errorf("migrated message = %+v, want created %d", message, want)
+	}
+	channel, err := s.GetChannel(ctx, "channel_1")
+	if err != nil {
+		t.Fatalf("get migrated channel: %v", err)
+	}
+	if channel.Created != want || channel.Title != "general" || len(channel.Messages) != 1 {
+		t.Errorf("migrated channel = %+v, want created %d", channel, want)
+	}
+}
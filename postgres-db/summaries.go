@@ -0,0 +1,47 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+
+	"crispy-doodle/main.go/store"
+)
+
+func CreateSummariesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS channel_summaries (
+		channel_id TEXT NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+		from_message TEXT NOT NULL,
+		digest TEXT NOT NULL,
+		summary TEXT NOT NULL,
+		messages INT NOT NULL,
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		PRIMARY KEY (channel_id, from_message)
+	);`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+func (s *Store) GetChannelSummary(ctx context.Context, channelID, from string) (*store.ChannelSummary, error) {
+	summary := store.ChannelSummary{ChannelID: channelID, From: from}
+	err := s.db.QueryRowContext(ctx, `SELECT digest, summary, messages, created FROM channel_summaries
+		WHERE channel_id = $1 AND from_message = $2`, channelID, from).
+		Scan(&summary.Digest, &summary.Summary, &summary.Messages, &summary.Created)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &summary, nil
+}
+
+func (s *Store) SaveChannelSummary(ctx context.Context, summary *store.ChannelSummary) error {
+	query := `INSERT INTO channel_summaries (channel_id, from_message, digest, summary, messages)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (channel_id, from_message) DO UPDATE
+		SET digest = EXCLUDED.digest, summary = EXCLUDED.summary, messages = EXCLUDED.messages,
+			created = EXTRACT(EPOCH FROM now())
+		RETURNING created`
+	err := s.db.QueryRowContext(ctx, query, summary.ChannelID, summary.From, summary.Digest, summary.Summary, summary.Messages).
+		Scan(&summary.Created)
+	return mapError(err)
+}
@@ -0,0 +1,110 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"crispy-doodle/main.go/store"
+)
+
+func CreateUploadSessionsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT UNIQUE NOT NULL PRIMARY KEY,
+		attachment_id TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		upload_id TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		received BIGINT NOT NULL DEFAULT 0,
+		parts JSONB NOT NULL DEFAULT '[]',
+		hash_state BYTEA,
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+		updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);
+	CREATE INDEX IF NOT EXISTS upload_sessions_updated_idx ON upload_sessions (updated);`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+const uploadSessionColumns = `id, attachment_id, owner, object_key, upload_id, size, received, parts, hash_state, created, updated`
+
+func scanUploadSession(row interface{ Scan(...any) error }) (*store.UploadSession, error) {
+	var session store.UploadSession
+	var parts []byte
+	err := row.Scan(&session.ID, &session.AttachmentID, &session.Owner, &session.Key, &session.UploadID,
+		&session.Size, &session.Offset, &parts, &session.HashState, &session.Created, &session.Updated)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if err := json.Unmarshal(parts, &session.Parts); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *Store) CreateUploadSession(ctx context.Context, session *store.UploadSession) error {
+	if session.ID == "" {
+		session.ID = store.NewUploadSessionID()
+	}
+	parts, err := json.Marshal(session.Parts)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO upload_sessions (id, attachment_id, owner, object_key, upload_id, size, received, parts, hash_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created, updated`
+	err = s.db.QueryRowContext(ctx, query, session.ID, session.AttachmentID, session.Owner, session.Key, session.UploadID,
+		session.Size, session.Offset, parts, session.HashState).
+		Scan(&session.Created, &session.Updated)
+	return mapError(err)
+}
+
+func (s *Store) GetUploadSession(ctx context.Context, id string) (*store.UploadSession, error) {
+	return scanUploadSession(s.db.QueryRowContext(ctx, `SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id = $1`, id))
+}
+
+func (s *Store) AdvanceUploadSession(ctx context.Context, session *store.UploadSession, from int64) error {
+	parts, err := json.Marshal(session.Parts)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE upload_sessions SET received=$1, parts=$2, hash_state=$3, updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$4 AND received=$5
+		RETURNING updated`
+	err = s.db.QueryRowContext(ctx, query, session.Offset, parts, session.HashState, session.ID, from).
+		Scan(&session.Updated)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return mapError(err)
+	}
+	// tell a missing session apart from one another request advanced
+	if _, err := s.GetUploadSession(ctx, session.ID); err != nil {
+		return err
+	}
+	return &store.ConflictError{Field: "offset"}
+}
+
+func (s *Store) DeleteUploadSession(ctx context.Context, id string) error {
+	return execOne(s.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = $1`, id))
+}
+
+func (s *Store) ListStaleUploadSessions(ctx context.Context, before int64) ([]store.UploadSession, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE updated < $1 ORDER BY id`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []store.UploadSession{}
+	for rows.Next() {
+		session, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
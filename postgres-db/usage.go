@@ -0,0 +1,58 @@
+package postgresdb
+
+import (
+	"context"
+	"database/sql"
+
+	"crispy-doodle/main.go/store"
+)
+
+// CreateAIUsageTable keeps a row per completion. Usage outlives the user so
+// past spending can still be accounted for.
+func CreateAIUsageTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS ai_usage (
+		id BIGSERIAL PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt_tokens INT NOT NULL,
+		completion_tokens INT NOT NULL,
+		total_tokens INT NOT NULL,
+		cost DOUBLE PRECISION NOT NULL,
+		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+	);
+	CREATE INDEX IF NOT EXISTS ai_usage_user_created ON ai_usage (user_id, created);`
+
+	_, err := db.Exec(query)
+	return err
+}
+
+func (s *Store) RecordAIUsage(ctx context.Context, usage *store.AIUsage) error {
+	query := `INSERT INTO ai_usage (user_id, model, prompt_tokens, completion_tokens, total_tokens, cost)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created`
+	err := s.db.QueryRowContext(ctx, query, usage.UserID, usage.Model, usage.PromptTokens, usage.CompletionTokens,
+		usage.TotalTokens, usage.Cost).Scan(&usage.Created)
+	return mapError(err)
+}
+
+func (s *Store) SumAIUsage(ctx context.Context, userID string, since int64) ([]store.AIUsageTotal, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT model, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens),
+			SUM(total_tokens), SUM(cost)
+		FROM ai_usage WHERE user_id = $1 AND created >= $2
+		GROUP BY model ORDER BY model`, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []store.AIUsageTotal{}
+	for rows.Next() {
+		var t store.AIUsageTotal
+		if err := rows.Scan(&t.Model, &t.Requests, &t.PromptTokens, &t.CompletionTokens, &t.TotalTokens, &t.Cost); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
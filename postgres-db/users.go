@@ -1,28 +1,14 @@
 package postgresdb
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/binary"
-	"fmt"
-	"net/http"
 
-	"github.com/gin-gonic/gin"
+	"crispy-doodle/main.go/store"
+
 	"github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 )
 
-type User struct {
-	ID       string         `json:"id"`
-	Name     string         `json:"name"`
-	Email    string         `json:"email"`
-	Password string         `json:"password"`
-	Online   bool           `json:"online"`
-	Channels pq.StringArray `json:"channels" sql:"type:text[]"`
-	Created  int64          `json:"created"`
-	Updated  int64          `json:"updated"`
-}
-
 func CreateUsersTable(db *sql.DB) error {
 	query := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -32,253 +18,110 @@ func CreateUsersTable(db *sql.DB) error {
 		password TEXT NOT NULL,
 		online BOOL DEFAULT false,
 		channels TEXT[],
+		role TEXT NOT NULL DEFAULT 'user',
+		quota BIGINT,
 		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
     	updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
-	);`
+	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS quota BIGINT;`
 
 	_, err := db.Exec(query)
 	return err
 }
 
-func GenerateUserID(email string) string {
-	hash := sha256.Sum256([]byte(email))
-	return fmt.Sprintf("user_%d", binary.BigEndian.Uint64(hash[:8]))
-}
-
-func HashedPassword(password string) (string, error) {
-	hashedPassword, error := bcrypt.GenerateFromPassword([]byte(password), 10)
-	return string(hashedPassword), error
-}
-
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
+const userColumns = `id, name, email, password, online, channels, role, quota, created, updated`
 
-func RegisterUser(db *sql.DB, c *gin.Context) {
-	var user User
-
-	if err := c.ShouldBindJSON(&user); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	fmt.Println("Registering user with email:", user.Email)
-
-	userId := GenerateUserID(user.Email)
-	fmt.Println("Generated user ID:", userId)
-
-	hashedPassword, err := HashedPassword(user.Password)
+func scanUser(row interface{ Scan(...any) error }) (*store.User, error) {
+	var user store.User
+	var quota sql.NullInt64
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Channels, &user.Role, &quota,
+		&user.Created, &user.Updated)
 	if err != nil {
-		fmt.Println("Error hashing password:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-		return
+		return nil, mapError(err)
 	}
-	fmt.Println("Password hashed successfully")
-
-	query := `INSERT INTO users (id, name, email, password, online, channels)
-		VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err = db.ExecContext(c, query, userId, user.Name, user.Email, hashedPassword, user.Online, pq.Array(user.Channels))
-	if err != nil {
-		fmt.Println("Database insert error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if quota.Valid {
+		user.Quota = &quota.Int64
 	}
-
-	fmt.Println("User registered successfully:", userId)
-	c.JSON(http.StatusCreated, gin.H{"message": "User created!"})
-}
-
-type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-}
-
-func Login(db *sql.DB, c *gin.Context) {
-	var req LoginRequest
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-	fmt.Println("Login attempt for email:", req.Email)
-
-	var user User
-	var channels pq.StringArray
-	query := `SELECT id, name, email, password, online, channels, created, updated FROM users WHERE email = $1`
-	err := db.QueryRowContext(c, query, req.Email).Scan(
-		&user.ID, &user.Name, &user.Email, &user.Password,
-		&user.Online, &channels, &user.Created, &user.Updated,
-	)
-	user.Channels = channels
 	if user.Channels == nil {
 		user.Channels = []string{}
 	}
-	if err == sql.ErrNoRows {
-		fmt.Println("No user found with email:", req.Email)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	} else if err != nil {
-		fmt.Println("Database query error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	fmt.Println("User found:", user.ID)
-
-	if !CheckPasswordHash(req.Password, user.Password) {
-		fmt.Println("Password verification failed for user:", user.ID)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password Verification Failed"})
-		return
-	}
-	fmt.Println("Password verified for user:", user.ID)
-
-	access, refresh, err := GenerateTokens(user.ID)
-
-	fmt.Println("Login successful for user:", user.ID)
-	c.JSON(http.StatusOK, gin.H{
-		"message":      "Login Success",
-		"token":        access,
-		"refreshToken": refresh,
-		"user":         user,
-	})
+	return &user, nil
 }
-func Refresh(c *gin.Context) {
-	var body struct {
-		RefreshToken string `json:"refresh_token"`
-	}
-	if err := c.ShouldBindJSON(&body); err != nil || body.RefreshToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing refresh token"})
-		return
-	}
 
-	claims, err := ValidateToken(body.RefreshToken, true)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
-		return
+func (s *Store) CreateUser(ctx context.Context, user *store.User) error {
+	if user.ID == "" {
+		user.ID = store.NewUserID(user.Email)
 	}
-
-	newAccess, _, err := GenerateTokens(claims.ID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate new token"})
-		return
+	if user.Role == "" {
+		user.Role = store.RoleUser
 	}
-
-	c.JSON(http.StatusOK, gin.H{"access_token": newAccess})
+	query := `INSERT INTO users (id, name, email, password, online, channels, role, quota)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created, updated`
+	err := s.db.QueryRowContext(ctx, query, user.ID, user.Name, user.Email, user.Password, user.Online, pq.Array(user.Channels),
+		user.Role, user.Quota).
+		Scan(&user.Created, &user.Updated)
+	return mapError(err)
 }
 
-func GetUsers(db *sql.DB, c *gin.Context) {
-	fmt.Println("Fetching all users")
-	rows, err := db.QueryContext(c, "SELECT id, name, email, password, online, channels, created, updated FROM users;")
+func (s *Store) ListUsers(ctx context.Context) ([]store.User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
 	if err != nil {
-		fmt.Println("Query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
+	users := []store.User{}
 	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Channels, &user.Created, &user.Updated); err != nil {
-			fmt.Println("Row scan failed:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
 		}
-		if user.Channels == nil {
-			user.Channels = []string{}
-		}
-		users = append(users, user)
-	}
-	if err := rows.Err(); err != nil {
-		fmt.Println("Row iteration error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		users = append(users, *user)
 	}
-	fmt.Println("Total users fetched:", len(users))
-	c.JSON(http.StatusOK, users)
+	return users, rows.Err()
 }
 
-func GetUserByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	fmt.Println("Fetching user with ID:", id)
-
-	var user User
-	query := `SELECT id, name, email, password, online, channels, created, updated FROM users WHERE id = $1`
-	err := db.QueryRowContext(c, query, id).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Channels, &user.Created, &user.Updated)
-	if err == sql.ErrNoRows {
-		fmt.Println("User not found:", id)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	} else if err != nil {
-		fmt.Println("Query error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	fmt.Println("User fetched:", user.ID)
-	c.JSON(http.StatusOK, user)
+func (s *Store) GetUser(ctx context.Context, id string) (*store.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
 }
 
-func UpdateUser(db *sql.DB, c *gin.Context) {
-	var user User
-
-	if err := c.ShouldBindJSON(&user); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	query := `UPDATE users SET name=$1, email=$2, password=$3, online=$4, channels=$5, updated=EXTRACT(EPOCH FROM now()) WHERE id=$6`
-	result, err := db.ExecContext(c, query, user.Name, user.Email, user.Password, user.Online, user.Channels, user.ID)
-	if err != nil {
-		fmt.Println("Update query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		fmt.Println("Failed to retrieve rows affected:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	if rowsAffected == 0 {
-		fmt.Println("No rows updated for ID:", user.ID)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	}
-
-	fmt.Println("User updated successfully:", user.ID)
-	c.JSON(http.StatusOK, gin.H{"message": "User updated!"})
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (*store.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = $1`, email))
 }
 
-func DeleteUserByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
-	fmt.Println("Deleting user with ID:", id)
+func (s *Store) UpdateUser(ctx context.Context, user *store.User) error {
+	query := `UPDATE users SET name=$1, email=$2, password=$3, online=$4, updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$5
+		RETURNING channels, role, quota, created, updated`
+	var quota sql.NullInt64
+	err := s.db.QueryRowContext(ctx, query, user.Name, user.Email, user.Password, user.Online, user.ID).
+		Scan(&user.Channels, &user.Role, &quota, &user.Created, &user.Updated)
+	user.Quota = nil
+	if quota.Valid {
+		user.Quota = &quota.Int64
+	}
+	return mapError(err)
+}
 
-	query := `DELETE FROM users WHERE id = $1`
-	result, err := db.ExecContext(c, query, id)
-	if err != nil {
-		fmt.Println("Delete query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+func (s *Store) SetUserQuota(ctx context.Context, id string, quota *int64) error {
+	return execOne(s.db.ExecContext(ctx, `UPDATE users SET quota=$1, updated=EXTRACT(EPOCH FROM now()) WHERE id=$2`, quota, id))
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		fmt.Println("Failed to retrieve rows affected:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+func (s *Store) AddUserChannel(ctx context.Context, userID, channelID string) error {
+	return execOne(s.db.ExecContext(ctx, `UPDATE users
+		SET channels = CASE WHEN $1 = ANY(channels) THEN channels ELSE array_append(channels, $1) END,
+			updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2`, channelID, userID))
+}
 
-	if rowsAffected == 0 {
-		fmt.Println("No user found to delete with ID:", id)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	}
+func (s *Store) RemoveUserChannel(ctx context.Context, userID, channelID string) error {
+	return execOne(s.db.ExecContext(ctx, `UPDATE users
+		SET channels = array_remove(channels, $1), updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2`, channelID, userID))
+}
 
-	fmt.Println("User deleted successfully:", id)
-	c.JSON(http.StatusOK, gin.H{"message": "User deleted!"})
+func (s *Store) DeleteUser(ctx context.Context, id string) error {
+	return execOne(s.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id))
 }
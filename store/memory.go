@@ -0,0 +1,1015 @@
+package store
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process implementation of every store interface. It is
+// used by tests and for running the server without Postgres.
+type Memory struct {
+	mu          sync.RWMutex
+	users       map[string]User
+	messages    map[string]Message
+	channels    map[string]Channel
+	attachments map[string]Attachment
+	uploads     map[string]UploadSession
+	// conversations hold their messages in order
+	conversations map[string]Conversation
+	aiMessages    map[string][]AIMessage
+	// reads are read positions by user, then channel
+	reads      map[string]map[string]int64
+	summaries  map[summaryKey]ChannelSummary
+	embeddings map[embeddingKey]MessageEmbedding
+	aiUsage    []AIUsage
+}
+
+type embeddingKey struct {
+	messageID, model string
+}
+
+type summaryKey struct {
+	channelID, from string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:         map[string]User{},
+		messages:      map[string]Message{},
+		channels:      map[string]Channel{},
+		attachments:   map[string]Attachment{},
+		uploads:       map[string]UploadSession{},
+		conversations: map[string]Conversation{},
+		aiMessages:    map[string][]AIMessage{},
+		reads:         map[string]map[string]int64{},
+		summaries:     map[summaryKey]ChannelSummary{},
+		embeddings:    map[embeddingKey]MessageEmbedding{},
+	}
+}
+
+// Stores returns m wired up as every repository.
+func (m *Memory) Stores() Stores {
+	return Stores{Users: m, Messages: m, Channels: m, Attachments: m, Uploads: m, Conversations: m, Summaries: m, Embeddings: m,
+		AIUsage: m}
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user.ID == "" {
+		user.ID = NewUserID(user.Email)
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if _, ok := m.users[user.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	if err := m.checkUserUnique(*user); err != nil {
+		return err
+	}
+	user.Created = time.Now().Unix()
+	user.Updated = user.Created
+	m.users[user.ID] = cloneUser(*user)
+	return nil
+}
+
+func (m *Memory) ListUsers(ctx context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, cloneUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *Memory) GetUser(ctx context.Context, id string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u = cloneUser(u)
+	return &u, nil
+}
+
+func (m *Memory) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if u.Email == email {
+			u = cloneUser(u)
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) UpdateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := m.checkUserUnique(*user); err != nil {
+		return err
+	}
+	user.Role = existing.Role
+	user.Quota = existing.Quota
+	user.Channels = append([]string{}, existing.Channels...)
+	user.Created = existing.Created
+	user.Updated = time.Now().Unix()
+	m.users[user.ID] = cloneUser(*user)
+	return nil
+}
+
+func (m *Memory) SetUserQuota(ctx context.Context, id string, quota *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Quota = quota
+	user.Updated = time.Now().Unix()
+	m.users[id] = cloneUser(user)
+	return nil
+}
+
+func (m *Memory) AddUserChannel(ctx context.Context, userID, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if slices.Contains(user.Channels, channelID) {
+		return nil
+	}
+	user = cloneUser(user)
+	user.Channels = append(user.Channels, channelID)
+	user.Updated = time.Now().Unix()
+	m.users[userID] = user
+	return nil
+}
+
+func (m *Memory) RemoveUserChannel(ctx context.Context, userID, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user = cloneUser(user)
+	user.Channels = slices.DeleteFunc(user.Channels, func(id string) bool { return id == channelID })
+	user.Updated = time.Now().Unix()
+	m.users[userID] = user
+	return nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, id)
+	return nil
+}
+
+// checkUserUnique mirrors the UNIQUE constraints on users.name and
+// users.email. Callers hold the lock.
+func (m *Memory) checkUserUnique(user User) error {
+	for id, u := range m.users {
+		if id == user.ID {
+			continue
+		}
+		if u.Email == user.Email {
+			return &ConflictError{Field: "email"}
+		}
+		if u.Name == user.Name {
+			return &ConflictError{Field: "name"}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateMessage(ctx context.Context, message *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if message.ID == "" {
+		message.ID = NewMessageID()
+	}
+	if _, ok := m.messages[message.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	message.Created = time.Now().Unix()
+	message.Updated = message.Created
+	m.messages[message.ID] = cloneMessage(*message)
+	return nil
+}
+
+func (m *Memory) ListMessages(ctx context.Context) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := make([]Message, 0, len(m.messages))
+	for _, msg := range m.messages {
+		messages = append(messages, cloneMessage(msg))
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (m *Memory) GetMessage(ctx context.Context, id string) (*Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	msg = cloneMessage(msg)
+	return &msg, nil
+}
+
+func (m *Memory) UpdateMessage(ctx context.Context, message *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.messages[message.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	message.AI = existing.AI
+	message.Created = existing.Created
+	message.Updated = time.Now().Unix()
+	m.messages[message.ID] = cloneMessage(*message)
+	return nil
+}
+
+func (m *Memory) DeleteMessage(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.messages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.messages, id)
+	for key := range m.embeddings {
+		if key.messageID == id {
+			delete(m.embeddings, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListMessagesByModeration(ctx context.Context, status string) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range m.messages {
+		if msg.Moderation != nil && msg.Moderation.Status == status {
+			messages = append(messages, cloneMessage(msg))
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Created != messages[j].Created {
+			return messages[i].Created < messages[j].Created
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+func (m *Memory) SetMessageModeration(ctx context.Context, id string, moderation *Moderation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	msg.Moderation = cloneModeration(moderation)
+	m.messages[id] = msg
+	return nil
+}
+
+func (m *Memory) CreateChannel(ctx context.Context, channel *Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if channel.ID == "" {
+		channel.ID = NewChannelID()
+	}
+	if _, ok := m.channels[channel.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	channel.Created = time.Now().Unix()
+	channel.Updated = channel.Created
+	m.channels[channel.ID] = cloneChannel(*channel)
+	return nil
+}
+
+func (m *Memory) ListChannels(ctx context.Context) ([]Channel, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	channels := make([]Channel, 0, len(m.channels))
+	for _, ch := range m.channels {
+		channels = append(channels, cloneChannel(ch))
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+	return channels, nil
+}
+
+func (m *Memory) GetChannel(ctx context.Context, id string) (*Channel, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ch, ok := m.channels[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ch = cloneChannel(ch)
+	return &ch, nil
+}
+
+func (m *Memory) UpdateChannel(ctx context.Context, channel *Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.channels[channel.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	channel.Owner = existing.Owner
+	channel.Messages = append([]string{}, existing.Messages...)
+	channel.Created = existing.Created
+	channel.Updated = time.Now().Unix()
+	m.channels[channel.ID] = cloneChannel(*channel)
+	return nil
+}
+
+func (m *Memory) DeleteChannel(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.channels[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.channels, id)
+	for _, reads := range m.reads {
+		delete(reads, id)
+	}
+	for key := range m.summaries {
+		if key.channelID == id {
+			delete(m.summaries, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) AddChannelMessage(ctx context.Context, channelID, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch, ok := m.channels[channelID]
+	if !ok {
+		return ErrNotFound
+	}
+	ch = cloneChannel(ch)
+	ch.Messages = append(ch.Messages, messageID)
+	ch.Updated = time.Now().Unix()
+	m.channels[channelID] = ch
+	return nil
+}
+
+func (m *Memory) FindMessageChannel(ctx context.Context, messageID string) (*Channel, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *Channel
+	for _, ch := range m.channels {
+		if slices.Contains(ch.Messages, messageID) && (found == nil || ch.ID < found.ID) {
+			found = &ch
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	ch := cloneChannel(*found)
+	return &ch, nil
+}
+
+func (m *Memory) ListChannelMessages(ctx context.Context, channelID string, since int64) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ch, ok := m.channels[channelID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	messages := []Message{}
+	for _, id := range ch.Messages {
+		if msg, ok := m.messages[id]; ok && msg.Created > since {
+			messages = append(messages, cloneMessage(msg))
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		if messages[i].Created != messages[j].Created {
+			return messages[i].Created < messages[j].Created
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+func (m *Memory) GetReadPosition(ctx context.Context, userID, channelID string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	at, ok := m.reads[userID][channelID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return at, nil
+}
+
+func (m *Memory) SetReadPosition(ctx context.Context, userID, channelID string, at int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.channels[channelID]; !ok {
+		return ErrNotFound
+	}
+	if m.reads[userID] == nil {
+		m.reads[userID] = map[string]int64{}
+	}
+	m.reads[userID][channelID] = at
+	return nil
+}
+
+func (m *Memory) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if attachment.ID == "" {
+		attachment.ID = NewAttachmentID()
+	}
+	if _, ok := m.attachments[attachment.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	if attachment.Status == "" {
+		attachment.Status = AttachmentReady
+	}
+	if attachment.Thumbnails == nil {
+		attachment.Thumbnails = []Thumbnail{}
+	}
+	attachment.Created = time.Now().Unix()
+	m.attachments[attachment.ID] = cloneAttachment(*attachment)
+	return nil
+}
+
+func (m *Memory) GetAttachment(ctx context.Context, id string) (*Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.attachments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	a = cloneAttachment(a)
+	return &a, nil
+}
+
+func (m *Memory) UpdateAttachment(ctx context.Context, attachment *Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.attachments[attachment.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	// owner and creation time are fixed once the row exists
+	attachment.Owner = existing.Owner
+	attachment.Created = existing.Created
+	m.attachments[attachment.ID] = cloneAttachment(*attachment)
+	return nil
+}
+
+func (m *Memory) ListAttachmentsByStatus(ctx context.Context, status string) ([]Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	attachments := []Attachment{}
+	for _, a := range m.attachments {
+		if a.Status == status {
+			attachments = append(attachments, cloneAttachment(a))
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].ID < attachments[j].ID })
+	return attachments, nil
+}
+
+func (m *Memory) CanAccessAttachment(ctx context.Context, userID, id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.attachments[id]
+	if !ok {
+		return false, nil
+	}
+	if a.Owner == userID {
+		return true, nil
+	}
+	user, ok := m.users[userID]
+	if !ok {
+		return false, nil
+	}
+	for _, channelID := range user.Channels {
+		for _, messageID := range m.channels[channelID].Messages {
+			if slices.Contains(m.messages[messageID].Images, id) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *Memory) DeleteAttachment(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.attachments[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.attachments, id)
+	return nil
+}
+
+func (m *Memory) FindAttachmentByKey(ctx context.Context, key string) (*Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *Attachment
+	for _, a := range m.attachments {
+		if a.Key == key && a.Status == AttachmentReady && (found == nil || a.Created < found.Created) {
+			a = cloneAttachment(a)
+			found = &a
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+func (m *Memory) ShareAttachment(ctx context.Context, attachment *Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keyRefs(attachment.Key, attachment.ID) == 0 {
+		return ErrNotFound
+	}
+	if attachment.ID == "" {
+		attachment.ID = NewAttachmentID()
+	}
+	if existing, ok := m.attachments[attachment.ID]; ok {
+		attachment.Owner = existing.Owner
+		attachment.Created = existing.Created
+	} else {
+		attachment.Created = time.Now().Unix()
+	}
+	if attachment.Thumbnails == nil {
+		attachment.Thumbnails = []Thumbnail{}
+	}
+	m.attachments[attachment.ID] = cloneAttachment(*attachment)
+	return nil
+}
+
+func (m *Memory) ReleaseAttachment(ctx context.Context, id string, purge func(*Attachment) error) error {
+	// the lock is held through purge, so nothing can share the key meanwhile
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	released, ok := m.attachments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if purge != nil && m.keyRefs(released.Key, id) == 0 {
+		a := cloneAttachment(released)
+		if err := purge(&a); err != nil {
+			return err
+		}
+	}
+	delete(m.attachments, id)
+	return nil
+}
+
+// keyRefs counts the attachments other than id stored under key.
+func (m *Memory) keyRefs(key, id string) int {
+	refs := 0
+	for _, a := range m.attachments {
+		if a.Key == key && a.ID != id {
+			refs++
+		}
+	}
+	return refs
+}
+
+func (m *Memory) GetStorageUsage(ctx context.Context, owner string, largest int) (*StorageUsage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	usage := &StorageUsage{Largest: []Attachment{}}
+	for _, a := range m.attachments {
+		if a.Owner != owner {
+			continue
+		}
+		usage.Bytes += a.Size
+		usage.Files++
+		usage.Largest = append(usage.Largest, cloneAttachment(a))
+	}
+	sort.Slice(usage.Largest, func(i, j int) bool {
+		a, b := usage.Largest[i], usage.Largest[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.ID < b.ID
+	})
+	if len(usage.Largest) > largest {
+		usage.Largest = usage.Largest[:largest]
+	}
+	return usage, nil
+}
+
+func (m *Memory) CreateUploadSession(ctx context.Context, session *UploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session.ID == "" {
+		session.ID = NewUploadSessionID()
+	}
+	if _, ok := m.uploads[session.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	session.Created = time.Now().Unix()
+	session.Updated = session.Created
+	m.uploads[session.ID] = cloneUploadSession(*session)
+	return nil
+}
+
+func (m *Memory) GetUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.uploads[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	session = cloneUploadSession(session)
+	return &session, nil
+}
+
+func (m *Memory) AdvanceUploadSession(ctx context.Context, session *UploadSession, from int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.uploads[session.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.Offset != from {
+		return &ConflictError{Field: "offset"}
+	}
+	session.Updated = time.Now().Unix()
+	m.uploads[session.ID] = cloneUploadSession(*session)
+	return nil
+}
+
+func (m *Memory) DeleteUploadSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.uploads[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.uploads, id)
+	return nil
+}
+
+func (m *Memory) ListStaleUploadSessions(ctx context.Context, before int64) ([]UploadSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []UploadSession{}
+	for _, session := range m.uploads {
+		if session.Updated < before {
+			sessions = append(sessions, cloneUploadSession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions, nil
+}
+
+func (m *Memory) CreateConversation(ctx context.Context, conversation *Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conversation.ID == "" {
+		conversation.ID = NewConversationID()
+	}
+	if _, ok := m.conversations[conversation.ID]; ok {
+		return &ConflictError{Field: "id"}
+	}
+	conversation.Created = time.Now().Unix()
+	conversation.Updated = conversation.Created
+	m.conversations[conversation.ID] = *conversation
+	return nil
+}
+
+func (m *Memory) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conversation, ok := m.conversations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &conversation, nil
+}
+
+func (m *Memory) UpdateConversation(ctx context.Context, conversation *Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.conversations[conversation.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	conversation.Owner = existing.Owner
+	conversation.Created = existing.Created
+	conversation.Updated = time.Now().Unix()
+	m.conversations[conversation.ID] = *conversation
+	return nil
+}
+
+func (m *Memory) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conversations := []Conversation{}
+	for _, conversation := range m.conversations {
+		if conversation.Owner == owner {
+			conversations = append(conversations, conversation)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].Updated != conversations[j].Updated {
+			return conversations[i].Updated > conversations[j].Updated
+		}
+		return conversations[i].ID < conversations[j].ID
+	})
+	return conversations, nil
+}
+
+func (m *Memory) DeleteConversation(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.conversations[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.conversations, id)
+	delete(m.aiMessages, id)
+	return nil
+}
+
+func (m *Memory) AddAIMessages(ctx context.Context, conversationID string, messages ...*AIMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation, ok := m.conversations[conversationID]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now().Unix()
+	for _, message := range messages {
+		if message.ID == "" {
+			message.ID = NewAIMessageID()
+		}
+		message.ConversationID = conversationID
+		message.Created = now
+		m.aiMessages[conversationID] = append(m.aiMessages[conversationID], *message)
+	}
+	conversation.Updated = now
+	m.conversations[conversationID] = conversation
+	return nil
+}
+
+func (m *Memory) ListAIMessages(ctx context.Context, conversationID string) ([]AIMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.conversations[conversationID]; !ok {
+		return nil, ErrNotFound
+	}
+	return append([]AIMessage{}, m.aiMessages[conversationID]...), nil
+}
+
+func (m *Memory) GetChannelSummary(ctx context.Context, channelID, from string) (*ChannelSummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	summary, ok := m.summaries[summaryKey{channelID, from}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &summary, nil
+}
+
+func (m *Memory) SaveChannelSummary(ctx context.Context, summary *ChannelSummary) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.channels[summary.ChannelID]; !ok {
+		return ErrNotFound
+	}
+	summary.Created = time.Now().Unix()
+	m.summaries[summaryKey{summary.ChannelID, summary.From}] = *summary
+	return nil
+}
+
+func (m *Memory) SaveEmbedding(ctx context.Context, embedding *MessageEmbedding) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.messages[embedding.MessageID]; !ok {
+		return ErrNotFound
+	}
+	e := *embedding
+	e.Vector = slices.Clone(e.Vector)
+	m.embeddings[embeddingKey{e.MessageID, e.Model}] = e
+	return nil
+}
+
+func (m *Memory) ListUnembeddedMessages(ctx context.Context, model string, limit int) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range m.messages {
+		e, ok := m.embeddings[embeddingKey{msg.ID, model}]
+		if msg.Text != "" && (!ok || e.Version < msg.Updated) {
+			messages = append(messages, cloneMessage(msg))
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Created != messages[j].Created {
+			return messages[i].Created < messages[j].Created
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	return messages[:min(limit, len(messages))], nil
+}
+
+func (m *Memory) SearchMessages(ctx context.Context, model string, vector []float32, userID string, limit int) ([]MessageMatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	channels := slices.Clone(m.users[userID].Channels)
+	sort.Strings(channels)
+	matches := []MessageMatch{}
+	seen := map[string]bool{}
+	for _, channelID := range channels {
+		for _, id := range m.channels[channelID].Messages {
+			e, ok := m.embeddings[embeddingKey{id, model}]
+			if !ok || seen[id] {
+				continue
+			}
+			if v := m.messages[id].Moderation; v != nil && v.Status == ModerationFlagged {
+				continue
+			}
+			seen[id] = true
+			matches = append(matches, MessageMatch{
+				Message:   cloneMessage(m.messages[id]),
+				ChannelID: channelID,
+				Score:     cosineSimilarity(vector, e.Vector),
+			})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches[:min(limit, len(matches))], nil
+}
+
+func (m *Memory) RecordAIUsage(ctx context.Context, usage *AIUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage.Created = time.Now().Unix()
+	m.aiUsage = append(m.aiUsage, *usage)
+	return nil
+}
+
+func (m *Memory) SumAIUsage(ctx context.Context, userID string, since int64) ([]AIUsageTotal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	byModel := map[string]*AIUsageTotal{}
+	for _, u := range m.aiUsage {
+		if u.UserID != userID || u.Created < since {
+			continue
+		}
+		total, ok := byModel[u.Model]
+		if !ok {
+			total = &AIUsageTotal{Model: u.Model}
+			byModel[u.Model] = total
+		}
+		total.Requests++
+		total.PromptTokens += int64(u.PromptTokens)
+		total.CompletionTokens += int64(u.CompletionTokens)
+		total.TotalTokens += int64(u.TotalTokens)
+		total.Cost += u.Cost
+	}
+	totals := make([]AIUsageTotal, 0, len(byModel))
+	for _, total := range byModel {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Model < totals[j].Model })
+	return totals, nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// the clone helpers keep callers from aliasing the slices held in the maps
+
+func cloneUser(u User) User {
+	u.Channels = append([]string{}, u.Channels...)
+	if u.Quota != nil {
+		quota := *u.Quota
+		u.Quota = &quota
+	}
+	return u
+}
+
+func cloneMessage(msg Message) Message {
+	msg.Images = append([]string{}, msg.Images...)
+	msg.Moderation = cloneModeration(msg.Moderation)
+	return msg
+}
+
+func cloneModeration(m *Moderation) *Moderation {
+	if m == nil {
+		return nil
+	}
+	cp := *m
+	cp.Categories = append([]string{}, m.Categories...)
+	return &cp
+}
+
+func cloneChannel(ch Channel) Channel {
+	ch.Messages = append([]string{}, ch.Messages...)
+	return ch
+}
+
+func cloneAttachment(a Attachment) Attachment {
+	a.Thumbnails = append([]Thumbnail{}, a.Thumbnails...)
+	return a
+}
+
+func cloneUploadSession(session UploadSession) UploadSession {
+	session.Parts = append([]UploadPart{}, session.Parts...)
+	session.HashState = append([]byte{}, session.HashState...)
+	return session
+}
@@ -0,0 +1,244 @@
+package store
+
+import "github.com/lib/pq"
+
+// User roles. Admins may set other users' storage quotas. Moderators, and
+// admins, review flagged messages. The assistant's account is the only bot.
+const (
+	RoleUser      = "user"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleBot       = "bot"
+)
+
+// AssistantUserID is the account the AI assistant posts as.
+const AssistantUserID = "user_assistant"
+
+type User struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+	Online   bool   `json:"online"`
+	// Channels are the channels the user is a member of. Only the server
+	// changes them; see UserStore.AddUserChannel.
+	Channels pq.StringArray `json:"channels" sql:"type:text[]"`
+	Role     string         `json:"role"`
+	// Quota is the user's own storage limit in bytes, replacing the one of
+	// its role when set.
+	Quota   *int64 `json:"quota,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+type Message struct {
+	ID     string   `json:"id"`
+	Sender string   `json:"sender"`
+	Text   string   `json:"text"`
+	Images []string `json:"images"`
+	// AI marks messages the assistant wrote. Only the server sets it.
+	AI bool `json:"ai"`
+	// Moderation is the verdict on the current text, nil when it was not
+	// moderated. Only the server sets it.
+	Moderation *Moderation `json:"moderation,omitempty"`
+	Created    int64       `json:"created"`
+	Updated    int64       `json:"updated"`
+}
+
+// Moderation statuses of a message. Flagged messages wait in the review
+// queue until a moderator approves or removes them.
+const (
+	ModerationAllowed  = "allowed"
+	ModerationFlagged  = "flagged"
+	ModerationApproved = "approved"
+)
+
+// Moderation is a moderation provider's verdict on a message. Flagged is
+// the provider's opinion; Status is what the channel's policy made of it.
+type Moderation struct {
+	Status     string   `json:"status"`
+	Flagged    bool     `json:"flagged"`
+	Categories []string `json:"categories"`
+	Provider   string   `json:"provider"`
+	Checked    int64    `json:"checked"`
+	ReviewedBy string   `json:"reviewed_by,omitempty"`
+	Reviewed   int64    `json:"reviewed,omitempty"`
+}
+
+// Channel moderation policies: what becomes of a message the moderation
+// provider flags. Channels without one follow the server's default.
+const (
+	PolicyAllow = "allow"
+	PolicyFlag  = "flag"
+	PolicyBlock = "block"
+)
+
+type Channel struct {
+	ID    string `json:"id"`
+	Title string `json:"text"`
+	// Owner is the user who created the channel. Only the server sets it,
+	// and channels from before owners have none.
+	Owner string `json:"owner"`
+	// Messages are the channel's messages in the order they were posted.
+	// Only the server adds to it, when a member posts.
+	Messages []string `json:"messages"`
+	// Assistant opts the channel in to the AI assistant answering mentions.
+	Assistant bool `json:"assistant"`
+	// Moderation is the channel's moderation policy, "" for the default.
+	Moderation string `json:"moderation"`
+	Created    int64  `json:"created"`
+	Updated    int64  `json:"updated"`
+}
+
+// Attachment statuses. Direct uploads stay pending until the client reports
+// the object as uploaded and the server has checked it. Attachments are then
+// processing while they are scanned and, for images, while metadata is
+// stripped and thumbnails are made. They end up ready, quarantined when the
+// scanner flags them, or failed when an image could not be read.
+const (
+	AttachmentPending     = "pending"
+	AttachmentProcessing  = "processing"
+	AttachmentReady       = "ready"
+	AttachmentQuarantined = "quarantined"
+	AttachmentFailed      = "failed"
+)
+
+// Attachment is an uploaded file. Key is where the bytes live in blob
+// storage and is never exposed; clients refer to attachments by ID.
+type Attachment struct {
+	ID          string `json:"id"`
+	Owner       string `json:"owner"`
+	Key         string `json:"-"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Checksum    string `json:"checksum"`
+	Status      string `json:"status"`
+	Created     int64  `json:"created"`
+
+	// set for images once processed
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	BlurHash   string      `json:"blurhash,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails"`
+}
+
+// Thumbnail is a scaled down copy of an image attachment whose longest side
+// is at most Size pixels.
+type Thumbnail struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	Key         string `json:"-"`
+}
+
+// UploadSession tracks a resumable upload into a pending attachment. Each
+// accepted chunk becomes one part of a multipart upload in blob storage.
+// HashState is the marshalled SHA-256 of the bytes received so far, so the
+// checksum survives across requests without re-reading the parts.
+type UploadSession struct {
+	ID           string       `json:"id"`
+	AttachmentID string       `json:"attachment_id"`
+	Owner        string       `json:"owner"`
+	Key          string       `json:"-"`
+	UploadID     string       `json:"-"`
+	Size         int64        `json:"size"`
+	Offset       int64        `json:"offset"`
+	Parts        []UploadPart `json:"-"`
+	HashState    []byte       `json:"-"`
+	Created      int64        `json:"created"`
+	Updated      int64        `json:"updated"`
+}
+
+type UploadPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// StorageUsage is what a user's attachments take up, counting every
+// attachment at its full size even when its content is shared.
+type StorageUsage struct {
+	Bytes   int64        `json:"bytes"`
+	Files   int          `json:"files"`
+	Largest []Attachment `json:"largest"`
+}
+
+// Roles of the turns in a Conversation.
+const (
+	AIRoleUser      = "user"
+	AIRoleAssistant = "assistant"
+)
+
+// Conversation is a thread with the assistant, owned by one user. Updated
+// moves with every turn.
+type Conversation struct {
+	ID      string `json:"id"`
+	Owner   string `json:"owner"`
+	Title   string `json:"title"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+// AIMessage is one turn of a Conversation. Tokens is what the turn costs
+// when it is sent back to the model as history.
+type AIMessage struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Role           string `json:"role"`
+	Content        string `json:"content"`
+	Tokens         int    `json:"tokens"`
+	Created        int64  `json:"created"`
+}
+
+// ChannelSummary is a summary of a channel's messages from the message From
+// onward. Digest identifies the messages summarized and the model used, so
+// a summary is stale once they change.
+type ChannelSummary struct {
+	ChannelID string `json:"channel_id"`
+	From      string `json:"from"`
+	Digest    string `json:"-"`
+	Summary   string `json:"summary"`
+	Messages  int    `json:"messages"`
+	Created   int64  `json:"created"`
+}
+
+// MessageEmbedding is the vector model made of a message's text as of
+// Version, the message's Updated time then.
+type MessageEmbedding struct {
+	MessageID string
+	Model     string
+	Vector    []float32
+	Version   int64
+}
+
+// MessageMatch is a message found by similarity in one of the channels
+// searched. Score is the cosine similarity to the query.
+type MessageMatch struct {
+	Message
+	ChannelID string  `json:"channel_id"`
+	Score     float64 `json:"score"`
+}
+
+// AIUsage is the tokens one completion used and what it cost in US
+// dollars, by the prices when it was made.
+type AIUsage struct {
+	UserID           string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             float64
+	Created          int64
+}
+
+// AIUsageTotal sums a user's completions with one model.
+type AIUsageTotal struct {
+	Model            string  `json:"model"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost_usd"`
+}
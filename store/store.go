@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is returned when the requested row does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a write would violate a uniqueness rule.
+// Implementations return a *ConflictError, which matches it with errors.Is.
+var ErrConflict = errors.New("conflict")
+
+// ErrUnavailable is returned by a store that cannot serve a request
+// because the database lacks what it needs, e.g. the pgvector extension.
+var ErrUnavailable = errors.New("unavailable")
+
+// ConflictError names the field that collided, when it is known.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	if e.Field == "" {
+		return ErrConflict.Error()
+	}
+	return fmt.Sprintf("%s: %s already in use", ErrConflict, e.Field)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Create methods fill in the ID (when empty) and timestamps on the value
+// passed in. Update methods return ErrNotFound when no row matches.
+
+type UserStore interface {
+	CreateUser(ctx context.Context, user *User) error
+	ListUsers(ctx context.Context) ([]User, error)
+	GetUser(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	// UpdateUser leaves the role, quota and channels alone; see
+	// SetUserQuota and AddUserChannel.
+	UpdateUser(ctx context.Context, user *User) error
+	// SetUserQuota sets a user's own quota, or clears it when quota is nil.
+	SetUserQuota(ctx context.Context, id string, quota *int64) error
+	// AddUserChannel makes a user a member of a channel, if they are not
+	// one already.
+	AddUserChannel(ctx context.Context, userID, channelID string) error
+	// RemoveUserChannel ends a user's membership of a channel.
+	RemoveUserChannel(ctx context.Context, userID, channelID string) error
+	DeleteUser(ctx context.Context, id string) error
+}
+
+type MessageStore interface {
+	CreateMessage(ctx context.Context, message *Message) error
+	ListMessages(ctx context.Context) ([]Message, error)
+	GetMessage(ctx context.Context, id string) (*Message, error)
+	// UpdateMessage leaves the AI flag alone and replaces the moderation
+	// verdict.
+	UpdateMessage(ctx context.Context, message *Message) error
+	DeleteMessage(ctx context.Context, id string) error
+	// ListMessagesByModeration returns the messages whose verdict has
+	// status, oldest first.
+	ListMessagesByModeration(ctx context.Context, status string) ([]Message, error)
+	// SetMessageModeration replaces a message's verdict without counting
+	// as an edit.
+	SetMessageModeration(ctx context.Context, id string, moderation *Moderation) error
+}
+
+type ChannelStore interface {
+	CreateChannel(ctx context.Context, channel *Channel) error
+	ListChannels(ctx context.Context) ([]Channel, error)
+	GetChannel(ctx context.Context, id string) (*Channel, error)
+	// UpdateChannel leaves the owner and messages alone; see
+	// AddChannelMessage.
+	UpdateChannel(ctx context.Context, channel *Channel) error
+	DeleteChannel(ctx context.Context, id string) error
+	// AddChannelMessage appends a message to a channel.
+	AddChannelMessage(ctx context.Context, channelID, messageID string) error
+	// FindMessageChannel returns the channel a message was posted to, the
+	// first by ID should there be several, or ErrNotFound.
+	FindMessageChannel(ctx context.Context, messageID string) (*Channel, error)
+	// ListChannelMessages returns the channel's messages created after
+	// since, oldest first.
+	ListChannelMessages(ctx context.Context, channelID string, since int64) ([]Message, error)
+	// GetReadPosition returns when userID last read the channel, or
+	// ErrNotFound if they never have.
+	GetReadPosition(ctx context.Context, userID, channelID string) (int64, error)
+	SetReadPosition(ctx context.Context, userID, channelID string, at int64) error
+}
+
+// AttachmentStore keeps attachments. Every attachment counts as one
+// reference to the object under its Key; identical uploads share a key.
+type AttachmentStore interface {
+	CreateAttachment(ctx context.Context, attachment *Attachment) error
+	GetAttachment(ctx context.Context, id string) (*Attachment, error)
+	UpdateAttachment(ctx context.Context, attachment *Attachment) error
+	ListAttachmentsByStatus(ctx context.Context, status string) ([]Attachment, error)
+	// CanAccessAttachment reports whether userID owns the attachment or is a
+	// member of a channel holding a message that references it.
+	CanAccessAttachment(ctx context.Context, userID, id string) (bool, error)
+	DeleteAttachment(ctx context.Context, id string) error
+	// FindAttachmentByKey returns a ready attachment stored under key, whose
+	// content a duplicate upload can share, or ErrNotFound.
+	FindAttachmentByKey(ctx context.Context, key string) (*Attachment, error)
+	// ShareAttachment saves attachment, new or already stored, as one more
+	// reference to the object under its key. It only succeeds while another
+	// attachment still references the key, so the object cannot have been
+	// purged, and returns ErrNotFound otherwise.
+	ShareAttachment(ctx context.Context, attachment *Attachment) error
+	// ReleaseAttachment deletes an attachment. When it was the last
+	// reference to its object key, purge is called with it before the delete
+	// is committed, while anything taking a new reference to the key waits,
+	// so the objects can be removed without racing an upload of the same
+	// content. An error from purge keeps the attachment. purge may be nil.
+	ReleaseAttachment(ctx context.Context, id string, purge func(*Attachment) error) error
+	// GetStorageUsage totals the attachments owner has, in any status, and
+	// lists up to largest of the biggest ones.
+	GetStorageUsage(ctx context.Context, owner string, largest int) (*StorageUsage, error)
+}
+
+type UploadSessionStore interface {
+	CreateUploadSession(ctx context.Context, session *UploadSession) error
+	GetUploadSession(ctx context.Context, id string) (*UploadSession, error)
+	// AdvanceUploadSession saves session only if its offset in the store is
+	// still from, returning ErrConflict when another request got there first.
+	AdvanceUploadSession(ctx context.Context, session *UploadSession, from int64) error
+	DeleteUploadSession(ctx context.Context, id string) error
+	// ListStaleUploadSessions returns sessions not updated since before.
+	ListStaleUploadSessions(ctx context.Context, before int64) ([]UploadSession, error)
+}
+
+type ConversationStore interface {
+	CreateConversation(ctx context.Context, conversation *Conversation) error
+	GetConversation(ctx context.Context, id string) (*Conversation, error)
+	UpdateConversation(ctx context.Context, conversation *Conversation) error
+	// ListConversations returns owner's conversations, most recently
+	// updated first.
+	ListConversations(ctx context.Context, owner string) ([]Conversation, error)
+	// DeleteConversation deletes a conversation with its messages.
+	DeleteConversation(ctx context.Context, id string) error
+	// AddAIMessages appends messages to a conversation, in order, and moves
+	// its Updated.
+	AddAIMessages(ctx context.Context, conversationID string, messages ...*AIMessage) error
+	// ListAIMessages returns a conversation's messages, oldest first.
+	ListAIMessages(ctx context.Context, conversationID string) ([]AIMessage, error)
+}
+
+type SummaryStore interface {
+	// GetChannelSummary returns the cached summary of a channel's messages
+	// from the message from onward, or ErrNotFound.
+	GetChannelSummary(ctx context.Context, channelID, from string) (*ChannelSummary, error)
+	// SaveChannelSummary caches a summary, replacing the one starting at
+	// the same message.
+	SaveChannelSummary(ctx context.Context, summary *ChannelSummary) error
+}
+
+type EmbeddingStore interface {
+	// SaveEmbedding replaces the message's embedding by the same model.
+	SaveEmbedding(ctx context.Context, embedding *MessageEmbedding) error
+	// ListUnembeddedMessages returns up to limit messages with text whose
+	// embedding by model is missing or older than the text, oldest first.
+	ListUnembeddedMessages(ctx context.Context, model string, limit int) ([]Message, error)
+	// SearchMessages returns up to limit messages whose embeddings by model
+	// are nearest to vector, nearest first, from the channels userID is a
+	// member of. Messages flagged for review are left out.
+	SearchMessages(ctx context.Context, model string, vector []float32, userID string, limit int) ([]MessageMatch, error)
+}
+
+type AIUsageStore interface {
+	RecordAIUsage(ctx context.Context, usage *AIUsage) error
+	// SumAIUsage totals userID's usage since a Unix time per model, by
+	// model name.
+	SumAIUsage(ctx context.Context, userID string, since int64) ([]AIUsageTotal, error)
+}
+
+// Stores bundles the repositories the HTTP layer depends on.
+type Stores struct {
+	Users         UserStore
+	Messages      MessageStore
+	Channels      ChannelStore
+	Attachments   AttachmentStore
+	Uploads       UploadSessionStore
+	Conversations ConversationStore
+	Summaries     SummaryStore
+	Embeddings    EmbeddingStore
+	AIUsage       AIUsageStore
+}
+
+func NewUserID(email string) string {
+	hash := sha256.Sum256([]byte(email))
+	return fmt.Sprintf("user_%d", binary.BigEndian.Uint64(hash[:8]))
+}
+
+func NewMessageID() string {
+	return fmt.Sprintf("message_%d", time.Now().UnixNano())
+}
+
+func NewChannelID() string {
+	return fmt.Sprintf("channel_%d", time.Now().UnixNano())
+}
+
+// NewAttachmentID is random rather than time based so IDs cannot be guessed.
+func NewAttachmentID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "attachment_" + hex.EncodeToString(b)
+}
+
+func NewUploadSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "upload_" + hex.EncodeToString(b)
+}
+
+func NewConversationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "conversation_" + hex.EncodeToString(b)
+}
+
+var lastAIMessage atomic.Int64
+
+// NewAIMessageID is time based and never repeats a timestamp, so the IDs
+// made by one process sort in the order turns were added.
+func NewAIMessageID() string {
+	for {
+		last := lastAIMessage.Load()
+		next := max(time.Now().UnixNano(), last+1)
+		if lastAIMessage.CompareAndSwap(last, next) {
+			return fmt.Sprintf("aimessage_%d", next)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package boba
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// APIError mirrors the server's error envelope, {"error": {...}}. Branch on
+// Code rather than Message, which is meant for humans.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s (%d %s, request %s)", e.Message, e.Status, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+// decodeAPIError reads a non 2xx response into an *APIError, falling back to
+// the raw body when the server did not send the envelope.
+func decodeAPIError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	var envelope struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	envelope.Error.Status = resp.StatusCode
+	return envelope.Error
+}
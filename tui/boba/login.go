@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 
@@ -174,19 +173,18 @@ func loginUser(email string, password string) (LoginResponse, error) {
 
 	resp, err := http.Post("http://localhost:8080/login", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Fatal(err)
+		return LoginResponse{}, fmt.Errorf("sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return LoginResponse{}, decodeAPIError(resp)
+	}
+
 	body, _ := io.ReadAll(resp.Body)
 	var loginResponse LoginResponse
 	if err := json.Unmarshal(body, &loginResponse); err != nil {
-		log.Fatal("Error unmarshalling response:", err)
-		return LoginResponse{}, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Login failed: %s", loginResponse.Message)
-		return LoginResponse{}, fmt.Errorf("login failed: %s", loginResponse.Message)
+		return LoginResponse{}, fmt.Errorf("decoding response: %w", err)
 	}
 
 	return loginResponse, nil
@@ -3,7 +3,6 @@ package boba
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -167,8 +166,7 @@ func GetAllUsers(token string) ([]User, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+		return nil, decodeAPIError(resp)
 	}
 
 	var parsed []User
@@ -198,8 +196,7 @@ func GetUserByID(token string, id string) (*User, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+		return nil, decodeAPIError(resp)
 	}
 
 	var user User